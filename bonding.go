@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 802.3ad模式在/proc/net/bonding中的名字
+const bondingModeLACP = "IEEE 802.3ad Dynamic link aggregation"
+
+// /proc/net/bonding/<bond>中关注的字段，key为原文中的名字
+var (
+	bondingFields = map[string]string{
+		"Bonding Mode":           "mode",
+		"Transmit Hash Policy":   "transmitHashPolicy",
+		"MII Status":             "miiStatus",
+		"Currently Active Slave": "activeSlave",
+		"Primary Slave":          "primarySlave",
+		"LACP rate":              "lacpRate",
+		"Aggregator selection policy (ad_select)": "adSelect",
+		"System MAC address":                      "systemMacAddress",
+	}
+	bondingAggregatorFields = map[string]string{
+		"Aggregator ID":       "aggregatorId",
+		"Number of ports":     "numberOfPorts",
+		"Actor Key":           "actorKey",
+		"Partner Key":         "partnerKey",
+		"Partner Mac Address": "partnerMacAddress",
+	}
+	bondingSlaveFields = map[string]string{
+		"MII Status":          "miiStatus",
+		"Speed":               "speed",
+		"Duplex":              "duplex",
+		"Link Failure Count":  "linkFailureCount",
+		"Permanent HW addr":   "permanentHwAddr",
+		"Aggregator ID":       "aggregatorId",
+		"Actor Churn State":   "actorChurnState",
+		"Partner Churn State": "partnerChurnState",
+	}
+	bondingPartnerFields = map[string]string{
+		"system mac address": "systemMacAddress",
+		"oper key":           "operKey",
+		"port number":        "portNumber",
+		"port state":         "portState",
+	}
+)
+
+// 解析/proc/net/bonding/<bond>，例如
+//
+//	Bonding Mode: IEEE 802.3ad Dynamic link aggregation
+//	MII Status: up
+//	Active Aggregator Info:
+//		Aggregator ID: 1
+//		Number of ports: 2
+//	Slave Interface: eth0
+//	MII Status: up
+//	Speed: 10000 Mbps
+//	Aggregator ID: 1
+//	details partner lacp pdu:
+//	    system mac address: 00:aa:bb:cc:dd:ee
+//
+// 不同版本的内核字段有差异，不认识的字段被忽略
+func parseProcBonding(content string) map[string]interface{} {
+	bond := make(map[string]interface{})
+	slaves := make(map[string]interface{})
+	bond["slaves"] = slaves
+	// 当前的字段属于bond、某个slave，以及缩进的子段
+	var current, sub map[string]interface{}
+	var subFields map[string]string
+	current, fields := bond, bondingFields
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		key := strings.TrimSpace(kv[0])
+		value := ""
+		if len(kv) == 2 {
+			value = strings.TrimSpace(kv[1])
+		}
+		if indented {
+			if sub != nil {
+				if name, ok := subFields[key]; ok {
+					sub[name] = value
+				}
+			}
+			continue
+		}
+		sub = nil
+		switch {
+		case key == "Slave Interface":
+			current, fields = make(map[string]interface{}), bondingSlaveFields
+			slaves[value] = current
+		case key == "Active Aggregator Info" && value == "":
+			sub, subFields = make(map[string]interface{}), bondingAggregatorFields
+			current["activeAggregator"] = sub
+		case key == "details partner lacp pdu" && value == "":
+			sub, subFields = make(map[string]interface{}), bondingPartnerFields
+			current["partner"] = sub
+		default:
+			if name, ok := fields[key]; ok {
+				current[name] = value
+			}
+		}
+	}
+	for _, slave := range slaves {
+		normalizeBondingSlave(slave.(map[string]interface{}))
+	}
+	return bond
+}
+
+// "10000 Mbps" -> 10000，"Unknown"被去掉；计数器转为整数
+func normalizeBondingSlave(slave map[string]interface{}) {
+	if speed, ok := slave["speed"].(string); ok {
+		delete(slave, "speed")
+		if value, err := strconv.Atoi(strings.TrimSuffix(speed, " Mbps")); err == nil {
+			slave["speedMbps"] = value
+		}
+	}
+	if count, ok := slave["linkFailureCount"].(string); ok {
+		if value, err := strconv.Atoi(count); err == nil {
+			slave["linkFailureCount"] = value
+		}
+	}
+}
+
+func readProcBonding(procBondingPath string, master string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path.Join(procBondingPath, master))
+	if err != nil {
+		return nil, err
+	}
+	return parseProcBonding(string(content)), nil
+}
+
+// 返回bond降级的原因，没有降级时为空：
+// bond或slave的MII状态不是up，up的slave速率不一致；
+// 802.3ad模式下没有LACP对端，slave不在活动的aggregator中，或者活动的aggregator中只有一个端口
+func judgeBond(master string, bond map[string]interface{}) []string {
+	reasons := []string{}
+	if status, _ := bond["miiStatus"].(string); status != "up" {
+		reasons = append(reasons, fmt.Sprintf("mii status of %s is %s", master, status))
+	}
+	slaves, _ := bond["slaves"].(map[string]interface{})
+	if len(slaves) == 0 {
+		return append(reasons, fmt.Sprintf("%s has no slave", master))
+	}
+	names := []string{}
+	for name := range slaves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	upSlaves := []string{}
+	speeds := make(map[int][]string)
+	for _, name := range names {
+		slave := slaves[name].(map[string]interface{})
+		if status, _ := slave["miiStatus"].(string); status != "up" {
+			reasons = append(reasons, fmt.Sprintf("slave %s of %s is %s", name, master, status))
+			continue
+		}
+		upSlaves = append(upSlaves, name)
+		if speed, ok := slave["speedMbps"].(int); ok {
+			speeds[speed] = append(speeds[speed], name)
+		}
+	}
+	if len(speeds) > 1 {
+		mismatch := []string{}
+		for speed, slaves := range speeds {
+			mismatch = append(mismatch, fmt.Sprintf("%s %dMbps", strings.Join(slaves, ","), speed))
+		}
+		sort.Strings(mismatch)
+		reasons = append(reasons, fmt.Sprintf("speeds of slaves of %s mismatch: %s", master, strings.Join(mismatch, ", ")))
+	}
+
+	if mode, _ := bond["mode"].(string); mode != bondingModeLACP {
+		return reasons
+	}
+	aggregator, _ := bond["activeAggregator"].(map[string]interface{})
+	if partner, _ := aggregator["partnerMacAddress"].(string); partner == "" || partner == "00:00:00:00:00:00" {
+		reasons = append(reasons, fmt.Sprintf("%s has no LACP partner", master))
+	}
+	aggregatorID, _ := aggregator["aggregatorId"].(string)
+	notAggregated := []string{}
+	for _, name := range upSlaves {
+		if id, _ := slaves[name].(map[string]interface{})["aggregatorId"].(string); aggregatorID != "" && id != "" && id != aggregatorID {
+			notAggregated = append(notAggregated, name)
+		}
+	}
+	if len(notAggregated) > 0 {
+		reasons = append(reasons, fmt.Sprintf("slaves %s of %s are not in the active aggregator %s", strings.Join(notAggregated, ","), master, aggregatorID))
+	}
+	// slave down或者不在活动的aggregator中时已经有原因了
+	if ports, err := strconv.Atoi(fmt.Sprint(aggregator["numberOfPorts"])); err == nil && ports == 1 && len(slaves) > 1 && len(upSlaves) == len(slaves) && len(notAggregated) == 0 {
+		reasons = append(reasons, fmt.Sprintf("only 1 of %d slaves of %s is active in the aggregator", len(slaves), master))
+	}
+	return reasons
+}
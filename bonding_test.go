@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 以下样本取自3.10和4.18内核的/proc/net/bonding/<bond>
+const testBondingActiveBackup = `Ethernet Channel Bonding Driver: v3.7.1 (April 27, 2011)
+
+Bonding Mode: fault-tolerance (active-backup)
+Primary Slave: None
+Currently Active Slave: eth0
+MII Status: up
+MII Polling Interval (ms): 100
+Up Delay (ms): 0
+Down Delay (ms): 0
+
+Slave Interface: eth0
+MII Status: up
+Speed: 10000 Mbps
+Duplex: full
+Link Failure Count: 0
+Permanent HW addr: 52:54:00:12:34:56
+Slave queue ID: 0
+
+Slave Interface: eth1
+MII Status: down
+Speed: Unknown
+Duplex: Unknown
+Link Failure Count: 3
+Permanent HW addr: 52:54:00:12:34:57
+Slave queue ID: 0
+`
+
+// 两个slave都在活动的aggregator 1中，对端为交换机
+const testBondingLACP = `Ethernet Channel Bonding Driver: v3.7.1 (April 27, 2011)
+
+Bonding Mode: IEEE 802.3ad Dynamic link aggregation
+Transmit Hash Policy: layer3+4 (1)
+MII Status: up
+MII Polling Interval (ms): 100
+Up Delay (ms): 0
+Down Delay (ms): 0
+
+802.3ad info
+LACP rate: fast
+Min links: 0
+Aggregator selection policy (ad_select): stable
+System priority: 65535
+System MAC address: 6c:92:bf:aa:bb:cc
+Active Aggregator Info:
+	Aggregator ID: 1
+	Number of ports: 2
+	Actor Key: 15
+	Partner Key: 32831
+	Partner Mac Address: 38:22:d6:11:22:33
+
+Slave Interface: eth0
+MII Status: up
+Speed: 10000 Mbps
+Duplex: full
+Link Failure Count: 0
+Permanent HW addr: 6c:92:bf:aa:bb:cc
+Slave queue ID: 0
+Aggregator ID: 1
+Actor Churn State: none
+Partner Churn State: none
+Actor Churned Count: 0
+Partner Churned Count: 0
+details actor lacp pdu:
+    system priority: 65535
+    system mac address: 6c:92:bf:aa:bb:cc
+    port key: 15
+    port priority: 255
+    port number: 1
+    port state: 63
+details partner lacp pdu:
+    system priority: 32768
+    system mac address: 38:22:d6:11:22:33
+    oper key: 32831
+    port priority: 32768
+    port number: 17
+    port state: 61
+
+Slave Interface: eth1
+MII Status: up
+Speed: 10000 Mbps
+Duplex: full
+Link Failure Count: 1
+Permanent HW addr: 6c:92:bf:aa:bb:cd
+Slave queue ID: 0
+Aggregator ID: 1
+Actor Churn State: none
+Partner Churn State: none
+Actor Churned Count: 0
+Partner Churned Count: 0
+details actor lacp pdu:
+    system priority: 65535
+    system mac address: 6c:92:bf:aa:bb:cc
+    port key: 15
+    port priority: 255
+    port number: 2
+    port state: 63
+details partner lacp pdu:
+    system priority: 32768
+    system mac address: 38:22:d6:11:22:33
+    oper key: 32831
+    port priority: 32768
+    port number: 18
+    port state: 61
+`
+
+func TestParseProcBonding(t *testing.T) {
+	bond := parseProcBonding(testBondingActiveBackup)
+	if bond["mode"] != "fault-tolerance (active-backup)" || bond["activeSlave"] != "eth0" || bond["miiStatus"] != "up" || bond["primarySlave"] != "None" {
+		t.Errorf("unexpected bond %v", bond)
+	}
+	slaves := bond["slaves"].(map[string]interface{})
+	expected := map[string]interface{}{
+		"eth0": map[string]interface{}{"miiStatus": "up", "speedMbps": 10000, "duplex": "full", "linkFailureCount": 0, "permanentHwAddr": "52:54:00:12:34:56"},
+		"eth1": map[string]interface{}{"miiStatus": "down", "duplex": "Unknown", "linkFailureCount": 3, "permanentHwAddr": "52:54:00:12:34:57"},
+	}
+	if !reflect.DeepEqual(slaves, expected) {
+		t.Errorf("expected slaves %v, got %v", expected, slaves)
+	}
+
+	bond = parseProcBonding(testBondingLACP)
+	if bond["mode"] != bondingModeLACP || bond["lacpRate"] != "fast" || bond["adSelect"] != "stable" || bond["transmitHashPolicy"] != "layer3+4 (1)" {
+		t.Errorf("unexpected bond %v", bond)
+	}
+	aggregator := map[string]interface{}{"aggregatorId": "1", "numberOfPorts": "2", "actorKey": "15", "partnerKey": "32831", "partnerMacAddress": "38:22:d6:11:22:33"}
+	if !reflect.DeepEqual(bond["activeAggregator"], aggregator) {
+		t.Errorf("expected active aggregator %v, got %v", aggregator, bond["activeAggregator"])
+	}
+	eth1 := bond["slaves"].(map[string]interface{})["eth1"].(map[string]interface{})
+	partner := map[string]interface{}{"systemMacAddress": "38:22:d6:11:22:33", "operKey": "32831", "portNumber": "18", "portState": "61"}
+	if eth1["aggregatorId"] != "1" || eth1["linkFailureCount"] != 1 || !reflect.DeepEqual(eth1["partner"], partner) {
+		t.Errorf("unexpected slave eth1 %v", eth1)
+	}
+	// actor lacp pdu中的字段不属于partner
+	if _, ok := eth1["systemMacAddress"]; ok {
+		t.Errorf("fields of the actor lacp pdu leaked into the slave: %v", eth1)
+	}
+}
+
+func TestJudgeBond(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		reasons []string
+	}{
+		{"lacp", testBondingLACP, []string{}},
+		{"active-backup", strings.Replace(testBondingActiveBackup, "MII Status: down", "MII Status: up", 1), []string{}},
+		{"active-backup with a slave down", testBondingActiveBackup, []string{"slave eth1 of bond0 is down"}},
+		{
+			"no lacp partner",
+			strings.NewReplacer("Partner Mac Address: 38:22:d6:11:22:33", "Partner Mac Address: 00:00:00:00:00:00", "Number of ports: 2", "Number of ports: 1").Replace(testBondingLACP),
+			[]string{"bond0 has no LACP partner", "only 1 of 2 slaves of bond0 is active in the aggregator"},
+		},
+		{
+			// 对端的两个端口不在一个LAG中时eth1会单独选出aggregator 2
+			"slave in another aggregator",
+			strings.NewReplacer("Number of ports: 2", "Number of ports: 1", "Link Failure Count: 1\nPermanent HW addr: 6c:92:bf:aa:bb:cd\nSlave queue ID: 0\nAggregator ID: 1", "Link Failure Count: 1\nPermanent HW addr: 6c:92:bf:aa:bb:cd\nSlave queue ID: 0\nAggregator ID: 2").Replace(testBondingLACP),
+			[]string{"slaves eth1 of bond0 are not in the active aggregator 1"},
+		},
+		{"single port aggregator", strings.Replace(testBondingLACP, "Number of ports: 2", "Number of ports: 1", 1), []string{"only 1 of 2 slaves of bond0 is active in the aggregator"}},
+		{
+			"speed mismatch",
+			strings.Replace(testBondingLACP, "Speed: 10000 Mbps\nDuplex: full\nLink Failure Count: 1", "Speed: 1000 Mbps\nDuplex: full\nLink Failure Count: 1", 1),
+			[]string{"speeds of slaves of bond0 mismatch: eth0 10000Mbps, eth1 1000Mbps"},
+		},
+		{"bond down", strings.Replace(testBondingActiveBackup, "Currently Active Slave: eth0\nMII Status: up", "Currently Active Slave: None\nMII Status: down", 1), []string{"mii status of bond0 is down", "slave eth1 of bond0 is down"}},
+		{"no slave", "Bonding Mode: fault-tolerance (active-backup)\nMII Status: down\n", []string{"mii status of bond0 is down", "bond0 has no slave"}},
+	}
+	for _, c := range cases {
+		reasons := judgeBond("bond0", parseProcBonding(c.content))
+		if !reflect.DeepEqual(reasons, c.reasons) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.reasons, reasons)
+		}
+	}
+}
+
+// 模拟/sys/class/net：eth0有lower_eth0链接，eth1只在旧内核的位置，eth2两处都没有
+func TestReadBondingStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysclassnet")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"bonding_masters":            "bond0\n",
+		"bond0/bonding/slaves":       "eth0 eth1 eth2\n",
+		"bond0/lower_eth0/operstate": "up\n",
+		"bond0/lower_eth0/speed":     "10000\n",
+		"eth1/operstate":             "down\n",
+	}
+	for name, content := range files {
+		file := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			t.Fatalf("create %s: %s", path.Dir(file), err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", file, err)
+		}
+	}
+
+	status, errs, err := readBondingStats(root)
+	if err != nil {
+		t.Fatalf("readBondingStats: %s", err)
+	}
+	expected := map[string]map[string]interface{}{
+		"bond0": {
+			"eth0": map[string]string{"state": "up", "speed": "10000"},
+			// slave down时读不到speed不是错误
+			"eth1": map[string]string{"state": "down"},
+			"eth2": map[string]string{},
+		},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected %v, got %v", expected, status)
+	}
+	// 读不到operstate时不再报speed的错误
+	if len(errs) != 1 || errs["bond0/lower_eth2/operstate"] == nil {
+		t.Errorf("expected errors of the missing lower_eth2, got %v", errs)
+	}
+
+	if status, errs, err := readBondingStats(path.Join(root, "missing")); err != nil || len(status) != 0 || len(errs) != 0 {
+		t.Errorf("expected no bond without the bonding module, got %v, %v, %v", status, errs, err)
+	}
+}
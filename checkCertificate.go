@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// 路径都相对于mount_point，支持通配符
+var defaultCertificatePaths = []string{
+	"/etc/kubernetes/pki/*.crt",
+	"/etc/kubernetes/pki/etcd/*.crt",
+	"/var/lib/kubelet/pki/kubelet.crt",
+	"/var/lib/kubelet/pki/kubelet-client-current.pem",
+	"/var/lib/kubelet/pki/kubelet-server-current.pem",
+	"/etc/docker/*.pem",
+	"/etc/docker/certs.d/*/*.crt",
+	"/etc/docker/certs.d/*/*.cert",
+	"/etc/hadoop/conf/*.pem",
+}
+
+var defaultKubeconfigPaths = []string{
+	"/etc/kubernetes/kubelet.conf",
+	"/etc/kubernetes/admin.conf",
+	"/etc/kubernetes/controller-manager.conf",
+	"/etc/kubernetes/scheduler.conf",
+}
+
+var defaultCAPaths = []string{
+	"/etc/kubernetes/pki/ca.crt",
+	"/etc/kubernetes/pki/front-proxy-ca.crt",
+	"/etc/kubernetes/pki/etcd/ca.crt",
+	"/etc/docker/ca.pem",
+	"/etc/docker/certs.d/*/ca.crt",
+}
+
+// 这些文件中自签名的证书作为同一个文件中其它证书的根证书，例如kubelet.crt中跟在服务端证书之后的<host>-ca@<timestamp>
+var defaultBundleRootPaths = []string{
+	"/var/lib/kubelet/pki/kubelet.crt",
+}
+
+func init() {
+	registerChecker("certificate", NewCertificateChecker())
+	registerConfigSchema("certificate",
+		ConfigItem{"checkInterval", time.Hour, "interval between checks"},
+		ConfigItem{"paths", defaultCertificatePaths, "globs of PEM certificate files relative to mount_point"},
+		ConfigItem{"kubeconfigs", defaultKubeconfigPaths, "kubeconfig files relative to mount_point, embedded and referenced certificates are checked"},
+		ConfigItem{"cas", defaultCAPaths, "globs of CA files relative to mount_point which certificates are verified against"},
+		ConfigItem{"bundle.roots", defaultBundleRootPaths, "globs of certificate files relative to mount_point whose self-signed certificates are trusted as roots of the other certificates in the same file"},
+		ConfigItem{"expiry.error", time.Hour * 24 * 30, "the checker turns Error when any certificate expires within this duration"},
+		ConfigItem{"expiry.fatal", time.Hour * 24 * 7, "the checker turns Fatal when any certificate expires within this duration"},
+		ConfigItem{"verify.state", oneOf("Error", stateValues...), "state when a certificate can not be verified against the CAs, Error, Fatal, or Live to ignore"},
+		rulesConfigItem,
+	)
+}
+
+type CertificateChecker struct {
+	name            string
+	mutex           sync.RWMutex
+	stopCh          chan struct{}
+	checkerState    State
+	stateReason     string
+	rules           []*Rule
+	checkTime       time.Time
+	checkDuration   time.Duration
+	checkInterval   time.Duration
+	basicInfo       map[string]interface{}
+	errors          map[string]interface{}
+	mountPoint      string
+	paths           []string
+	kubeconfigPaths []string
+	caPaths         []string
+	bundleRootPaths []string
+	expiryError     time.Duration
+	expiryFatal     time.Duration
+	verifyState     State
+}
+
+// 同一个文件中的其它证书作为验证证书链时的中间证书，trustBundle时其中自签名的证书作为根证书
+type certificateEntry struct {
+	key         string
+	cert        *x509.Certificate
+	bundle      []*x509.Certificate
+	trustBundle bool
+}
+
+// kubeconfig中只关心证书相关的字段
+type kubeconfigCertificates struct {
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+func (c *CertificateChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.name = "certificate"
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.basicInfo = make(map[string]interface{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Hour).(time.Duration)
+	c.mountPoint = path.Clean(daemonConfig.mount_point)
+	c.paths = daemonConfig.getOrDefault(c.name, "paths", defaultCertificatePaths).([]string)
+	c.kubeconfigPaths = daemonConfig.getOrDefault(c.name, "kubeconfigs", defaultKubeconfigPaths).([]string)
+	c.caPaths = daemonConfig.getOrDefault(c.name, "cas", defaultCAPaths).([]string)
+	c.bundleRootPaths = daemonConfig.getOrDefault(c.name, "bundle.roots", defaultBundleRootPaths).([]string)
+	for _, pattern := range append(append(append([]string{}, c.paths...), c.caPaths...), c.bundleRootPaths...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob '%s' of checker %s: %s", pattern, c.name, err)
+		}
+	}
+	c.expiryError = daemonConfig.getOrDefault(c.name, "expiry.error", time.Hour*24*30).(time.Duration)
+	c.expiryFatal = daemonConfig.getOrDefault(c.name, "expiry.fatal", time.Hour*24*7).(time.Duration)
+	if c.expiryFatal > c.expiryError {
+		return fmt.Errorf("expiry.fatal of checker %s should not be longer than expiry.error", c.name)
+	}
+	c.verifyState = State(daemonConfig.getOrDefault(c.name, "verify.state", "Error").(string))
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *CertificateChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *CertificateChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *CertificateChecker) stop() {
+	close(c.stopCh)
+}
+
+func (c *CertificateChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	fileErrors := make(map[string]interface{})
+	entries := []certificateEntry{}
+	for _, pattern := range c.paths {
+		entries = append(entries, c.globCertificates(pattern, fileErrors)...)
+	}
+	roots, intermediates := []*x509.Certificate{}, []*x509.Certificate{}
+	for _, pattern := range c.caPaths {
+		for _, entry := range c.globCertificates(pattern, fileErrors) {
+			if isSelfSigned(entry.cert) {
+				roots = append(roots, entry.cert)
+			} else {
+				intermediates = append(intermediates, entry.cert)
+			}
+		}
+	}
+	for _, kubeconfigPath := range c.kubeconfigPaths {
+		kubeconfigEntries, cas, err := c.readKubeconfig(kubeconfigPath)
+		if err != nil {
+			fileErrors[kubeconfigPath] = err.Error()
+			continue
+		}
+		entries = append(entries, kubeconfigEntries...)
+		roots = append(roots, cas...)
+	}
+	if len(fileErrors) > 0 {
+		errors["files"] = fileErrors
+	}
+
+	now := time.Now()
+	certificates := make(map[string]interface{})
+	verifyErrors := make(map[string]interface{})
+	expiring := map[State][]string{}
+	for _, entry := range entries {
+		if _, ok := certificates[entry.key]; ok {
+			continue
+		}
+		info := certificateInfo(entry.cert, now)
+		certificates[entry.key] = info
+		expiresIn := entry.cert.NotAfter.Sub(now)
+		switch {
+		case expiresIn <= c.expiryFatal:
+			expiring[Fatal] = append(expiring[Fatal], fmt.Sprintf("%s (%.1f days)", entry.key, expiresIn.Hours()/24))
+		case expiresIn <= c.expiryError:
+			expiring[Error] = append(expiring[Error], fmt.Sprintf("%s (%.1f days)", entry.key, expiresIn.Hours()/24))
+		}
+		// 自签名的证书本身就是根证书，过期的证书已经按有效期报告
+		if (len(roots) == 0 && !(entry.trustBundle && hasSelfSigned(entry.bundle))) || isSelfSigned(entry.cert) || expiresIn <= 0 {
+			continue
+		}
+		if err := verifyCertificate(entry, roots, intermediates, now); err != nil {
+			info["verified"] = false
+			verifyErrors[entry.key] = err.Error()
+		} else {
+			info["verified"] = true
+		}
+	}
+	basicInfo["certificates"] = certificates
+	if len(verifyErrors) > 0 {
+		errors["verify"] = verifyErrors
+		if c.verifyState != Live {
+			keys := []string{}
+			for key := range verifyErrors {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			verdicts = append(verdicts, Verdict{c.verifyState, fmt.Sprintf("certificates can not be verified against the CAs: %s", strings.Join(keys, ", "))})
+		}
+	}
+	for _, state := range []State{Fatal, Error} {
+		if names := expiring[state]; len(names) > 0 {
+			sort.Strings(names)
+			threshold := c.expiryFatal
+			if state == Error {
+				threshold = c.expiryError
+			}
+			verdicts = append(verdicts, Verdict{state, fmt.Sprintf("certificates expired or expiring within %.0f days: %s", threshold.Hours()/24, strings.Join(names, ", "))})
+		}
+	}
+	return nil
+}
+
+// 没有匹配的文件以及不包含证书的文件(例如私钥)直接跳过
+func (c *CertificateChecker) globCertificates(pattern string, fileErrors map[string]interface{}) []certificateEntry {
+	entries := []certificateEntry{}
+	matches, err := filepath.Glob(path.Join(c.mountPoint, pattern))
+	if err != nil {
+		fileErrors[pattern] = err.Error()
+		return entries
+	}
+	for _, match := range matches {
+		key := c.hostPath(match)
+		data, err := ioutil.ReadFile(match)
+		if err != nil {
+			fileErrors[key] = err.Error()
+			continue
+		}
+		certs, err := parsePEMCertificates(data)
+		if err != nil {
+			fileErrors[key] = err.Error()
+			continue
+		}
+		fileEntries := bundleEntries(key, certs)
+		for i := range fileEntries {
+			fileEntries[i].trustBundle = c.isBundleRoot(key)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries
+}
+
+func (c *CertificateChecker) isBundleRoot(key string) bool {
+	for _, pattern := range c.bundleRootPaths {
+		if matched, _ := filepath.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回用户的客户端证书以及集群的CA，不存在的kubeconfig直接跳过
+func (c *CertificateChecker) readKubeconfig(kubeconfigPath string) ([]certificateEntry, []*x509.Certificate, error) {
+	entries := []certificateEntry{}
+	cas := []*x509.Certificate{}
+	fullPath := path.Join(c.mountPoint, kubeconfigPath)
+	data, err := ioutil.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return entries, cas, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	config := kubeconfigCertificates{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+	// 引用的文件是宿主机上的路径，相对路径相对于kubeconfig所在的目录
+	load := func(embedded string, file string) ([]*x509.Certificate, error) {
+		if embedded != "" {
+			decoded, err := base64.StdEncoding.DecodeString(embedded)
+			if err != nil {
+				return nil, err
+			}
+			return parsePEMCertificates(decoded)
+		}
+		if file == "" {
+			return nil, nil
+		}
+		if !path.IsAbs(file) {
+			file = path.Join(path.Dir(kubeconfigPath), file)
+		}
+		data, err := ioutil.ReadFile(path.Join(c.mountPoint, file))
+		if err != nil {
+			return nil, err
+		}
+		return parsePEMCertificates(data)
+	}
+	for _, user := range config.Users {
+		key := fmt.Sprintf("%s#user/%s", kubeconfigPath, user.Name)
+		certs, err := load(user.User.ClientCertificateData, user.User.ClientCertificate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("client certificate of user %s: %s", user.Name, err)
+		}
+		entries = append(entries, bundleEntries(key, certs)...)
+	}
+	for _, cluster := range config.Clusters {
+		key := fmt.Sprintf("%s#cluster/%s", kubeconfigPath, cluster.Name)
+		certs, err := load(cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, nil, fmt.Errorf("certificate authority of cluster %s: %s", cluster.Name, err)
+		}
+		entries = append(entries, bundleEntries(key, certs)...)
+		cas = append(cas, certs...)
+	}
+	return entries, cas, nil
+}
+
+func (c *CertificateChecker) hostPath(fullPath string) string {
+	if c.mountPoint == "/" {
+		return fullPath
+	}
+	return strings.TrimPrefix(fullPath, c.mountPoint)
+}
+
+func (c *CertificateChecker) info() Info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *CertificateChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	certificates, ok := c.basicInfo["certificates"].(map[string]interface{})
+	if !ok {
+		return metrics
+	}
+	for key, certificate := range certificates {
+		certificateMap := certificate.(map[string]interface{})
+		labels := []string{"certificate", key, "subject", certificateMap["subject"].(string)}
+		notAfter := certificateMap["notAfter"].(time.Time)
+		metrics = append(metrics, newMetric("certificate_expiry_timestamp_seconds", "Time when the certificate expires.", float64(notAfter.Unix()), labels...))
+		if verified, ok := certificateMap["verified"].(bool); ok {
+			metrics = append(metrics, newMetric("certificate_verified", "Whether the certificate can be verified against the CAs.", boolToFloat(verified), labels...))
+		}
+	}
+	return metrics
+}
+
+func (c *CertificateChecker) newRouters() Routers {
+	routers := make(Routers)
+	return routers
+}
+
+func NewCertificateChecker() *CertificateChecker {
+	return &CertificateChecker{}
+}
+
+// 只解析CERTIFICATE块，忽略私钥等其它块
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// 一个文件中有多个证书时key加上序号，例如ca-bundle.crt#1
+func bundleEntries(key string, certs []*x509.Certificate) []certificateEntry {
+	entries := []certificateEntry{}
+	for i, cert := range certs {
+		entryKey := key
+		if len(certs) > 1 {
+			entryKey = fmt.Sprintf("%s#%d", key, i)
+		}
+		entries = append(entries, certificateEntry{key: entryKey, cert: cert, bundle: certs})
+	}
+	return entries
+}
+
+func certificateInfo(cert *x509.Certificate, now time.Time) map[string]interface{} {
+	sans := []string{}
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return map[string]interface{}{
+		"subject":      cert.Subject.String(),
+		"issuer":       cert.Issuer.String(),
+		"sans":         sans,
+		"serialNumber": cert.SerialNumber.String(),
+		"isCA":         cert.IsCA,
+		"notBefore":    cert.NotBefore,
+		"notAfter":     cert.NotAfter,
+		"daysToExpiry": cert.NotAfter.Sub(now).Hours() / 24,
+	}
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	// CheckSignatureFrom要求签发者是CA，自签名的服务端证书不一定是
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+func hasSelfSigned(certs []*x509.Certificate) bool {
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// 不限制用途，kubernetes的证书有客户端也有服务端的。
+// 只有bundle.roots中的文件，同一个文件中自签名的证书才作为该证书的根证书，否则任何文件都可以带上自己的根证书通过验证
+func verifyCertificate(entry certificateEntry, roots []*x509.Certificate, intermediates []*x509.Certificate, now time.Time) error {
+	rootPool, pool := x509.NewCertPool(), x509.NewCertPool()
+	for _, cert := range roots {
+		rootPool.AddCert(cert)
+	}
+	for _, cert := range intermediates {
+		pool.AddCert(cert)
+	}
+	for _, cert := range entry.bundle {
+		if cert == entry.cert {
+			continue
+		}
+		if !isSelfSigned(cert) {
+			pool.AddCert(cert)
+		} else if entry.trustBundle {
+			rootPool.AddCert(cert)
+		}
+	}
+	_, err := entry.cert.Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: pool,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
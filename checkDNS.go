@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerChecker("dns", NewDNSChecker())
+	registerConfigSchema("dns",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"timeout", time.Second * 2, "timeout of a dns query"},
+		ConfigItem{"etc.resolv.conf.path", "{mount_point}/etc/resolv.conf", "path of /etc/resolv.conf, whose nameservers and search domains are used"},
+		ConfigItem{"etc.hosts.path", "{mount_point}/etc/hosts", "path of /etc/hosts"},
+		ConfigItem{"etc.hosts.concerned", []string{}, "hostnames in /etc/hosts to compare with dns"},
+		ConfigItem{"nameservers", []string{}, "extra nameservers to query besides those in resolv.conf, e.g. the cluster dns 10.96.0.10 or 127.0.0.1:5353"},
+		ConfigItem{"names", []string{}, "names to resolve with each nameserver, e.g. kubernetes.default.svc.cluster.local"},
+		ConfigItem{"names.self", false, "whether to resolve the fqdn of the node, which fails when the node is only in /etc/hosts"},
+		ConfigItem{"reverse.enabled", false, "whether to check that the PTR records of the answers contain the names, addresses without PTR records are not checked"},
+		ConfigItem{"failure.state", oneOf(Error, stateValues...), "state when a name can not be resolved by a nameserver, Error, Fatal or Live"},
+		ConfigItem{"mismatch.state", oneOf(Error, stateValues...), "state when /etc/hosts or a reverse lookup does not match dns, Error, Fatal or Live"},
+		rulesConfigItem,
+	)
+}
+
+type DNSChecker struct {
+	name           string
+	mutex          sync.RWMutex
+	stopCh         chan struct{}
+	checkerState   State
+	stateReason    string
+	rules          []*Rule
+	checkTime      time.Time
+	checkDuration  time.Duration
+	checkInterval  time.Duration
+	basicInfo      map[string]interface{}
+	errors         map[string]interface{}
+	timeout        time.Duration
+	resolvConfPath string
+	hostsPath      string
+	concernedHosts []string
+	nameservers    []string
+	names          []string
+	reverseEnabled bool
+	failureState   State
+	mismatchState  State
+}
+
+func (c *DNSChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.name = "dns"
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.basicInfo = make(map[string]interface{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
+	c.timeout = daemonConfig.getOrDefault(c.name, "timeout", time.Second*2).(time.Duration)
+	c.resolvConfPath = daemonConfig.getOrDefault(c.name, "etc.resolv.conf.path", path.Join(daemonConfig.mount_point, "/etc/resolv.conf")).(string)
+	c.hostsPath = daemonConfig.getOrDefault(c.name, "etc.hosts.path", path.Join(daemonConfig.mount_point, "/etc/hosts")).(string)
+	c.concernedHosts = daemonConfig.getOrDefault(c.name, "etc.hosts.concerned", []string{}).([]string)
+	c.nameservers = daemonConfig.getOrDefault(c.name, "nameservers", []string{}).([]string)
+	c.names = append([]string{}, daemonConfig.getOrDefault(c.name, "names", []string{}).([]string)...)
+	if daemonConfig.getOrDefault(c.name, "names.self", false).(bool) {
+		if self, err := fqdnHostname(); err != nil {
+			warnln(fmt.Sprintf("failed to get the fqdn of the node: %s", err))
+		} else {
+			// 以"."结尾，不使用search域
+			c.names = append(c.names, self+".")
+		}
+	}
+	c.reverseEnabled = daemonConfig.getOrDefault(c.name, "reverse.enabled", false).(bool)
+	c.failureState = State(daemonConfig.getOrDefault(c.name, "failure.state", string(Error)).(string))
+	c.mismatchState = State(daemonConfig.getOrDefault(c.name, "mismatch.state", string(Error)).(string))
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *DNSChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *DNSChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *DNSChecker) stop() {
+	close(c.stopCh)
+}
+
+// 一个名字在一个nameserver上的解析结果，reverse的key为answers中的ip
+type dnsLookupResult struct {
+	resolved string
+	answers  []string
+	latency  time.Duration
+	err      error
+	reverse  map[string][]string
+	// 反向解析出错或者不包含resolved的ip
+	reverseMismatch map[string]string
+}
+
+func (r dnsLookupResult) toMap() map[string]interface{} {
+	result := make(map[string]interface{})
+	if r.err != nil {
+		result["error"] = r.err.Error()
+		return result
+	}
+	result["name"] = r.resolved
+	result["answers"] = r.answers
+	result["latencyMilliseconds"] = float64(r.latency) / float64(time.Millisecond)
+	if r.reverse != nil {
+		reverse := make(map[string]interface{})
+		for ip, names := range r.reverse {
+			reverse[ip] = names
+		}
+		for ip, mismatch := range r.reverseMismatch {
+			if _, ok := reverse[ip]; !ok {
+				reverse[ip] = mismatch
+			}
+		}
+		result["reverse"] = reverse
+	}
+	return result
+}
+
+// 每个名字在每个nameserver上并发解析，名字不以"."结尾时按resolv.conf的search和ndots展开
+func (c *DNSChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	nameservers := []string{}
+	searches := []string{}
+	ndots := 1
+	if _, resolv, err := getResolv(c.resolvConfPath); err != nil {
+		errors["resolv.conf"] = err.Error()
+	} else {
+		basicInfo["resolv.conf"] = resolv
+		nameservers = append(nameservers, resolv["nameservers"].([]string)...)
+		searches = resolv["searchs"].([]string)
+		ndots = resolvNdots(resolv["options"].([]string))
+	}
+	for _, nameserver := range c.nameservers {
+		if !containsString(nameservers, nameserver) {
+			nameservers = append(nameservers, nameserver)
+		}
+	}
+	basicInfo["nameservers"] = nameservers
+	if len(nameservers) == 0 {
+		if c.failureState != Live {
+			verdicts = append(verdicts, Verdict{c.failureState, "no nameserver is configured"})
+		}
+		return nil
+	}
+
+	lookups := c.lookupAll(c.names, nameservers, searches, ndots, c.reverseEnabled)
+	lookupsInfo := make(map[string]interface{})
+	lookupErrors := make(map[string]interface{})
+	reverseMismatches := make(map[string]interface{})
+	failures, mismatches := []string{}, []string{}
+	for _, name := range c.names {
+		name = strings.TrimSuffix(name, ".")
+		serversInfo := make(map[string]interface{})
+		for _, nameserver := range nameservers {
+			result := lookups[name][nameserver]
+			serversInfo[nameserver] = result.toMap()
+			if result.err != nil {
+				setNested(lookupErrors, name, nameserver, result.err.Error())
+				failures = append(failures, fmt.Sprintf("%s@%s", name, nameserver))
+				continue
+			}
+			for ip, mismatch := range result.reverseMismatch {
+				setNested(reverseMismatches, name, nameserver+"/"+ip, mismatch)
+			}
+			if len(result.reverseMismatch) > 0 {
+				mismatches = append(mismatches, fmt.Sprintf("reverse lookups of %d of %d addresses of %s on %s do not match", len(result.reverseMismatch), len(result.answers), name, nameserver))
+			}
+		}
+		lookupsInfo[name] = serversInfo
+	}
+	basicInfo["lookups"] = lookupsInfo
+	if len(lookupErrors) > 0 {
+		errors["lookups"] = lookupErrors
+	}
+	if len(reverseMismatches) > 0 {
+		errors["reverse.mismatch"] = reverseMismatches
+	}
+
+	if len(c.concernedHosts) > 0 {
+		hostsInfo, hostsMismatches, err := c.compareHosts(nameservers, searches, ndots)
+		if err != nil {
+			errors["hosts"] = err.Error()
+		} else {
+			basicInfo["hosts"] = hostsInfo
+			if len(hostsMismatches) > 0 {
+				errors["hosts.mismatch"] = hostsMismatches
+				hostsReasons := []string{}
+				for _, reason := range hostsMismatches {
+					hostsReasons = append(hostsReasons, reason.(string))
+				}
+				sort.Strings(hostsReasons)
+				mismatches = append(mismatches, hostsReasons...)
+			}
+		}
+	}
+
+	if len(failures) > 0 && c.failureState != Live {
+		sort.Strings(failures)
+		verdicts = append(verdicts, Verdict{c.failureState, fmt.Sprintf("failed to resolve %s", strings.Join(failures, ", "))})
+	}
+	if len(mismatches) > 0 && c.mismatchState != Live {
+		verdicts = append(verdicts, Verdict{c.mismatchState, strings.Join(mismatches, "; ")})
+	}
+	return nil
+}
+
+// 返回名字(不带结尾的".")到nameserver到结果的映射
+func (c *DNSChecker) lookupAll(names []string, nameservers []string, searches []string, ndots int, reverse bool) map[string]map[string]dnsLookupResult {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]map[string]dnsLookupResult)
+	for _, name := range names {
+		results[strings.TrimSuffix(name, ".")] = make(map[string]dnsLookupResult)
+		candidates := dnsCandidates(name, searches, ndots)
+		for _, nameserver := range nameservers {
+			wg.Add(1)
+			go func(name string, candidates []string, nameserver string) {
+				defer wg.Done()
+				result := c.lookup(candidates, nameserver, reverse)
+				mutex.Lock()
+				results[name][nameserver] = result
+				mutex.Unlock()
+			}(strings.TrimSuffix(name, "."), candidates, nameserver)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+func (c *DNSChecker) lookup(candidates []string, nameserver string, reverse bool) dnsLookupResult {
+	result := dnsLookupResult{}
+	server := nameserverAddress(nameserver)
+	start := time.Now()
+	result.resolved, result.answers, result.err = dnsLookupIPs(server, candidates, c.timeout)
+	result.latency = time.Since(start)
+	if result.err != nil || !reverse {
+		return result
+	}
+	// 只要有一个PTR记录与解析的名字相同就认为匹配；内网的地址通常没有PTR记录，NXDOMAIN或者没有记录都不算不一致
+	result.reverse = make(map[string][]string)
+	result.reverseMismatch = make(map[string]string)
+	for _, ip := range result.answers {
+		names, err := dnsLookupPTR(server, ip, c.timeout)
+		if isNXDomain(err) {
+			names, err = []string{}, nil
+		}
+		if err != nil {
+			result.reverseMismatch[ip] = err.Error()
+			continue
+		}
+		result.reverse[ip] = names
+		if len(names) == 0 {
+			continue
+		}
+		matched := false
+		for _, name := range names {
+			if strings.EqualFold(name, result.resolved) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			result.reverseMismatch[ip] = fmt.Sprintf("PTR records %v do not contain %s", names, result.resolved)
+		}
+	}
+	return result
+}
+
+// 比较/etc/hosts与每个nameserver的解析结果，dns的结果中不包含/etc/hosts中的ip时认为不一致，
+// 不在/etc/hosts中或者dns中不存在的名字不比较
+func (c *DNSChecker) compareHosts(nameservers []string, searches []string, ndots int) (map[string]interface{}, map[string]interface{}, error) {
+	_, hosts, err := getHosts(c.hostsPath, c.concernedHosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{}
+	for host, ip := range hosts {
+		if ip != "" {
+			names = append(names, host)
+		}
+	}
+	lookups := c.lookupAll(names, nameservers, searches, ndots, false)
+	hostsInfo := make(map[string]interface{})
+	mismatches := make(map[string]interface{})
+	for host, ip := range hosts {
+		hostInfo := map[string]interface{}{"ip": ip}
+		hostsInfo[host] = hostInfo
+		if ip == "" {
+			continue
+		}
+		dnsInfo := make(map[string]interface{})
+		hostInfo["dns"] = dnsInfo
+		differences := []string{}
+		for _, nameserver := range nameservers {
+			result := lookups[strings.TrimSuffix(host, ".")][nameserver]
+			switch {
+			case result.err != nil:
+				dnsInfo[nameserver] = result.err.Error()
+			case !containsString(result.answers, ip):
+				dnsInfo[nameserver] = result.answers
+				differences = append(differences, fmt.Sprintf("%v from %s", result.answers, nameserver))
+			default:
+				dnsInfo[nameserver] = result.answers
+			}
+		}
+		hostInfo["match"] = len(differences) == 0
+		if len(differences) > 0 {
+			mismatches[host] = fmt.Sprintf("%s is %s in /etc/hosts but %s", host, ip, strings.Join(differences, ", "))
+		}
+	}
+	return hostsInfo, mismatches, nil
+}
+
+func (c *DNSChecker) info() Info {
+	defer c.mutex.RUnlock()
+	c.mutex.RLock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *DNSChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	lookups, _ := c.basicInfo["lookups"].(map[string]interface{})
+	for name, servers := range lookups {
+		for nameserver, result := range servers.(map[string]interface{}) {
+			resultInfo := result.(map[string]interface{})
+			_, failed := resultInfo["error"]
+			metrics = append(metrics, newMetric("dns_lookup_success", "Whether the name was resolved by the nameserver.", boolToFloat(!failed), "name", name, "nameserver", nameserver))
+			if latency, ok := resultInfo["latencyMilliseconds"].(float64); ok {
+				metrics = append(metrics, newMetric("dns_lookup_latency_seconds", "Latency of resolving the name by the nameserver.", latency/1000, "name", name, "nameserver", nameserver))
+			}
+		}
+	}
+	hosts, _ := c.basicInfo["hosts"].(map[string]interface{})
+	for host, hostInfo := range hosts {
+		if match, ok := hostInfo.(map[string]interface{})["match"].(bool); ok {
+			metrics = append(metrics, newMetric("dns_hosts_match", "Whether the ip of the host in /etc/hosts is returned by all nameservers.", boolToFloat(match), "host", host))
+		}
+	}
+	return metrics
+}
+
+func (c *DNSChecker) newRouters() Routers {
+	routers := make(Routers)
+	return routers
+}
+
+func NewDNSChecker() *DNSChecker {
+	return &DNSChecker{}
+}
+
+// resolv.conf中的nameserver没有端口，配置的nameservers可以带端口
+func nameserverAddress(nameserver string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
+	}
+	return net.JoinHostPort(nameserver, "53")
+}
+
+// options ndots:n，缺省为1
+func resolvNdots(options []string) int {
+	ndots := 1
+	for _, option := range options {
+		if strings.HasPrefix(option, "ndots:") {
+			if n, err := strconv.Atoi(strings.TrimPrefix(option, "ndots:")); err == nil && n >= 0 {
+				ndots = n
+			}
+		}
+	}
+	return ndots
+}
+
+func setNested(m map[string]interface{}, key string, subKey string, value interface{}) {
+	sub, ok := m[key].(map[string]interface{})
+	if !ok {
+		sub = make(map[string]interface{})
+		m[key] = sub
+	}
+	sub[subKey] = value
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
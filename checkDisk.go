@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 伪文件系统以及容器的可写层没有检测的意义
+var defaultIgnoredFsTypes = []string{
+	"autofs", "binfmt_misc", "bpf", "cgroup", "cgroup2", "configfs", "debugfs", "devpts", "devtmpfs",
+	"fusectl", "hugetlbfs", "mqueue", "nsfs", "overlay", "proc", "pstore", "rpc_pipefs", "securityfs",
+	"squashfs", "sysfs", "tmpfs", "tracefs",
+}
+
+const (
+	defaultIgnoredMountPoints = `^/(proc|sys|dev|run)($|/)|^/var/lib/(docker|kubelet|containerd)/.+`
+	defaultIgnoredDevices     = `^(ram|loop|fd|sr|nbd|zram)\d+$`
+	diskSectorSize            = 512
+)
+
+func init() {
+	registerChecker("disk", NewDiskChecker())
+	registerConfigSchema("disk",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"fs.types.ignored", defaultIgnoredFsTypes, "filesystem types which are not checked"},
+		ConfigItem{"mountpoints.ignored", defaultIgnoredMountPoints, "regexp of mount points (relative to the host) which are not checked"},
+		ConfigItem{"readOnly.allowed", []string{}, "mount points which are expected to be read-only"},
+		ConfigItem{"statfs.timeout", time.Second * 5, "timeout of statfs, e.g. on a hung nfs mount"},
+		ConfigItem{"thresholds", []interface{}{}, "usage thresholds per mount point, see docs/checkers.md"},
+		ConfigItem{"diskstats.devices.ignored", defaultIgnoredDevices, "regexp of block devices which are not reported"},
+		rulesConfigItem,
+	)
+}
+
+type DiskChecker struct {
+	name               string
+	mutex              sync.RWMutex
+	stopCh             chan struct{}
+	checkerState       State
+	stateReason        string
+	rules              []*Rule
+	checkTime          time.Time
+	checkDuration      time.Duration
+	checkInterval      time.Duration
+	basicInfo          map[string]interface{}
+	errors             map[string]interface{}
+	procPath           string
+	mountPoint         string
+	ignoredFsTypes     map[string]bool
+	ignoredMountPoints *regexp.Regexp
+	readOnlyAllowed    map[string]bool
+	statfsTimeout      time.Duration
+	statfsMutex        sync.Mutex
+	statfsPending      map[string]bool
+	thresholds         []diskThreshold
+	ignoredDevices     *regexp.Regexp
+	lastDiskstats      map[string]diskstat
+	lastDiskstatsTime  time.Time
+}
+
+// mountPoint为"*"时对所有的文件系统生效，usedPercent和inodesUsedPercent为0表示不检测
+type diskThreshold struct {
+	mountPoint        string
+	usedPercent       float64
+	inodesUsedPercent float64
+	state             State
+}
+
+type mountInfo struct {
+	mountPoint string
+	fsType     string
+	source     string
+	readOnly   bool
+}
+
+// /proc/diskstats中的计数器，ticks的单位是毫秒
+type diskstat struct {
+	reads        uint64
+	readSectors  uint64
+	readTicks    uint64
+	writes       uint64
+	writeSectors uint64
+	writeTicks   uint64
+	ioInProgress uint64
+	ioTicks      uint64
+}
+
+func (c *DiskChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.name = "disk"
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.basicInfo = make(map[string]interface{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
+	c.procPath = daemonConfig.proc_path
+	c.mountPoint = path.Clean(daemonConfig.mount_point)
+	c.ignoredFsTypes = make(map[string]bool)
+	for _, fsType := range daemonConfig.getOrDefault(c.name, "fs.types.ignored", defaultIgnoredFsTypes).([]string) {
+		c.ignoredFsTypes[fsType] = true
+	}
+	if c.ignoredMountPoints, err = regexp.Compile(daemonConfig.getOrDefault(c.name, "mountpoints.ignored", defaultIgnoredMountPoints).(string)); err != nil {
+		return fmt.Errorf("invalid mountpoints.ignored of checker %s: %s", c.name, err)
+	}
+	c.readOnlyAllowed = make(map[string]bool)
+	for _, mountPoint := range daemonConfig.getOrDefault(c.name, "readOnly.allowed", []string{}).([]string) {
+		c.readOnlyAllowed[mountPoint] = true
+	}
+	c.statfsTimeout = daemonConfig.getOrDefault(c.name, "statfs.timeout", time.Second*5).(time.Duration)
+	if c.thresholds, err = parseDiskThresholds(daemonConfig.getOrDefault(c.name, "thresholds", []interface{}{}).([]interface{})); err != nil {
+		return fmt.Errorf("invalid thresholds of checker %s: %s", c.name, err)
+	}
+	if c.ignoredDevices, err = regexp.Compile(daemonConfig.getOrDefault(c.name, "diskstats.devices.ignored", defaultIgnoredDevices).(string)); err != nil {
+		return fmt.Errorf("invalid diskstats.devices.ignored of checker %s: %s", c.name, err)
+	}
+	c.lastDiskstats = nil
+	c.lastDiskstatsTime = time.Time{}
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *DiskChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *DiskChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *DiskChecker) stop() {
+	close(c.stopCh)
+}
+
+func (c *DiskChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	mounts, err := readMountInfo(path.Join(c.procPath, "self/mountinfo"))
+	if err != nil {
+		errors["mountinfo"] = err.Error()
+	} else {
+		filesystems, statfsErrors := c.getFilesystems(mounts)
+		basicInfo["filesystems"] = filesystems
+		if len(statfsErrors) > 0 {
+			errors["filesystems"] = statfsErrors
+		}
+		verdicts = append(verdicts, c.filesystemVerdicts(filesystems)...)
+	}
+
+	now := time.Now()
+	diskstats, err := readDiskstats(path.Join(c.procPath, "diskstats"))
+	if err != nil {
+		errors["diskstats"] = err.Error()
+	} else {
+		basicInfo["diskstats"] = c.diskstatsInfo(diskstats, now)
+		c.lastDiskstats, c.lastDiskstatsTime = diskstats, now
+	}
+	return nil
+}
+
+// 文件系统按在宿主机上的挂载点组织，同一个挂载点被多次挂载时以最后一次为准
+func (c *DiskChecker) getFilesystems(mounts []mountInfo) (map[string]interface{}, map[string]interface{}) {
+	filesystems := make(map[string]interface{})
+	statfsErrors := make(map[string]interface{})
+	for _, mount := range mounts {
+		mountPoint, ok := hostMountPoint(c.mountPoint, mount.mountPoint)
+		if !ok || c.ignoredFsTypes[mount.fsType] || c.ignoredMountPoints.MatchString(mountPoint) {
+			continue
+		}
+		filesystem := map[string]interface{}{
+			"device": mount.source,
+			"fsType": mount.fsType,
+			// 以superblock的选项为准，容器中以ro方式bind mount不算只读，errors=remount-ro之后才算
+			"readOnly": mount.readOnly,
+		}
+		delete(statfsErrors, mountPoint)
+		usage, err := c.statfs(mount.mountPoint)
+		if err != nil {
+			statfsErrors[mountPoint] = err.Error()
+		}
+		for key, value := range usage {
+			filesystem[key] = value
+		}
+		filesystems[mountPoint] = filesystem
+	}
+	return filesystems, statfsErrors
+}
+
+func (c *DiskChecker) filesystemVerdicts(filesystems map[string]interface{}) []Verdict {
+	verdicts := []Verdict{}
+	mountPoints := []string{}
+	for mountPoint := range filesystems {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	sort.Strings(mountPoints)
+	for _, mountPoint := range mountPoints {
+		filesystemMap := filesystems[mountPoint].(map[string]interface{})
+		if filesystemMap["readOnly"].(bool) && !c.readOnlyAllowed[mountPoint] {
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("%s is read-only", mountPoint)})
+		}
+		for _, threshold := range c.thresholds {
+			if threshold.mountPoint != "*" && threshold.mountPoint != mountPoint {
+				continue
+			}
+			if used, ok := filesystemMap["usedPercent"].(float64); ok && threshold.usedPercent > 0 && used > threshold.usedPercent {
+				verdicts = append(verdicts, Verdict{threshold.state, fmt.Sprintf("%s is %.1f%% full (threshold: %g%%)", mountPoint, used, threshold.usedPercent)})
+			}
+			if used, ok := filesystemMap["inodesUsedPercent"].(float64); ok && threshold.inodesUsedPercent > 0 && used > threshold.inodesUsedPercent {
+				verdicts = append(verdicts, Verdict{threshold.state, fmt.Sprintf("%s has used %.1f%% inodes (threshold: %g%%)", mountPoint, used, threshold.inodesUsedPercent)})
+			}
+		}
+	}
+	return verdicts
+}
+
+// 计数器是累计值，利用率、await以及吞吐需要和上一次check()的结果相减，第一次check()时只有计数器
+func (c *DiskChecker) diskstatsInfo(diskstats map[string]diskstat, now time.Time) map[string]interface{} {
+	info := make(map[string]interface{})
+	elapsed := now.Sub(c.lastDiskstatsTime).Seconds()
+	for device, stat := range diskstats {
+		if c.ignoredDevices.MatchString(device) || stat.reads+stat.writes == 0 {
+			continue
+		}
+		deviceInfo := map[string]interface{}{
+			"reads":        stat.reads,
+			"writes":       stat.writes,
+			"readBytes":    stat.readSectors * diskSectorSize,
+			"writtenBytes": stat.writeSectors * diskSectorSize,
+			"ioInProgress": stat.ioInProgress,
+		}
+		last, ok := c.lastDiskstats[device]
+		if ok && elapsed > 0 && stat.reads >= last.reads && stat.writes >= last.writes && stat.ioTicks >= last.ioTicks {
+			ios := float64(stat.reads - last.reads + stat.writes - last.writes)
+			utilization := float64(stat.ioTicks-last.ioTicks) / (elapsed * 1000) * 100
+			if utilization > 100 {
+				utilization = 100
+			}
+			deviceInfo["utilizationPercent"] = utilization
+			deviceInfo["iops"] = ios / elapsed
+			deviceInfo["readBytesPerSecond"] = float64(stat.readSectors-last.readSectors) * diskSectorSize / elapsed
+			deviceInfo["writeBytesPerSecond"] = float64(stat.writeSectors-last.writeSectors) * diskSectorSize / elapsed
+			deviceInfo["awaitMilliseconds"] = float64(0)
+			if ios > 0 {
+				deviceInfo["awaitMilliseconds"] = float64(stat.readTicks-last.readTicks+stat.writeTicks-last.writeTicks) / ios
+			}
+		}
+		info[device] = deviceInfo
+	}
+	return info
+}
+
+func (c *DiskChecker) info() Info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *DiskChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	if filesystems, ok := c.basicInfo["filesystems"].(map[string]interface{}); ok {
+		for mountPoint, filesystem := range filesystems {
+			filesystemMap := filesystem.(map[string]interface{})
+			labels := []string{"mountpoint", mountPoint, "device", filesystemMap["device"].(string), "fstype", filesystemMap["fsType"].(string)}
+			metrics = append(metrics, newMetric("disk_readonly", "Whether the filesystem is read-only.", boolToFloat(filesystemMap["readOnly"].(bool)), labels...))
+			for _, item := range []struct{ key, name, help string }{
+				{"bytesTotal", "disk_size_bytes", "Size of the filesystem in bytes."},
+				{"bytesFree", "disk_bytes_free", "Free bytes of the filesystem."},
+				{"bytesAvailable", "disk_bytes_available", "Bytes available to non-root users."},
+				{"inodesTotal", "disk_inodes", "Total inodes of the filesystem."},
+				{"inodesFree", "disk_inodes_free", "Free inodes of the filesystem."},
+			} {
+				if value, ok := toFloat(filesystemMap[item.key]); ok {
+					metrics = append(metrics, newMetric(item.name, item.help, value, labels...))
+				}
+			}
+		}
+	}
+	if diskstats, ok := c.basicInfo["diskstats"].(map[string]interface{}); ok {
+		for device, deviceInfo := range diskstats {
+			deviceInfoMap := deviceInfo.(map[string]interface{})
+			for _, item := range []struct{ key, name, help string }{
+				{"reads", "disk_reads_completed", "Reads completed of the block device."},
+				{"writes", "disk_writes_completed", "Writes completed of the block device."},
+				{"readBytes", "disk_read_bytes", "Bytes read from the block device."},
+				{"writtenBytes", "disk_written_bytes", "Bytes written to the block device."},
+			} {
+				if value, ok := toFloat(deviceInfoMap[item.key]); ok {
+					metrics = append(metrics, newCounter(item.name, item.help, value, "device", device))
+				}
+			}
+			for _, item := range []struct{ key, name, help string }{
+				{"utilizationPercent", "disk_io_utilization_percent", "Percentage of time the block device was busy between the last two checks."},
+				{"awaitMilliseconds", "disk_io_await_milliseconds", "Average time of an I/O request between the last two checks."},
+			} {
+				if value, ok := toFloat(deviceInfoMap[item.key]); ok {
+					metrics = append(metrics, newMetric(item.name, item.help, value, "device", device))
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+func (c *DiskChecker) newRouters() Routers {
+	routers := make(Routers)
+	return routers
+}
+
+func NewDiskChecker() *DiskChecker {
+	return &DiskChecker{statfsPending: make(map[string]bool)}
+}
+
+func parseDiskThresholds(items []interface{}) ([]diskThreshold, error) {
+	thresholds := []diskThreshold{}
+	for i, item := range items {
+		itemMap, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("threshold %d should be a map", i)
+		}
+		threshold := diskThreshold{state: Error}
+		threshold.mountPoint, _ = itemMap["mountPoint"].(string)
+		if threshold.mountPoint == "" {
+			return nil, fmt.Errorf("mountPoint of threshold %d is required", i)
+		}
+		if state, ok := itemMap["state"].(string); ok {
+			threshold.state = State(state)
+		}
+		if err := checkAllowed(string(threshold.state), ruleStateValues); err != nil {
+			return nil, fmt.Errorf("state of threshold %d %s", i, err)
+		}
+		for key, target := range map[string]*float64{"usedPercent": &threshold.usedPercent, "inodesUsedPercent": &threshold.inodesUsedPercent} {
+			value, ok := itemMap[key]
+			if !ok {
+				continue
+			}
+			if *target, ok = toFloat(value); !ok {
+				return nil, fmt.Errorf("%s of threshold %d should be a number, got %v", key, i, value)
+			}
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// 参考 https://www.kernel.org/doc/Documentation/filesystems/proc.txt 中的/proc/<pid>/mountinfo
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func readMountInfo(mountInfoPath string) ([]mountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mounts := []mountInfo{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || len(fields) < separator+4 {
+			return nil, fmt.Errorf("unexpected line in %s: %s", mountInfoPath, scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			mountPoint: unescapeMountPath(fields[4]),
+			fsType:     fields[separator+1],
+			source:     unescapeMountPath(fields[separator+2]),
+			readOnly:   strings.HasPrefix(fields[separator+3]+",", "ro,"),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// mountinfo中的空格、tab、换行和反斜杠被转义为\040、\011、\012和\134
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if value, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+// 把容器中的挂载点转换为宿主机上的挂载点，不在mount_point之下的挂载点返回false
+func hostMountPoint(mountPoint string, containerMountPoint string) (string, bool) {
+	if mountPoint == "/" {
+		return containerMountPoint, true
+	}
+	if containerMountPoint == mountPoint {
+		return "/", true
+	}
+	if strings.HasPrefix(containerMountPoint, mountPoint+"/") {
+		return containerMountPoint[len(mountPoint):], true
+	}
+	return "", false
+}
+
+// 挂掉的nfs会让statfs一直阻塞，超时后放弃等待。上一次的statfs还没有返回时跳过这个挂载点，
+// 每个挂载点最多只有一个阻塞的goroutine
+func (c *DiskChecker) statfs(mountPoint string) (map[string]interface{}, error) {
+	c.statfsMutex.Lock()
+	if c.statfsPending[mountPoint] {
+		c.statfsMutex.Unlock()
+		return nil, fmt.Errorf("statfs of a previous check has not returned")
+	}
+	c.statfsPending[mountPoint] = true
+	c.statfsMutex.Unlock()
+	type result struct {
+		stat unix.Statfs_t
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var stat unix.Statfs_t
+		err := unix.Statfs(mountPoint, &stat)
+		c.statfsMutex.Lock()
+		delete(c.statfsPending, mountPoint)
+		c.statfsMutex.Unlock()
+		ch <- result{stat, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		stat := r.stat
+		usage := map[string]interface{}{
+			"bytesTotal":     stat.Blocks * uint64(stat.Bsize),
+			"bytesFree":      stat.Bfree * uint64(stat.Bsize),
+			"bytesAvailable": stat.Bavail * uint64(stat.Bsize),
+			"inodesTotal":    stat.Files,
+			"inodesFree":     stat.Ffree,
+		}
+		// 和df一致，已用的比例不包含只有root可用的保留空间
+		if used := stat.Blocks - stat.Bfree; used+stat.Bavail > 0 {
+			usage["usedPercent"] = float64(used) / float64(used+stat.Bavail) * 100
+		}
+		if stat.Files > 0 {
+			usage["inodesUsedPercent"] = float64(stat.Files-stat.Ffree) / float64(stat.Files) * 100
+		}
+		return usage, nil
+	case <-time.After(c.statfsTimeout):
+		return nil, fmt.Errorf("statfs timeout after %s", c.statfsTimeout)
+	}
+}
+
+// 参考 https://www.kernel.org/doc/Documentation/iostats.txt
+func readDiskstats(diskstatsPath string) (map[string]diskstat, error) {
+	file, err := os.Open(diskstatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	diskstats := make(map[string]diskstat)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		values := make([]uint64, 11)
+		for i := range values {
+			if values[i], err = strconv.ParseUint(fields[i+3], 10, 64); err != nil {
+				return nil, fmt.Errorf("unexpected line in %s: %s", diskstatsPath, scanner.Text())
+			}
+		}
+		diskstats[fields[2]] = diskstat{
+			reads:        values[0],
+			readSectors:  values[2],
+			readTicks:    values[3],
+			writes:       values[4],
+			writeSectors: values[6],
+			writeTicks:   values[7],
+			ioInProgress: values[8],
+			ioTicks:      values[9],
+		}
+	}
+	return diskstats, scanner.Err()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadMountInfo(t *testing.T) {
+	root, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(path.Join(root, "mountinfo"), []byte(strings.Join([]string{
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro",
+		// 没有可选字段
+		"36 22 98:0 /mnt1 /host/mnt2 rw,noatime - ext3 /dev/root ro,errors=continue",
+		// 多个可选字段，挂载点和设备中有转义的空格
+		`40 22 0:45 / /host/mnt/my\040disk ro,relatime shared:2 master:1 - nfs4 server:/export\040dir rw,vers=4.1`,
+	}, "\n")+"\n"), 0644)
+	ioutil.WriteFile(path.Join(root, "broken"), []byte("36 22 98:0 /mnt1 /mnt2 rw,noatime ext3 /dev/root rw\n"), 0644)
+
+	mounts, err := readMountInfo(path.Join(root, "mountinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []mountInfo{
+		{mountPoint: "/", fsType: "ext4", source: "/dev/sda1", readOnly: false},
+		{mountPoint: "/host/mnt2", fsType: "ext3", source: "/dev/root", readOnly: true},
+		// 以superblock的选项为准，挂载选项中的ro不算只读
+		{mountPoint: "/host/mnt/my disk", fsType: "nfs4", source: "server:/export dir", readOnly: false},
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, mounts)
+	}
+	for i := range expected {
+		if mounts[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], mounts[i])
+		}
+	}
+	if _, err := readMountInfo(path.Join(root, "broken")); err == nil {
+		t.Errorf("expected an error without the separator")
+	}
+	if _, err := readMountInfo(path.Join(root, "missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := map[string]string{
+		"/mnt/data":           "/mnt/data",
+		`/mnt/my\040disk`:     "/mnt/my disk",
+		`/mnt/a\011b\012c`:    "/mnt/a\tb\nc",
+		`/mnt/back\134slash`:  `/mnt/back\slash`,
+		`/mnt/not\08escaped`:  `/mnt/not\08escaped`,
+		`/mnt/trailing\04`:    `/mnt/trailing\04`,
+		`\040leading`:         " leading",
+		`/mnt/\040\040double`: "/mnt/  double",
+	}
+	for escaped, expected := range tests {
+		if actual := unescapeMountPath(escaped); actual != expected {
+			t.Errorf("unescapeMountPath(%q): expected %q, got %q", escaped, expected, actual)
+		}
+	}
+}
+
+func TestHostMountPoint(t *testing.T) {
+	tests := []struct {
+		mountPoint          string
+		containerMountPoint string
+		expected            string
+		ok                  bool
+	}{
+		{"/", "/var/lib/docker", "/var/lib/docker", true},
+		{"/host", "/host", "/", true},
+		{"/host", "/host/var/lib/docker", "/var/lib/docker", true},
+		{"/host", "/hostname", "", false},
+		{"/host", "/etc/hosts", "", false},
+		{"/host", "/", "", false},
+	}
+	for _, test := range tests {
+		actual, ok := hostMountPoint(test.mountPoint, test.containerMountPoint)
+		if actual != test.expected || ok != test.ok {
+			t.Errorf("hostMountPoint(%s, %s): expected %s %v, got %s %v", test.mountPoint, test.containerMountPoint, test.expected, test.ok, actual, ok)
+		}
+	}
+}
+
+func TestReadDiskstats(t *testing.T) {
+	root, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(path.Join(root, "diskstats"), []byte(strings.Join([]string{
+		"   8       0 sda 1000 10 80000 500 2000 20 160000 1500 1 3000 2000",
+		// 4.18之后有discard的字段，5.5之后有flush的字段
+		" 259       0 nvme0n1 100 0 800 50 200 0 1600 150 0 300 200 0 0 0 0 2 10",
+		"   7       0 loop0 0 0 0 0 0 0 0 0 0 0 0",
+		"   8       1 sda1 short line",
+	}, "\n")+"\n"), 0644)
+	ioutil.WriteFile(path.Join(root, "broken"), []byte("   8       0 sda 1000 10 80000 500 2000 20 abc 1500 1 3000 2000\n"), 0644)
+
+	diskstats, err := readDiskstats(path.Join(root, "diskstats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := diskstat{reads: 1000, readSectors: 80000, readTicks: 500, writes: 2000, writeSectors: 160000, writeTicks: 1500, ioInProgress: 1, ioTicks: 3000}
+	if diskstats["sda"] != expected {
+		t.Errorf("expected %+v, got %+v", expected, diskstats["sda"])
+	}
+	if diskstats["nvme0n1"].writes != 200 || diskstats["nvme0n1"].ioTicks != 300 {
+		t.Errorf("unexpected nvme0n1 %+v", diskstats["nvme0n1"])
+	}
+	if _, ok := diskstats["sda1"]; ok || len(diskstats) != 3 {
+		t.Errorf("short lines should be skipped, got %v", diskstats)
+	}
+	if _, err := readDiskstats(path.Join(root, "broken")); err == nil {
+		t.Errorf("expected an error for an invalid counter")
+	}
+}
+
+func TestDiskstatsInfo(t *testing.T) {
+	now := time.Now()
+	checker := &DiskChecker{ignoredDevices: regexp.MustCompile(defaultIgnoredDevices)}
+	diskstats := map[string]diskstat{
+		"sda":   {reads: 1000, readSectors: 8000, readTicks: 500, writes: 2000, writeSectors: 16000, writeTicks: 1500, ioTicks: 3000},
+		"loop0": {reads: 10, writes: 10},
+		"sdb":   {},
+	}
+	info := checker.diskstatsInfo(diskstats, now)
+	if len(info) != 1 {
+		t.Fatalf("ignored and idle devices should be skipped, got %v", info)
+	}
+	sda := info["sda"].(map[string]interface{})
+	if sda["readBytes"] != uint64(8000*512) || sda["writtenBytes"] != uint64(16000*512) {
+		t.Errorf("unexpected counters %v", sda)
+	}
+	if _, ok := sda["utilizationPercent"]; ok {
+		t.Errorf("expected no rates in the first check, got %v", sda)
+	}
+
+	checker.lastDiskstats, checker.lastDiskstatsTime = diskstats, now
+	info = checker.diskstatsInfo(map[string]diskstat{
+		"sda": {reads: 1100, readSectors: 10000, readTicks: 600, writes: 2100, writeSectors: 20000, writeTicks: 1900, ioTicks: 8000},
+	}, now.Add(time.Second*10))
+	sda = info["sda"].(map[string]interface{})
+	expected := map[string]float64{
+		"utilizationPercent":  50,
+		"iops":                20,
+		"readBytesPerSecond":  2000 * 512 / 10,
+		"writeBytesPerSecond": 4000 * 512 / 10,
+		"awaitMilliseconds":   2.5,
+	}
+	for key, value := range expected {
+		if sda[key] != value {
+			t.Errorf("expected %s %v, got %v", key, value, sda[key])
+		}
+	}
+
+	// 计数器回绕或者设备被重新挂载时不计算速率
+	info = checker.diskstatsInfo(map[string]diskstat{"sda": {reads: 10, writes: 10}}, now.Add(time.Second*10))
+	if _, ok := info["sda"].(map[string]interface{})["iops"]; ok {
+		t.Errorf("expected no rates when counters decrease")
+	}
+}
+
+func TestFilesystemVerdicts(t *testing.T) {
+	thresholds, err := parseDiskThresholds([]interface{}{
+		map[interface{}]interface{}{"mountPoint": "/var/lib/docker", "usedPercent": 85, "inodesUsedPercent": 90.5},
+		map[interface{}]interface{}{"mountPoint": "*", "usedPercent": 95, "state": "Fatal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &DiskChecker{thresholds: thresholds, readOnlyAllowed: map[string]bool{"/mnt/iso": true}}
+	verdicts := checker.filesystemVerdicts(map[string]interface{}{
+		"/":               map[string]interface{}{"readOnly": true, "usedPercent": 50.0},
+		"/mnt/iso":        map[string]interface{}{"readOnly": true},
+		"/var/lib/docker": map[string]interface{}{"readOnly": false, "usedPercent": 96.0, "inodesUsedPercent": 91.0},
+		"/data":           map[string]interface{}{"readOnly": false, "usedPercent": 90.0, "inodesUsedPercent": 99.0},
+	})
+	expected := []Verdict{
+		{Error, "/ is read-only"},
+		{Error, "/var/lib/docker is 96.0% full (threshold: 85%)"},
+		{Error, "/var/lib/docker has used 91.0% inodes (threshold: 90.5%)"},
+		{Fatal, "/var/lib/docker is 96.0% full (threshold: 95%)"},
+	}
+	if len(verdicts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, verdicts)
+	}
+	for i := range expected {
+		if verdicts[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], verdicts[i])
+		}
+	}
+
+	for _, items := range [][]interface{}{
+		{"/var/lib/docker"},
+		{map[interface{}]interface{}{"usedPercent": 85}},
+		{map[interface{}]interface{}{"mountPoint": "/", "usedPercent": "high"}},
+		{map[interface{}]interface{}{"mountPoint": "/", "state": "Live"}},
+	} {
+		if _, err := parseDiskThresholds(items); err == nil {
+			t.Errorf("parseDiskThresholds(%v): expected an error", items)
+		}
+	}
+}
+
+func TestDiskStatfs(t *testing.T) {
+	root, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	checker := NewDiskChecker()
+	checker.statfsTimeout = time.Second
+
+	usage, err := checker.statfs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := usage["bytesTotal"].(uint64); total == 0 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+	if _, err := checker.statfs(path.Join(root, "missing")); err == nil {
+		t.Errorf("expected an error for a missing mount point")
+	}
+	if len(checker.statfsPending) != 0 {
+		t.Errorf("finished statfs should not be pending, got %v", checker.statfsPending)
+	}
+
+	// 上一次的statfs还没有返回时不再发起新的
+	checker.statfsPending[root] = true
+	if _, err := checker.statfs(root); err == nil || !strings.Contains(err.Error(), "has not returned") {
+		t.Errorf("expected the mount point to be skipped, got %v", err)
+	}
+}
+
+func TestDiskCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(path.Join(root, "proc/self"), 0755)
+	os.MkdirAll(path.Join(root, "host/data"), 0755)
+	ioutil.WriteFile(path.Join(root, "proc/self/mountinfo"), []byte(strings.Join([]string{
+		"22 1 8:1 / " + path.Join(root, "host") + " rw,relatime - ext4 /dev/sda1 rw",
+		"23 22 8:2 / " + path.Join(root, "host/data") + " rw,relatime - xfs /dev/sda2 ro",
+		"24 22 0:5 / " + path.Join(root, "host/proc") + " rw - proc proc rw",
+		"25 1 8:3 / /etc/hosts rw - ext4 /dev/sda3 rw",
+	}, "\n")+"\n"), 0644)
+
+	checker := NewDiskChecker()
+	checker.procPath = path.Join(root, "proc")
+	checker.mountPoint = path.Join(root, "host")
+	checker.ignoredFsTypes = map[string]bool{"proc": true}
+	checker.ignoredMountPoints = regexp.MustCompile(defaultIgnoredMountPoints)
+	checker.ignoredDevices = regexp.MustCompile(defaultIgnoredDevices)
+	checker.statfsTimeout = time.Second
+	checker.check()
+
+	filesystems := checker.basicInfo["filesystems"].(map[string]interface{})
+	if len(filesystems) != 2 || filesystems["/"] == nil || filesystems["/data"] == nil {
+		t.Fatalf("expected / and /data, got %v", filesystems)
+	}
+	if checker.checkerState != Error || checker.stateReason != "/data is read-only" {
+		t.Errorf("expected /data to be read-only, got %s %s", checker.checkerState, checker.stateReason)
+	}
+	// errors中是字符串
+	if message, ok := checker.errors["diskstats"].(string); !ok || !strings.Contains(message, "diskstats") {
+		t.Errorf("expected the diskstats error as a string, got %v", checker.errors)
+	}
+
+	ioutil.WriteFile(path.Join(root, "proc/diskstats"), []byte("   8       0 sda 1000 10 80000 500 2000 20 160000 1500 1 3000 2000\n"), 0644)
+	checker.check()
+	output := string(writeMetrics(checker.metrics()))
+	for _, line := range []string{
+		"# TYPE node_guard_disk_reads_completed_total counter",
+		"# TYPE node_guard_disk_read_bytes_total counter",
+		"# TYPE node_guard_disk_written_bytes_total counter",
+		`node_guard_disk_written_bytes_total{device="sda"} 8.192e+07`,
+		"# TYPE node_guard_disk_size_bytes gauge",
+		"# TYPE node_guard_disk_inodes gauge",
+		`node_guard_disk_readonly{device="/dev/sda2",fstype="xfs",mountpoint="/data"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+
+	os.Remove(path.Join(root, "proc/self/mountinfo"))
+	checker.check()
+	if _, ok := checker.errors["mountinfo"].(string); !ok {
+		t.Errorf("expected the mountinfo error as a string, got %v", checker.errors)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// exec instance的配置项都是一样的，以这个名字注册schema
+const execInstanceSchema = "<exec instance>"
+
+func init() {
+	registerConfigSchema("exec",
+		ConfigItem{"instances", []string{}, "names of exec checkers, each one is configured in the section with the same name"},
+	)
+	registerConfigSchema(execInstanceSchema,
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"command", "", "the command to run, required"},
+		ConfigItem{"args", []string{}, "arguments of the command"},
+		ConfigItem{"env", []string{}, "extra environment variables, e.g. FOO=bar"},
+		ConfigItem{"timeout", time.Second * 30, "the process group is killed after timeout"},
+		ConfigItem{"output", oneOf("nagios", "nagios", "json"), "format of stdout, nagios or json"},
+		rulesConfigItem,
+	)
+}
+
+func isExecInstance(daemonConfig *DaemonConfig, name string) bool {
+	for _, instance := range daemonConfig.getOrDefault("exec", "instances", []string{}).([]string) {
+		if instance == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exec类型的checker由配置文件声明，例如
+//
+//	exec:
+//	  instances:
+//	    - disk-health
+//	disk-health:
+//	  command: /host/opt/scripts/check_disk.sh
+//
+// 每个instance都是一个独立的checker，配置项写在以instance名字命名的配置下
+func registerExecCheckers(daemonConfig *DaemonConfig) error {
+	for _, name := range daemonConfig.getOrDefault("exec", "instances", []string{}).([]string) {
+		if checker, ok := checkers[name]; ok {
+			if _, ok := checker.(*ExecChecker); ok {
+				continue
+			}
+			return fmt.Errorf("exec checker %s conflicts with an existing checker", name)
+		}
+		registerChecker(name, NewExecChecker(name))
+	}
+	return nil
+}
+
+// nagios插件的退出码对应的状态
+var nagiosStates = map[int]State{
+	0: Live,
+	1: Error,
+	2: Fatal,
+	3: Unknown,
+}
+
+type ExecChecker struct {
+	name          string
+	mutex         sync.RWMutex
+	stopCh        chan struct{}
+	checkerState  State
+	stateReason   string
+	rules         []*Rule
+	checkTime     time.Time
+	checkDuration time.Duration
+	checkInterval time.Duration
+	basicInfo     map[string]interface{}
+	details       map[string]interface{}
+	errors        map[string]interface{}
+	command       string
+	args          []string
+	env           []string
+	timeout       time.Duration
+	output        string
+	exitCode      int
+}
+
+type execJSONOutput struct {
+	State  State                  `json:"state"`
+	Reason string                 `json:"reason"`
+	Basic  map[string]interface{} `json:"basic"`
+	Detail map[string]interface{} `json:"detail"`
+	Errors map[string]interface{} `json:"errors"`
+}
+
+func (c *ExecChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
+	c.command = daemonConfig.getOrDefault(c.name, "command", "").(string)
+	c.args = daemonConfig.getOrDefault(c.name, "args", []string{}).([]string)
+	c.timeout = daemonConfig.getOrDefault(c.name, "timeout", time.Second*30).(time.Duration)
+	c.output = daemonConfig.getOrDefault(c.name, "output", "nagios").(string)
+	if c.command == "" {
+		return fmt.Errorf("command of exec checker %s is required", c.name)
+	}
+	c.env = append(os.Environ(),
+		"NODE_GUARD_CHECKER="+c.name,
+		"NODE_GUARD_MOUNT_POINT="+daemonConfig.mount_point,
+		"NODE_GUARD_PROC_PATH="+daemonConfig.proc_path,
+		"NODE_GUARD_SYS_PATH="+daemonConfig.sys_path,
+		"NODE_GUARD_ROOTFS_PATH="+daemonConfig.rootfs_path,
+		"NODE_GUARD_DBUS_ADDRESS="+daemonConfig.dbus_address,
+	)
+	c.env = append(c.env, daemonConfig.getOrDefault(c.name, "env", []string{}).([]string)...)
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *ExecChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *ExecChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *ExecChecker) stop() {
+	close(c.stopCh)
+}
+
+func (c *ExecChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	details := make(map[string]interface{})
+	verdicts := []Verdict{}
+	exitCode := -1
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.details = details
+		c.exitCode = exitCode
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	stdout, stderr, exitCode, err := runCommand(c.command, c.args, c.env, c.timeout)
+	if stderr != "" {
+		details["stderr"] = stderr
+	}
+	if err != nil {
+		errors["exec"] = err.Error()
+		verdicts = append(verdicts, Verdict{Unknown, fmt.Sprintf("failed to run %s: %s", c.command, err)})
+		return nil
+	}
+	basicInfo["exitCode"] = exitCode
+
+	switch c.output {
+	case "json":
+		var output execJSONOutput
+		if err := json.Unmarshal([]byte(stdout), &output); err != nil {
+			errors["output"] = fmt.Sprintf("can not parse output as json: %s", err)
+			verdicts = append(verdicts, Verdict{Unknown, "invalid json output"})
+			return nil
+		}
+		for key, value := range output.Basic {
+			basicInfo[key] = value
+		}
+		for key, value := range output.Detail {
+			details[key] = value
+		}
+		for key, value := range output.Errors {
+			errors[key] = value
+		}
+		state := output.State
+		if state != "" {
+			if err := checkAllowed(string(state), append(stateValues, Unknown)); err != nil {
+				errors["output.state"] = err.Error()
+				state = ""
+			}
+		}
+		if state == "" {
+			state = exitCodeState(exitCode)
+		}
+		verdicts = append(verdicts, Verdict{state, output.Reason})
+	case "nagios":
+		summary, longOutput, perfdata := parseNagiosOutput(stdout)
+		basicInfo["output"] = summary
+		if len(perfdata) > 0 {
+			basicInfo["perfdata"] = perfdata
+		}
+		if longOutput != "" {
+			details["longOutput"] = longOutput
+		}
+		verdicts = append(verdicts, Verdict{exitCodeState(exitCode), summary})
+	}
+	return nil
+}
+
+func (c *ExecChecker) info() Info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *ExecChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	if c.exitCode >= 0 {
+		metrics = append(metrics, newMetric("exec_exit_code", "Exit code of the last execution.", float64(c.exitCode), "checker", c.name))
+	}
+	if perfdata, ok := c.basicInfo["perfdata"].(map[string]float64); ok {
+		for label, value := range perfdata {
+			metrics = append(metrics, newMetric("exec_perfdata", "Performance data reported by the nagios plugin.", value, "checker", c.name, "label", label))
+		}
+	}
+	return metrics
+}
+
+func (c *ExecChecker) newRouters() Routers {
+	routers := make(Routers)
+	routers["detail"] = func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		formatWrite(c.details, w, r)
+	}
+	return routers
+}
+
+func NewExecChecker(name string) *ExecChecker {
+	return &ExecChecker{name: name}
+}
+
+func exitCodeState(exitCode int) State {
+	if state, ok := nagiosStates[exitCode]; ok {
+		return state
+	}
+	return Unknown
+}
+
+// 进程退出或者被杀掉之后等待读完stdout和stderr的最长时间
+const execPipeDrainTimeout = time.Second
+
+// 超时后会杀掉整个进程组，避免脚本起的子进程残留。stdout和stderr使用自己创建的管道，
+// setsid等脱离了进程组的子进程继承管道时不会让Wait()一直阻塞，最多等待execPipeDrainTimeout后关闭管道
+func runCommand(command string, args []string, env []string, timeout time.Duration) (string, string, int, error) {
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return "", "", -1, err
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		return "", "", -1, err
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Env = env
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		stdoutReader.Close()
+		stderrReader.Close()
+		return "", "", -1, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	for _, pipe := range []struct {
+		buf    *bytes.Buffer
+		reader *os.File
+	}{{&stdout, stdoutReader}, {&stderr, stderrReader}} {
+		wg.Add(1)
+		go func(buf *bytes.Buffer, reader *os.File) {
+			defer wg.Done()
+			io.Copy(buf, reader)
+		}(pipe.buf, pipe.reader)
+	}
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	// 关闭读端之后io.Copy()会返回，之后才能读取buffer
+	drain := func() {
+		select {
+		case <-drained:
+		case <-time.After(execPipeDrainTimeout):
+		}
+		stdoutReader.Close()
+		stderrReader.Close()
+		<-drained
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		drain()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				return stdout.String(), stderr.String(), status.ExitStatus(), nil
+			}
+		}
+		if err != nil {
+			return stdout.String(), stderr.String(), -1, err
+		}
+		return stdout.String(), stderr.String(), 0, nil
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		drain()
+		return stdout.String(), stderr.String(), -1, fmt.Errorf("timeout after %s", timeout)
+	}
+}
+
+// 参考 https://nagios-plugins.org/doc/guidelines.html#AEN200
+// 第一行"|"之前为summary，之后的行为long output，所有"|"之后的内容为perfdata
+func parseNagiosOutput(output string) (string, string, map[string]float64) {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	perfdataParts := []string{}
+	texts := []string{}
+	for i, line := range lines {
+		segs := strings.SplitN(line, "|", 2)
+		texts = append(texts, strings.TrimSpace(segs[0]))
+		if len(segs) == 2 {
+			perfdataParts = append(perfdataParts, segs[1])
+			if i > 0 {
+				// long output中出现"|"之后的所有行都是perfdata
+				perfdataParts = append(perfdataParts, lines[i+1:]...)
+				break
+			}
+		}
+	}
+	perfdata := make(map[string]float64)
+	for _, item := range splitPerfdata(strings.Join(perfdataParts, " ")) {
+		segs := strings.SplitN(item, "=", 2)
+		if len(segs) != 2 {
+			continue
+		}
+		value := strings.SplitN(segs[1], ";", 2)[0]
+		value = strings.TrimRightFunc(value, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.'
+		})
+		if valueFloat, err := strconv.ParseFloat(value, 64); err == nil {
+			perfdata[unquote(segs[0])] = valueFloat
+		}
+	}
+	return texts[0], strings.TrimSpace(strings.Join(texts[1:], "\n")), perfdata
+}
+
+// 按空白分隔，单引号中的空白不分隔
+func splitPerfdata(perfdata string) []string {
+	items := []string{}
+	var current strings.Builder
+	quoted := false
+	for _, r := range perfdata {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			current.WriteRune(r)
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if current.Len() > 0 {
+				items = append(items, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		items = append(items, current.String())
+	}
+	return items
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNagiosOutput(t *testing.T) {
+	tests := []struct {
+		output     string
+		summary    string
+		longOutput string
+		perfdata   map[string]float64
+	}{
+		{"", "", "", map[string]float64{}},
+		{"DISK OK - free space: / 3326 MB (56%)\n", "DISK OK - free space: / 3326 MB (56%)", "", map[string]float64{}},
+		{"DISK OK | /=2643MB;5948;5958;0;5968\n", "DISK OK", "", map[string]float64{"/": 2643}},
+		// 参考nagios plugin guidelines中的例子
+		{strings.Join([]string{
+			"DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968",
+			"/ 15272 MB (77%);",
+			"/boot 68 MB (69%);",
+			"/var/log 819 MB (84%); | /boot=68MB;88;93;0;98",
+			"/home=69357MB;253404;253409;0;253414",
+			"/var/log=818MB;970;975;0;980",
+		}, "\n"), "DISK OK - free space: / 3326 MB (56%);", "/ 15272 MB (77%);\n/boot 68 MB (69%);\n/var/log 819 MB (84%);",
+			map[string]float64{"/": 2643, "/boot": 68, "/home": 69357, "/var/log": 818}},
+		// 单引号中的空白不分隔，无法解析的值被忽略
+		{"OK | 'used space'=10%;80;90 time=0.5s temperature=-5 unknown=U invalid\n", "OK", "",
+			map[string]float64{"used space": 10, "time": 0.5, "temperature": -5}},
+	}
+	for _, test := range tests {
+		summary, longOutput, perfdata := parseNagiosOutput(test.output)
+		if summary != test.summary || longOutput != test.longOutput {
+			t.Errorf("parseNagiosOutput(%q): expected %q %q, got %q %q", test.output, test.summary, test.longOutput, summary, longOutput)
+		}
+		if fmt.Sprint(perfdata) != fmt.Sprint(test.perfdata) {
+			t.Errorf("parseNagiosOutput(%q): expected perfdata %v, got %v", test.output, test.perfdata, perfdata)
+		}
+	}
+}
+
+func TestExitCodeState(t *testing.T) {
+	tests := map[int]State{0: Live, 1: Error, 2: Fatal, 3: Unknown, 4: Unknown, 255: Unknown, -1: Unknown}
+	for exitCode, expected := range tests {
+		if actual := exitCodeState(exitCode); actual != expected {
+			t.Errorf("exitCodeState(%d): expected %s, got %s", exitCode, expected, actual)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	stdout, stderr, exitCode, err := runCommand("sh", []string{"-c", "echo out; echo err >&2; exit 2"}, nil, time.Second*5)
+	if err != nil || stdout != "out\n" || stderr != "err\n" || exitCode != 2 {
+		t.Errorf("unexpected result %q %q %d %v", stdout, stderr, exitCode, err)
+	}
+	stdout, _, exitCode, err = runCommand("sh", []string{"-c", "echo $FOO"}, []string{"FOO=bar"}, time.Second*5)
+	if err != nil || stdout != "bar\n" || exitCode != 0 {
+		t.Errorf("unexpected result %q %d %v", stdout, exitCode, err)
+	}
+	if _, _, exitCode, err = runCommand("/nonexistent/check.sh", nil, nil, time.Second*5); err == nil || exitCode != -1 {
+		t.Errorf("expected an error for a missing command, got %d %v", exitCode, err)
+	}
+	// 被信号杀掉的进程没有退出码
+	if _, _, exitCode, err = runCommand("sh", []string{"-c", "kill -9 $$"}, nil, time.Second*5); err == nil || exitCode != -1 {
+		t.Errorf("expected an error for a killed process, got %d %v", exitCode, err)
+	}
+
+	startTime := time.Now()
+	stdout, _, exitCode, err = runCommand("sh", []string{"-c", "echo started; sleep 10"}, nil, time.Millisecond*200)
+	if err == nil || !strings.Contains(err.Error(), "timeout") || exitCode != -1 || stdout != "started\n" {
+		t.Errorf("expected a timeout with partial output, got %q %d %v", stdout, exitCode, err)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second*3 {
+		t.Errorf("the process group should be killed after timeout, took %s", elapsed)
+	}
+}
+
+func TestRunCommandDetachedChild(t *testing.T) {
+	// setsid的子进程不在进程组中，继承的stdout不会让runCommand一直阻塞
+	startTime := time.Now()
+	stdout, _, exitCode, err := runCommand("sh", []string{"-c", "setsid sleep 5 & echo started"}, nil, time.Second*10)
+	if err != nil || exitCode != 0 || stdout != "started\n" {
+		t.Errorf("unexpected result %q %d %v", stdout, exitCode, err)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second*3 {
+		t.Errorf("expected to return after the pipe drain timeout, took %s", elapsed)
+	}
+
+	startTime = time.Now()
+	if _, _, _, err = runCommand("sh", []string{"-c", "setsid sleep 5 & sleep 10"}, nil, time.Millisecond*200); err == nil {
+		t.Errorf("expected a timeout")
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second*3 {
+		t.Errorf("expected to return after the pipe drain timeout, took %s", elapsed)
+	}
+}
+
+func TestExecCheck(t *testing.T) {
+	newChecker := func(output string, script string) *ExecChecker {
+		checker := NewExecChecker("exec-test")
+		checker.command = "sh"
+		checker.args = []string{"-c", script}
+		checker.timeout = time.Second * 5
+		checker.output = output
+		return checker
+	}
+
+	checker := newChecker("nagios", "echo 'DISK WARNING | /=90%;80;95'; echo 'long output'; exit 1")
+	checker.check()
+	if checker.checkerState != Error || checker.stateReason != "DISK WARNING" {
+		t.Errorf("expected Error from the exit code, got %s %s", checker.checkerState, checker.stateReason)
+	}
+	if checker.basicInfo["exitCode"] != 1 || checker.details["longOutput"] != "long output" {
+		t.Errorf("unexpected basic %v and details %v", checker.basicInfo, checker.details)
+	}
+	output := string(writeMetrics(checker.metrics()))
+	for _, line := range []string{`node_guard_exec_exit_code{checker="exec-test"} 1`, `node_guard_exec_perfdata{checker="exec-test",label="/"} 90`} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+
+	checker = newChecker("json", `echo '{"state": "Fatal", "reason": "disk is broken", "basic": {"disks": 2}, "errors": {"smart": "sdb failed"}}'`)
+	checker.check()
+	if checker.checkerState != Fatal || !strings.HasPrefix(checker.stateReason, "disk is broken") {
+		t.Errorf("expected Fatal from the output, got %s %s", checker.checkerState, checker.stateReason)
+	}
+	if checker.basicInfo["disks"] != float64(2) || checker.errors["smart"] != "sdb failed" {
+		t.Errorf("unexpected basic %v and errors %v", checker.basicInfo, checker.errors)
+	}
+
+	// 不合法的state记录在errors中，按退出码判断
+	checker = newChecker("json", `echo '{"state": "Broken"}'; exit 2`)
+	checker.check()
+	if checker.checkerState != Fatal {
+		t.Errorf("expected Fatal from the exit code, got %s %s", checker.checkerState, checker.stateReason)
+	}
+	if _, ok := checker.errors["output.state"].(string); !ok {
+		t.Errorf("expected output.state in errors, got %v", checker.errors)
+	}
+
+	checker = newChecker("json", "echo not json")
+	checker.check()
+	if checker.checkerState != Unknown || checker.errors["output"] == nil {
+		t.Errorf("expected Unknown for invalid json, got %s %v", checker.checkerState, checker.errors)
+	}
+
+	checker = newChecker("nagios", "sleep 10")
+	checker.timeout = time.Millisecond * 200
+	checker.check()
+	if checker.checkerState != Unknown || checker.exitCode != -1 || len(checker.metrics()) != 0 {
+		t.Errorf("expected Unknown after timeout, got %s %s", checker.checkerState, checker.stateReason)
+	}
+}
@@ -1,51 +1,220 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func init() {
 	registerChecker("hadoop", NewHadoopChecker())
+	registerConfigSchema("hadoop",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"etc.krb5.conf.path", "{mount_point}/etc/krb5.conf", "path of /etc/krb5.conf"},
+		ConfigItem{"keytabs", []string{"/etc/security/keytabs/*.keytab"}, "globs of keytab files relative to mount_point"},
+		ConfigItem{"hostname", "", "FQDN of the node which service principals should be for, detected when empty"},
+		ConfigItem{"keytab.enctypes.weak", defaultWeakEnctypes, "enctypes which are reported as weak"},
+		ConfigItem{"keytab.weakEnctype.state", oneOf(Error, stateValues...), "state when a keytab contains weak enctypes, Error, Fatal or Live"},
+		ConfigItem{"keytab.mismatch.state", oneOf(Error, stateValues...), "state when service principals in a keytab are for another host or realm, or none is for this node, Error, Fatal or Live"},
+		ConfigItem{"kdc.check.enable", true, "whether to check the reachability of the KDCs"},
+		ConfigItem{"kdc.timeout", time.Second * 3, "timeout of probing a KDC"},
+		ConfigItem{"kdc.unreachable.state", oneOf(Error, stateValues...), "state when a KDC is reachable over neither TCP nor UDP, Error, Fatal or Live"},
+		ConfigItem{"conf.dirs", defaultHadoopConfDirs, "candidate hadoop configuration directories relative to mount_point, the first existing one is used"},
+		ConfigItem{"site.files", []string{"core-site.xml", "hdfs-site.xml", "yarn-site.xml"}, "site files loaded in order, later files override earlier ones"},
+		ConfigItem{"properties.reported", defaultHadoopReportedProperties, "properties reported in basic"},
+		ConfigItem{"properties.expected", []interface{}{}, "expected values of properties, see docs/checkers.md"},
+		ConfigItem{"dirs.properties", defaultHadoopDirProperties, "properties whose values are local directories which should exist and be writable"},
+		ConfigItem{"dirs.users", defaultHadoopDirUsers, "prefix=user pairs, directories of properties with the longest matching prefix should be writable by the user of the host"},
+		ConfigItem{"jmx.daemons", []string{hadoopDataNode, hadoopNodeManager, hadoopRegionServer}, "daemons whose /jmx endpoints are probed, datanode, nodemanager or regionserver"},
+		ConfigItem{"jmx.required", []string{}, "daemons which must be running on the node, a refused connection to other daemons means they are not deployed"},
+		ConfigItem{"jmx.address", "127.0.0.1", "address of the http servers of the daemons"},
+		ConfigItem{"jmx.scheme", oneOf("http", "http", "https"), "scheme of the http servers of the daemons, http or https"},
+		ConfigItem{"jmx.datanode.port", defaultHadoopJMXPorts[hadoopDataNode], "http port of the datanode"},
+		ConfigItem{"jmx.nodemanager.port", defaultHadoopJMXPorts[hadoopNodeManager], "http port of the nodemanager"},
+		ConfigItem{"jmx.regionserver.port", defaultHadoopJMXPorts[hadoopRegionServer], "http port of the regionserver"},
+		ConfigItem{"jmx.timeout", time.Second * 5, "timeout of a request to a daemon"},
+		ConfigItem{"jmx.heartbeat.maxAge", time.Second * 30, "max age of the last heartbeat from the datanode to a namenode"},
+		rulesConfigItem,
+	)
+}
+
+// 相对于mount_point
+var defaultHadoopConfDirs = []string{
+	"/etc/hadoop/conf",
+	"/usr/hdp/current/hadoop-client/conf",
+	"/opt/hadoop/etc/hadoop",
+}
+
+var defaultHadoopReportedProperties = []string{
+	"fs.defaultFS",
+	"hadoop.security.authentication",
+	"dfs.nameservices",
+	"dfs.replication",
+	"dfs.datanode.data.dir",
+	"yarn.resourcemanager.hostname",
+	"yarn.nodemanager.resource.memory-mb",
+	"yarn.nodemanager.resource.cpu-vcores",
+}
+
+var defaultHadoopDirProperties = []string{
+	hadoopDataDirProperty,
+	"dfs.namenode.name.dir",
+	"dfs.journalnode.edits.dir",
+	"yarn.nodemanager.local-dirs",
+	"yarn.nodemanager.log-dirs",
+}
+
+// 属性前缀=宿主机上的用户，按最长前缀匹配
+var defaultHadoopDirUsers = []string{
+	"dfs.=hdfs",
+	"yarn.=yarn",
+}
+
+// 该属性中的目录不能在宿主机的根文件系统上
+const hadoopDataDirProperty = "dfs.datanode.data.dir"
+
+type hadoopExpectedProperty struct {
+	name  string
+	value string
+	state State
 }
 
 type HadoopChecker struct {
 	name          string
-	ticker        *time.Ticker
 	mutex         sync.RWMutex
 	stopCh        chan struct{}
 	checkerState  State
+	stateReason   string
+	rules         []*Rule
 	checkTime     time.Time
+	checkDuration time.Duration
 	checkInterval time.Duration
 	basicInfo     map[string]interface{}
 	errors        map[string]interface{}
 	procPath      string
+	mountPoint    string
 	krb5Path      string
+	keytabPaths   []string
+	hostname      string
+	weakEnctypes  map[string]bool
+	weakState     State
+	mismatchState State
+	kdcCheck      bool
+	kdcTimeout    time.Duration
+	kdcState      State
+	confDirs      []string
+	siteFiles     []string
+	reported      []string
+	expected      []hadoopExpectedProperty
+	dirProperties []string
+	dirUsers      map[string]string
+	conf          *hadoopConf
+	jmxDaemons    []string
+	jmxRequired   map[string]bool
+	jmxURLs       map[string]string
+	jmxClient     *http.Client
+	heartbeatAge  time.Duration
 }
 
 func (c *HadoopChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
 	c.name = "hadoop"
 	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
 	c.basicInfo = make(map[string]interface{})
 	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
 	c.procPath = daemonConfig.proc_path
 	c.krb5Path = daemonConfig.getOrDefault(c.name, "etc.krb5.conf.path", path.Join(daemonConfig.mount_point, "/etc/krb5.conf")).(string)
+	c.mountPoint = path.Clean(daemonConfig.mount_point)
+	c.keytabPaths = daemonConfig.getOrDefault(c.name, "keytabs", []string{"/etc/security/keytabs/*.keytab"}).([]string)
+	for _, pattern := range c.keytabPaths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob '%s' of checker %s: %s", pattern, c.name, err)
+		}
+	}
+	c.hostname = strings.ToLower(daemonConfig.getOrDefault(c.name, "hostname", "").(string))
+	if c.hostname == "" {
+		if c.hostname, err = fqdnHostname(); err != nil {
+			return err
+		}
+	}
+	c.weakEnctypes = make(map[string]bool)
+	for _, enctype := range daemonConfig.getOrDefault(c.name, "keytab.enctypes.weak", defaultWeakEnctypes).([]string) {
+		c.weakEnctypes[enctype] = true
+	}
+	c.weakState = State(daemonConfig.getOrDefault(c.name, "keytab.weakEnctype.state", string(Error)).(string))
+	c.mismatchState = State(daemonConfig.getOrDefault(c.name, "keytab.mismatch.state", string(Error)).(string))
+	c.kdcCheck = daemonConfig.getOrDefault(c.name, "kdc.check.enable", true).(bool)
+	c.kdcTimeout = daemonConfig.getOrDefault(c.name, "kdc.timeout", time.Second*3).(time.Duration)
+	c.kdcState = State(daemonConfig.getOrDefault(c.name, "kdc.unreachable.state", string(Error)).(string))
+	c.confDirs = daemonConfig.getOrDefault(c.name, "conf.dirs", defaultHadoopConfDirs).([]string)
+	c.siteFiles = daemonConfig.getOrDefault(c.name, "site.files", []string{"core-site.xml", "hdfs-site.xml", "yarn-site.xml"}).([]string)
+	c.reported = daemonConfig.getOrDefault(c.name, "properties.reported", defaultHadoopReportedProperties).([]string)
+	if c.expected, err = parseHadoopExpectedProperties(daemonConfig.getOrDefault(c.name, "properties.expected", []interface{}{}).([]interface{})); err != nil {
+		return fmt.Errorf("invalid properties.expected of checker %s: %s", c.name, err)
+	}
+	c.dirProperties = daemonConfig.getOrDefault(c.name, "dirs.properties", defaultHadoopDirProperties).([]string)
+	c.dirUsers = make(map[string]string)
+	for _, pair := range daemonConfig.getOrDefault(c.name, "dirs.users", defaultHadoopDirUsers).([]string) {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			return fmt.Errorf("invalid dirs.users '%s' of checker %s, should be prefix=user", pair, c.name)
+		}
+		c.dirUsers[fields[0]] = fields[1]
+	}
+	c.jmxDaemons = daemonConfig.getOrDefault(c.name, "jmx.daemons", []string{hadoopDataNode, hadoopNodeManager, hadoopRegionServer}).([]string)
+	c.jmxRequired = make(map[string]bool)
+	for _, daemon := range daemonConfig.getOrDefault(c.name, "jmx.required", []string{}).([]string) {
+		c.jmxRequired[daemon] = true
+	}
+	jmxAddress := daemonConfig.getOrDefault(c.name, "jmx.address", "127.0.0.1").(string)
+	jmxScheme := daemonConfig.getOrDefault(c.name, "jmx.scheme", "http").(string)
+	c.jmxURLs = make(map[string]string)
+	for _, daemon := range c.jmxDaemons {
+		defaultPort, ok := defaultHadoopJMXPorts[daemon]
+		if !ok {
+			return fmt.Errorf("unknown daemon '%s' in jmx.daemons of checker %s", daemon, c.name)
+		}
+		port := daemonConfig.getOrDefault(c.name, "jmx."+daemon+".port", defaultPort).(int)
+		c.jmxURLs[daemon] = fmt.Sprintf("%s://%s", jmxScheme, net.JoinHostPort(jmxAddress, strconv.Itoa(port)))
+	}
+	for daemon := range c.jmxRequired {
+		if _, ok := c.jmxURLs[daemon]; !ok {
+			return fmt.Errorf("daemon '%s' in jmx.required of checker %s is not in jmx.daemons", daemon, c.name)
+		}
+	}
+	c.jmxClient = &http.Client{Timeout: daemonConfig.getOrDefault(c.name, "jmx.timeout", time.Second*5).(time.Duration)}
+	c.heartbeatAge = daemonConfig.getOrDefault(c.name, "jmx.heartbeat.maxAge", time.Second*30).(time.Duration)
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
 	return c.check()
 }
 
 func (c *HadoopChecker) state() (State, string) {
-	return c.checkerState, ""
+	return c.checkerState, c.stateReason
 }
 
 func (c *HadoopChecker) start() {
-	c.ticker = time.NewTicker(c.checkInterval)
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
 	for {
 		select {
-		case <-c.ticker.C:
-			go c.check()
-		case <-c.stopCh:
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
 			return
 		}
 	}
@@ -55,26 +224,450 @@ func (c *HadoopChecker) stop() {
 	close(c.stopCh)
 }
 
+// 探测KDC可能要等到超时，只在最后更新结果时加锁
 func (c *HadoopChecker) check() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	startTime := time.Now()
 	basicInfo := make(map[string]interface{})
 	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	var conf *hadoopConf
 	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
 		c.basicInfo = basicInfo
 		c.errors = errors
+		c.conf = conf
 		c.checkTime = time.Now()
-		c.checkerState = Live
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
 	}()
-	krb5Content, err := getKrb5(c.krb5Path)
+
+	basicInfo["hostname"] = c.hostname
+	krb5, err := getKrb5(c.krb5Path)
 	if err != nil {
-		errors["krb5"] = err
+		errors["krb5"] = err.Error()
 	} else {
-		basicInfo["krb5"] = krb5Content
+		basicInfo["krb5"] = krb5.toMap()
+		if c.kdcCheck {
+			kdcs, kdcErrors, kdcVerdicts := c.checkKDCs(krb5)
+			basicInfo["kdcs"] = kdcs
+			if len(kdcErrors) > 0 {
+				errors["kdcs"] = kdcErrors
+			}
+			verdicts = append(verdicts, kdcVerdicts...)
+		}
+	}
+	keytabs, keytabErrors, keytabVerdicts := c.checkKeytabs(krb5)
+	basicInfo["keytabs"] = keytabs
+	for key, value := range keytabErrors {
+		errors[key] = value
+	}
+	verdicts = append(verdicts, keytabVerdicts...)
+
+	daemons := make(map[string]interface{})
+	for _, daemon := range c.jmxDaemons {
+		daemonInfo, daemonVerdicts := c.probeDaemon(daemon, errors)
+		daemons[daemon] = daemonInfo
+		verdicts = append(verdicts, daemonVerdicts...)
+	}
+	basicInfo["daemons"] = daemons
+
+	confDir := findHadoopConfDir(c.mountPoint, c.confDirs)
+	if confDir == "" {
+		// 不是hadoop节点时没有配置目录，不认为是错误
+		return nil
+	}
+	conf, confErrors := loadHadoopConf(c.mountPoint, confDir, c.siteFiles)
+	if len(confErrors) > 0 {
+		errors["conf"] = confErrors
+		verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("failed to parse hadoop site files in %s", confDir)})
+	}
+	basicInfo["conf"] = map[string]interface{}{"dir": confDir, "files": conf.files}
+	properties := make(map[string]interface{})
+	for _, name := range c.reported {
+		if value, ok := conf.get(name); ok {
+			properties[name] = value
+		}
 	}
+	basicInfo["properties"] = properties
+
+	if resolved, err := conf.resolveDefaultFS(); err != nil {
+		errors["fs.defaultFS"] = err.Error()
+		verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("fs.defaultFS does not resolve: %s", err)})
+	} else {
+		basicInfo["fs.defaultFS"] = resolved
+	}
+
+	dirs, dirVerdicts := c.checkHadoopDirs(conf, errors)
+	basicInfo["dirs"] = dirs
+	verdicts = append(verdicts, dirVerdicts...)
+	verdicts = append(verdicts, c.checkExpectedProperties(conf, errors)...)
 	return nil
 }
 
+// 检查目录是否存在、对服务用户可写，以及所在的挂载点，datanode的目录不能在宿主机的根文件系统上。
+// node_guard以root运行，access(2)总是认为可写，而宿主机的根以ro方式bind mount到容器中时又总是EROFS，
+// 所以按宿主机/etc/passwd中服务用户的uid和gid比较目录的属主和权限，只读以挂载点的superblock选项为准
+func (c *HadoopChecker) checkHadoopDirs(conf *hadoopConf, errors map[string]interface{}) (map[string]interface{}, []Verdict) {
+	dirs := make(map[string]interface{})
+	dirErrors := make(map[string]interface{})
+	onRootfs := []string{}
+	mounts, err := readMountInfo(path.Join(c.procPath, "self/mountinfo"))
+	if err != nil {
+		errors["mountinfo"] = err.Error()
+	}
+	users, err := readHostUsers(c.mountPoint)
+	if err != nil {
+		errors["users"] = err.Error()
+	}
+	for _, property := range c.dirProperties {
+		value, ok := conf.get(property)
+		if !ok {
+			continue
+		}
+		userName := hadoopDirUser(c.dirUsers, property)
+		for _, dir := range hadoopDirs(value) {
+			hostPath := path.Join(c.mountPoint, dir)
+			dirInfo := map[string]interface{}{"property": property}
+			dirs[dir] = dirInfo
+			var stat unix.Stat_t
+			if err := unix.Stat(hostPath, &stat); err != nil {
+				dirErrors[dir] = err.Error()
+				continue
+			} else if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+				dirErrors[dir] = "not a directory"
+				continue
+			}
+			dirInfo["uid"] = stat.Uid
+			dirInfo["gid"] = stat.Gid
+			dirInfo["mode"] = fmt.Sprintf("%04o", stat.Mode&07777)
+			if userName != "" && users != nil {
+				dirInfo["user"] = userName
+				if user, ok := users[userName]; !ok {
+					dirErrors[dir] = fmt.Sprintf("user %s does not exist on the host", userName)
+				} else if !user.canWrite(stat.Uid, stat.Gid, stat.Mode) {
+					dirErrors[dir] = fmt.Sprintf("not writable by %s (uid %d, gid %d, mode %04o)", userName, stat.Uid, stat.Gid, stat.Mode&07777)
+				}
+			}
+			mount, found := containingMount(mounts, hostPath)
+			if !found {
+				continue
+			}
+			mountPoint, ok := hostMountPoint(c.mountPoint, mount.mountPoint)
+			if !ok {
+				continue
+			}
+			dirInfo["mountPoint"] = mountPoint
+			dirInfo["source"] = mount.source
+			dirInfo["readOnly"] = mount.readOnly
+			if mount.readOnly {
+				dirErrors[dir] = fmt.Sprintf("mount point %s is read-only", mountPoint)
+			}
+			if property == hadoopDataDirProperty && mountPoint == "/" {
+				onRootfs = append(onRootfs, dir)
+			}
+		}
+	}
+	verdicts := []Verdict{}
+	if len(dirErrors) > 0 {
+		errors["dirs"] = dirErrors
+		verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("%d hadoop directories are missing or not writable", len(dirErrors))})
+	}
+	if len(onRootfs) > 0 {
+		sort.Strings(onRootfs)
+		errors["dirs.onRootfs"] = onRootfs
+		verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("datanode directories on the root filesystem: %s", strings.Join(onRootfs, ","))})
+	}
+	return dirs, verdicts
+}
+
+// 最长前缀匹配，没有匹配的属性不检查属主和权限
+func hadoopDirUser(dirUsers map[string]string, property string) string {
+	userName, matched := "", -1
+	for prefix, user := range dirUsers {
+		if strings.HasPrefix(property, prefix) && len(prefix) > matched {
+			userName, matched = user, len(prefix)
+		}
+	}
+	return userName
+}
+
+// 连接被拒绝时认为该daemon没有部署在本节点，只有jmx.required中的daemon才报错
+func (c *HadoopChecker) probeDaemon(daemon string, errors map[string]interface{}) (map[string]interface{}, []Verdict) {
+	baseURL := c.jmxURLs[daemon]
+	daemonInfo := map[string]interface{}{"url": baseURL, "running": false}
+	verdicts := []Verdict{}
+	beans, err := fetchJMX(c.jmxClient, baseURL)
+	if err != nil {
+		if !isConnectionRefused(err) {
+			errors["jmx."+daemon] = err.Error()
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("failed to probe %s: %s", daemon, err)})
+		} else if c.jmxRequired[daemon] {
+			errors["jmx."+daemon] = err.Error()
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("%s is not running", daemon)})
+		}
+		return daemonInfo, verdicts
+	}
+	daemonInfo["running"] = true
+	copyBeanAttributes(daemonInfo, findJvmMetrics(beans), map[string]string{
+		"GcTimeMillis": "gcTimeMillis",
+		"GcCount":      "gcCount",
+		"MemHeapUsedM": "heapUsedMB",
+		"MemHeapMaxM":  "heapMaxMB",
+	})
+	switch daemon {
+	case hadoopDataNode:
+		datasetState := findBean(beans, "Hadoop:service=DataNode,name=FSDatasetState")
+		copyBeanAttributes(daemonInfo, datasetState, map[string]string{
+			"NumFailedVolumes":       "failedVolumes",
+			"FailedStorageLocations": "failedStorageLocations",
+			"Capacity":               "capacity",
+			"Remaining":              "remaining",
+		})
+		if failedVolumes, _ := toFloat(daemonInfo["failedVolumes"]); failedVolumes > 0 {
+			errors["jmx.datanode.failedVolumes"] = daemonInfo["failedStorageLocations"]
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("%.0f volumes of datanode failed", failedVolumes)})
+		}
+		dataNodeInfo := findBean(beans, "Hadoop:service=DataNode,name=DataNodeInfo")
+		copyBeanAttributes(daemonInfo, dataNodeInfo, map[string]string{"Version": "version", "ClusterId": "clusterId"})
+		heartbeats, err := parseBPServiceActorInfo(dataNodeInfo)
+		if err != nil {
+			errors["jmx.datanode"] = err.Error()
+			break
+		}
+		daemonInfo["heartbeats"] = heartbeats
+		staleHeartbeats := make(map[string]interface{})
+		for namenode, heartbeat := range heartbeats {
+			age, ok := heartbeat.(map[string]interface{})["lastHeartbeatSeconds"].(float64)
+			if ok && age > c.heartbeatAge.Seconds() {
+				staleHeartbeats[namenode] = fmt.Sprintf("last heartbeat %.0fs ago", age)
+			}
+		}
+		if len(staleHeartbeats) > 0 {
+			errors["jmx.datanode.heartbeat"] = staleHeartbeats
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("heartbeats of datanode to %d namenodes are stale", len(staleHeartbeats))})
+		}
+	case hadoopNodeManager:
+		copyBeanAttributes(daemonInfo, findBean(beans, "Hadoop:service=NodeManager,name=NodeManagerMetrics"), map[string]string{
+			"ContainersRunning": "containersRunning",
+			"ContainersFailed":  "containersFailed",
+			"BadLocalDirs":      "badLocalDirs",
+			"BadLogDirs":        "badLogDirs",
+		})
+		// 健康检查的结果不在JMX中，从REST API获取
+		nodeInfo := struct {
+			NodeInfo struct {
+				NodeHealthy        bool   `json:"nodeHealthy"`
+				HealthReport       string `json:"healthReport"`
+				LastNodeUpdateTime int64  `json:"lastNodeUpdateTime"`
+				Version            string `json:"nodeManagerVersion"`
+			} `json:"nodeInfo"`
+		}{}
+		if err := getJSON(c.jmxClient, baseURL+"/ws/v1/node/info", &nodeInfo); err != nil {
+			errors["jmx.nodemanager.nodeInfo"] = err.Error()
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("failed to get the health of nodemanager: %s", err)})
+			break
+		}
+		daemonInfo["version"] = nodeInfo.NodeInfo.Version
+		daemonInfo["healthy"] = nodeInfo.NodeInfo.NodeHealthy
+		daemonInfo["healthReport"] = nodeInfo.NodeInfo.HealthReport
+		daemonInfo["lastHealthUpdate"] = time.Unix(0, nodeInfo.NodeInfo.LastNodeUpdateTime*int64(time.Millisecond))
+		if !nodeInfo.NodeInfo.NodeHealthy {
+			errors["jmx.nodemanager.health"] = nodeInfo.NodeInfo.HealthReport
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("nodemanager is unhealthy: %s", nodeInfo.NodeInfo.HealthReport)})
+		}
+	case hadoopRegionServer:
+		copyBeanAttributes(daemonInfo, findBean(beans, "Hadoop:service=HBase,name=RegionServer,sub=Server"), map[string]string{
+			"tag.serverName":    "serverName",
+			"regionCount":       "regionCount",
+			"totalRequestCount": "totalRequestCount",
+		})
+	}
+	return daemonInfo, verdicts
+}
+
+// 与yaml中配置的集群统一的值比较，没有配置的属性也认为不一致
+func (c *HadoopChecker) checkExpectedProperties(conf *hadoopConf, errors map[string]interface{}) []Verdict {
+	mismatches := make(map[string]interface{})
+	verdicts := []Verdict{}
+	for _, expected := range c.expected {
+		value, ok := conf.get(expected.name)
+		if ok && value == expected.value {
+			continue
+		}
+		mismatch := map[string]interface{}{"expected": expected.value}
+		if ok {
+			mismatch["actual"] = value
+		}
+		mismatches[expected.name] = mismatch
+		if expected.state != Live {
+			verdicts = append(verdicts, Verdict{expected.state, fmt.Sprintf("hadoop property %s is '%s', expected '%s'", expected.name, value, expected.value)})
+		}
+	}
+	if len(mismatches) > 0 {
+		errors["properties.mismatch"] = mismatches
+	}
+	return verdicts
+}
+
+// 每个realm的每个KDC都分别探测TCP和UDP，只有两者都不可达时才认为KDC不可达
+func (c *HadoopChecker) checkKDCs(krb5 *krb5Config) (map[string]interface{}, map[string]interface{}, []Verdict) {
+	kdcs := make(map[string]interface{})
+	kdcErrors := make(map[string]interface{})
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for realmName, realm := range krb5.realms {
+		realmKDCs := make(map[string]interface{})
+		kdcs[realmName] = realmKDCs
+		for _, kdc := range realm.kdcs {
+			for _, network := range []string{"tcp", "udp"} {
+				wg.Add(1)
+				go func(realmName string, realmKDCs map[string]interface{}, kdc string, network string) {
+					defer wg.Done()
+					err := probeKDC(network, kdcAddress(kdc), realmName, c.kdcTimeout)
+					mutex.Lock()
+					defer mutex.Unlock()
+					result, ok := realmKDCs[kdc].(map[string]interface{})
+					if !ok {
+						result = make(map[string]interface{})
+						realmKDCs[kdc] = result
+					}
+					result[network] = err == nil
+					if err != nil {
+						kdcErrors[fmt.Sprintf("%s/%s/%s", realmName, kdc, network)] = err.Error()
+					}
+				}(realmName, realmKDCs, kdc, network)
+			}
+		}
+	}
+	wg.Wait()
+	verdicts := []Verdict{}
+	unreachable := []string{}
+	for realmName, realmKDCs := range kdcs {
+		for kdc, result := range realmKDCs.(map[string]interface{}) {
+			if result := result.(map[string]interface{}); result["tcp"] != true && result["udp"] != true {
+				unreachable = append(unreachable, fmt.Sprintf("%s of %s", kdc, realmName))
+			}
+		}
+	}
+	if len(unreachable) > 0 && c.kdcState != Live {
+		sort.Strings(unreachable)
+		verdicts = append(verdicts, Verdict{c.kdcState, fmt.Sprintf("KDC %s is unreachable", strings.Join(unreachable, ", "))})
+	}
+	return kdcs, kdcErrors, verdicts
+}
+
+// 列出每个keytab中的principal，并检查弱加密类型以及主机名、realm是否与本节点一致
+func (c *HadoopChecker) checkKeytabs(krb5 *krb5Config) (map[string]interface{}, map[string]interface{}, []Verdict) {
+	keytabs := make(map[string]interface{})
+	fileErrors := make(map[string]interface{})
+	weakEnctypes := make(map[string]interface{})
+	wrongHosts := make(map[string]interface{})
+	wrongRealms := make(map[string]interface{})
+	missingHost := []string{}
+	expectedRealm := ""
+	if krb5 != nil {
+		expectedRealm = krb5.hostRealm(c.hostname)
+	}
+	for _, pattern := range c.keytabPaths {
+		matches, err := filepath.Glob(path.Join(c.mountPoint, pattern))
+		if err != nil {
+			fileErrors[pattern] = err.Error()
+			continue
+		}
+		for _, match := range matches {
+			key := match
+			if c.mountPoint != "/" {
+				key = strings.TrimPrefix(match, c.mountPoint)
+			}
+			entries, err := readKeytab(match)
+			if err != nil {
+				fileErrors[key] = err.Error()
+				continue
+			}
+			principals := []interface{}{}
+			weak, wrongHost, wrongRealm := map[string]bool{}, map[string]bool{}, map[string]bool{}
+			// 只有service/host形式的principal需要与本节点匹配，headless的principal(例如hdfs-cluster@REALM)不检查
+			hasServicePrincipal, hasHostPrincipal := false, false
+			for _, entry := range entries {
+				enctype := enctypeName(entry.enctype)
+				principals = append(principals, map[string]interface{}{
+					"principal": entry.principal,
+					"kvno":      entry.kvno,
+					"enctype":   enctype,
+					"timestamp": entry.timestamp,
+				})
+				if c.weakEnctypes[enctype] {
+					weak[fmt.Sprintf("%s (%s)", entry.principal, enctype)] = true
+				}
+				if len(entry.components) != 2 {
+					continue
+				}
+				hasServicePrincipal = true
+				if strings.ToLower(entry.components[1]) != c.hostname {
+					wrongHost[entry.principal] = true
+					continue
+				}
+				hasHostPrincipal = true
+				if expectedRealm != "" && entry.realm != expectedRealm {
+					wrongRealm[entry.principal] = true
+				}
+			}
+			keytabs[key] = principals
+			if len(weak) > 0 {
+				weakEnctypes[key] = sortedKeys(weak)
+			}
+			if len(wrongHost) > 0 {
+				wrongHosts[key] = sortedKeys(wrongHost)
+			}
+			if len(wrongRealm) > 0 {
+				wrongRealms[key] = sortedKeys(wrongRealm)
+			}
+			if hasServicePrincipal && !hasHostPrincipal {
+				missingHost = append(missingHost, key)
+			}
+		}
+	}
+	keytabErrors := make(map[string]interface{})
+	for name, value := range map[string]map[string]interface{}{
+		"keytabs":             fileErrors,
+		"keytabs.weakEnctype": weakEnctypes,
+		"keytabs.wrongHost":   wrongHosts,
+		"keytabs.wrongRealm":  wrongRealms,
+	} {
+		if len(value) > 0 {
+			keytabErrors[name] = value
+		}
+	}
+	if len(missingHost) > 0 {
+		sort.Strings(missingHost)
+		keytabErrors["keytabs.missingHost"] = missingHost
+	}
+
+	verdicts := []Verdict{}
+	if len(weakEnctypes) > 0 && c.weakState != Live {
+		verdicts = append(verdicts, Verdict{c.weakState, fmt.Sprintf("keytab %s contains weak enctypes", strings.Join(sortedMapKeys(weakEnctypes), ", "))})
+	}
+	if c.mismatchState != Live {
+		if len(wrongHosts) > 0 {
+			verdicts = append(verdicts, Verdict{c.mismatchState, fmt.Sprintf("keytab %s contains principals of other hosts than %s", strings.Join(sortedMapKeys(wrongHosts), ", "), c.hostname)})
+		}
+		if len(wrongRealms) > 0 {
+			verdicts = append(verdicts, Verdict{c.mismatchState, fmt.Sprintf("keytab %s contains principals of other realms than %s", strings.Join(sortedMapKeys(wrongRealms), ", "), expectedRealm)})
+		}
+		if len(missingHost) > 0 {
+			verdicts = append(verdicts, Verdict{c.mismatchState, fmt.Sprintf("keytab %s has no principal of %s", strings.Join(missingHost, ", "), c.hostname)})
+		}
+	}
+	return keytabs, keytabErrors, verdicts
+}
+
 func (c *HadoopChecker) info() Info {
 	defer c.mutex.RUnlock()
 	c.mutex.RLock()
@@ -82,7 +675,9 @@ func (c *HadoopChecker) info() Info {
 	return Info{
 		name:      c.name,
 		checkTime: c.checkTime,
+		duration:  c.checkDuration,
 		state:     c.checkerState,
+		reason:    c.stateReason,
 		basic:     c.basicInfo,
 		errors:    c.errors,
 	}
@@ -90,17 +685,203 @@ func (c *HadoopChecker) info() Info {
 
 func (c *HadoopChecker) newRouters() Routers {
 	routers := make(Routers)
+	routers["detail"] = func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		details := make(map[string]interface{})
+		if c.conf != nil {
+			details["dir"] = c.conf.dir
+			details["properties"] = c.conf.toMap()
+		}
+
+		formatWrite(details, w, r)
+	}
 	return routers
 }
 
+func (c *HadoopChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	daemons, _ := c.basicInfo["daemons"].(map[string]interface{})
+	for daemon, info := range daemons {
+		daemonInfo := info.(map[string]interface{})
+		running, _ := daemonInfo["running"].(bool)
+		metrics = append(metrics, newMetric("hadoop_daemon_up", "Whether the http server of the hadoop daemon responds.", boolToFloat(running), "daemon", daemon))
+		if gcTime, ok := toFloat(daemonInfo["gcTimeMillis"]); ok {
+			metrics = append(metrics, newCounter("hadoop_jvm_gc_time_milliseconds", "Total GC time of the hadoop daemon.", gcTime, "daemon", daemon))
+		}
+		if gcCount, ok := toFloat(daemonInfo["gcCount"]); ok {
+			metrics = append(metrics, newCounter("hadoop_jvm_gc_count", "Total GC count of the hadoop daemon.", gcCount, "daemon", daemon))
+		}
+		if failedVolumes, ok := toFloat(daemonInfo["failedVolumes"]); ok {
+			metrics = append(metrics, newMetric("hadoop_datanode_failed_volumes", "Number of failed volumes of the datanode.", failedVolumes))
+		}
+		heartbeats, _ := daemonInfo["heartbeats"].(map[string]interface{})
+		for namenode, heartbeat := range heartbeats {
+			if age, ok := heartbeat.(map[string]interface{})["lastHeartbeatSeconds"].(float64); ok {
+				metrics = append(metrics, newMetric("hadoop_datanode_heartbeat_age_seconds", "Seconds since the last heartbeat from the datanode to the namenode.", age, "namenode", namenode))
+			}
+		}
+		if healthy, ok := daemonInfo["healthy"].(bool); ok {
+			metrics = append(metrics, newMetric("hadoop_nodemanager_healthy", "Whether the nodemanager reports itself healthy.", boolToFloat(healthy)))
+		}
+		if regionCount, ok := toFloat(daemonInfo["regionCount"]); ok {
+			metrics = append(metrics, newMetric("hadoop_regionserver_regions", "Number of regions on the regionserver.", regionCount))
+		}
+	}
+	return metrics
+}
+
 func NewHadoopChecker() *HadoopChecker {
 	return &HadoopChecker{}
 }
 
-func getKrb5(krb5Path string) (string, error) {
-	data, err := ioutil.ReadFile(krb5Path)
+func getKrb5(krb5Path string) (*krb5Config, error) {
+	file, err := os.Open(krb5Path)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(data), nil
+	defer file.Close()
+	return parseKrb5Conf(file)
+}
+
+func parseHadoopExpectedProperties(items []interface{}) ([]hadoopExpectedProperty, error) {
+	properties := []hadoopExpectedProperty{}
+	for i, item := range items {
+		itemMap, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("property %d should be a map", i)
+		}
+		property := hadoopExpectedProperty{state: Error}
+		property.name, _ = itemMap["name"].(string)
+		if property.name == "" {
+			return nil, fmt.Errorf("name of property %d is required", i)
+		}
+		value, ok := itemMap["value"]
+		if !ok {
+			return nil, fmt.Errorf("value of property %s is required", property.name)
+		}
+		// yaml中的数字和布尔值按字符串比较
+		property.value = fmt.Sprint(value)
+		if state, ok := itemMap["state"].(string); ok {
+			property.state = State(state)
+		}
+		if err := checkAllowed(string(property.state), stateValues); err != nil {
+			return nil, fmt.Errorf("state of property %s %s", property.name, err)
+		}
+		properties = append(properties, property)
+	}
+	return properties, nil
+}
+
+// 最长前缀匹配，找到路径所在的挂载点
+func containingMount(mounts []mountInfo, file string) (mountInfo, bool) {
+	var result mountInfo
+	found := false
+	for _, mount := range mounts {
+		if mount.mountPoint != "/" && file != mount.mountPoint && !strings.HasPrefix(file, mount.mountPoint+"/") {
+			continue
+		}
+		if !found || len(mount.mountPoint) >= len(result.mountPoint) {
+			result, found = mount, true
+		}
+	}
+	return result, found
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type hostUser struct {
+	uid  uint32
+	gids map[uint32]bool
+}
+
+// 按owner、group、other的顺序只看第一个匹配的权限位，与内核一致，root总是可写
+func (user hostUser) canWrite(uid uint32, gid uint32, mode uint32) bool {
+	switch {
+	case user.uid == 0:
+		return true
+	case user.uid == uid:
+		return mode&unix.S_IWUSR != 0
+	case user.gids[gid]:
+		return mode&unix.S_IWGRP != 0
+	}
+	return mode&unix.S_IWOTH != 0
+}
+
+// 从宿主机的/etc/passwd和/etc/group读取用户的uid以及主组和附加组，不支持ldap等nss来源
+func readHostUsers(mountPoint string) (map[string]hostUser, error) {
+	users := make(map[string]hostUser)
+	err := readColonFile(path.Join(mountPoint, "/etc/passwd"), func(fields []string) error {
+		if len(fields) < 4 {
+			return fmt.Errorf("too few fields")
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return err
+		}
+		users[fields[0]] = hostUser{uid: uint32(uid), gids: map[uint32]bool{uint32(gid): true}}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readColonFile(path.Join(mountPoint, "/etc/group"), func(fields []string) error {
+		if len(fields) < 4 {
+			return fmt.Errorf("too few fields")
+		}
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if user, ok := users[member]; ok {
+				user.gids[uint32(gid)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// passwd和group格式的文件，跳过空行、注释以及nis的+/-条目
+func readColonFile(file string, parse func(fields []string) error) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if err := parse(strings.Split(line, ":")); err != nil {
+			return fmt.Errorf("line %d of %s: %s", i+1, file, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReadHostUsers(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	os.MkdirAll(path.Join(mountPoint, "etc"), 0755)
+	ioutil.WriteFile(path.Join(mountPoint, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/bash\n# comment\nhdfs:x:1001:1001::/home/hdfs:/bin/bash\nyarn:x:1002:1002::/home/yarn:/bin/bash\n+@nis::::::\n"), 0644)
+	ioutil.WriteFile(path.Join(mountPoint, "etc/group"), []byte("root:x:0:\nhadoop:x:1000:hdfs,yarn\nhdfs:x:1001:\nyarn:x:1002:\n"), 0644)
+
+	users, err := readHostUsers(mountPoint)
+	if err != nil {
+		t.Fatalf("readHostUsers: %s", err)
+	}
+	hdfs, ok := users["hdfs"]
+	if !ok || hdfs.uid != 1001 || !hdfs.gids[1001] || !hdfs.gids[1000] || hdfs.gids[1002] {
+		t.Fatalf("unexpected hdfs user %+v", hdfs)
+	}
+	for _, c := range []struct {
+		user     string
+		uid, gid uint32
+		mode     uint32
+		writable bool
+	}{
+		{"hdfs", 1001, 1001, 0755, true},
+		{"hdfs", 1001, 1001, 0555, false},
+		// 属主匹配时不再看组的权限
+		{"hdfs", 1001, 1000, 0575, false},
+		{"hdfs", 0, 1000, 0775, true},
+		{"hdfs", 0, 1000, 0755, false},
+		{"yarn", 1001, 1001, 0755, false},
+		{"yarn", 1001, 1001, 0757, true},
+		{"root", 1001, 1001, 0500, true},
+	} {
+		if writable := users[c.user].canWrite(c.uid, c.gid, c.mode); writable != c.writable {
+			t.Errorf("%s on %d:%d %04o: expected writable %v", c.user, c.uid, c.gid, c.mode, c.writable)
+		}
+	}
+
+	ioutil.WriteFile(path.Join(mountPoint, "etc/passwd"), []byte("hdfs:x:abc:1001::/home/hdfs:/bin/bash\n"), 0644)
+	if _, err := readHostUsers(mountPoint); err == nil {
+		t.Errorf("expected an error for an invalid uid")
+	}
+}
+
+func TestHadoopDirUser(t *testing.T) {
+	dirUsers := map[string]string{"dfs.": "hdfs", "yarn.": "yarn", "dfs.journalnode.": "journal"}
+	for property, expected := range map[string]string{
+		"dfs.datanode.data.dir":       "hdfs",
+		"dfs.journalnode.edits.dir":   "journal",
+		"yarn.nodemanager.local-dirs": "yarn",
+		"hbase.tmp.dir":               "",
+	} {
+		if user := hadoopDirUser(dirUsers, property); user != expected {
+			t.Errorf("user of %s: expected '%s', got '%s'", property, expected, user)
+		}
+	}
+}
+
+func TestHadoopMetrics(t *testing.T) {
+	c := &HadoopChecker{basicInfo: map[string]interface{}{"daemons": map[string]interface{}{
+		"datanode": map[string]interface{}{"running": true, "gcTimeMillis": int64(1500), "gcCount": int64(12), "failedVolumes": 1},
+	}}}
+	output := string(writeMetrics(c.metrics()))
+	// GC的时间和次数是JVM启动以来的累计值
+	for _, line := range []string{
+		"# TYPE node_guard_hadoop_jvm_gc_time_milliseconds_total counter",
+		`node_guard_hadoop_jvm_gc_time_milliseconds_total{daemon="datanode"} 1500`,
+		"# TYPE node_guard_hadoop_jvm_gc_count_total counter",
+		`node_guard_hadoop_jvm_gc_count_total{daemon="datanode"} 12`,
+		"# TYPE node_guard_hadoop_datanode_failed_volumes gauge",
+		`node_guard_hadoop_daemon_up{daemon="datanode"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+}
@@ -6,63 +6,160 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 func init() {
 	registerChecker("kubernetes", NewKubernetesChecker())
+	registerConfigSchema("kubernetes",
+		ConfigItem{"checkInterval", time.Second * 120, "interval between checks"},
+		ConfigItem{"pingTimeout", time.Second * 5, "time to wait for echo replies from pods and nodes after the last echo request"},
+		ConfigItem{"ping.count", 3, "number of echo requests sent to each pod and node"},
+		ConfigItem{"ping.interval", time.Millisecond * 200, "interval between echo requests"},
+		ConfigItem{"ping.socket", oneOf("auto", pingSocketAuto, pingSocketRaw, pingSocketUnprivileged), "ICMP socket, raw, unprivileged, or auto to fall back to unprivileged when raw sockets are not permitted"},
+		ConfigItem{"cacheSyncTimeout", time.Second * 30, "max time to wait for the informer caches to sync on initialization"},
+		ConfigItem{"kubelet.conf.path", "{mount_point}/etc/kubernetes/kubelet.conf", "path of kubelet.conf"},
+		ConfigItem{"kubelet.address", "127.0.0.1", "address of the local kubelet, the port is read from daemonEndpoints of the node"},
+		ConfigItem{"kubelet.healthz.paths", []string{"/healthz", "/healthz/syncloop"}, "health check paths of the kubelet"},
+		ConfigItem{"kubelet.timeout", time.Second * 5, "timeout of requests to the kubelet"},
+		ConfigItem{"kubelet.insecureSkipVerify", true, "whether to skip verifying the serving certificate of the kubelet, which is usually self-signed"},
+		ConfigItem{"heartbeat.maxAge", time.Minute * 6, "max age of the heartbeat of the Ready condition before the checker turns Error"},
+		ConfigItem{"notReady.state", oneOf("Fatal", stateValues...), "state when the local node is not ready, Error, Fatal, or Live to ignore"},
+		ConfigItem{"network.pods.perNode", 2, "number of pods sampled on each peer node for the pod network test, 0 to ping only the gateways"},
+		ConfigItem{"network.pods.resampleInterval", time.Minute * 30, "interval between listing the pods of a peer node to sample, pods which are not reachable are resampled in the next check"},
+		ConfigItem{"network.pods.newPeersPerCheck", 20, "max number of peer nodes which have not been sampled yet whose pods are listed in one check, the others ping only the gateway until their turn"},
+		ConfigItem{"network.brokenRatio", 0.5, "the pod network of the local node is considered broken when at least this ratio of peers is unreachable"},
+		ConfigItem{"network.local.state", oneOf("Fatal", stateValues...), "state when the pod network of the local node is broken, Error, Fatal, or Live to ignore"},
+		ConfigItem{"network.peer.state", oneOf("Error", stateValues...), "state when the pod network of some peers is unreachable, Error, Fatal, or Live to ignore"},
+		ConfigItem{"runtime", oneOf("auto", "auto", runtimeDocker, runtimeCRI), "container runtime, auto, docker or cri"},
+		ConfigItem{"runtime.timeout", time.Second * 10, "timeout of requests to the container runtime"},
+		ConfigItem{"cri.endpoint", "", "CRI socket, e.g. unix://{mount_point}/run/containerd/containerd.sock, detected when empty"},
+		ConfigItem{"docker.host", "unix://{mount_point}/var/run/docker.sock", "address of the docker daemon"},
+		ConfigItem{"docker.api.version", "1.22", "docker api version"},
+		rulesConfigItem,
+	)
 }
 
 type KubernetesChecker struct {
 	name             string
-	ticker           *time.Ticker
 	mutex            sync.RWMutex
 	stopCh           chan struct{}
 	checkerState     State
+	stateReason      string
+	rules            []*Rule
 	checkTime        time.Time
+	checkDuration    time.Duration
 	checkInterval    time.Duration
-	pingTimeout      time.Duration
+	pingOptions      pingOptions
 	basicInfo        map[string]interface{}
 	errors           map[string]interface{}
 	procPath         string
 	kubeletConfPath  string
 	clientConfig     *rest.Config
-	clientset        *kubernetes.Clientset
+	clientset        kubernetes.Interface
+	nodeName         string
+	cacheSyncTimeout time.Duration
+	podInformer      cache.SharedIndexInformer
+	nodeInformer     cache.SharedIndexInformer
+	watchErrorsMutex sync.Mutex
+	watchErrors      map[string]string
 	clientConfigAuth map[string]interface{}
+	kubeletAddress   string
+	healthzPaths     []string
+	kubeletClient    *http.Client
+	heartbeatMaxAge  time.Duration
+	notReadyState    State
 	localNode        *v1.Node
+	network          map[string]interface{}
+	meshPodsPerNode  int
+	meshResample     time.Duration
+	meshNewPeers     int
+	peerSamples      map[string]*peerPodSample
+	meshBrokenRatio  float64
+	meshLocalState   State
+	meshPeerState    State
+	mountPoint       string
+	runtimeType      string
+	runtimeTimeout   time.Duration
+	criEndpoint      string
 	dockerHost       string
 	dockerAPIVersion string
-	dockerClient     *client.Client
+	runtime          ContainerRuntime
+	runtimeError     string
 }
 
 func (c *KubernetesChecker) initialize(daemonConfig *DaemonConfig) error {
 	var err error
 	c.name = "kubernetes"
 	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
 	c.procPath = daemonConfig.proc_path
 	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*120).(time.Duration)
-	c.pingTimeout = daemonConfig.getOrDefault(c.name, "pingTimeout", time.Second*5).(time.Duration)
+	c.pingOptions = pingOptions{
+		count:    daemonConfig.getOrDefault(c.name, "ping.count", 3).(int),
+		interval: daemonConfig.getOrDefault(c.name, "ping.interval", time.Millisecond*200).(time.Duration),
+		timeout:  daemonConfig.getOrDefault(c.name, "pingTimeout", time.Second*5).(time.Duration),
+		socket:   daemonConfig.getOrDefault(c.name, "ping.socket", pingSocketAuto).(string),
+	}
+	if c.pingOptions.count < 1 {
+		return fmt.Errorf("ping.count of checker %s should be positive, got %d", c.name, c.pingOptions.count)
+	}
+	c.meshPodsPerNode = daemonConfig.getOrDefault(c.name, "network.pods.perNode", 2).(int)
+	if c.meshPodsPerNode < 0 {
+		return fmt.Errorf("network.pods.perNode of checker %s should not be negative, got %d", c.name, c.meshPodsPerNode)
+	}
+	c.meshResample = daemonConfig.getOrDefault(c.name, "network.pods.resampleInterval", time.Minute*30).(time.Duration)
+	if c.meshResample <= 0 {
+		return fmt.Errorf("network.pods.resampleInterval of checker %s should be positive, got %s", c.name, c.meshResample)
+	}
+	c.meshNewPeers = daemonConfig.getOrDefault(c.name, "network.pods.newPeersPerCheck", 20).(int)
+	if c.meshNewPeers < 1 {
+		return fmt.Errorf("network.pods.newPeersPerCheck of checker %s should be positive, got %d", c.name, c.meshNewPeers)
+	}
+	c.peerSamples = make(map[string]*peerPodSample)
+	c.meshBrokenRatio = daemonConfig.getOrDefault(c.name, "network.brokenRatio", 0.5).(float64)
+	if c.meshBrokenRatio <= 0 || c.meshBrokenRatio > 1 {
+		return fmt.Errorf("network.brokenRatio of checker %s should be in (0, 1], got %v", c.name, c.meshBrokenRatio)
+	}
+	c.meshLocalState = State(daemonConfig.getOrDefault(c.name, "network.local.state", "Fatal").(string))
+	c.meshPeerState = State(daemonConfig.getOrDefault(c.name, "network.peer.state", "Error").(string))
+	c.cacheSyncTimeout = daemonConfig.getOrDefault(c.name, "cacheSyncTimeout", time.Second*30).(time.Duration)
+	if c.nodeName, err = os.Hostname(); err != nil {
+		return err
+	}
 	c.kubeletConfPath = daemonConfig.getOrDefault(c.name, "kubelet.conf.path", path.Join(daemonConfig.mount_point, "/etc/kubernetes/kubelet.conf")).(string)
 	c.dockerHost = daemonConfig.getOrDefault(c.name, "docker.host", "unix://"+path.Join(daemonConfig.mount_point, "/var/run/docker.sock")).(string)
-	c.dockerAPIVersion = daemonConfig.getOrDefault(c.name, "dcoker.api.version", "1.22").(string)
-	c.dockerClient, err = client.NewClient(c.dockerHost, c.dockerAPIVersion, nil, nil)
-	if err != nil {
-		return err
+	// 兼容旧的拼写dcoker.api.version
+	c.dockerAPIVersion = daemonConfig.getOrDeprecated(c.name, "docker.api.version", "1.22").(string)
+	c.mountPoint = daemonConfig.mount_point
+	c.runtimeType = daemonConfig.getOrDefault(c.name, "runtime", "auto").(string)
+	c.runtimeTimeout = daemonConfig.getOrDefault(c.name, "runtime.timeout", time.Second*10).(time.Duration)
+	c.criEndpoint = daemonConfig.getOrDefault(c.name, "cri.endpoint", "").(string)
+	if c.runtime != nil {
+		c.runtime.close()
+		c.runtime = nil
 	}
 	c.clientConfig, err = clientcmd.BuildConfigFromFlags("", c.kubeletConfPath)
 	if err != nil {
@@ -72,6 +169,25 @@ func (c *KubernetesChecker) initialize(daemonConfig *DaemonConfig) error {
 	if err != nil {
 		return err
 	}
+	c.kubeletAddress = daemonConfig.getOrDefault(c.name, "kubelet.address", "127.0.0.1").(string)
+	c.healthzPaths = daemonConfig.getOrDefault(c.name, "kubelet.healthz.paths", []string{"/healthz", "/healthz/syncloop"}).([]string)
+	c.heartbeatMaxAge = daemonConfig.getOrDefault(c.name, "heartbeat.maxAge", time.Minute*6).(time.Duration)
+	c.notReadyState = State(daemonConfig.getOrDefault(c.name, "notReady.state", "Fatal").(string))
+	// 使用kubelet.conf中的客户端证书访问kubelet，kubelet的服务端证书通常是自签名的
+	kubeletConfig := rest.CopyConfig(c.clientConfig)
+	if daemonConfig.getOrDefault(c.name, "kubelet.insecureSkipVerify", true).(bool) {
+		kubeletConfig.Insecure = true
+		kubeletConfig.CAFile = ""
+		kubeletConfig.CAData = nil
+	}
+	kubeletTransport, err := rest.TransportFor(kubeletConfig)
+	if err != nil {
+		return err
+	}
+	c.kubeletClient = &http.Client{
+		Transport: kubeletTransport,
+		Timeout:   daemonConfig.getOrDefault(c.name, "kubelet.timeout", time.Second*5).(time.Duration),
+	}
 	c.clientConfigAuth = make(map[string]interface{})
 	c.clientConfigAuth["host"] = c.clientConfig.Host
 	if c.clientConfig.CertData != nil {
@@ -93,20 +209,31 @@ func (c *KubernetesChecker) initialize(daemonConfig *DaemonConfig) error {
 		// }
 	}
 
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	c.startInformers()
+	// auto时依赖informer缓存中本节点的containerRuntimeVersion
+	c.runtime, err = c.newContainerRuntime()
+	c.runtimeError = ""
+	if err != nil {
+		c.runtime, c.runtimeError = nil, err.Error()
+	}
 	return c.check()
 }
 
 func (c *KubernetesChecker) state() (State, string) {
-	return c.checkerState, ""
+	return c.checkerState, c.stateReason
 }
 
 func (c *KubernetesChecker) start() {
-	c.ticker = time.NewTicker(c.checkInterval)
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
 	for {
 		select {
-		case <-c.ticker.C:
-			go c.check()
-		case <-c.stopCh:
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
 			return
 		}
 	}
@@ -117,17 +244,22 @@ func (c *KubernetesChecker) stop() {
 }
 
 func (c *KubernetesChecker) check() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	startTime := time.Now()
 	basicInfo := make(map[string]interface{})
 	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
 	localNode := &v1.Node{}
+	network := make(map[string]interface{})
 	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
 		c.basicInfo = basicInfo
 		c.errors = errors
 		c.localNode = localNode
+		c.network = network
 		c.checkTime = time.Now()
-		c.checkerState = Live
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
 	}()
 
 	defer func() {
@@ -136,14 +268,45 @@ func (c *KubernetesChecker) check() error {
 		}
 	}()
 	// get basic info
-	var err error
-	basicInfo["docker"], err = getDockerInfo(c.dockerClient)
-	if err != nil {
-		errors["docker"] = err.Error()
+	runtime := c.ensureRuntime()
+	if runtime == nil {
+		c.mutex.RLock()
+		errors["runtime"] = c.runtimeError
+		c.mutex.RUnlock()
+	} else {
+		runtimeInfo := runtime.summary(errors)
+		basicInfo["runtime"] = runtimeInfo
+		conditions, _ := runtimeInfo["conditions"].(map[string]interface{})
+		for condition, status := range conditions {
+			if status == false {
+				verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("container runtime condition %s is false", condition)})
+			}
+		}
 	}
-	basicInfo["kubernetes"], localNode, err = getKubernetesInfo(c.clientset, c.pingTimeout)
-	if err != nil {
-		errors["kubernetes"] = err.Error()
+	// 兼容原来basic中的docker
+	if docker, ok := runtime.(*DockerRuntime); ok {
+		var err error
+		basicInfo["docker"], err = getDockerInfo(docker.client)
+		if err != nil {
+			errors["docker"] = err.Error()
+		}
+	}
+	kubernetesInfo, localNode := c.getKubernetesInfo(errors)
+	basicInfo["kubernetes"] = kubernetesInfo
+	var networkVerdicts []Verdict
+	network, networkVerdicts = c.testPodNetwork(kubernetesInfo["nodes"].(map[string]interface{}), errors)
+	verdicts = append(verdicts, networkVerdicts...)
+	basicInfo["network"] = map[string]interface{}{
+		"verdict":     network["verdict"],
+		"peers":       network["peers"],
+		"unreachable": network["unreachable"],
+		"degraded":    network["degraded"],
+		"local":       network["local"].(map[string]interface{})["state"],
+	}
+	if localNode.Name != "" {
+		var kubeletVerdicts []Verdict
+		basicInfo["kubelet"], kubeletVerdicts = c.getKubeletInfo(localNode, errors)
+		verdicts = append(verdicts, kubeletVerdicts...)
 	}
 	basicInfo["clientConfigAuth"] = c.clientConfigAuth
 
@@ -153,40 +316,156 @@ func (c *KubernetesChecker) check() error {
 func (c *KubernetesChecker) newRouters() Routers {
 	routers := make(Routers)
 	routers["detail"] = func(w http.ResponseWriter, r *http.Request) {
+		// 请求容器运行时可能很慢，不持有锁
 		c.mutex.RLock()
-		defer c.mutex.RUnlock()
 		details := map[string]interface{}{
 			"localNode": c.localNode,
 		}
+		runtime, runtimeError := c.runtime, c.runtimeError
+		c.mutex.RUnlock()
 		errors := make(map[string]interface{})
-		containers, err := c.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
-		if err != nil {
-			errors["docker.containers"] = err
+		if runtime == nil {
+			errors["runtime"] = runtimeError
 		} else {
-			details["docker.containers"] = containers
-		}
-		images, err := c.dockerClient.ImageList(context.Background(), types.ImageListOptions{})
-		if err != nil {
-			errors["docker.images"] = err
-		} else {
-			details["docker.images"] = images
+			details["runtime"] = runtime.summary(errors)
+			for key, value := range runtime.detail(errors) {
+				details[key] = value
+			}
 		}
-		info, err := c.dockerClient.Info(context.Background())
-		if err != nil {
-			errors["docker.info"] = err
-		} else {
-			details["docker.info"] = info
+		if len(errors) > 0 {
+			details["errors"] = errors
 		}
 
 		formatWrite(details, w, r)
 	}
+	routers["network"] = func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		formatWrite(c.network, w, r)
+	}
 	return routers
 }
 
+func (c *KubernetesChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	if runtimeInfo, ok := c.basicInfo["runtime"].(map[string]interface{}); ok {
+		metrics = append(metrics, runtimeMetrics(runtimeInfo)...)
+	}
+	if kubeletInfo, ok := c.basicInfo["kubelet"].(map[string]interface{}); ok {
+		healthz, _ := kubeletInfo["healthz"].(map[string]interface{})
+		for _, healthzPath := range c.healthzPaths {
+			_, healthy := healthz[healthzPath]
+			metrics = append(metrics, newMetric("kubernetes_kubelet_healthz", "Whether the health check of the kubelet passed.", boolToFloat(healthy), "path", healthzPath))
+		}
+		conditions, _ := kubeletInfo["conditions"].(map[string]interface{})
+		for conditionType, condition := range conditions {
+			status := condition.(map[string]interface{})["status"].(string)
+			metrics = append(metrics, newMetric("kubernetes_node_condition", "Whether the condition of the local node is True.", boolToFloat(status == string(v1.ConditionTrue)), "condition", conditionType))
+		}
+		if heartbeatAge, ok := kubeletInfo["heartbeatAgeSeconds"].(float64); ok {
+			metrics = append(metrics, newMetric("kubernetes_node_heartbeat_age_seconds", "Age of the heartbeat of the Ready condition of the local node.", heartbeatAge))
+		}
+	}
+	kubernetesInfo, ok := c.basicInfo["kubernetes"].(map[string]interface{})
+	if !ok {
+		return metrics
+	}
+	nodes, ok := kubernetesInfo["nodes"].(map[string]interface{})
+	if !ok {
+		return metrics
+	}
+	for nodeName, node := range nodes {
+		nodeMap := node.(map[string]interface{})
+		if cond, ok := nodeMap["flannel.ping"].(bool); ok {
+			metrics = append(metrics, newMetric("kubernetes_flannel_ping", "Whether the flannel ip of the node is reachable.", boolToFloat(cond), "node", nodeName))
+		}
+		stats, _ := nodeMap["flannel.ping.stats"].(map[string]interface{})
+		if lossPercent, ok := stats["lossPercent"].(float64); ok {
+			metrics = append(metrics, newMetric("kubernetes_flannel_ping_loss_percent", "Packet loss of pinging the flannel ip of the node.", lossPercent, "node", nodeName))
+		}
+		if rtt, ok := stats["rttAvgMilliseconds"].(float64); ok {
+			metrics = append(metrics, newMetric("kubernetes_flannel_ping_rtt_seconds", "Average round trip time of pinging the flannel ip of the node.", rtt/1000, "node", nodeName))
+		}
+		successNum, _ := nodeMap["pods.ping.success.num"].(int)
+		failPods, _ := nodeMap["pods.ping.fail"].([]string)
+		metrics = append(metrics,
+			newMetric("kubernetes_pods_ping_success", "Number of reachable pods on the node.", float64(successNum), "node", nodeName),
+			newMetric("kubernetes_pods_ping_fail", "Number of unreachable pods on the node.", float64(len(failPods)), "node", nodeName),
+		)
+	}
+	return metrics
+}
+
+func runtimeMetrics(runtimeInfo map[string]interface{}) []Metric {
+	metrics := []Metric{}
+	runtimeType, _ := runtimeInfo["type"].(string)
+	states, _ := runtimeInfo["containers.states"].(map[string]interface{})
+	for state, count := range states {
+		metrics = append(metrics, newMetric("kubernetes_runtime_containers", "Number of containers in the container runtime by state.", float64(count.(int)), "runtime", runtimeType, "state", state))
+	}
+	states, _ = runtimeInfo["sandboxes.states"].(map[string]interface{})
+	for state, count := range states {
+		metrics = append(metrics, newMetric("kubernetes_runtime_sandboxes", "Number of pod sandboxes in the container runtime by state.", float64(count.(int)), "runtime", runtimeType, "state", state))
+	}
+	if images, ok := runtimeInfo["images"].(int); ok {
+		metrics = append(metrics, newMetric("kubernetes_runtime_images", "Number of images in the container runtime.", float64(images), "runtime", runtimeType))
+	}
+	conditions, _ := runtimeInfo["conditions"].(map[string]interface{})
+	for condition, status := range conditions {
+		metrics = append(metrics, newMetric("kubernetes_runtime_condition", "Whether the condition of the container runtime is true.", boolToFloat(status.(bool)), "runtime", runtimeType, "condition", condition))
+	}
+	return metrics
+}
+
 func NewKubernetesChecker() *KubernetesChecker {
 	return &KubernetesChecker{}
 }
 
+// 创建失败时由check()在errors中报告，不影响kubernetes部分的检测
+// initialize()时socket可能还不存在或者容器运行时正在重启，之后每次check()重新创建直到成功
+func (c *KubernetesChecker) ensureRuntime() ContainerRuntime {
+	c.mutex.RLock()
+	runtime := c.runtime
+	c.mutex.RUnlock()
+	if runtime != nil {
+		return runtime
+	}
+	runtime, err := c.newContainerRuntime()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		c.runtimeError = err.Error()
+		return nil
+	}
+	c.runtime, c.runtimeError = runtime, ""
+	return runtime
+}
+
+func (c *KubernetesChecker) newContainerRuntime() (ContainerRuntime, error) {
+	nodeRuntimeVersion := ""
+	if obj, exists, err := c.nodeInformer.GetStore().GetByKey(c.nodeName); err == nil && exists {
+		nodeRuntimeVersion = obj.(*v1.Node).Status.NodeInfo.ContainerRuntimeVersion
+	}
+	if detectRuntimeType(c.runtimeType, nodeRuntimeVersion, c.dockerHost) == runtimeDocker {
+		dockerRuntime, err := NewDockerRuntime(c.dockerHost, c.dockerAPIVersion, c.runtimeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return dockerRuntime, nil
+	}
+	endpoint, err := detectCRIEndpoint(c.criEndpoint, c.mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	criRuntime, err := NewCRIRuntime(endpoint, c.runtimeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return criRuntime, nil
+}
+
 func getDockerInfo(cli *client.Client) (map[string]interface{}, error) {
 
 	info, err := cli.Info(context.Background())
@@ -212,111 +491,177 @@ func getDockerInfo(cli *client.Client) (map[string]interface{}, error) {
 	return dockerInfo, nil
 }
 
-func getKubernetesInfo(clientset *kubernetes.Clientset, pingTimeout time.Duration) (map[string]interface{}, *v1.Node, error) {
+// 只读informer的本地缓存，不再每次都list整个集群
+func (c *KubernetesChecker) getKubernetesInfo(errors map[string]interface{}) (map[string]interface{}, *v1.Node) {
 	kubernetesInfo := make(map[string]interface{})
-
-	// namespaces
-	namespaces, err := clientset.Core().Namespaces().List(metav1.ListOptions{})
-	namespaceNames := []string{}
-	for _, namespace := range namespaces.Items {
-		namespaceNames = append(namespaceNames, namespace.Name)
+	c.watchErrorsMutex.Lock()
+	for resource, err := range c.watchErrors {
+		errors["informer."+resource] = err
 	}
-	if err != nil {
-		return nil, nil, err
+	c.watchErrorsMutex.Unlock()
+	for resource, informer := range map[string]cache.SharedIndexInformer{"pods": c.podInformer, "nodes": c.nodeInformer} {
+		if !informer.HasSynced() {
+			errors["cache."+resource] = "cache is not synced yet"
+		}
 	}
-	kubernetesInfo["namespaces"] = namespaceNames
 
-	// pods
-	nodePods := make(map[string][]v1.Pod)
-	for _, namespace := range namespaces.Items {
-		pods, err := clientset.Core().Pods(namespace.Name).List(metav1.ListOptions{})
-		if err != nil {
-			return kubernetesInfo, nil, err
-		}
-		for _, pod := range pods.Items {
-			nodeName := pod.Spec.NodeName
-			if nodeName != "" {
-				thePods, ok := nodePods[nodeName]
-				if ok {
-					nodePods[nodeName] = append(thePods, pod)
-				} else {
-					nodePods[nodeName] = []v1.Pod{pod}
-				}
-			}
+	nodes := make(map[string]interface{})
+	for _, obj := range c.nodeInformer.GetStore().List() {
+		node := obj.(*v1.Node)
+		nodes[node.Name] = map[string]interface{}{
+			"spec.podCIDR": node.Spec.PodCIDR,
 		}
 	}
+	localPods, _ := c.podInformer.GetIndexer().ByIndex(podNodeNameIndex, c.nodeName)
+	kubernetesInfo["pods"] = len(localPods)
+	kubernetesInfo["nodes"] = nodes
 
-	nodeList, err := clientset.Core().Nodes().List(metav1.ListOptions{})
-	if err != nil {
-		return kubernetesInfo, nil, err
+	obj, exists, err := c.nodeInformer.GetStore().GetByKey(c.nodeName)
+	if err != nil || !exists {
+		errors["kubernetes.localNode"] = fmt.Sprintf("node %s is not found", c.nodeName)
+		return kubernetesInfo, &v1.Node{}
+	}
+	localNode := obj.(*v1.Node)
+	local := map[string]interface{}{
+		"status.capacity.memory":                 localNode.Status.Capacity.Memory().String(),
+		"status.capacity.cpu":                    localNode.Status.Capacity.Cpu().String(),
+		"status.capacity.pods":                   localNode.Status.Capacity.Pods().String(),
+		"status.allocatable.memory":              localNode.Status.Allocatable.Memory().String(),
+		"status.allocatable.cpu":                 localNode.Status.Capacity.Cpu().String(),
+		"status.allocatable.pods":                localNode.Status.Capacity.Pods().String(),
+		"status.daemonEndpoints.kubeletEndpoint": localNode.Status.DaemonEndpoints.KubeletEndpoint,
 	}
+	kubernetesInfo["local"] = local
+	return kubernetesInfo, localNode
+}
 
-	nodes := make(map[string]interface{})
-	ips := make(map[string]string)
-	for _, node := range nodeList.Items {
-		flannelIP := strings.Split(node.Spec.PodCIDR, "/")[0]
-		ips[node.Name] = flannelIP
-	}
-	flannelIPConditions := ping(ips, pingTimeout)
-	for _, node := range nodeList.Items {
-		cond, ok := flannelIPConditions[node.Name]
-		if !ok {
-			cond = false
+// 探测kubelet的healthz，并根据本节点的condition和心跳判断状态
+func (c *KubernetesChecker) getKubeletInfo(localNode *v1.Node, errors map[string]interface{}) (map[string]interface{}, []Verdict) {
+	verdicts := []Verdict{}
+	endpoint := fmt.Sprintf("https://%s", net.JoinHostPort(c.kubeletAddress, strconv.Itoa(int(localNode.Status.DaemonEndpoints.KubeletEndpoint.Port))))
+	healthz := make(map[string]interface{})
+	for _, healthzPath := range c.healthzPaths {
+		body, err := c.probeKubelet(endpoint + healthzPath)
+		if err != nil {
+			errors["kubelet."+healthzPath] = err.Error()
+			verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("kubelet %s failed", healthzPath)})
+			continue
 		}
+		healthz[healthzPath] = body
+	}
 
-		nodes[node.Name] = map[string]interface{}{
-			"spec.podCIDR": node.Spec.PodCIDR,
-			"flannel.ping": cond,
+	kubeletInfo := map[string]interface{}{
+		"endpoint": endpoint,
+		"healthz":  healthz,
+	}
+	conditions := make(map[string]interface{})
+	for _, condition := range localNode.Status.Conditions {
+		conditions[string(condition.Type)] = map[string]interface{}{
+			"status":             string(condition.Status),
+			"reason":             condition.Reason,
+			"message":            condition.Message,
+			"lastTransitionTime": condition.LastTransitionTime.Time,
+			"lastHeartbeatTime":  condition.LastHeartbeatTime.Time,
 		}
-
-		thePods, ok := nodePods[node.Name]
-		if ok {
-			podIPs := make(map[string]string)
-			for _, pod := range thePods {
-				podIP := pod.Status.PodIP
-				if podIP != "" {
-					podIPs[pod.Name] = podIP
-				}
+		switch condition.Type {
+		case v1.NodeReady:
+			if condition.Status != v1.ConditionTrue && c.notReadyState != Live {
+				verdicts = append(verdicts, Verdict{c.notReadyState, fmt.Sprintf("node %s is not ready: %s", localNode.Name, condition.Message)})
 			}
-			podIPConditions := ping(podIPs, pingTimeout)
-			pingSuccessPods := []string{}
-			pingFailPods := []string{}
-			for name, cond := range podIPConditions {
-				if cond {
-					pingSuccessPods = append(pingSuccessPods, name)
-				} else {
-					pingFailPods = append(pingFailPods, name)
-				}
+			if condition.LastHeartbeatTime.IsZero() {
+				continue
 			}
-			if len(pingSuccessPods) > 0 {
-				nodes[node.Name].(map[string]interface{})["pods.ping.success.num"] = len(pingSuccessPods)
+			heartbeatAge := time.Since(condition.LastHeartbeatTime.Time)
+			kubeletInfo["heartbeatAgeSeconds"] = heartbeatAge.Seconds()
+			if heartbeatAge > c.heartbeatMaxAge {
+				verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("heartbeat of node %s is %s old", localNode.Name, heartbeatAge.Truncate(time.Second))})
 			}
-			if len(pingFailPods) > 0 {
-				nodes[node.Name].(map[string]interface{})["pods.ping.fail"] = pingFailPods
+		case v1.NodeMemoryPressure, v1.NodeDiskPressure, v1.NodePIDPressure, v1.NodeNetworkUnavailable:
+			if condition.Status == v1.ConditionTrue {
+				verdicts = append(verdicts, Verdict{Error, fmt.Sprintf("node %s has %s: %s", localNode.Name, condition.Type, condition.Message)})
 			}
 		}
 	}
+	kubeletInfo["conditions"] = conditions
+	return kubeletInfo, verdicts
+}
 
-	kubernetesInfo["nodes"] = nodes
-	hostname, err := os.Hostname()
+// 返回healthz的响应，通常为ok
+func (c *KubernetesChecker) probeKubelet(url string) (string, error) {
+	resp, err := c.kubeletClient.Get(url)
 	if err != nil {
-		return kubernetesInfo, nil, err
+		return "", err
 	}
-	localNode, err := clientset.Core().Nodes().Get(hostname, metav1.GetOptions{})
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
 	if err != nil {
-		return kubernetesInfo, nil, err
+		return "", err
 	}
-	local := map[string]interface{}{
-		"status.capacity.memory":                 localNode.Status.Capacity.Memory().String(),
-		"status.capacity.cpu":                    localNode.Status.Capacity.Cpu().String(),
-		"status.capacity.pods":                   localNode.Status.Capacity.Pods().String(),
-		"status.allocatable.memory":              localNode.Status.Allocatable.Memory().String(),
-		"status.allocatable.cpu":                 localNode.Status.Capacity.Cpu().String(),
-		"status.allocatable.pods":                localNode.Status.Capacity.Pods().String(),
-		"status.daemonEndpoints.kubeletEndpoint": localNode.Status.DaemonEndpoints.KubeletEndpoint,
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// pod只watch调度到本节点的，对端的pod由samplePeerPods按节点list，节点总是watch全部。
+// informer随stopCh停止，重新初始化时旧informer的回调只会写到旧的watchErrors
+func (c *KubernetesChecker) startInformers() {
+	clientset, watchErrors := c.clientset, make(map[string]string)
+	c.watchErrorsMutex.Lock()
+	c.watchErrors = watchErrors
+	c.watchErrorsMutex.Unlock()
+	podSelector := fields.OneTermEqualSelector("spec.nodeName", c.nodeName).String()
+	c.podInformer = cache.NewSharedIndexInformer(c.listWatch("pods", watchErrors,
+		func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = podSelector
+			return clientset.CoreV1().Pods(metav1.NamespaceAll).List(options)
+		},
+		func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = podSelector
+			return clientset.CoreV1().Pods(metav1.NamespaceAll).Watch(options)
+		},
+	), &v1.Pod{}, 0, cache.Indexers{podNodeNameIndex: podNodeName})
+	c.nodeInformer = cache.NewSharedIndexInformer(c.listWatch("nodes", watchErrors,
+		func(options metav1.ListOptions) (runtime.Object, error) {
+			return clientset.CoreV1().Nodes().List(options)
+		},
+		func(options metav1.ListOptions) (watch.Interface, error) {
+			return clientset.CoreV1().Nodes().Watch(options)
+		},
+	), &v1.Node{}, 0, cache.Indexers{})
+	go c.podInformer.Run(c.stopCh)
+	go c.nodeInformer.Run(c.stopCh)
+
+	// 等待第一次同步，超时之后由check()在errors中报告
+	syncCh := make(chan struct{})
+	timer := time.AfterFunc(c.cacheSyncTimeout, func() { close(syncCh) })
+	defer timer.Stop()
+	cache.WaitForCacheSync(syncCh, c.podInformer.HasSynced, c.nodeInformer.HasSynced)
+}
+
+// 记录list和watch的错误，成功之后清除
+func (c *KubernetesChecker) listWatch(resource string, watchErrors map[string]string, listFunc cache.ListFunc, watchFunc cache.WatchFunc) *cache.ListWatch {
+	setError := func(op string, err error) {
+		c.watchErrorsMutex.Lock()
+		defer c.watchErrorsMutex.Unlock()
+		if err != nil {
+			watchErrors[resource] = fmt.Sprintf("%s: %s", op, err)
+		} else {
+			delete(watchErrors, resource)
+		}
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			obj, err := listFunc(options)
+			setError("list", err)
+			return obj, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := watchFunc(options)
+			setError("watch", err)
+			return w, err
+		},
 	}
-	kubernetesInfo["local"] = local
-	return kubernetesInfo, localNode, nil
 }
 
 func (c *KubernetesChecker) info() Info {
@@ -326,7 +671,9 @@ func (c *KubernetesChecker) info() Info {
 	return Info{
 		name:      c.name,
 		checkTime: c.checkTime,
+		duration:  c.checkDuration,
 		state:     c.checkerState,
+		reason:    c.stateReason,
 		basic:     c.basicInfo,
 		errors:    c.errors,
 	}
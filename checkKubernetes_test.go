@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 在httptest的TLS server上模拟kubelet的healthz
+func newTestKubelet(t *testing.T, responses map[string]int) (*httptest.Server, int32) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprintln(w, "ok")
+		} else {
+			fmt.Fprintf(w, "[-]%s failed: reason withheld\n", strings.TrimPrefix(r.URL.Path, "/healthz/"))
+		}
+	}))
+	// 不信任证书的client会让server打印握手失败的日志
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	return server, int32(portNumber)
+}
+
+func newTestLocalNode(port int32, conditions ...v1.NodeCondition) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	node.Status.DaemonEndpoints.KubeletEndpoint.Port = port
+	node.Status.Conditions = conditions
+	return node
+}
+
+func TestKubeletProbe(t *testing.T) {
+	server, port := newTestKubelet(t, map[string]int{"/healthz": http.StatusOK, "/healthz/syncloop": http.StatusInternalServerError})
+	defer server.Close()
+	checker := &KubernetesChecker{
+		kubeletAddress:  "127.0.0.1",
+		healthzPaths:    []string{"/healthz", "/healthz/syncloop"},
+		kubeletClient:   server.Client(),
+		heartbeatMaxAge: time.Minute,
+		notReadyState:   Fatal,
+	}
+	now := time.Now()
+	localNode := newTestLocalNode(port,
+		v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionFalse, Message: "PLEG is not healthy", LastHeartbeatTime: metav1.NewTime(now.Add(-time.Minute * 5))},
+		v1.NodeCondition{Type: v1.NodeMemoryPressure, Status: v1.ConditionTrue, Message: "kubelet has insufficient memory available"},
+		v1.NodeCondition{Type: v1.NodeDiskPressure, Status: v1.ConditionFalse},
+	)
+
+	errors := make(map[string]interface{})
+	kubeletInfo, verdicts := checker.getKubeletInfo(localNode, errors)
+	if kubeletInfo["endpoint"] != fmt.Sprintf("https://127.0.0.1:%d", port) {
+		t.Errorf("unexpected endpoint %v", kubeletInfo["endpoint"])
+	}
+	healthz := kubeletInfo["healthz"].(map[string]interface{})
+	if healthz["/healthz"] != "ok" || len(healthz) != 1 {
+		t.Errorf("expected only /healthz to pass, got %v", healthz)
+	}
+	if message, _ := errors["kubelet./healthz/syncloop"].(string); message != "500 Internal Server Error: [-]syncloop failed: reason withheld" || len(errors) != 1 {
+		t.Errorf("expected the syncloop error, got %v", errors)
+	}
+	if age := kubeletInfo["heartbeatAgeSeconds"].(float64); age < 300 || age > 310 {
+		t.Errorf("unexpected heartbeat age %v", age)
+	}
+	expected := []Verdict{
+		{Error, "kubelet /healthz/syncloop failed"},
+		{Fatal, "node node1 is not ready: PLEG is not healthy"},
+		{Error, "heartbeat of node node1 is 5m0s old"},
+		{Error, "node node1 has MemoryPressure: kubelet has insufficient memory available"},
+	}
+	if fmt.Sprint(verdicts) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, verdicts)
+	}
+
+	checker.basicInfo = map[string]interface{}{"kubelet": kubeletInfo}
+	output := string(writeMetrics(checker.metrics()))
+	for _, line := range []string{
+		`node_guard_kubernetes_kubelet_healthz{path="/healthz"} 1`,
+		`node_guard_kubernetes_kubelet_healthz{path="/healthz/syncloop"} 0`,
+		`node_guard_kubernetes_node_condition{condition="MemoryPressure"} 1`,
+		`node_guard_kubernetes_node_condition{condition="Ready"} 0`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+
+	// 健康的节点没有verdict，notReadyState为Live时忽略NotReady
+	checker.notReadyState = Live
+	checker.healthzPaths = []string{"/healthz"}
+	localNode = newTestLocalNode(port, v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionUnknown, LastHeartbeatTime: metav1.NewTime(now)})
+	errors = make(map[string]interface{})
+	if _, verdicts = checker.getKubeletInfo(localNode, errors); len(verdicts) != 0 || len(errors) != 0 {
+		t.Errorf("expected no verdicts and errors, got %v %v", verdicts, errors)
+	}
+}
+
+func TestKubeletProbeUnavailable(t *testing.T) {
+	server, port := newTestKubelet(t, map[string]int{"/healthz": http.StatusOK})
+	checker := &KubernetesChecker{kubeletAddress: "127.0.0.1", healthzPaths: []string{"/healthz"}, heartbeatMaxAge: time.Minute, notReadyState: Error}
+
+	// 不跳过校验时自签名的服务端证书无法通过
+	checker.kubeletClient = &http.Client{Timeout: time.Second}
+	errors := make(map[string]interface{})
+	if _, verdicts := checker.getKubeletInfo(newTestLocalNode(port), errors); len(verdicts) != 1 || errors["kubelet./healthz"] == nil {
+		t.Errorf("expected a certificate error, got %v %v", verdicts, errors)
+	}
+
+	checker.kubeletClient = server.Client()
+	server.Close()
+	errors = make(map[string]interface{})
+	_, verdicts := checker.getKubeletInfo(newTestLocalNode(port), errors)
+	if len(verdicts) != 1 || verdicts[0] != (Verdict{Error, "kubelet /healthz failed"}) || errors["kubelet./healthz"] == nil {
+		t.Errorf("expected a connection error, got %v %v", verdicts, errors)
+	}
+}
+
+func TestKubernetesRuntimeRecovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checker := &KubernetesChecker{
+		nodeName:       "node1",
+		runtimeType:    runtimeCRI,
+		mountPoint:     dir,
+		runtimeTimeout: time.Second,
+		nodeInformer:   cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1.Node{}, 0, cache.Indexers{}),
+	}
+
+	// initialize()时containerd还没有启动
+	if _, err := checker.newContainerRuntime(); err != nil {
+		checker.runtimeError = err.Error()
+	}
+	if runtime := checker.ensureRuntime(); runtime != nil || !strings.HasPrefix(checker.runtimeError, "no CRI socket found") {
+		t.Fatalf("expected no runtime without a socket, got %v %s", runtime, checker.runtimeError)
+	}
+
+	socket := path.Join(dir, defaultCRIEndpoints[0])
+	if err := os.MkdirAll(path.Dir(socket), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stop := serveFakeCRIServer(t, socket, newTestCRIServer())
+	defer stop()
+	runtime := checker.ensureRuntime()
+	if runtime == nil || checker.runtimeError != "" {
+		t.Fatalf("expected the runtime after the socket appeared, got %s", checker.runtimeError)
+	}
+	defer runtime.close()
+	errors := make(map[string]interface{})
+	if summary := runtime.summary(errors); summary["endpoint"] != "unix://"+socket || summary["version"] != "v1.6.8" {
+		t.Errorf("unexpected summary %v %v", summary, errors)
+	}
+	if again := checker.ensureRuntime(); again != runtime {
+		t.Errorf("expected the runtime to be reused")
+	}
+}
+
+func newTestNodePod(name string, nodeName string) *v1.Pod {
+	pod := newTestPod(name, "")
+	pod.Spec.NodeName = nodeName
+	return pod
+}
+
+func newTestInformerChecker(client *fake.Clientset, cacheSyncTimeout time.Duration) *KubernetesChecker {
+	return &KubernetesChecker{clientset: client, nodeName: "node1", cacheSyncTimeout: cacheSyncTimeout, stopCh: make(chan struct{})}
+}
+
+func TestKubernetesInformers(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Spec: v1.NodeSpec{PodCIDR: "10.244.1.0/24"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}, Spec: v1.NodeSpec{PodCIDR: "10.244.2.0/24"}},
+		newTestNodePod("a", "node1"), newTestNodePod("b", "node1"), newTestNodePod("c", "node2"),
+	)
+	c := newTestInformerChecker(client, time.Second*5)
+	defer close(c.stopCh)
+	c.startInformers()
+
+	// pod只list和watch本节点的，节点list和watch全部
+	selectors := make(map[string]string)
+	for _, action := range client.Actions() {
+		key := action.GetVerb() + " " + action.GetResource().Resource
+		switch action := action.(type) {
+		case k8stesting.ListAction:
+			selectors[key] = action.GetListRestrictions().Fields.String()
+		case k8stesting.WatchAction:
+			selectors[key] = action.GetWatchRestrictions().Fields.String()
+		}
+	}
+	expected := map[string]string{"list pods": "spec.nodeName=node1", "watch pods": "spec.nodeName=node1", "list nodes": "", "watch nodes": ""}
+	if fmt.Sprint(selectors) != fmt.Sprint(expected) {
+		t.Errorf("expected selectors %v, got %v", expected, selectors)
+	}
+
+	// fake clientset忽略field selector，pod的数量只能来自按spec.nodeName的索引
+	errors := make(map[string]interface{})
+	kubernetesInfo, localNode := c.getKubernetesInfo(errors)
+	if kubernetesInfo["pods"] != 2 || len(errors) != 0 || localNode.Name != "node1" {
+		t.Errorf("expected 2 local pods without errors, got %v %v", kubernetesInfo, errors)
+	}
+	nodes := kubernetesInfo["nodes"].(map[string]interface{})
+	if len(nodes) != 2 || nodes["node2"].(map[string]interface{})["spec.podCIDR"] != "10.244.2.0/24" {
+		t.Errorf("unexpected nodes %v", nodes)
+	}
+
+	// 之后的变化经watch更新到缓存
+	if _, err := client.CoreV1().Pods("default").Create(newTestNodePod("d", "node1")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		kubernetesInfo, _ = c.getKubernetesInfo(make(map[string]interface{}))
+		if kubernetesInfo["pods"] == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 local pods after the watch event, got %v", kubernetesInfo["pods"])
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestKubernetesInformerErrors(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	failing := int32(1)
+	client.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return true, nil, fmt.Errorf("apiserver is unavailable")
+		}
+		return false, nil, nil
+	})
+	c := newTestInformerChecker(client, time.Millisecond*200)
+	defer close(c.stopCh)
+	c.startInformers()
+
+	errors := make(map[string]interface{})
+	c.getKubernetesInfo(errors)
+	expected := map[string]interface{}{
+		"informer.nodes":       "list: apiserver is unavailable",
+		"cache.nodes":          "cache is not synced yet",
+		"kubernetes.localNode": "node node1 is not found",
+	}
+	if fmt.Sprint(errors) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, errors)
+	}
+
+	// reflector重试成功之后清除错误
+	atomic.StoreInt32(&failing, 0)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		errors = make(map[string]interface{})
+		c.getKubernetesInfo(errors)
+		if len(errors) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the errors to be cleared, got %v", errors)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestKubernetesCacheSyncTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	block := make(chan struct{})
+	// apiserver没有响应，list一直阻塞
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		<-block
+		return false, nil, nil
+	})
+	c := newTestInformerChecker(client, time.Millisecond*200)
+	defer close(c.stopCh)
+	defer close(block)
+
+	startTime := time.Now()
+	c.startInformers()
+	if elapsed := time.Since(startTime); elapsed < time.Millisecond*200 || elapsed > time.Second*2 {
+		t.Errorf("expected to stop waiting after cacheSyncTimeout, took %s", elapsed)
+	}
+	errors := make(map[string]interface{})
+	c.getKubernetesInfo(errors)
+	if errors["cache.pods"] != "cache is not synced yet" || errors["cache.nodes"] != "cache is not synced yet" {
+		t.Errorf("expected the caches to be unsynced, got %v", errors)
+	}
+}
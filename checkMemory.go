@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// Out of memory: Killed process 1234 (java) total-vm:...
+	// Memory cgroup out of memory: Kill process 1234 (java) score 1000 or sacrifice child
+	oomKilledRegexp = regexp.MustCompile(`(?:[Oo]ut of memory|Memory cgroup out of memory): Kill(?:ed)? process (\d+) \(([^)]*)\)`)
+	// oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),...,task_memcg=/kubepods/...,task=java,pid=1234,uid=0
+	oomKillRegexp = regexp.MustCompile(`oom-kill:constraint=([^,]*),.*task_memcg=([^,]*),task=.*,pid=(\d+)`)
+)
+
+func init() {
+	registerChecker("memory", NewMemoryChecker())
+	registerConfigSchema("memory",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"kmsg.path", "{mount_point}/dev/kmsg", "path of /dev/kmsg, a regular file with kmsg-style lines also works"},
+		ConfigItem{"thp.path", "{sys_path}/kernel/mm/transparent_hugepage", "path of the transparent hugepage settings"},
+		ConfigItem{"oom.window", time.Hour, "OOM kills in kernel log within the window are reported"},
+		ConfigItem{"oom.state", oneOf("Error", stateValues...), "state when processes were OOM-killed, Error, Fatal, or Live to ignore"},
+		rulesConfigItem,
+	)
+}
+
+type MemoryChecker struct {
+	name          string
+	mutex         sync.RWMutex
+	stopCh        chan struct{}
+	checkerState  State
+	stateReason   string
+	rules         []*Rule
+	checkTime     time.Time
+	checkDuration time.Duration
+	checkInterval time.Duration
+	basicInfo     map[string]interface{}
+	errors        map[string]interface{}
+	procPath      string
+	kmsgPath      string
+	thpPath       string
+	oomWindow     time.Duration
+	oomState      State
+	lastVmstat    map[string]uint64
+	lastCheckTime time.Time
+}
+
+func (c *MemoryChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.name = "memory"
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.basicInfo = make(map[string]interface{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
+	c.procPath = daemonConfig.proc_path
+	c.kmsgPath = daemonConfig.getOrDefault(c.name, "kmsg.path", path.Join(daemonConfig.mount_point, "/dev/kmsg")).(string)
+	c.thpPath = daemonConfig.getOrDefault(c.name, "thp.path", path.Join(daemonConfig.sys_path, "kernel/mm/transparent_hugepage")).(string)
+	c.oomWindow = daemonConfig.getOrDefault(c.name, "oom.window", time.Hour).(time.Duration)
+	c.oomState = State(daemonConfig.getOrDefault(c.name, "oom.state", "Error").(string))
+	c.lastVmstat = nil
+	c.lastCheckTime = time.Time{}
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *MemoryChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *MemoryChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *MemoryChecker) stop() {
+	close(c.stopCh)
+}
+
+func (c *MemoryChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	meminfo, err := readMeminfo(path.Join(c.procPath, "meminfo"))
+	if err != nil {
+		errors["meminfo"] = err.Error()
+	} else {
+		basicInfo["memory"], basicInfo["swap"], basicInfo["hugepages"] = meminfoToInfo(meminfo)
+	}
+
+	thp := make(map[string]interface{})
+	for _, name := range []string{"enabled", "defrag"} {
+		if value, err := readTHPSetting(path.Join(c.thpPath, name)); err != nil {
+			errors["transparentHugepage."+name] = err.Error()
+		} else {
+			thp[name] = value
+		}
+	}
+	basicInfo["transparentHugepage"] = thp
+
+	oom := make(map[string]interface{})
+	now := time.Now()
+	vmstat, err := readVmstat(path.Join(c.procPath, "vmstat"))
+	if err != nil {
+		errors["vmstat"] = err.Error()
+	} else {
+		c.vmstatRates(vmstat, now, basicInfo)
+		if kills, ok := vmstat["oom_kill"]; ok {
+			oom["killsTotal"] = kills
+			if lastKills, ok := c.lastVmstat["oom_kill"]; ok && kills >= lastKills {
+				oom["killsSinceLastCheck"] = kills - lastKills
+			}
+		}
+		c.lastVmstat, c.lastCheckTime = vmstat, now
+	}
+
+	kills, err := c.recentOOMKills(now)
+	if err != nil {
+		errors["kmsg"] = err.Error()
+	} else {
+		oom["recentKills"] = kills
+	}
+	basicInfo["oom"] = oom
+
+	if c.oomState != Live {
+		if killed, ok := oom["killsSinceLastCheck"].(uint64); ok && killed > 0 && len(kills) == 0 {
+			verdicts = append(verdicts, Verdict{c.oomState, fmt.Sprintf("%d processes were OOM-killed since last check", killed)})
+		}
+		if len(kills) > 0 {
+			processes := []string{}
+			for _, kill := range kills {
+				processes = append(processes, fmt.Sprintf("%s(%d)", kill["process"], kill["pid"]))
+			}
+			verdicts = append(verdicts, Verdict{c.oomState, fmt.Sprintf("%d processes were OOM-killed in the last %s: %s", len(kills), c.oomWindow, strings.Join(processes, ", "))})
+		}
+	}
+	return nil
+}
+
+// 换页和缺页是累计值，和上一次check()相减得到速率，第一次check()时没有
+func (c *MemoryChecker) vmstatRates(vmstat map[string]uint64, now time.Time, basicInfo map[string]interface{}) {
+	elapsed := now.Sub(c.lastCheckTime).Seconds()
+	if c.lastVmstat == nil || elapsed <= 0 {
+		return
+	}
+	rate := func(key string) (float64, bool) {
+		value, ok := vmstat[key]
+		lastValue, lastOk := c.lastVmstat[key]
+		if !ok || !lastOk || value < lastValue {
+			return 0, false
+		}
+		return float64(value-lastValue) / elapsed, true
+	}
+	if swap, ok := basicInfo["swap"].(map[string]interface{}); ok {
+		if value, ok := rate("pswpin"); ok {
+			swap["inPagesPerSecond"] = value
+		}
+		if value, ok := rate("pswpout"); ok {
+			swap["outPagesPerSecond"] = value
+		}
+	}
+	if memory, ok := basicInfo["memory"].(map[string]interface{}); ok {
+		if value, ok := rate("pgmajfault"); ok {
+			memory["majorFaultsPerSecond"] = value
+		}
+	}
+}
+
+// kmsg中的时间是开机以来的微秒数，加上/proc/stat中的btime换算为墙上时间
+func (c *MemoryChecker) recentOOMKills(now time.Time) ([]map[string]interface{}, error) {
+	fs, err := procfs.NewFS(c.procPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fs.NewStat()
+	if err != nil {
+		return nil, err
+	}
+	bootTime := time.Unix(int64(stat.BootTime), 0)
+	records, err := readKmsg(c.kmsgPath)
+	if err != nil {
+		return nil, err
+	}
+	kills := []map[string]interface{}{}
+	memcgs := make(map[string][]string)
+	for _, record := range records {
+		if matches := oomKillRegexp.FindStringSubmatch(record.message); matches != nil {
+			memcgs[matches[3]] = []string{matches[1], matches[2]}
+			continue
+		}
+		matches := oomKilledRegexp.FindStringSubmatch(record.message)
+		if matches == nil {
+			continue
+		}
+		killTime := bootTime.Add(record.sinceBoot)
+		if now.Sub(killTime) > c.oomWindow {
+			continue
+		}
+		pid, _ := strconv.Atoi(matches[1])
+		kill := map[string]interface{}{
+			"time":    killTime,
+			"pid":     pid,
+			"process": matches[2],
+		}
+		if memcg, ok := memcgs[matches[1]]; ok {
+			kill["constraint"], kill["memcg"] = memcg[0], memcg[1]
+			delete(memcgs, matches[1])
+		}
+		kills = append(kills, kill)
+	}
+	return kills, nil
+}
+
+func (c *MemoryChecker) info() Info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *MemoryChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	for section, name := range map[string]string{"memory": "memory_bytes", "swap": "memory_swap_bytes"} {
+		if info, ok := c.basicInfo[section].(map[string]interface{}); ok {
+			for _, key := range []string{"total", "free", "available", "buffers", "cached", "slab", "used"} {
+				if value, ok := toFloat(info[key]); ok {
+					metrics = append(metrics, newMetric(name, fmt.Sprintf("Bytes of %s from /proc/meminfo.", section), value, "type", key))
+				}
+			}
+		}
+	}
+	if swap, ok := c.basicInfo["swap"].(map[string]interface{}); ok {
+		for direction, key := range map[string]string{"in": "inPagesPerSecond", "out": "outPagesPerSecond"} {
+			if value, ok := toFloat(swap[key]); ok {
+				metrics = append(metrics, newMetric("memory_swap_pages_per_second", "Pages swapped between the last two checks.", value, "direction", direction))
+			}
+		}
+	}
+	if hugepages, ok := c.basicInfo["hugepages"].(map[string]interface{}); ok {
+		for _, key := range []string{"total", "free", "reserved", "surplus"} {
+			if value, ok := toFloat(hugepages[key]); ok {
+				metrics = append(metrics, newMetric("memory_hugepages", "Number of hugepages.", value, "state", key))
+			}
+		}
+	}
+	if oom, ok := c.basicInfo["oom"].(map[string]interface{}); ok {
+		if value, ok := toFloat(oom["killsTotal"]); ok {
+			metrics = append(metrics, newCounter("memory_oom_kills", "oom_kill from /proc/vmstat.", value))
+		}
+		if kills, ok := oom["recentKills"].([]map[string]interface{}); ok {
+			metrics = append(metrics, newMetric("memory_oom_kills_recent", "OOM kills in kernel log within oom.window.", float64(len(kills))))
+		}
+	}
+	return metrics
+}
+
+func (c *MemoryChecker) newRouters() Routers {
+	routers := make(Routers)
+	return routers
+}
+
+func NewMemoryChecker() *MemoryChecker {
+	return &MemoryChecker{}
+}
+
+// /proc/meminfo中带kB的值转换为字节，HugePages_*等不带单位的值保持原样
+func readMeminfo(meminfoPath string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(meminfoPath)
+	if err != nil {
+		return nil, err
+	}
+	meminfo := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected line in %s: %s", meminfoPath, line)
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			value *= 1024
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	return meminfo, nil
+}
+
+func meminfoToInfo(meminfo map[string]uint64) (map[string]interface{}, map[string]interface{}, map[string]interface{}) {
+	memory := map[string]interface{}{
+		"total":             meminfo["MemTotal"],
+		"free":              meminfo["MemFree"],
+		"available":         meminfo["MemAvailable"],
+		"buffers":           meminfo["Buffers"],
+		"cached":            meminfo["Cached"],
+		"slab":              meminfo["Slab"],
+		"slabReclaimable":   meminfo["SReclaimable"],
+		"slabUnreclaimable": meminfo["SUnreclaim"],
+		"dirty":             meminfo["Dirty"],
+		"writeback":         meminfo["Writeback"],
+		"committed":         meminfo["Committed_AS"],
+		"commitLimit":       meminfo["CommitLimit"],
+	}
+	if total := meminfo["MemTotal"]; total > 0 && meminfo["MemAvailable"] <= total {
+		memory["usedPercent"] = float64(total-meminfo["MemAvailable"]) / float64(total) * 100
+	}
+	swap := map[string]interface{}{
+		"total": meminfo["SwapTotal"],
+		"free":  meminfo["SwapFree"],
+	}
+	if total := meminfo["SwapTotal"]; total > 0 && meminfo["SwapFree"] <= total {
+		swap["used"] = total - meminfo["SwapFree"]
+		swap["usedPercent"] = float64(total-meminfo["SwapFree"]) / float64(total) * 100
+	}
+	hugepages := map[string]interface{}{
+		"total":         meminfo["HugePages_Total"],
+		"free":          meminfo["HugePages_Free"],
+		"reserved":      meminfo["HugePages_Rsvd"],
+		"surplus":       meminfo["HugePages_Surp"],
+		"pageSizeBytes": meminfo["Hugepagesize"],
+	}
+	return memory, swap, hugepages
+}
+
+func readVmstat(vmstatPath string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(vmstatPath)
+	if err != nil {
+		return nil, err
+	}
+	vmstat := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			vmstat[fields[0]] = value
+		}
+	}
+	return vmstat, nil
+}
+
+// 形如"always [madvise] never"，方括号中的为当前的值
+func readTHPSetting(settingPath string) (string, error) {
+	data, err := ioutil.ReadFile(settingPath)
+	if err != nil {
+		return "", err
+	}
+	setting := strings.TrimSpace(string(data))
+	start, end := strings.Index(setting, "["), strings.Index(setting, "]")
+	if start < 0 || end < start {
+		return setting, nil
+	}
+	return setting[start+1 : end], nil
+}
+
+type kmsgRecord struct {
+	sequence  uint64
+	sinceBoot time.Duration
+	message   string
+}
+
+// 参考 https://www.kernel.org/doc/Documentation/ABI/testing/dev-kmsg
+// 每条记录形如"6,1234,5678901234,-;message"，以空格开头的行是上一条记录的附加信息
+// /dev/kmsg以O_NONBLOCK打开，读到EAGAIN即为读完了当前的ring buffer，不能用os.File，否则会被poller阻塞
+func readKmsg(kmsgPath string) ([]kmsgRecord, error) {
+	fd, err := unix.Open(kmsgPath, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: kmsgPath, Err: err}
+	}
+	defer unix.Close(fd)
+	var data bytes.Buffer
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EPIPE {
+			// 未读的记录已被覆盖，继续读之后的记录
+			continue
+		}
+		if err == unix.EAGAIN || n == 0 {
+			break
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "read", Path: kmsgPath, Err: err}
+		}
+		data.Write(buf[:n])
+	}
+
+	records := []kmsgRecord{}
+	scanner := bufio.NewScanner(&data)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		semicolon := strings.Index(line, ";")
+		if strings.HasPrefix(line, " ") || semicolon < 0 {
+			continue
+		}
+		fields := strings.Split(line[:semicolon], ",")
+		if len(fields) < 3 {
+			continue
+		}
+		sequence, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		usec, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		records = append(records, kmsgRecord{
+			sequence:  sequence,
+			sinceBoot: time.Duration(usec) * time.Microsecond,
+			message:   line[semicolon+1:],
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].sequence < records[j].sequence })
+	return records, scanner.Err()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMeminfo = `MemTotal:       16384000 kB
+MemFree:         2048000 kB
+MemAvailable:    4096000 kB
+Buffers:          102400 kB
+Cached:          3072000 kB
+SwapTotal:       2048000 kB
+SwapFree:        1536000 kB
+Dirty:               128 kB
+Slab:             512000 kB
+SReclaimable:     256000 kB
+SUnreclaim:       256000 kB
+HugePages_Total:      16
+HugePages_Free:        8
+HugePages_Rsvd:        2
+HugePages_Surp:        0
+Hugepagesize:       2048 kB
+`
+
+// 写入fixture文件，返回临时目录
+func writeMemoryFixtures(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		file := path.Join(root, name)
+		os.MkdirAll(path.Dir(file), 0755)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReadMeminfo(t *testing.T) {
+	root := writeMemoryFixtures(t, map[string]string{
+		"meminfo": testMeminfo,
+		"broken":  "MemTotal:       16384000 kB\nMemFree:        abc kB\n",
+	})
+	defer os.RemoveAll(root)
+
+	meminfo, err := readMeminfo(path.Join(root, "meminfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meminfo["MemTotal"] != 16384000*1024 || meminfo["HugePages_Total"] != 16 || meminfo["Hugepagesize"] != 2048*1024 {
+		t.Errorf("unexpected meminfo %v", meminfo)
+	}
+	memory, swap, hugepages := meminfoToInfo(meminfo)
+	if memory["available"] != uint64(4096000*1024) || memory["usedPercent"] != float64(75) || memory["slabReclaimable"] != uint64(256000*1024) {
+		t.Errorf("unexpected memory %v", memory)
+	}
+	if swap["used"] != uint64(512000*1024) || swap["usedPercent"] != float64(25) {
+		t.Errorf("unexpected swap %v", swap)
+	}
+	if hugepages["total"] != uint64(16) || hugepages["reserved"] != uint64(2) || hugepages["pageSizeBytes"] != uint64(2048*1024) {
+		t.Errorf("unexpected hugepages %v", hugepages)
+	}
+
+	// 没有swap时没有used
+	_, swap, _ = meminfoToInfo(map[string]uint64{"MemTotal": 1024})
+	if _, ok := swap["used"]; ok {
+		t.Errorf("expected no used swap without swap, got %v", swap)
+	}
+
+	if _, err := readMeminfo(path.Join(root, "broken")); err == nil {
+		t.Errorf("expected an error for an unexpected line")
+	}
+	if _, err := readMeminfo(path.Join(root, "missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestReadVmstat(t *testing.T) {
+	root := writeMemoryFixtures(t, map[string]string{
+		"vmstat": "nr_free_pages 512000\npswpin 100\npswpout 200\npgmajfault 3000\noom_kill 2\nbroken\nnegative -1\n",
+	})
+	defer os.RemoveAll(root)
+
+	vmstat, err := readVmstat(path.Join(root, "vmstat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint64{"nr_free_pages": 512000, "pswpin": 100, "pswpout": 200, "pgmajfault": 3000, "oom_kill": 2}
+	if fmt.Sprint(vmstat) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, vmstat)
+	}
+}
+
+func TestReadTHPSetting(t *testing.T) {
+	root := writeMemoryFixtures(t, map[string]string{
+		"enabled": "always [madvise] never\n",
+		"defrag":  "[always] defer defer+madvise madvise never\n",
+		"plain":   "never\n",
+	})
+	defer os.RemoveAll(root)
+
+	for name, expected := range map[string]string{"enabled": "madvise", "defrag": "always", "plain": "never"} {
+		if value, err := readTHPSetting(path.Join(root, name)); err != nil || value != expected {
+			t.Errorf("%s: expected %s, got %s %v", name, expected, value, err)
+		}
+	}
+}
+
+func TestReadKmsg(t *testing.T) {
+	// 普通文件也可以作为kmsg读取，记录按序号排序
+	root := writeMemoryFixtures(t, map[string]string{
+		"kmsg": strings.Join([]string{
+			"6,12,2000000,-;second message",
+			" SUBSYSTEM=memory",
+			"6,11,1000000,-;first message; with semicolon",
+			"broken line",
+			"6,x,1000,-;bad sequence",
+			"6,13,y,-;bad timestamp",
+			"6,14;too few fields",
+		}, "\n") + "\n",
+	})
+	defer os.RemoveAll(root)
+
+	records, err := readKmsg(path.Join(root, "kmsg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if records[0].sequence != 11 || records[0].sinceBoot != time.Second || records[0].message != "first message; with semicolon" {
+		t.Errorf("unexpected record %+v", records[0])
+	}
+	if records[1].sequence != 12 || records[1].sinceBoot != time.Second*2 || records[1].message != "second message" {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+	if _, err := readKmsg(path.Join(root, "missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestRecentOOMKills(t *testing.T) {
+	now := time.Now()
+	bootTime := now.Add(-time.Hour * 2).Unix()
+	sinceBoot := func(ago time.Duration) int64 {
+		return (now.Unix() - bootTime - int64(ago.Seconds())) * 1000000
+	}
+	root := writeMemoryFixtures(t, map[string]string{
+		"proc/stat": fmt.Sprintf("cpu  1 2 3 4 5 6 7 8 9 10\nbtime %d\n", bootTime),
+		"kmsg": strings.Join([]string{
+			// oom.window之外的不报告
+			fmt.Sprintf("3,1,%d,-;Out of memory: Killed process 100 (old) total-vm:1024kB", sinceBoot(time.Hour+time.Minute)),
+			fmt.Sprintf("6,2,%d,-;oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=abc,mems_allowed=0,oom_memcg=/kubepods/pod1,task_memcg=/kubepods/pod1/abc,task=java,pid=1234,uid=0", sinceBoot(time.Minute*10)),
+			fmt.Sprintf("3,3,%d,-;Memory cgroup out of memory: Killed process 1234 (java) total-vm:4096kB, anon-rss:2048kB", sinceBoot(time.Minute*10)),
+			fmt.Sprintf("3,4,%d,-;Out of memory: Kill process 5678 (python) score 900 or sacrifice child", sinceBoot(time.Minute)),
+			fmt.Sprintf("6,5,%d,-;eth0: link up", sinceBoot(time.Second)),
+		}, "\n") + "\n",
+	})
+	defer os.RemoveAll(root)
+
+	checker := &MemoryChecker{procPath: path.Join(root, "proc"), kmsgPath: path.Join(root, "kmsg"), oomWindow: time.Hour}
+	kills, err := checker.recentOOMKills(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kills) != 2 {
+		t.Fatalf("expected 2 kills, got %v", kills)
+	}
+	if kills[0]["pid"] != 1234 || kills[0]["process"] != "java" || kills[0]["constraint"] != "CONSTRAINT_MEMCG" || kills[0]["memcg"] != "/kubepods/pod1/abc" {
+		t.Errorf("unexpected kill %v", kills[0])
+	}
+	if killTime := kills[0]["time"].(time.Time); killTime.Sub(now.Add(-time.Minute*10)) > time.Second || now.Add(-time.Minute*10).Sub(killTime) > time.Second {
+		t.Errorf("unexpected kill time %s", killTime)
+	}
+	if _, ok := kills[1]["memcg"]; ok || kills[1]["pid"] != 5678 || kills[1]["process"] != "python" {
+		t.Errorf("unexpected kill %v", kills[1])
+	}
+}
+
+func TestMemoryCheck(t *testing.T) {
+	root := writeMemoryFixtures(t, map[string]string{
+		"proc/meminfo": testMeminfo,
+		"proc/vmstat":  "pswpin 100\npswpout 200\npgmajfault 3000\noom_kill 2\n",
+		"proc/stat":    fmt.Sprintf("btime %d\n", time.Now().Unix()-3600),
+		"kmsg":         "",
+		"thp/enabled":  "always [madvise] never\n",
+	})
+	defer os.RemoveAll(root)
+
+	checker := &MemoryChecker{
+		procPath:  path.Join(root, "proc"),
+		kmsgPath:  path.Join(root, "kmsg"),
+		thpPath:   path.Join(root, "thp"),
+		oomWindow: time.Hour,
+		oomState:  Error,
+	}
+	checker.check()
+	if checker.checkerState != Live {
+		t.Errorf("expected Live, got %s %s", checker.checkerState, checker.stateReason)
+	}
+	// errors中是字符串，可以序列化为json
+	message, ok := checker.errors["transparentHugepage.defrag"].(string)
+	if !ok || !strings.Contains(message, "defrag") || len(checker.errors) != 1 {
+		t.Errorf("expected only the defrag error as a string, got %v", checker.errors)
+	}
+	if data, err := json.Marshal(checker.errors); err != nil || strings.Contains(string(data), "{}") {
+		t.Errorf("unexpected json of errors %s %v", data, err)
+	}
+	if oom := checker.basicInfo["oom"].(map[string]interface{}); oom["killsTotal"] != uint64(2) || oom["killsSinceLastCheck"] != nil {
+		t.Errorf("unexpected oom %v", oom)
+	}
+
+	// 第二次check()时计算速率，新的oom_kill产生verdict
+	checker.lastCheckTime = checker.lastCheckTime.Add(-time.Second * 10)
+	ioutil.WriteFile(path.Join(root, "proc/vmstat"), []byte("pswpin 150\npswpout 200\npgmajfault 3100\noom_kill 3\n"), 0644)
+	checker.check()
+	swap := checker.basicInfo["swap"].(map[string]interface{})
+	if rate := swap["inPagesPerSecond"].(float64); rate < 4.9 || rate > 5 || swap["outPagesPerSecond"] != float64(0) {
+		t.Errorf("unexpected swap rates %v", swap)
+	}
+	if rate := checker.basicInfo["memory"].(map[string]interface{})["majorFaultsPerSecond"].(float64); rate < 9.9 || rate > 10 {
+		t.Errorf("unexpected major fault rate %v", rate)
+	}
+	if checker.checkerState != Error || checker.stateReason != "1 processes were OOM-killed since last check" {
+		t.Errorf("expected an OOM verdict, got %s %s", checker.checkerState, checker.stateReason)
+	}
+
+	metrics := map[string]bool{}
+	for _, metric := range checker.metrics() {
+		metrics[metric.name] = true
+		if metric.counter != strings.HasSuffix(metric.name, "_total") {
+			t.Errorf("only metrics ending with _total should be counters, got %s", metric.name)
+		}
+	}
+	for _, name := range []string{"node_guard_memory_bytes", "node_guard_memory_swap_bytes", "node_guard_memory_swap_pages_per_second", "node_guard_memory_hugepages", "node_guard_memory_oom_kills_total", "node_guard_memory_oom_kills_recent"} {
+		if !metrics[name] {
+			t.Errorf("expected metric %s, got %v", name, metrics)
+		}
+	}
+
+	os.Remove(path.Join(root, "proc/meminfo"))
+	checker.check()
+	if _, ok := checker.errors["meminfo"].(string); !ok {
+		t.Errorf("expected the meminfo error as a string, got %v", checker.errors)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,16 +18,36 @@ import (
 
 func init() {
 	registerChecker("network", NewNetworkChecker())
+	registerConfigSchema("network",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"etc.hosts.path", "{mount_point}/etc/hosts", "path of /etc/hosts"},
+		ConfigItem{"etc.hosts.concerned", []string{}, "concerned hostnames in /etc/hosts"},
+		ConfigItem{"etc.resolv.conf.path", "{mount_point}/etc/resolv.conf", "path of /etc/resolv.conf"},
+		ConfigItem{"kernel.parameters", []string{}, "concerned kernel runtime parameters, e.g. net.ipv4.ip_forward"},
+		ConfigItem{"status.file.path", "{sys_path}/class/net", "path of /sys/class/net"},
+		ConfigItem{"net.route.path", "{proc_path}/net/route", "path of /proc/net/route"},
+		ConfigItem{"bonding.path", "{proc_path}/net/bonding", "path of /proc/net/bonding"},
+		ConfigItem{"bonding.degraded.state", oneOf(Error, stateValues...), "state when a bond is degraded, Error, Fatal or Live"},
+		ConfigItem{"interfaces.include", []string{"*"}, "patterns of interfaces under status.file.path to report link status and counters"},
+		ConfigItem{"interfaces.exclude", []string{"lo", "veth*"}, "patterns of interfaces to skip"},
+		ConfigItem{"interfaces.errors.perSecond", 1.0, "threshold of rx_errors+tx_errors per second of an interface, 0 to disable"},
+		ConfigItem{"interfaces.drops.perSecond", 100.0, "threshold of rx_dropped+tx_dropped per second of an interface, 0 to disable"},
+		ConfigItem{"interfaces.state", oneOf(Error, ruleStateValues...), "state when the errors or drops of an interface exceed the thresholds, Error or Fatal"},
+		ConfigItem{"interfaces.mtu.expected", []interface{}{}, "expected mtu of interfaces, a list of {interface, mtu, state}"},
+		rulesConfigItem,
+	)
 }
 
 type NetworkChecker struct {
 	name             string
-	ticker           *time.Ticker
 	mutex            sync.RWMutex
 	stopCh           chan struct{}
 	checkInterval    time.Duration
 	checkerState     State
+	stateReason      string
+	rules            []*Rule
 	checkTime        time.Time
+	checkDuration    time.Duration
 	basicInfo        map[string]interface{}
 	errors           map[string]interface{}
 	details          map[string]interface{}
@@ -37,11 +58,23 @@ type NetworkChecker struct {
 	kernelParameters []string
 	statusFilePath   string
 	netRoutePath     string
+	bondingPath      string
+	bondingState     State
+	intfInclude      []string
+	intfExclude      []string
+	intfErrorsRate   float64
+	intfDropsRate    float64
+	intfState        State
+	mtuExpectations  []mtuExpectation
+	lastIntfCounters map[string]map[string]uint64
+	lastIntfTime     time.Time
 }
 
 func (c *NetworkChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
 	c.name = "network"
 	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
 	c.procPath = daemonConfig.proc_path
 	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
 	c.hostsPath = daemonConfig.getOrDefault(c.name, "etc.hosts.path", path.Join(daemonConfig.mount_point, "/etc/hosts")).(string)
@@ -50,20 +83,36 @@ func (c *NetworkChecker) initialize(daemonConfig *DaemonConfig) error {
 	c.kernelParameters = daemonConfig.getOrDefault(c.name, "kernel.parameters", []string{}).([]string)
 	c.statusFilePath = daemonConfig.getOrDefault(c.name, "status.file.path", path.Join(daemonConfig.sys_path, "class/net")).(string)
 	c.netRoutePath = daemonConfig.getOrDefault(c.name, "net.route.path", path.Join(daemonConfig.proc_path, "net/route")).(string)
+	c.bondingPath = daemonConfig.getOrDefault(c.name, "bonding.path", path.Join(daemonConfig.proc_path, "net/bonding")).(string)
+	c.bondingState = State(daemonConfig.getOrDefault(c.name, "bonding.degraded.state", string(Error)).(string))
+	c.intfInclude = daemonConfig.getOrDefault(c.name, "interfaces.include", []string{"*"}).([]string)
+	c.intfExclude = daemonConfig.getOrDefault(c.name, "interfaces.exclude", []string{"lo", "veth*"}).([]string)
+	c.intfErrorsRate = daemonConfig.getOrDefault(c.name, "interfaces.errors.perSecond", 1.0).(float64)
+	c.intfDropsRate = daemonConfig.getOrDefault(c.name, "interfaces.drops.perSecond", 100.0).(float64)
+	c.intfState = State(daemonConfig.getOrDefault(c.name, "interfaces.state", string(Error)).(string))
+	if c.mtuExpectations, err = parseMTUExpectations(daemonConfig.getOrDefault(c.name, "interfaces.mtu.expected", []interface{}{}).([]interface{})); err != nil {
+		return fmt.Errorf("invalid interfaces.mtu.expected of checker %s: %s", c.name, err)
+	}
+	c.lastIntfCounters = nil
+	c.lastIntfTime = time.Time{}
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
 	return c.check()
 }
 
 func (c *NetworkChecker) state() (State, string) {
-	return c.checkerState, ""
+	return c.checkerState, c.stateReason
 }
 
 func (c *NetworkChecker) start() {
-	c.ticker = time.NewTicker(time.Second * 5)
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
 	for {
 		select {
-		case <-c.ticker.C:
-			go c.check()
-		case <-c.stopCh:
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
 			return
 		}
 	}
@@ -76,15 +125,18 @@ func (c *NetworkChecker) stop() {
 func (c *NetworkChecker) check() error {
 	defer c.mutex.Unlock()
 	c.mutex.Lock()
+	startTime := time.Now()
 	basicInfo := make(map[string]interface{})
 	errors := make(map[string]interface{})
 	details := make(map[string]interface{})
+	verdicts := []Verdict{}
 	defer func() {
 		c.basicInfo = basicInfo
 		c.errors = errors
 		c.details = details
 		c.checkTime = time.Now()
-		c.checkerState = Live
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
 	}()
 
 	defer func() {
@@ -116,12 +168,16 @@ func (c *NetworkChecker) check() error {
 		basicInfo["kernel.runtime.parameters"] = runtimeParameters
 	}
 
-	bondingStates, err := readBondingStats(c.statusFilePath)
+	bondingStates, bondingErrors, err := readBondingStats(c.statusFilePath)
 	if err != nil {
 		errors["bonding.stats"] = err
 	} else {
 		basicInfo["bonding.stats"] = bondingStates
+		if len(bondingErrors) > 0 {
+			errors["bonding.stats"] = bondingErrors
+		}
 	}
+	verdicts = append(verdicts, c.checkBonds(bondingStates, basicInfo, errors)...)
 
 	intfs, err := readIntfs(c.netRoutePath)
 	if err != nil {
@@ -130,9 +186,155 @@ func (c *NetworkChecker) check() error {
 		basicInfo["net"] = intfs
 	}
 
+	verdicts = append(verdicts, c.checkIntfs(basicInfo, errors)...)
+
 	return nil
 }
 
+// bond来自sysfs的bonding_masters以及/proc/net/bonding下的文件，每个bond单独解析和判断
+func (c *NetworkChecker) checkBonds(bondingStates map[string]map[string]interface{}, basicInfo map[string]interface{}, errors map[string]interface{}) []Verdict {
+	verdicts := []Verdict{}
+	masters := []string{}
+	for master := range bondingStates {
+		masters = append(masters, master)
+	}
+	if entries, err := ioutil.ReadDir(c.bondingPath); err == nil {
+		for _, entry := range entries {
+			if !containsString(masters, entry.Name()) {
+				masters = append(masters, entry.Name())
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		errors["bonding"] = err.Error()
+	}
+	if len(masters) == 0 {
+		return verdicts
+	}
+	sort.Strings(masters)
+	bonds := make(map[string]interface{})
+	bondErrors := make(map[string]interface{})
+	degraded := make(map[string]interface{})
+	for _, master := range masters {
+		bond, err := readProcBonding(c.bondingPath, master)
+		if err != nil {
+			bondErrors[master] = err.Error()
+			continue
+		}
+		reasons := judgeBond(master, bond)
+		bond["degraded"] = len(reasons) > 0
+		bonds[master] = bond
+		if len(reasons) > 0 {
+			degraded[master] = reasons
+			if c.bondingState != Live {
+				verdicts = append(verdicts, Verdict{c.bondingState, fmt.Sprintf("%s is degraded: %s", master, strings.Join(reasons, "; "))})
+			}
+		}
+	}
+	basicInfo["bonding"] = bonds
+	if len(bondErrors) > 0 {
+		errors["bonding"] = bondErrors
+	}
+	if len(degraded) > 0 {
+		errors["bonding.degraded"] = degraded
+	}
+	return verdicts
+}
+
+// 网卡的计数器是累计值，和上一次check()相减得到速率，第一次check()时没有。
+// 只有错误和丢包的速率超过阈值以及MTU不符合期望时产生verdict
+func (c *NetworkChecker) checkIntfs(basicInfo map[string]interface{}, errors map[string]interface{}) []Verdict {
+	verdicts := []Verdict{}
+	names, err := listIntfs(c.statusFilePath, c.intfInclude, c.intfExclude)
+	if err != nil {
+		errors["interfaces"] = err.Error()
+		return verdicts
+	}
+	now := time.Now()
+	elapsed := now.Sub(c.lastIntfTime).Seconds()
+	intfs := make(map[string]interface{})
+	intfErrors := make(map[string]interface{})
+	counters := make(map[string]map[string]uint64)
+	exceeded := []string{}
+	for _, name := range names {
+		info, intfCounters, err := readIntfLink(c.statusFilePath, name)
+		if err != nil {
+			intfErrors[name] = err.Error()
+			continue
+		}
+		intfs[name] = info
+		counters[name] = intfCounters
+		lastCounters, ok := c.lastIntfCounters[name]
+		if !ok || elapsed <= 0 {
+			continue
+		}
+		rates := make(map[string]interface{})
+		for counter, value := range intfCounters {
+			// 网卡重建或者驱动重新加载后计数器会清零
+			if lastValue, ok := lastCounters[counter]; ok && value >= lastValue {
+				if counter == "carrier_changes" {
+					info["carrierChangesSinceLastCheck"] = value - lastValue
+				} else {
+					rates[counter] = float64(value-lastValue) / elapsed
+				}
+			}
+		}
+		info["ratesPerSecond"] = rates
+		for _, threshold := range []struct {
+			name      string
+			counters  []string
+			perSecond float64
+		}{
+			{"errors", []string{"rx_errors", "tx_errors"}, c.intfErrorsRate},
+			{"drops", []string{"rx_dropped", "tx_dropped"}, c.intfDropsRate},
+		} {
+			rate, ok := 0.0, true
+			for _, counter := range threshold.counters {
+				value, exists := rates[counter].(float64)
+				rate, ok = rate+value, ok && exists
+			}
+			if ok && threshold.perSecond > 0 && rate > threshold.perSecond {
+				exceeded = append(exceeded, fmt.Sprintf("%s of %s are %.2f/s, exceeding %g/s", threshold.name, name, rate, threshold.perSecond))
+			}
+		}
+	}
+	c.lastIntfCounters, c.lastIntfTime = counters, now
+	basicInfo["interfaces"] = intfs
+	if len(intfErrors) > 0 {
+		errors["interfaces"] = intfErrors
+	}
+	if len(exceeded) > 0 {
+		errors["interfaces.thresholds"] = exceeded
+		verdicts = append(verdicts, Verdict{c.intfState, strings.Join(exceeded, "; ")})
+	}
+
+	// 精确的名字没有匹配到网卡时也认为不符合期望，通配符没有匹配到时忽略
+	mismatches := make(map[string]interface{})
+	for _, expectation := range c.mtuExpectations {
+		matched := false
+		for _, name := range names {
+			info, ok := intfs[name].(map[string]interface{})
+			if hit, _ := path.Match(expectation.intf, name); !ok || !hit {
+				continue
+			}
+			matched = true
+			if mtu, ok := info["mtu"].(int); ok && mtu != expectation.mtu {
+				reason := fmt.Sprintf("mtu of %s is %d, expected %d", name, mtu, expectation.mtu)
+				mismatches[name] = reason
+				verdicts = append(verdicts, Verdict{expectation.state, reason})
+			}
+		}
+		if !matched && !strings.ContainsAny(expectation.intf, "*?[") {
+			reason := fmt.Sprintf("interface %s with expected mtu %d is not found", expectation.intf, expectation.mtu)
+			mismatches[expectation.intf] = reason
+			verdicts = append(verdicts, Verdict{expectation.state, reason})
+		}
+	}
+	if len(mismatches) > 0 {
+		errors["interfaces.mtu.mismatch"] = mismatches
+	}
+	return verdicts
+}
+
 func (c *NetworkChecker) info() Info {
 	defer c.mutex.RUnlock()
 	c.mutex.RLock()
@@ -140,7 +342,9 @@ func (c *NetworkChecker) info() Info {
 	return Info{
 		name:      c.name,
 		checkTime: c.checkTime,
+		duration:  c.checkDuration,
 		state:     c.checkerState,
+		reason:    c.stateReason,
 		basic:     c.basicInfo,
 		errors:    c.errors,
 	}
@@ -151,6 +355,65 @@ func (c *NetworkChecker) newRouters() Routers {
 	return routers
 }
 
+func (c *NetworkChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	if bondingStates, ok := c.basicInfo["bonding.stats"].(map[string]map[string]interface{}); ok {
+		for master, slaves := range bondingStates {
+			for slave, slaveState := range slaves {
+				slaveStateMap := slaveState.(map[string]string)
+				metrics = append(metrics, newMetric("network_bonding_slave_up", "Whether the bonding slave is up.", boolToFloat(slaveStateMap["state"] == "up"), "master", master, "slave", slave))
+				if speed, ok := toFloat(slaveStateMap["speed"]); ok {
+					metrics = append(metrics, newMetric("network_bonding_slave_speed_mbps", "Speed of the bonding slave.", speed, "master", master, "slave", slave))
+				}
+			}
+		}
+	}
+	bonds, _ := c.basicInfo["bonding"].(map[string]interface{})
+	for master, bond := range bonds {
+		bondMap := bond.(map[string]interface{})
+		metrics = append(metrics, newMetric("network_bonding_degraded", "Whether the bond is degraded.", boolToFloat(bondMap["degraded"] == true), "master", master))
+		if aggregator, ok := bondMap["activeAggregator"].(map[string]interface{}); ok {
+			if ports, ok := toFloat(aggregator["numberOfPorts"]); ok {
+				metrics = append(metrics, newMetric("network_bonding_aggregator_ports", "Number of ports in the active 802.3ad aggregator of the bond.", ports, "master", master))
+			}
+		}
+		slaves, _ := bondMap["slaves"].(map[string]interface{})
+		for slave, slaveInfo := range slaves {
+			if failures, ok := toFloat(slaveInfo.(map[string]interface{})["linkFailureCount"]); ok {
+				metrics = append(metrics, newMetric("network_bonding_slave_link_failures", "Link failure count of the bonding slave.", failures, "master", master, "slave", slave))
+			}
+		}
+	}
+	intfs, _ := c.basicInfo["interfaces"].(map[string]interface{})
+	for name, intf := range intfs {
+		info := intf.(map[string]interface{})
+		metrics = append(metrics, newMetric("network_interface_up", "Whether the operstate of the interface is up.", boolToFloat(info["operstate"] == "up"), "interface", name))
+		if carrier, ok := info["carrier"].(bool); ok {
+			metrics = append(metrics, newMetric("network_interface_carrier", "Whether the interface has carrier.", boolToFloat(carrier), "interface", name))
+		}
+		if changes, ok := toFloat(info["carrierChanges"]); ok {
+			metrics = append(metrics, newCounter("network_interface_carrier_changes", "Number of carrier changes of the interface.", changes, "interface", name))
+		}
+		if mtu, ok := toFloat(info["mtu"]); ok {
+			metrics = append(metrics, newMetric("network_interface_mtu", "MTU of the interface.", mtu, "interface", name))
+		}
+		if speed, ok := toFloat(info["speedMbps"]); ok {
+			metrics = append(metrics, newMetric("network_interface_speed_mbps", "Speed of the interface.", speed, "interface", name))
+		}
+		rates, _ := info["ratesPerSecond"].(map[string]interface{})
+		for counter, rate := range rates {
+			// rx_bytes -> network_interface_bytes_per_second{direction="rx"}
+			fields := strings.SplitN(counter, "_", 2)
+			metricName := map[string]string{"bytes": "bytes", "packets": "packets", "errors": "errors", "dropped": "drops"}[fields[1]]
+			metrics = append(metrics, newMetric("network_interface_"+metricName+"_per_second", "Rate of the interface counter between the last two checks.", rate.(float64), "interface", name, "direction", fields[0]))
+		}
+	}
+	metrics = append(metrics, kernelParameterMetrics(c.name, c.basicInfo["kernel.runtime.parameters"])...)
+	return metrics
+}
+
 func NewNetworkChecker() *NetworkChecker {
 	return &NetworkChecker{}
 }
@@ -193,6 +456,7 @@ func getResolv(resolvConfPath string) (string, map[string]interface{}, error) {
 	resolv_str := string(resolv_data)
 	nameservers := []string{}
 	searchs := []string{}
+	options := []string{}
 	for _, line := range strings.Split(resolv_str, "\n") {
 		segs := strings.Fields(line)
 		if len(segs) < 2 {
@@ -205,42 +469,55 @@ func getResolv(resolvConfPath string) (string, map[string]interface{}, error) {
 			for _, search := range segs[1:] {
 				searchs = append(searchs, search)
 			}
+		case "options":
+			options = append(options, segs[1:]...)
 		}
 	}
 
-	return resolv_str, map[string]interface{}{"nameservers": nameservers, "searchs": searchs}, nil
+	return resolv_str, map[string]interface{}{"nameservers": nameservers, "searchs": searchs, "options": options}, nil
 }
 
 // github.com/prometheus/node_exporter/collector/bonding_linux.go
-func readBondingStats(root string) (status map[string]map[string]interface{}, err error) {
+// 某个bond或slave的文件读取失败时只跳过对应的值，错误的key为文件相对root的路径；没有加载bonding模块时没有bond
+func readBondingStats(root string) (status map[string]map[string]interface{}, errs map[string]interface{}, err error) {
 	status = map[string]map[string]interface{}{}
+	errs = map[string]interface{}{}
 	masters, err := ioutil.ReadFile(path.Join(root, "bonding_masters"))
 	if err != nil {
-		return nil, err
+		if os.IsNotExist(err) {
+			return status, errs, nil
+		}
+		return nil, nil, err
 	}
 	for _, master := range strings.Fields(string(masters)) {
 		slaves, err := ioutil.ReadFile(path.Join(root, master, "bonding", "slaves"))
 		if err != nil {
-			return nil, err
+			errs[path.Join(master, "bonding", "slaves")] = err.Error()
+			continue
 		}
 		sstat := map[string]interface{}{}
 		for _, slave := range strings.Fields(string(slaves)) {
-			state, err := ioutil.ReadFile(path.Join(root, master, fmt.Sprintf("lower_%s", slave), "operstate"))
-			if err != nil {
-				return nil, err
-			}
-			speed, err := ioutil.ReadFile(path.Join(root, master, fmt.Sprintf("lower_%s", slave), "speed"))
-			if err != nil {
-				return nil, err
-			}
-			sstat[slave] = map[string]string{
-				"state": strings.TrimSpace(string(state)),
-				"speed": strings.TrimSpace(string(speed)),
+			slaveStat := map[string]string{}
+			for _, field := range []struct{ file, key string }{{"operstate", "state"}, {"speed", "speed"}} {
+				// 旧的内核没有lower_<slave>链接
+				value, err := ioutil.ReadFile(path.Join(root, master, fmt.Sprintf("lower_%s", slave), field.file))
+				if os.IsNotExist(err) {
+					value, err = ioutil.ReadFile(path.Join(root, slave, field.file))
+				}
+				switch {
+				case err == nil:
+					slaveStat[field.key] = strings.TrimSpace(string(value))
+				// slave down时读取speed返回EINVAL
+				case field.file == "speed" && slaveStat["state"] != "up":
+				default:
+					errs[path.Join(master, fmt.Sprintf("lower_%s", slave), field.file)] = err.Error()
+				}
 			}
+			sstat[slave] = slaveStat
 		}
 		status[master] = sstat
 	}
-	return status, err
+	return status, errs, nil
 }
 
 func readIntfs(netRoutePath string) (map[string]interface{}, error) {
@@ -18,15 +18,23 @@ import (
 
 func init() {
 	registerChecker("os", NewOSChecker())
+	registerConfigSchema("os",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"kernel.parameters", []string{}, "concerned kernel runtime parameters, e.g. vm.max_map_count"},
+		ConfigItem{"units", []string{}, "concerned systemd units, e.g. docker.service"},
+		rulesConfigItem,
+	)
 }
 
 type OSChecker struct {
 	name             string
-	ticker           *time.Ticker
 	mutex            sync.RWMutex
 	stopCh           chan struct{}
 	checkerState     State
+	stateReason      string
+	rules            []*Rule
 	checkTime        time.Time
+	checkDuration    time.Duration
 	checkInterval    time.Duration
 	basicInfo        map[string]interface{}
 	errors           map[string]interface{}
@@ -37,28 +45,34 @@ type OSChecker struct {
 }
 
 func (c *OSChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
 	c.name = "os"
 	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
 	c.basicInfo = make(map[string]interface{})
 	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
 	c.procPath = daemonConfig.proc_path
 	c.kernelParameters = daemonConfig.getOrDefault(c.name, "kernel.parameters", []string{}).([]string)
 	c.dbusAddress = daemonConfig.dbus_address
 	c.units = daemonConfig.getOrDefault(c.name, "units", []string{}).([]string)
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
 	return c.check()
 }
 
 func (c *OSChecker) state() (State, string) {
-	return c.checkerState, ""
+	return c.checkerState, c.stateReason
 }
 
 func (c *OSChecker) start() {
-	c.ticker = time.NewTicker(c.checkInterval)
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
 	for {
 		select {
-		case <-c.ticker.C:
-			go c.check()
-		case <-c.stopCh:
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
 			return
 		}
 	}
@@ -69,6 +83,7 @@ func (c *OSChecker) stop() {
 }
 
 func (c *OSChecker) check() error {
+	startTime := time.Now()
 	basicInfo := make(map[string]interface{})
 	errors := make(map[string]interface{})
 	defer func() {
@@ -77,7 +92,8 @@ func (c *OSChecker) check() error {
 		c.basicInfo = basicInfo
 		c.errors = errors
 		c.checkTime = time.Now()
-		c.checkerState = Live
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors)
 	}()
 
 	defer func() {
@@ -128,7 +144,9 @@ func (c *OSChecker) info() Info {
 	return Info{
 		name:      c.name,
 		checkTime: c.checkTime,
+		duration:  c.checkDuration,
 		state:     c.checkerState,
+		reason:    c.stateReason,
 		basic:     c.basicInfo,
 		errors:    c.errors,
 	}
@@ -139,6 +157,35 @@ func (c *OSChecker) newRouters() Routers {
 	return routers
 }
 
+func (c *OSChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	if loads, ok := c.basicInfo["loads"].([]float64); ok {
+		for i, period := range []string{"1m", "5m", "15m"} {
+			metrics = append(metrics, newMetric("os_load", "Load average.", loads[i], "period", period))
+		}
+	}
+	if stats, ok := c.basicInfo["stats"].(map[string]interface{}); ok {
+		for name, value := range stats {
+			metrics = append(metrics, newMetric("os_stat", "Statistics from /proc/stat.", value.(float64), "stat", name))
+		}
+	}
+	if unitsStatus, ok := c.basicInfo["units"].(map[string]interface{}); ok {
+		for unitName, unitStatus := range unitsStatus {
+			activeState := ""
+			if unitStatusMap, ok := unitStatus.(map[string]interface{}); ok {
+				activeState, _ = unitStatusMap["activeState"].(string)
+			}
+			for _, state := range unitActiveStates {
+				metrics = append(metrics, newMetric("os_unit_state", "Active state of the concerned systemd unit.", boolToFloat(activeState == state), "unit", unitName, "state", state))
+			}
+		}
+	}
+	metrics = append(metrics, kernelParameterMetrics(c.name, c.basicInfo["kernel.runtime.parameters"])...)
+	return metrics
+}
+
 func NewOSChecker() *OSChecker {
 	return &OSChecker{}
 }
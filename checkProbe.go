@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeTCP       = "tcp"
+	probeHTTP      = "http"
+	probeZookeeper = "zookeeper"
+)
+
+// 延迟直方图的上界，单位为秒
+var probeLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 只读取响应的前64KB用于匹配
+const maxProbeBodySize = 64 << 10
+
+func init() {
+	registerChecker("probe", NewProbeChecker())
+	registerConfigSchema("probe",
+		ConfigItem{"checkInterval", time.Second * 30, "interval between checks"},
+		ConfigItem{"timeout", time.Second * 5, "default timeout of a target"},
+		ConfigItem{"targets", []interface{}{}, "targets to probe, see docs/checkers.md"},
+		rulesConfigItem,
+	)
+}
+
+type probeTarget struct {
+	name               string
+	probeType          string
+	address            string
+	url                string
+	timeout            time.Duration
+	expectedStatus     int
+	bodyRegexp         *regexp.Regexp
+	insecureSkipVerify bool
+	command            string
+	state              State
+}
+
+// 自initialize()以来的累计值，buckets与probeLatencyBuckets一一对应，不含失败的探测
+type probeHistogram struct {
+	buckets  []uint64
+	count    uint64
+	sum      float64
+	failures uint64
+}
+
+type ProbeChecker struct {
+	name          string
+	mutex         sync.RWMutex
+	stopCh        chan struct{}
+	checkerState  State
+	stateReason   string
+	rules         []*Rule
+	checkTime     time.Time
+	checkDuration time.Duration
+	checkInterval time.Duration
+	basicInfo     map[string]interface{}
+	errors        map[string]interface{}
+	targets       []probeTarget
+	histograms    map[string]*probeHistogram
+}
+
+func (c *ProbeChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.name = "probe"
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.basicInfo = make(map[string]interface{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*30).(time.Duration)
+	timeout := daemonConfig.getOrDefault(c.name, "timeout", time.Second*5).(time.Duration)
+	if c.targets, err = parseProbeTargets(daemonConfig.getOrDefault(c.name, "targets", []interface{}{}).([]interface{}), timeout); err != nil {
+		return fmt.Errorf("invalid targets of checker %s: %s", c.name, err)
+	}
+	c.mutex.Lock()
+	c.histograms = make(map[string]*probeHistogram)
+	for _, target := range c.targets {
+		c.histograms[target.name] = &probeHistogram{buckets: make([]uint64, len(probeLatencyBuckets))}
+	}
+	c.mutex.Unlock()
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *ProbeChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *ProbeChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *ProbeChecker) stop() {
+	close(c.stopCh)
+}
+
+type probeResult struct {
+	latency time.Duration
+	info    map[string]interface{}
+	err     error
+}
+
+// 所有目标并发探测，耗时取决于最慢的目标
+func (c *ProbeChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	results := make([]probeResult, len(c.targets))
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, target := range c.targets {
+		wg.Add(1)
+		go func(i int, target probeTarget) {
+			defer wg.Done()
+			results[i] = probe(target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	targets := make(map[string]interface{})
+	for i, target := range c.targets {
+		result := results[i]
+		info := result.info
+		info["type"] = target.probeType
+		info["up"] = result.err == nil
+		if target.probeType == probeHTTP {
+			info["url"] = target.url
+		} else {
+			info["address"] = target.address
+		}
+		if result.err != nil {
+			errors[target.name] = result.err.Error()
+			if target.state != Live {
+				verdicts = append(verdicts, Verdict{target.state, fmt.Sprintf("probe %s failed: %s", target.name, result.err)})
+			}
+		} else {
+			info["latencyMilliseconds"] = float64(result.latency) / float64(time.Millisecond)
+		}
+		targets[target.name] = info
+	}
+	basicInfo["targets"] = targets
+
+	c.mutex.Lock()
+	for i, target := range c.targets {
+		c.histograms[target.name].observe(results[i])
+	}
+	c.mutex.Unlock()
+	return nil
+}
+
+func (h *probeHistogram) observe(result probeResult) {
+	if result.err != nil {
+		h.failures++
+		return
+	}
+	seconds := result.latency.Seconds()
+	h.count++
+	h.sum += seconds
+	for i, bound := range probeLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+}
+
+// 与prometheus的直方图一样，每个bucket的计数是累计的，le为上界
+func (h *probeHistogram) toMap() map[string]interface{} {
+	buckets := []interface{}{}
+	for i, bound := range probeLatencyBuckets {
+		buckets = append(buckets, map[string]interface{}{"le": strconv.FormatFloat(bound, 'g', -1, 64), "count": h.buckets[i]})
+	}
+	buckets = append(buckets, map[string]interface{}{"le": "+Inf", "count": h.count})
+	return map[string]interface{}{
+		"buckets":    buckets,
+		"count":      h.count,
+		"sumSeconds": h.sum,
+		"failures":   h.failures,
+	}
+}
+
+func (c *ProbeChecker) info() Info {
+	defer c.mutex.RUnlock()
+	c.mutex.RLock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *ProbeChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	targets, _ := c.basicInfo["targets"].(map[string]interface{})
+	for name, target := range targets {
+		targetInfo := target.(map[string]interface{})
+		probeType := targetInfo["type"].(string)
+		up, _ := targetInfo["up"].(bool)
+		metrics = append(metrics, newMetric("probe_up", "Whether the probe of the target succeeded.", boolToFloat(up), "target", name, "type", probeType))
+		if latency, ok := targetInfo["latencyMilliseconds"].(float64); ok {
+			metrics = append(metrics, newMetric("probe_latency_seconds", "Latency of the last successful probe of the target.", latency/1000, "target", name, "type", probeType))
+		}
+	}
+	return metrics
+}
+
+func (c *ProbeChecker) newRouters() Routers {
+	routers := make(Routers)
+	routers["detail"] = func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		histograms := make(map[string]interface{})
+		for name, histogram := range c.histograms {
+			histograms[name] = histogram.toMap()
+		}
+
+		formatWrite(map[string]interface{}{"latency": histograms}, w, r)
+	}
+	return routers
+}
+
+func NewProbeChecker() *ProbeChecker {
+	return &ProbeChecker{}
+}
+
+func parseProbeTargets(items []interface{}, defaultTimeout time.Duration) ([]probeTarget, error) {
+	targets := []probeTarget{}
+	names := make(map[string]bool)
+	for i, item := range items {
+		itemMap, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("target %d should be a map", i)
+		}
+		target := probeTarget{timeout: defaultTimeout, expectedStatus: http.StatusOK, command: "ruok", state: Error}
+		target.name, _ = itemMap["name"].(string)
+		if target.name == "" {
+			return nil, fmt.Errorf("name of target %d is required", i)
+		}
+		if names[target.name] {
+			return nil, fmt.Errorf("duplicated target %s", target.name)
+		}
+		names[target.name] = true
+		target.probeType, _ = itemMap["type"].(string)
+		switch target.probeType {
+		case probeTCP, probeZookeeper:
+			target.address, _ = itemMap["address"].(string)
+			if _, _, err := net.SplitHostPort(target.address); err != nil {
+				return nil, fmt.Errorf("address of target %s should be host:port: %s", target.name, err)
+			}
+		case probeHTTP:
+			target.url, _ = itemMap["url"].(string)
+			if !strings.HasPrefix(target.url, "http://") && !strings.HasPrefix(target.url, "https://") {
+				return nil, fmt.Errorf("url of target %s should start with http:// or https://, got '%s'", target.name, target.url)
+			}
+		default:
+			return nil, fmt.Errorf("type of target %s should be %s, %s or %s, got '%s'", target.name, probeTCP, probeHTTP, probeZookeeper, target.probeType)
+		}
+		if value, ok := itemMap["timeout"]; ok {
+			timeout, err := time.ParseDuration(fmt.Sprint(value))
+			if err != nil {
+				return nil, fmt.Errorf("timeout of target %s: %s", target.name, err)
+			}
+			target.timeout = timeout
+		}
+		if value, ok := itemMap["expectedStatus"]; ok {
+			if target.expectedStatus, ok = value.(int); !ok {
+				return nil, fmt.Errorf("expectedStatus of target %s should be an integer, got %v", target.name, value)
+			}
+		}
+		if value, ok := itemMap["bodyRegex"].(string); ok {
+			var err error
+			if target.bodyRegexp, err = regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("bodyRegex of target %s: %s", target.name, err)
+			}
+		}
+		target.insecureSkipVerify, _ = itemMap["insecureSkipVerify"].(bool)
+		if command, ok := itemMap["command"].(string); ok {
+			target.command = command
+		}
+		if target.command != "ruok" && target.command != "mntr" {
+			return nil, fmt.Errorf("command of target %s should be ruok or mntr, got '%s'", target.name, target.command)
+		}
+		if state, ok := itemMap["state"].(string); ok {
+			target.state = State(state)
+		}
+		if err := checkAllowed(string(target.state), stateValues); err != nil {
+			return nil, fmt.Errorf("state of target %s %s", target.name, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// 探测失败时info中也可能有部分结果，例如http的状态码
+func probe(target probeTarget) probeResult {
+	result := probeResult{info: make(map[string]interface{})}
+	start := time.Now()
+	switch target.probeType {
+	case probeTCP:
+		result.err = probeTCPConnect(target)
+	case probeHTTP:
+		result.err = probeHTTPGet(target, result.info)
+	case probeZookeeper:
+		result.err = probeZookeeperCommand(target, result.info)
+	}
+	result.latency = time.Since(start)
+	return result
+}
+
+func probeTCPConnect(target probeTarget) error {
+	conn, err := net.DialTimeout("tcp", target.address, target.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeHTTPGet(target probeTarget, info map[string]interface{}) error {
+	client := &http.Client{
+		Timeout: target.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: target.insecureSkipVerify},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(target.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	info["status"] = resp.StatusCode
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeBodySize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != target.expectedStatus {
+		return fmt.Errorf("unexpected status %s, expected %d", resp.Status, target.expectedStatus)
+	}
+	if target.bodyRegexp != nil && !target.bodyRegexp.Match(body) {
+		return fmt.Errorf("body does not match '%s'", target.bodyRegexp)
+	}
+	return nil
+}
+
+// 四字命令，服务端回复后关闭连接。3.5以后的版本需要在4lw.commands.whitelist中允许该命令，
+// 否则回复"ruok is not executed because it is not in the whitelist."
+func probeZookeeperCommand(target probeTarget, info map[string]interface{}) error {
+	conn, err := net.DialTimeout("tcp", target.address, target.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(target.timeout))
+	if _, err := conn.Write([]byte(target.command)); err != nil {
+		return err
+	}
+	response, err := ioutil.ReadAll(io.LimitReader(conn, maxProbeBodySize))
+	if err != nil {
+		return err
+	}
+	switch target.command {
+	case "ruok":
+		if string(response) != "imok" {
+			return fmt.Errorf("unexpected response to ruok: %s", strings.TrimSpace(string(response)))
+		}
+	case "mntr":
+		// 每行为tab分隔的key和value，例如zk_server_state	leader
+		stats := make(map[string]interface{})
+		scanner := bufio.NewScanner(strings.NewReader(string(response)))
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), "\t", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				stats[fields[0]] = value
+			} else {
+				stats[fields[0]] = fields[1]
+			}
+		}
+		if _, ok := stats["zk_server_state"]; !ok {
+			return fmt.Errorf("unexpected response to mntr: %s", strings.TrimSpace(string(response)))
+		}
+		info["mntr"] = stats
+	}
+	return nil
+}
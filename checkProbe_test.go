@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 模拟zookeeper的四字命令，回复之后关闭连接，未知的命令等待1秒后不回复直接关闭
+func newTestZookeeper(t *testing.T, responses map[string]string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				command := make([]byte, 4)
+				if _, err := io.ReadFull(conn, command); err != nil {
+					conn.Close()
+					return
+				}
+				response, ok := responses[string(command)]
+				if !ok {
+					time.Sleep(time.Second)
+				}
+				conn.Write([]byte(response))
+				conn.Close()
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestProbeZookeeper(t *testing.T) {
+	listener := newTestZookeeper(t, map[string]string{
+		"ruok": "imok",
+		"mntr": "zk_version\t3.5.9-83df9301aa5c2a5d284a9940177808c01bc35cef, built on 01/06/2021 20:03 GMT\nzk_avg_latency\t0\nzk_server_state\tfollower\nzk_znode_count\t42\nmalformed\n",
+	})
+	defer listener.Close()
+	address := listener.Addr().String()
+
+	info := make(map[string]interface{})
+	if err := probeZookeeperCommand(probeTarget{address: address, command: "ruok", timeout: time.Second}, info); err != nil || len(info) != 0 {
+		t.Errorf("expected ruok to pass, got %v %v", info, err)
+	}
+	if err := probeZookeeperCommand(probeTarget{address: address, command: "mntr", timeout: time.Second}, info); err != nil {
+		t.Fatal(err)
+	}
+	stats := info["mntr"].(map[string]interface{})
+	if stats["zk_server_state"] != "follower" || stats["zk_znode_count"] != float64(42) || stats["zk_avg_latency"] != float64(0) || len(stats) != 4 {
+		t.Errorf("unexpected mntr stats %v", stats)
+	}
+	if !strings.HasPrefix(stats["zk_version"].(string), "3.5.9-") {
+		t.Errorf("unexpected version %v", stats["zk_version"])
+	}
+
+	// 命令不在白名单中
+	listener2 := newTestZookeeper(t, map[string]string{
+		"ruok": "ruok is not executed because it is not in the whitelist.\n",
+		"mntr": "mntr is not executed because it is not in the whitelist.\n",
+	})
+	defer listener2.Close()
+	for _, test := range []struct {
+		command string
+		err     string
+	}{
+		{"ruok", "unexpected response to ruok: ruok is not executed because it is not in the whitelist."},
+		{"mntr", "unexpected response to mntr: mntr is not executed because it is not in the whitelist."},
+	} {
+		err := probeZookeeperCommand(probeTarget{address: listener2.Addr().String(), command: test.command, timeout: time.Second}, make(map[string]interface{}))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected %s, got %v", test.command, test.err, err)
+		}
+	}
+
+	// 没有回复时在timeout之后返回
+	listener3 := newTestZookeeper(t, map[string]string{})
+	defer listener3.Close()
+	startTime := time.Now()
+	err := probeZookeeperCommand(probeTarget{address: listener3.Addr().String(), command: "ruok", timeout: time.Millisecond * 100}, make(map[string]interface{}))
+	if elapsed := time.Since(startTime); err == nil || elapsed > time.Millisecond*900 {
+		t.Errorf("expected a timeout after 100ms, got %v after %s", err, elapsed)
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, `{"status":"UP"}`)
+		case "/slow":
+			time.Sleep(time.Millisecond * 500)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	for _, test := range []struct {
+		target probeTarget
+		status interface{}
+		err    string
+	}{
+		{probeTarget{url: server.URL + "/health", expectedStatus: 200, bodyRegexp: regexp.MustCompile(`"status":"UP"`)}, 200, ""},
+		{probeTarget{url: server.URL + "/health", expectedStatus: 200, bodyRegexp: regexp.MustCompile(`"status":"DOWN"`)}, 200, `body does not match '"status":"DOWN"'`},
+		{probeTarget{url: server.URL + "/missing", expectedStatus: 200}, 404, "unexpected status 404 Not Found, expected 200"},
+		{probeTarget{url: server.URL + "/missing", expectedStatus: 404}, 404, ""},
+		{probeTarget{url: tlsServer.URL + "/health", expectedStatus: 200, insecureSkipVerify: true}, 200, ""},
+		{probeTarget{url: tlsServer.URL + "/health", expectedStatus: 200}, nil, "certificate"},
+		{probeTarget{url: server.URL + "/slow", expectedStatus: 200, timeout: time.Millisecond * 100}, nil, "Client.Timeout exceeded"},
+	} {
+		if test.target.timeout == 0 {
+			test.target.timeout = time.Second
+		}
+		info := make(map[string]interface{})
+		err := probeHTTPGet(test.target, info)
+		if info["status"] != test.status {
+			t.Errorf("%s: expected status %v, got %v", test.target.url, test.status, info["status"])
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.target.url, test.err, err)
+		}
+	}
+}
+
+func TestProbeCheck(t *testing.T) {
+	listener := newTestZookeeper(t, map[string]string{"ruok": "imok"})
+	defer listener.Close()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	checker := NewProbeChecker()
+	err := checker.initialize(&DaemonConfig{customConfigs: map[string]map[string]interface{}{
+		"probe": {"targets": []interface{}{
+			map[interface{}]interface{}{"name": "zk", "type": "zookeeper", "address": listener.Addr().String()},
+			map[interface{}]interface{}{"name": "web", "type": "http", "url": server.URL, "state": "Fatal"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := checker.info()
+	if info.state != Fatal || info.reason != "probe web failed: unexpected status 404 Not Found, expected 200" {
+		t.Errorf("unexpected state %s %s", info.state, info.reason)
+	}
+	targets := info.basic["targets"].(map[string]interface{})
+	if zk := targets["zk"].(map[string]interface{}); zk["up"] != true || zk["address"] != listener.Addr().String() {
+		t.Errorf("unexpected zk info %v", zk)
+	}
+	if web := targets["web"].(map[string]interface{}); web["up"] != false || web["status"] != 404 || web["url"] != server.URL {
+		t.Errorf("unexpected web info %v", web)
+	}
+
+	output := string(writeMetrics(checker.metrics()))
+	for _, line := range []string{
+		`node_guard_probe_up{target="zk",type="zookeeper"} 1`,
+		`node_guard_probe_up{target="web",type="http"} 0`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, `node_guard_probe_latency_seconds{target="web"`) {
+		t.Errorf("failed probes should have no latency:\n%s", output)
+	}
+	if histogram := checker.histograms["web"]; histogram.failures != 1 || histogram.count != 0 {
+		t.Errorf("unexpected histogram of web %+v", histogram)
+	}
+	if histogram := checker.histograms["zk"]; histogram.failures != 0 || histogram.count != 1 || histogram.buckets[len(probeLatencyBuckets)-1] != 1 {
+		t.Errorf("unexpected histogram of zk %+v", histogram)
+	}
+}
+
+func TestParseProbeTargets(t *testing.T) {
+	targets, err := parseProbeTargets([]interface{}{
+		map[interface{}]interface{}{"name": "zk", "type": "zookeeper", "address": "127.0.0.1:2181", "command": "mntr", "timeout": "2s"},
+		map[interface{}]interface{}{"name": "web", "type": "http", "url": "https://127.0.0.1/health", "expectedStatus": 204, "state": "Live"},
+	}, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets[0].command != "mntr" || targets[0].timeout != time.Second*2 || targets[0].state != Error {
+		t.Errorf("unexpected target %+v", targets[0])
+	}
+	if targets[1].expectedStatus != 204 || targets[1].timeout != time.Second*5 || targets[1].state != Live {
+		t.Errorf("unexpected target %+v", targets[1])
+	}
+
+	for _, item := range []map[interface{}]interface{}{
+		{"type": "tcp", "address": "127.0.0.1:22"},
+		{"name": "zk", "type": "zookeeper", "address": "127.0.0.1"},
+		{"name": "zk", "type": "zookeeper", "address": "127.0.0.1:2181", "command": "stat"},
+		{"name": "web", "type": "http", "url": "127.0.0.1/health"},
+		{"name": "web", "type": "http", "url": "http://127.0.0.1", "expectedStatus": "200"},
+		{"name": "web", "type": "http", "url": "http://127.0.0.1", "bodyRegex": "("},
+		{"name": "udp", "type": "udp", "address": "127.0.0.1:53"},
+		{"name": "ssh", "type": "tcp", "address": "127.0.0.1:22", "state": "Down"},
+	} {
+		if _, err := parseProbeTargets([]interface{}{item}, time.Second); err == nil {
+			t.Errorf("parseProbeTargets(%v): expected an error", item)
+		}
+	}
+	duplicated := map[interface{}]interface{}{"name": "ssh", "type": "tcp", "address": "127.0.0.1:22"}
+	if _, err := parseProbeTargets([]interface{}{duplicated, duplicated}, time.Second); err == nil || err.Error() != "duplicated target ssh" {
+		t.Errorf("expected the duplicated target error, got %v", err)
+	}
+}
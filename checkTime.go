@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// 参考 linux/timex.h
+const (
+	adjtimexStaUnsync = 0x0040
+	adjtimexStaNano   = 0x2000
+	adjtimexTimeError = 5
+	// 1900-01-01到1970-01-01的秒数
+	ntpEpochOffset = 2208988800
+	// kubelet每隔leaseDuration/4(缺省10s)在该namespace中续约与节点同名的lease
+	nodeLeaseNamespace = "kube-node-lease"
+)
+
+func init() {
+	registerChecker("time", NewTimeChecker())
+	registerConfigSchema("time",
+		ConfigItem{"checkInterval", time.Second * 60, "interval between checks"},
+		ConfigItem{"chrony.drift.path", "{mount_point}/var/lib/chrony/drift", "path of the chrony drift file, ignored if not present"},
+		ConfigItem{"ntpd.drift.path", "{mount_point}/var/lib/ntp/drift", "path of the ntpd drift file, ignored if not present"},
+		ConfigItem{"ntp.server", "", "ntp server to query, e.g. ntp.example.com:123, empty to disable"},
+		ConfigItem{"ntp.timeout", time.Second * 5, "timeout of the ntp query"},
+		ConfigItem{"peers.enable", false, "whether to compare with the renew time of the node leases of other kubernetes nodes"},
+		ConfigItem{"peers.kubeconfig", "", "kubeconfig allowed to list and watch leases in kube-node-lease, required if peers.enable is true since the credential of kubelet can only get the lease of its own node"},
+		ConfigItem{"peers.window", time.Minute, "lease renewals observed within the window are used to estimate the offsets of nodes"},
+		ConfigItem{"peers.margin", time.Second, "tolerance for the delay between a node renewing its lease and the update arriving via watch"},
+		ConfigItem{"skew.error", time.Second * 5, "state is Error if the clock skew exceeds it"},
+		ConfigItem{"skew.fatal", time.Minute * 4, "state is Fatal if the clock skew exceeds it, kerberos allows 5m by default"},
+		ConfigItem{"unsynchronized.state", oneOf("Error", stateValues...), "state when the kernel clock is not synchronized, Error, Fatal, or Live to ignore"},
+		rulesConfigItem,
+	)
+}
+
+type TimeChecker struct {
+	name                string
+	mutex               sync.RWMutex
+	stopCh              chan struct{}
+	checkerState        State
+	stateReason         string
+	rules               []*Rule
+	checkTime           time.Time
+	checkDuration       time.Duration
+	checkInterval       time.Duration
+	basicInfo           map[string]interface{}
+	errors              map[string]interface{}
+	chronyDriftPath     string
+	ntpdDriftPath       string
+	ntpServer           string
+	ntpTimeout          time.Duration
+	peersWindow         time.Duration
+	peersMargin         time.Duration
+	leaseInformer       cache.SharedIndexInformer
+	leaseMutex          sync.Mutex
+	leaseSamples        map[string][]leaseSample
+	leaseWatchError     string
+	skewError           time.Duration
+	skewFatal           time.Duration
+	unsynchronizedState State
+}
+
+// 本地收到lease更新的时间，以及续约时间(对端的时钟)减去收到的时间；
+// 更新到达总有延迟，所以差值只会比真实的偏差小，取窗口内的最大值作为该节点的偏差
+type leaseSample struct {
+	observed      time.Time
+	renewTime     time.Time
+	offsetSeconds float64
+}
+
+func (c *TimeChecker) initialize(daemonConfig *DaemonConfig) error {
+	var err error
+	c.name = "time"
+	c.checkerState = Unitialized
+	c.stopCh = make(chan struct{})
+	c.basicInfo = make(map[string]interface{})
+	c.checkInterval = daemonConfig.getOrDefault(c.name, "checkInterval", time.Second*60).(time.Duration)
+	c.chronyDriftPath = daemonConfig.getOrDefault(c.name, "chrony.drift.path", path.Join(daemonConfig.mount_point, "/var/lib/chrony/drift")).(string)
+	c.ntpdDriftPath = daemonConfig.getOrDefault(c.name, "ntpd.drift.path", path.Join(daemonConfig.mount_point, "/var/lib/ntp/drift")).(string)
+	c.ntpServer = daemonConfig.getOrDefault(c.name, "ntp.server", "").(string)
+	c.ntpTimeout = daemonConfig.getOrDefault(c.name, "ntp.timeout", time.Second*5).(time.Duration)
+	c.peersWindow = daemonConfig.getOrDefault(c.name, "peers.window", time.Minute).(time.Duration)
+	c.peersMargin = daemonConfig.getOrDefault(c.name, "peers.margin", time.Second).(time.Duration)
+	c.skewError = daemonConfig.getOrDefault(c.name, "skew.error", time.Second*5).(time.Duration)
+	c.skewFatal = daemonConfig.getOrDefault(c.name, "skew.fatal", time.Minute*4).(time.Duration)
+	c.unsynchronizedState = State(daemonConfig.getOrDefault(c.name, "unsynchronized.state", "Error").(string))
+	c.leaseInformer = nil
+	c.leaseSamples = make(map[string][]leaseSample)
+	c.leaseWatchError = ""
+	if c.rules, err = loadRules(daemonConfig, c.name); err != nil {
+		return err
+	}
+	// informer随stopCh停止，所有可能失败的初始化都要在它之前完成，否则失败后重新初始化时旧的informer不会停止
+	if daemonConfig.getOrDefault(c.name, "peers.enable", false).(bool) {
+		kubeconfig := daemonConfig.getOrDefault(c.name, "peers.kubeconfig", "").(string)
+		if kubeconfig == "" {
+			return fmt.Errorf("peers.kubeconfig of checker %s is required when peers.enable is true", c.name)
+		}
+		clientConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return err
+		}
+		clientset, err := kubernetes.NewForConfig(clientConfig)
+		if err != nil {
+			return err
+		}
+		c.startLeaseInformer(clientset)
+	}
+	return c.check()
+}
+
+func (c *TimeChecker) state() (State, string) {
+	return c.checkerState, c.stateReason
+}
+
+func (c *TimeChecker) start() {
+	ticker, stopCh := time.NewTicker(c.checkInterval), c.stopCh
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			runCheck(c)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *TimeChecker) stop() {
+	close(c.stopCh)
+}
+
+func (c *TimeChecker) check() error {
+	startTime := time.Now()
+	basicInfo := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	verdicts := []Verdict{}
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.basicInfo = basicInfo
+		c.errors = errors
+		c.checkTime = time.Now()
+		c.checkDuration = c.checkTime.Sub(startTime)
+		c.checkerState, c.stateReason = evaluateRules(c.rules, basicInfo, errors, verdicts...)
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Error Catched: %s", r))
+		}
+	}()
+
+	kernel, err := getKernelClock()
+	if err != nil {
+		errors["kernel"] = err
+	} else {
+		basicInfo["kernel"] = kernel
+		if !kernel["synchronized"].(bool) && c.unsynchronizedState != Live {
+			verdicts = append(verdicts, Verdict{c.unsynchronizedState, "kernel clock is not synchronized"})
+		}
+		verdicts = append(verdicts, c.skewVerdict("kernel", kernel["offsetSeconds"].(float64), 0)...)
+	}
+
+	for name, driftPath := range map[string]string{"chrony": c.chronyDriftPath, "ntpd": c.ntpdDriftPath} {
+		drift, err := readDriftFile(driftPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			errors[name] = err
+		} else {
+			basicInfo[name] = drift
+		}
+	}
+
+	if c.ntpServer != "" {
+		ntp, err := querySNTP(c.ntpServer, c.ntpTimeout)
+		if err != nil {
+			errors["ntp"] = err.Error()
+		} else {
+			basicInfo["ntp"] = ntp
+			verdicts = append(verdicts, c.skewVerdict("ntp server "+c.ntpServer, ntp["offsetSeconds"].(float64), 0)...)
+		}
+	}
+
+	if c.leaseInformer != nil {
+		peers, err := c.getPeers()
+		if err != nil {
+			errors["peers"] = err.Error()
+		}
+		basicInfo["peers"] = peers
+		if skew, ok := peers["localSkewSeconds"].(float64); ok {
+			verdicts = append(verdicts, c.skewVerdict("other nodes", skew, c.peersMargin)...)
+		}
+	}
+	return nil
+}
+
+// 偏差减去误差之后超过阈值才算
+func (c *TimeChecker) skewVerdict(source string, offsetSeconds float64, margin time.Duration) []Verdict {
+	skew := time.Duration(math.Abs(offsetSeconds)*float64(time.Second)) - margin
+	reason := fmt.Sprintf("clock offset from %s is %.3fs", source, offsetSeconds)
+	switch {
+	case skew > c.skewFatal:
+		return []Verdict{{Fatal, reason}}
+	case skew > c.skewError:
+		return []Verdict{{Error, reason}}
+	}
+	return nil
+}
+
+// 只watch kube-node-lease中的lease，比list所有的节点轻得多；
+// 初次list得到的lease不知道何时续约的，只有续约时间变化的更新才作为样本
+func (c *TimeChecker) startLeaseInformer(clientset kubernetes.Interface) {
+	leases := clientset.CoordinationV1beta1().Leases(nodeLeaseNamespace)
+	c.leaseInformer = cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			obj, err := leases.List(options)
+			c.setLeaseWatchError("list", err)
+			return obj, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := leases.Watch(options)
+			c.setLeaseWatchError("watch", err)
+			return w, err
+		},
+	}, &coordinationv1beta1.Lease{}, 0, cache.Indexers{})
+	c.leaseInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldLease, ok := oldObj.(*coordinationv1beta1.Lease)
+			newLease, ok2 := newObj.(*coordinationv1beta1.Lease)
+			if !ok || !ok2 || newLease.Spec.RenewTime == nil {
+				return
+			}
+			if oldLease.Spec.RenewTime != nil && !newLease.Spec.RenewTime.After(oldLease.Spec.RenewTime.Time) {
+				return
+			}
+			c.observeLease(newLease.Name, newLease.Spec.RenewTime.Time, time.Now())
+		},
+		DeleteFunc: func(obj interface{}) {
+			if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = deleted.Obj
+			}
+			if lease, ok := obj.(*coordinationv1beta1.Lease); ok {
+				c.leaseMutex.Lock()
+				defer c.leaseMutex.Unlock()
+				delete(c.leaseSamples, lease.Name)
+			}
+		},
+	})
+	go c.leaseInformer.Run(c.stopCh)
+}
+
+func (c *TimeChecker) setLeaseWatchError(op string, err error) {
+	c.leaseMutex.Lock()
+	defer c.leaseMutex.Unlock()
+	if err != nil {
+		c.leaseWatchError = fmt.Sprintf("%s leases in %s: %s", op, nodeLeaseNamespace, err)
+	} else {
+		c.leaseWatchError = ""
+	}
+}
+
+// lease与节点同名，超出窗口的样本被丢弃
+func (c *TimeChecker) observeLease(node string, renewTime time.Time, observed time.Time) {
+	c.leaseMutex.Lock()
+	defer c.leaseMutex.Unlock()
+	samples := []leaseSample{}
+	for _, sample := range c.leaseSamples[node] {
+		if observed.Sub(sample.observed) <= c.peersWindow {
+			samples = append(samples, sample)
+		}
+	}
+	c.leaseSamples[node] = append(samples, leaseSample{
+		observed:      observed,
+		renewTime:     renewTime,
+		offsetSeconds: renewTime.Sub(observed).Seconds(),
+	})
+}
+
+// 每个节点取窗口内最大的样本作为相对本地的偏差，本节点的样本只反映了更新到达的延迟；
+// 其它节点偏差的中位数取反即为本地相对集群的偏差
+func (c *TimeChecker) getPeers() (map[string]interface{}, error) {
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	nodes := make(map[string]interface{})
+	offsets := []float64{}
+	c.leaseMutex.Lock()
+	watchError := c.leaseWatchError
+	for name, samples := range c.leaseSamples {
+		var best *leaseSample
+		count := 0
+		for i := range samples {
+			if now.Sub(samples[i].observed) > c.peersWindow {
+				continue
+			}
+			count++
+			if best == nil || samples[i].offsetSeconds > best.offsetSeconds {
+				best = &samples[i]
+			}
+		}
+		if best == nil {
+			continue
+		}
+		nodes[name] = map[string]interface{}{
+			"renewTime":     samples[len(samples)-1].renewTime,
+			"offsetSeconds": best.offsetSeconds,
+			"samples":       count,
+		}
+		if name != hostname {
+			offsets = append(offsets, best.offsetSeconds)
+		}
+	}
+	c.leaseMutex.Unlock()
+
+	peers := map[string]interface{}{
+		"nodes": nodes,
+	}
+	if len(offsets) > 0 {
+		sort.Float64s(offsets)
+		median := offsets[len(offsets)/2]
+		if len(offsets)%2 == 0 {
+			median = (offsets[len(offsets)/2-1] + offsets[len(offsets)/2]) / 2
+		}
+		peers["localSkewSeconds"] = -median
+	}
+	if watchError != "" {
+		return peers, fmt.Errorf("%s", watchError)
+	}
+	if !c.leaseInformer.HasSynced() {
+		return peers, fmt.Errorf("leases in %s are not synced yet", nodeLeaseNamespace)
+	}
+	return peers, nil
+}
+
+func (c *TimeChecker) info() Info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return Info{
+		name:      c.name,
+		checkTime: c.checkTime,
+		duration:  c.checkDuration,
+		state:     c.checkerState,
+		reason:    c.stateReason,
+		basic:     c.basicInfo,
+		errors:    c.errors,
+	}
+}
+
+func (c *TimeChecker) metrics() []Metric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	metrics := []Metric{}
+	if kernel, ok := c.basicInfo["kernel"].(map[string]interface{}); ok {
+		metrics = append(metrics,
+			newMetric("time_synchronized", "Whether the kernel clock is synchronized.", boolToFloat(kernel["synchronized"].(bool))),
+			newMetric("time_offset_seconds", "Clock offset estimated from the source.", kernel["offsetSeconds"].(float64), "source", "kernel"),
+			newMetric("time_maxerror_seconds", "Maximum error of the kernel clock.", kernel["maxErrorSeconds"].(float64)),
+		)
+	}
+	if ntp, ok := c.basicInfo["ntp"].(map[string]interface{}); ok {
+		metrics = append(metrics, newMetric("time_offset_seconds", "Clock offset estimated from the source.", ntp["offsetSeconds"].(float64), "source", "ntp"))
+	}
+	if peers, ok := c.basicInfo["peers"].(map[string]interface{}); ok {
+		if skew, ok := peers["localSkewSeconds"].(float64); ok {
+			metrics = append(metrics, newMetric("time_offset_seconds", "Clock offset estimated from the source.", skew, "source", "peers"))
+		}
+		for name, node := range peers["nodes"].(map[string]interface{}) {
+			metrics = append(metrics, newMetric("time_peer_offset_seconds", "Clock offset of the node relative to the local clock.", node.(map[string]interface{})["offsetSeconds"].(float64), "node", name))
+		}
+	}
+	return metrics
+}
+
+func (c *TimeChecker) newRouters() Routers {
+	routers := make(Routers)
+	return routers
+}
+
+func NewTimeChecker() *TimeChecker {
+	return &TimeChecker{}
+}
+
+// adjtimex的modes为0时只读取内核时钟的状态，offset是ntp守护进程正在校正的偏差
+func getKernelClock() (map[string]interface{}, error) {
+	var timex unix.Timex
+	state, err := unix.Adjtimex(&timex)
+	if err != nil {
+		return nil, err
+	}
+	offset := float64(timex.Offset) / 1e6
+	if timex.Status&adjtimexStaNano != 0 {
+		offset = float64(timex.Offset) / 1e9
+	}
+	return map[string]interface{}{
+		"synchronized":    timex.Status&adjtimexStaUnsync == 0 && state != adjtimexTimeError,
+		"state":           state,
+		"status":          timex.Status,
+		"offsetSeconds":   offset,
+		"maxErrorSeconds": float64(timex.Maxerror) / 1e6,
+		"estErrorSeconds": float64(timex.Esterror) / 1e6,
+	}, nil
+}
+
+// chrony的drift文件为"频率偏差 偏差的估计误差"，ntpd只有频率偏差，单位都是ppm
+func readDriftFile(driftPath string) (map[string]interface{}, error) {
+	stat, err := os.Stat(driftPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(driftPath)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s is empty", driftPath)
+	}
+	drift := map[string]interface{}{
+		"updated": stat.ModTime(),
+	}
+	for i, key := range []string{"frequencyPpm", "skewPpm"} {
+		if i >= len(fields) {
+			break
+		}
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected content in %s: %s", driftPath, strings.TrimSpace(string(data)))
+		}
+		drift[key] = value
+	}
+	return drift, nil
+}
+
+// 参考 https://tools.ietf.org/html/rfc4330
+func querySNTP(server string, timeout time.Duration) (map[string]interface{}, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := make([]byte, 48)
+	request[0] = 0<<6 | 4<<3 | 3 // LI=0, VN=4, Mode=3(client)
+	originTime := time.Now()
+	putNTPTime(request[40:48], originTime)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 48)
+	n, err := conn.Read(response)
+	destinationTime := time.Now()
+	if err != nil {
+		return nil, err
+	}
+	if n < 48 {
+		return nil, fmt.Errorf("short ntp response of %d bytes", n)
+	}
+	leap, mode, stratum := response[0]>>6, response[0]&0x07, response[1]
+	if mode != 4 {
+		return nil, fmt.Errorf("unexpected ntp mode %d", mode)
+	}
+	if !bytes.Equal(response[24:32], request[40:48]) {
+		return nil, fmt.Errorf("ntp response does not match the request")
+	}
+	if stratum == 0 {
+		return nil, fmt.Errorf("kiss-o'-death from ntp server: %s", strings.TrimRight(string(response[12:16]), "\x00"))
+	}
+	if leap == 3 {
+		return nil, fmt.Errorf("ntp server is not synchronized")
+	}
+	receiveTime, transmitTime := ntpTime(response[32:40]), ntpTime(response[40:48])
+	offset := (receiveTime.Sub(originTime) + transmitTime.Sub(destinationTime)) / 2
+	delay := destinationTime.Sub(originTime) - transmitTime.Sub(receiveTime)
+	return map[string]interface{}{
+		"server":        server,
+		"stratum":       int(stratum),
+		"offsetSeconds": offset.Seconds(),
+		"delaySeconds":  delay.Seconds(),
+	}, nil
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := (uint64(t.Nanosecond()) << 32) / 1e9
+	for i := 0; i < 4; i++ {
+		b[i] = byte(seconds >> uint(24-8*i))
+		b[4+i] = byte(fraction >> uint(24-8*i))
+	}
+}
+
+func ntpTime(b []byte) time.Time {
+	var seconds, fraction uint64
+	for i := 0; i < 4; i++ {
+		seconds = seconds<<8 | uint64(b[i])
+		fraction = fraction<<8 | uint64(b[4+i])
+	}
+	return time.Unix(int64(seconds)-ntpEpochOffset, int64((fraction*1e9)>>32))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 本地的SNTP服务端，按reply构造响应；reply返回nil时不响应
+func newTestNTPServer(t *testing.T, reply func(request []byte, received time.Time) []byte) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := reply(buf[:n], time.Now()); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+// 比本机快offset的服务端，收到请求后处理hold再发出响应
+func ntpResponse(request []byte, received time.Time, offset time.Duration, hold time.Duration, leap byte, stratum byte) []byte {
+	response := make([]byte, 48)
+	response[0] = leap<<6 | 4<<3 | 4
+	response[1] = stratum
+	copy(response[12:16], "GPS\x00")
+	copy(response[24:32], request[40:48])
+	putNTPTime(response[32:40], received.Add(offset))
+	time.Sleep(hold)
+	putNTPTime(response[40:48], time.Now().Add(offset))
+	return response
+}
+
+func TestNTPTime(t *testing.T) {
+	b := make([]byte, 8)
+	now := time.Unix(1600000000, 123456789)
+	putNTPTime(b, now)
+	// 32位的小数部分精度约为0.23ns
+	if parsed := ntpTime(b); parsed.Sub(now) > time.Nanosecond || now.Sub(parsed) > time.Nanosecond {
+		t.Errorf("expected %s, got %s", now, parsed)
+	}
+	if seconds := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]); seconds != uint32(1600000000+ntpEpochOffset) {
+		t.Errorf("unexpected ntp seconds %d", seconds)
+	}
+}
+
+func TestQuerySNTP(t *testing.T) {
+	offset, hold := time.Second*10, time.Millisecond*100
+	conn := newTestNTPServer(t, func(request []byte, received time.Time) []byte {
+		if len(request) != 48 || request[0] != 0x23 {
+			t.Errorf("unexpected request %x", request)
+		}
+		return ntpResponse(request, received, offset, hold, 0, 2)
+	})
+	defer conn.Close()
+	server := conn.LocalAddr().String()
+	result, err := querySNTP(server, time.Second*2)
+	if err != nil {
+		t.Fatalf("querySNTP: %s", err)
+	}
+	if result["server"] != server || result["stratum"] != 2 {
+		t.Errorf("unexpected result %v", result)
+	}
+	// 服务端的处理时间不计入延迟，偏移量不受延迟影响
+	if seconds := result["offsetSeconds"].(float64); math.Abs(seconds-offset.Seconds()) > 0.05 {
+		t.Errorf("expected an offset of about %s, got %vs", offset, seconds)
+	}
+	if seconds := result["delaySeconds"].(float64); seconds < -0.01 || seconds > 0.05 {
+		t.Errorf("expected a delay without the hold of the server, got %vs", seconds)
+	}
+
+	// 本机比服务端快
+	behind := newTestNTPServer(t, func(request []byte, received time.Time) []byte {
+		return ntpResponse(request, received, -time.Second*3, 0, 0, 1)
+	})
+	defer behind.Close()
+	if result, err := querySNTP(behind.LocalAddr().String(), time.Second*2); err != nil || math.Abs(result["offsetSeconds"].(float64)+3) > 0.05 {
+		t.Errorf("expected an offset of about -3s, got %v, %v", result, err)
+	}
+}
+
+func TestQuerySNTPInvalidResponses(t *testing.T) {
+	cases := []struct {
+		name  string
+		reply func(request []byte, received time.Time) []byte
+		err   string
+	}{
+		{
+			"kiss-o'-death",
+			func(request []byte, received time.Time) []byte {
+				response := ntpResponse(request, received, 0, 0, 3, 0)
+				copy(response[12:16], "RATE")
+				return response
+			},
+			"kiss-o'-death from ntp server: RATE",
+		},
+		{
+			"unsynchronized",
+			func(request []byte, received time.Time) []byte {
+				return ntpResponse(request, received, 0, 0, 3, 16)
+			},
+			"not synchronized",
+		},
+		{
+			"mismatched originate timestamp",
+			func(request []byte, received time.Time) []byte {
+				response := ntpResponse(request, received, 0, 0, 0, 2)
+				response[31]++
+				return response
+			},
+			"does not match",
+		},
+		{
+			"server mode",
+			func(request []byte, received time.Time) []byte {
+				response := ntpResponse(request, received, 0, 0, 0, 2)
+				response[0] = 4<<3 | 5
+				return response
+			},
+			"unexpected ntp mode 5",
+		},
+		{
+			"short response",
+			func(request []byte, received time.Time) []byte {
+				return ntpResponse(request, received, 0, 0, 0, 2)[:40]
+			},
+			"short ntp response",
+		},
+		{
+			"timeout",
+			func(request []byte, received time.Time) []byte {
+				return nil
+			},
+			"timeout",
+		},
+	}
+	for _, c := range cases {
+		conn := newTestNTPServer(t, c.reply)
+		start := time.Now()
+		_, err := querySNTP(conn.LocalAddr().String(), time.Millisecond*300)
+		conn.Close()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", c.name, c.err, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: querySNTP did not return in the timeout, took %s", c.name, elapsed)
+		}
+	}
+}
+
+func TestTimeCheckerPeersConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := path.Join(dir, "kubeconfig")
+	content := "apiVersion: v1\nkind: Config\nclusters:\n- name: test\n  cluster:\n    server: https://127.0.0.1:1\ncontexts:\n- name: test\n  context:\n    cluster: test\ncurrent-context: test\n"
+	if err := ioutil.WriteFile(kubeconfig, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initLogger(false)
+	// kubelet的证书不能list lease，必须显式指定kubeconfig
+	c := NewTimeChecker()
+	err = c.initialize(&DaemonConfig{customConfigs: map[string]map[string]interface{}{"time": {"peers.enable": true}}})
+	if err == nil || err.Error() != "peers.kubeconfig of checker time is required when peers.enable is true" {
+		t.Errorf("expected the kubeconfig error, got %v", err)
+	}
+
+	// 规则错误时informer还没有启动，重新初始化不会留下旧的informer
+	err = c.initialize(&DaemonConfig{customConfigs: map[string]map[string]interface{}{"time": {
+		"peers.enable":     true,
+		"peers.kubeconfig": kubeconfig,
+		"rules":            []interface{}{map[interface{}]interface{}{"when": "kernel.offsetSeconds > 1", "state": "Live"}},
+	}}})
+	if err == nil || c.leaseInformer != nil {
+		t.Errorf("expected the rules error before starting the informer, got %v", err)
+	}
+}
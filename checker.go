@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync"
 	"time"
 )
 
@@ -11,19 +12,75 @@ type Checker interface {
 	stop()
 	check() error
 	info() Info
+	metrics() []Metric
 	newRouters() Routers
 }
 
 var checkers = make(map[string]Checker)
 
+var (
+	checkCallsMutex sync.Mutex
+	checkCalls      = make(map[Checker]*checkCall)
+)
+
 func registerChecker(name string, checker Checker) {
 	checkers[name] = checker
 }
 
+var checkHooks = []func(info Info){}
+
+// 每次check()完成之后都会以最新的Info调用所有的hook
+func registerCheckHook(hook func(info Info)) {
+	checkHooks = append(checkHooks, hook)
+}
+
+func notifyCheckHooks(info Info) {
+	for _, hook := range checkHooks {
+		hook(info)
+	}
+}
+
+type checkCall struct {
+	done chan struct{}
+	err  error
+}
+
+// 同一个checker同时只会有一次check()在执行，期间其它的触发(定时器或者外部请求)会共享这一次的结果
+func runCheck(checker Checker) *checkCall {
+	checkCallsMutex.Lock()
+	defer checkCallsMutex.Unlock()
+	if call, ok := checkCalls[checker]; ok {
+		return call
+	}
+	call := &checkCall{done: make(chan struct{})}
+	checkCalls[checker] = call
+	go func() {
+		call.err = checker.check()
+		checkCallsMutex.Lock()
+		delete(checkCalls, checker)
+		checkCallsMutex.Unlock()
+		close(call.done)
+		notifyCheckHooks(checker.info())
+	}()
+	return call
+}
+
+// 等待正在执行的check()结束，没有正在执行的check()时立即返回
+func waitCheck(checker Checker) {
+	checkCallsMutex.Lock()
+	call, ok := checkCalls[checker]
+	checkCallsMutex.Unlock()
+	if ok {
+		<-call.done
+	}
+}
+
 type Info struct {
 	name      string
 	checkTime time.Time
+	duration  time.Duration
 	state     State
+	reason    string
 	basic     map[string]interface{}
 	detail    map[string]interface{}
 	errors    map[string]interface{}
@@ -34,6 +91,9 @@ func (info *Info) toMap() map[string]interface{} {
 	infoMap["name"] = info.name
 	infoMap["time"] = info.checkTime
 	infoMap["state"] = info.state
+	if info.reason != "" {
+		infoMap["reason"] = info.reason
+	}
 	if info.detail != nil {
 		infoMap["detail"] = info.detail
 	}
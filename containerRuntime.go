@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	runtimeDocker = "docker"
+	runtimeCRI    = "cri"
+	// dockershim用这个label区分pod sandbox和普通容器
+	dockerContainerTypeLabel = "io.kubernetes.docker.type"
+	dockerSandboxType        = "podsandbox"
+)
+
+// 没有配置cri.endpoint时依次尝试的socket，路径相对于mount_point
+var defaultCRIEndpoints = []string{
+	"/run/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+}
+
+// 容器运行时，docker或者CRI。summary写到basic中的runtime，detail用于/kubernetes/detail，
+// 两者都把失败的调用写到errors中，返回已经拿到的部分
+type ContainerRuntime interface {
+	summary(errors map[string]interface{}) map[string]interface{}
+	detail(errors map[string]interface{}) map[string]interface{}
+	close() error
+}
+
+// runtimeType为auto时，优先使用本节点上报的containerRuntimeVersion（例如docker://18.9.2、containerd://1.6.8），
+// 节点信息拿不到时docker的socket存在则用docker，否则用CRI
+func detectRuntimeType(runtimeType string, nodeRuntimeVersion string, dockerHost string) string {
+	if runtimeType != "auto" {
+		return runtimeType
+	}
+	if nodeRuntimeVersion != "" {
+		if strings.HasPrefix(nodeRuntimeVersion, "docker://") {
+			return runtimeDocker
+		}
+		return runtimeCRI
+	}
+	if strings.HasPrefix(dockerHost, "unix://") {
+		if _, err := os.Stat(strings.TrimPrefix(dockerHost, "unix://")); err == nil {
+			return runtimeDocker
+		}
+	}
+	return runtimeCRI
+}
+
+// endpoint为空时返回第一个存在的缺省socket
+func detectCRIEndpoint(endpoint string, mountPoint string) (string, error) {
+	if endpoint != "" {
+		return endpoint, nil
+	}
+	for _, candidate := range defaultCRIEndpoints {
+		socket := path.Join(mountPoint, candidate)
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket, nil
+		}
+	}
+	return "", fmt.Errorf("no CRI socket found in %s", strings.Join(defaultCRIEndpoints, ","))
+}
+
+type DockerRuntime struct {
+	host    string
+	client  *client.Client
+	timeout time.Duration
+}
+
+func NewDockerRuntime(host string, apiVersion string, timeout time.Duration) (*DockerRuntime, error) {
+	cli, err := client.NewClient(host, apiVersion, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &DockerRuntime{host: host, client: cli, timeout: timeout}, nil
+}
+
+func (r *DockerRuntime) summary(errors map[string]interface{}) map[string]interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	summary := map[string]interface{}{
+		"type":     runtimeDocker,
+		"endpoint": r.host,
+		"name":     runtimeDocker,
+	}
+	info, err := r.client.Info(ctx)
+	if err != nil {
+		errors["runtime.info"] = err.Error()
+		summary["conditions"] = map[string]interface{}{"RuntimeReady": false}
+		return summary
+	}
+	summary["version"] = info.ServerVersion
+	summary["images"] = info.Images
+	summary["conditions"] = map[string]interface{}{"RuntimeReady": true}
+	containers, err := r.client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		errors["runtime.containers"] = err.Error()
+		return summary
+	}
+	containerStates := []string{}
+	sandboxStates := []string{}
+	for _, container := range containers {
+		if container.Labels[dockerContainerTypeLabel] != dockerSandboxType {
+			containerStates = append(containerStates, container.State)
+		} else if container.State == "running" {
+			sandboxStates = append(sandboxStates, "ready")
+		} else {
+			sandboxStates = append(sandboxStates, "notready")
+		}
+	}
+	summary["containers"] = len(containerStates)
+	summary["containers.states"] = countStates(containerStates)
+	summary["sandboxes"] = len(sandboxStates)
+	summary["sandboxes.states"] = countStates(sandboxStates)
+	return summary
+}
+
+func (r *DockerRuntime) detail(errors map[string]interface{}) map[string]interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	details := make(map[string]interface{})
+	containers, err := r.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		errors["docker.containers"] = err.Error()
+	} else {
+		details["docker.containers"] = containers
+	}
+	images, err := r.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		errors["docker.images"] = err.Error()
+	} else {
+		details["docker.images"] = images
+	}
+	info, err := r.client.Info(ctx)
+	if err != nil {
+		errors["docker.info"] = err.Error()
+	} else {
+		details["docker.info"] = info
+	}
+	return details
+}
+
+func (r *DockerRuntime) close() error {
+	return r.client.Close()
+}
+
+type CRIRuntime struct {
+	endpoint      string
+	conn          *grpc.ClientConn
+	runtimeClient runtimeapi.RuntimeServiceClient
+	imageClient   runtimeapi.ImageServiceClient
+	timeout       time.Duration
+}
+
+// 连接是惰性的，socket不可用时在summary()中报告
+func NewCRIRuntime(endpoint string, timeout time.Duration) (*CRIRuntime, error) {
+	if !strings.HasPrefix(endpoint, "unix://") {
+		return nil, fmt.Errorf("unsupported CRI endpoint '%s', only unix:// is supported", endpoint)
+	}
+	conn, err := grpc.Dial(strings.TrimPrefix(endpoint, "unix://"),
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newCRIRuntime(endpoint, conn, timeout), nil
+}
+
+// conn可以连到进程内的fake CRI server，便于测试
+func newCRIRuntime(endpoint string, conn *grpc.ClientConn, timeout time.Duration) *CRIRuntime {
+	return &CRIRuntime{
+		endpoint:      endpoint,
+		conn:          conn,
+		runtimeClient: runtimeapi.NewRuntimeServiceClient(conn),
+		imageClient:   runtimeapi.NewImageServiceClient(conn),
+		timeout:       timeout,
+	}
+}
+
+func (r *CRIRuntime) summary(errors map[string]interface{}) map[string]interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	summary := map[string]interface{}{
+		"type":     runtimeCRI,
+		"endpoint": r.endpoint,
+	}
+	version, err := r.runtimeClient.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		// 版本都拿不到时不再继续，避免每个调用都等到超时
+		errors["runtime.version"] = err.Error()
+		return summary
+	}
+	summary["name"] = version.RuntimeName
+	summary["version"] = version.RuntimeVersion
+	summary["apiVersion"] = version.RuntimeApiVersion
+
+	if status, err := r.runtimeClient.Status(ctx, &runtimeapi.StatusRequest{}); err != nil {
+		errors["runtime.status"] = err.Error()
+	} else {
+		conditions := make(map[string]interface{})
+		for _, condition := range status.GetStatus().GetConditions() {
+			conditions[condition.Type] = condition.Status
+			if !condition.Status {
+				errors["runtime.conditions."+condition.Type] = fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+			}
+		}
+		summary["conditions"] = conditions
+	}
+
+	if containers, err := r.runtimeClient.ListContainers(ctx, &runtimeapi.ListContainersRequest{}); err != nil {
+		errors["runtime.containers"] = err.Error()
+	} else {
+		states := []string{}
+		for _, container := range containers.Containers {
+			states = append(states, criStateName(container.State.String(), "CONTAINER_"))
+		}
+		summary["containers"] = len(states)
+		summary["containers.states"] = countStates(states)
+	}
+
+	if sandboxes, err := r.runtimeClient.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{}); err != nil {
+		errors["runtime.sandboxes"] = err.Error()
+	} else {
+		states := []string{}
+		for _, sandbox := range sandboxes.Items {
+			states = append(states, criStateName(sandbox.State.String(), "SANDBOX_"))
+		}
+		summary["sandboxes"] = len(states)
+		summary["sandboxes.states"] = countStates(states)
+	}
+
+	if images, err := r.imageClient.ListImages(ctx, &runtimeapi.ListImagesRequest{}); err != nil {
+		errors["runtime.images"] = err.Error()
+	} else {
+		summary["images"] = len(images.Images)
+	}
+	return summary
+}
+
+func (r *CRIRuntime) detail(errors map[string]interface{}) map[string]interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	details := make(map[string]interface{})
+	if status, err := r.runtimeClient.Status(ctx, &runtimeapi.StatusRequest{Verbose: true}); err != nil {
+		errors["cri.status"] = err.Error()
+	} else {
+		details["cri.status"] = status
+	}
+	if containers, err := r.runtimeClient.ListContainers(ctx, &runtimeapi.ListContainersRequest{}); err != nil {
+		errors["cri.containers"] = err.Error()
+	} else {
+		details["cri.containers"] = containers.Containers
+	}
+	if sandboxes, err := r.runtimeClient.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{}); err != nil {
+		errors["cri.sandboxes"] = err.Error()
+	} else {
+		details["cri.sandboxes"] = sandboxes.Items
+	}
+	if images, err := r.imageClient.ListImages(ctx, &runtimeapi.ListImagesRequest{}); err != nil {
+		errors["cri.images"] = err.Error()
+	} else {
+		details["cri.images"] = images.Images
+	}
+	return details
+}
+
+func (r *CRIRuntime) close() error {
+	return r.conn.Close()
+}
+
+// CONTAINER_RUNNING对应running，SANDBOX_NOTREADY对应notready
+func criStateName(state string, prefix string) string {
+	return strings.ToLower(strings.TrimPrefix(state, prefix))
+}
+
+func countStates(states []string) map[string]interface{} {
+	counts := make(map[string]interface{})
+	for _, state := range states {
+		count, _ := counts[state].(int)
+		counts[state] = count + 1
+	}
+	return counts
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// 进程内的CRI server，failures中的方法返回错误
+type fakeCRIServer struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	runtimeapi.UnimplementedImageServiceServer
+	conditions []*runtimeapi.RuntimeCondition
+	containers []*runtimeapi.Container
+	sandboxes  []*runtimeapi.PodSandbox
+	images     []*runtimeapi.Image
+	failures   map[string]bool
+}
+
+func (s *fakeCRIServer) fail(method string) error {
+	if s.failures[method] {
+		return fmt.Errorf("%s is broken", method)
+	}
+	return nil
+}
+
+func (s *fakeCRIServer) Version(ctx context.Context, req *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	if err := s.fail("Version"); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.VersionResponse{Version: "0.1.0", RuntimeName: "containerd", RuntimeVersion: "v1.6.8", RuntimeApiVersion: "v1"}, nil
+}
+
+func (s *fakeCRIServer) Status(ctx context.Context, req *runtimeapi.StatusRequest) (*runtimeapi.StatusResponse, error) {
+	if err := s.fail("Status"); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.StatusResponse{Status: &runtimeapi.RuntimeStatus{Conditions: s.conditions}}, nil
+}
+
+func (s *fakeCRIServer) ListContainers(ctx context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	if err := s.fail("ListContainers"); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.ListContainersResponse{Containers: s.containers}, nil
+}
+
+func (s *fakeCRIServer) ListPodSandbox(ctx context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	if err := s.fail("ListPodSandbox"); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.ListPodSandboxResponse{Items: s.sandboxes}, nil
+}
+
+func (s *fakeCRIServer) ListImages(ctx context.Context, req *runtimeapi.ListImagesRequest) (*runtimeapi.ListImagesResponse, error) {
+	if err := s.fail("ListImages"); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.ListImagesResponse{Images: s.images}, nil
+}
+
+// 在临时目录的unix socket上启动fake server，返回endpoint和清理函数
+func startFakeCRIServer(t *testing.T, server *fakeCRIServer) (string, func()) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := path.Join(dir, "containerd.sock")
+	stop := serveFakeCRIServer(t, socket, server)
+	return "unix://" + socket, func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// 在指定的unix socket上启动fake server，返回停止函数
+func serveFakeCRIServer(t *testing.T, socket string, server *fakeCRIServer) func() {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(grpcServer, server)
+	runtimeapi.RegisterImageServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	return grpcServer.Stop
+}
+
+func newTestCRIServer() *fakeCRIServer {
+	return &fakeCRIServer{
+		conditions: []*runtimeapi.RuntimeCondition{
+			{Type: "RuntimeReady", Status: true},
+			{Type: "NetworkReady", Status: false, Reason: "NetworkPluginNotReady", Message: "cni config uninitialized"},
+		},
+		containers: []*runtimeapi.Container{
+			{Id: "c1", State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+			{Id: "c2", State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+			{Id: "c3", State: runtimeapi.ContainerState_CONTAINER_EXITED},
+		},
+		sandboxes: []*runtimeapi.PodSandbox{
+			{Id: "s1", State: runtimeapi.PodSandboxState_SANDBOX_READY},
+			{Id: "s2", State: runtimeapi.PodSandboxState_SANDBOX_NOTREADY},
+		},
+		images: []*runtimeapi.Image{
+			{Id: "sha256:1", RepoTags: []string{"pause:3.2"}},
+			{Id: "sha256:2", RepoTags: []string{"busybox:latest"}},
+		},
+		failures: map[string]bool{},
+	}
+}
+
+func TestCRIRuntimeSummary(t *testing.T) {
+	endpoint, stop := startFakeCRIServer(t, newTestCRIServer())
+	defer stop()
+	runtime, err := NewCRIRuntime(endpoint, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.close()
+
+	errors := make(map[string]interface{})
+	summary := runtime.summary(errors)
+	if summary["type"] != runtimeCRI || summary["endpoint"] != endpoint || summary["name"] != "containerd" || summary["version"] != "v1.6.8" || summary["apiVersion"] != "v1" {
+		t.Errorf("unexpected summary %v", summary)
+	}
+	conditions := summary["conditions"].(map[string]interface{})
+	if conditions["RuntimeReady"] != true || conditions["NetworkReady"] != false {
+		t.Errorf("unexpected conditions %v", conditions)
+	}
+	if errors["runtime.conditions.NetworkReady"] != "NetworkPluginNotReady: cni config uninitialized" || len(errors) != 1 {
+		t.Errorf("expected only the false condition in errors, got %v", errors)
+	}
+	if summary["containers"] != 3 || fmt.Sprint(summary["containers.states"]) != "map[exited:1 running:2]" {
+		t.Errorf("unexpected containers %v %v", summary["containers"], summary["containers.states"])
+	}
+	if summary["sandboxes"] != 2 || fmt.Sprint(summary["sandboxes.states"]) != "map[notready:1 ready:1]" {
+		t.Errorf("unexpected sandboxes %v %v", summary["sandboxes"], summary["sandboxes.states"])
+	}
+	if summary["images"] != 2 {
+		t.Errorf("expected 2 images, got %v", summary["images"])
+	}
+}
+
+func TestCRIRuntimeDetail(t *testing.T) {
+	server := newTestCRIServer()
+	server.failures["ListImages"] = true
+	endpoint, stop := startFakeCRIServer(t, server)
+	defer stop()
+	runtime, err := NewCRIRuntime(endpoint, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.close()
+
+	errors := make(map[string]interface{})
+	details := runtime.detail(errors)
+	if containers, _ := details["cri.containers"].([]*runtimeapi.Container); len(containers) != 3 || containers[0].Id != "c1" {
+		t.Errorf("unexpected containers %v", details["cri.containers"])
+	}
+	if sandboxes, _ := details["cri.sandboxes"].([]*runtimeapi.PodSandbox); len(sandboxes) != 2 {
+		t.Errorf("unexpected sandboxes %v", details["cri.sandboxes"])
+	}
+	if _, ok := details["cri.status"]; !ok {
+		t.Errorf("expected the runtime status")
+	}
+	// 一个调用失败不影响其它部分
+	if _, ok := details["cri.images"]; ok {
+		t.Errorf("images should be missing when ListImages fails")
+	}
+	if message, _ := errors["cri.images"].(string); message == "" || len(errors) != 1 {
+		t.Errorf("expected only the image error, got %v", errors)
+	}
+}
+
+func TestCRIRuntimeErrors(t *testing.T) {
+	server := newTestCRIServer()
+	server.failures["ListContainers"] = true
+	server.failures["Status"] = true
+	endpoint, stop := startFakeCRIServer(t, server)
+	defer stop()
+	runtime, err := NewCRIRuntime(endpoint, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.close()
+
+	errors := make(map[string]interface{})
+	summary := runtime.summary(errors)
+	for _, key := range []string{"runtime.containers", "runtime.status"} {
+		if _, ok := errors[key].(string); !ok {
+			t.Errorf("expected %s in errors, got %v", key, errors)
+		}
+	}
+	if _, ok := summary["conditions"]; ok {
+		t.Errorf("conditions should be missing when Status fails")
+	}
+	if summary["sandboxes"] != 2 || summary["images"] != 2 {
+		t.Errorf("other calls should still be made, got %v", summary)
+	}
+
+	// Version失败时不再调用其它方法
+	server.failures["Version"] = true
+	errors = make(map[string]interface{})
+	summary = runtime.summary(errors)
+	if _, ok := errors["runtime.version"].(string); !ok || len(errors) != 1 {
+		t.Errorf("expected only the version error, got %v", errors)
+	}
+	if _, ok := summary["sandboxes"]; ok {
+		t.Errorf("expected no other calls after Version fails, got %v", summary)
+	}
+}
+
+func TestCRIRuntimeUnavailable(t *testing.T) {
+	if _, err := NewCRIRuntime("tcp://127.0.0.1:10010", time.Second); err == nil {
+		t.Errorf("expected an error for a tcp endpoint")
+	}
+	// 连接是惰性的，socket不存在时在summary中报告
+	runtime, err := NewCRIRuntime("unix:///nonexistent/containerd.sock", time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.close()
+	errors := make(map[string]interface{})
+	summary := runtime.summary(errors)
+	if _, ok := errors["runtime.version"].(string); !ok {
+		t.Errorf("expected a version error, got %v", errors)
+	}
+	if summary["type"] != runtimeCRI {
+		t.Errorf("unexpected summary %v", summary)
+	}
+}
+
+func TestDetectRuntimeType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dockerSocket := path.Join(dir, "docker.sock")
+	ioutil.WriteFile(dockerSocket, nil, 0644)
+
+	tests := []struct {
+		runtimeType        string
+		nodeRuntimeVersion string
+		dockerHost         string
+		expected           string
+	}{
+		{runtimeDocker, "containerd://1.6.8", "", runtimeDocker},
+		{runtimeCRI, "docker://18.9.2", "unix://" + dockerSocket, runtimeCRI},
+		{"auto", "docker://18.9.2", "", runtimeDocker},
+		{"auto", "containerd://1.6.8", "unix://" + dockerSocket, runtimeCRI},
+		{"auto", "cri-o://1.20.0", "", runtimeCRI},
+		{"auto", "", "unix://" + dockerSocket, runtimeDocker},
+		{"auto", "", "unix://" + path.Join(dir, "missing.sock"), runtimeCRI},
+		{"auto", "", "tcp://127.0.0.1:2375", runtimeCRI},
+	}
+	for _, test := range tests {
+		if actual := detectRuntimeType(test.runtimeType, test.nodeRuntimeVersion, test.dockerHost); actual != test.expected {
+			t.Errorf("detectRuntimeType(%s, %s, %s): expected %s, got %s", test.runtimeType, test.nodeRuntimeVersion, test.dockerHost, test.expected, actual)
+		}
+	}
+}
+
+func TestDetectCRIEndpoint(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+
+	if endpoint, err := detectCRIEndpoint("unix:///run/custom.sock", mountPoint); err != nil || endpoint != "unix:///run/custom.sock" {
+		t.Errorf("expected the configured endpoint, got %s %v", endpoint, err)
+	}
+	if _, err := detectCRIEndpoint("", mountPoint); err == nil {
+		t.Errorf("expected an error without any socket")
+	}
+	// containerd优先于crio
+	for _, socket := range []string{"/var/run/crio/crio.sock", "/run/containerd/containerd.sock"} {
+		os.MkdirAll(path.Join(mountPoint, path.Dir(socket)), 0755)
+		ioutil.WriteFile(path.Join(mountPoint, socket), nil, 0644)
+		endpoint, err := detectCRIEndpoint("", mountPoint)
+		if err != nil || endpoint != "unix://"+path.Join(mountPoint, socket) {
+			t.Errorf("expected %s, got %s %v", socket, endpoint, err)
+		}
+	}
+}
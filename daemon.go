@@ -2,13 +2,21 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"reflect"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	timeoutSeconds = 30
+	// 需要小于Prometheus缺省的scrape_timeout(10s)，否则超时的checker会让整次抓取失败
+	defaultMetricsTimeout = time.Second * 8
 )
 
 type State string
@@ -21,46 +29,399 @@ const (
 	Unitialized = "Unitialized"
 )
 
+func init() {
+	registerConfigSchema("checkers",
+		ConfigItem{"disable", []string{}, "names of disabled checkers"},
+	)
+	registerConfigSchema("reload",
+		ConfigItem{"interval", time.Second * 10, "interval between checking whether the config file is changed"},
+	)
+	registerConfigSchema("metrics",
+		ConfigItem{"timeout", defaultMetricsTimeout, "checkers not returning metrics within timeout are reported as Unknown, keep it below scrape_timeout of Prometheus"},
+	)
+}
+
 type Daemon struct {
-	config *DaemonConfig
+	mutex       sync.RWMutex
+	config      *DaemonConfig
+	active      map[string]Checker
+	running     map[string]chan struct{}
+	routers     map[string]Routers
+	history     *History
+	events      *Events
+	publisher   *Publisher
+	reloadState map[string]interface{}
+	failedHash  string
+	// 每个运行中的checker实际使用的配置，热加载时部分checker初始化失败并回退，它们仍使用原来的配置
+	applied map[string]*DaemonConfig
 }
 
 func NewDaemon(config *DaemonConfig) *Daemon {
 	daemon := &Daemon{
-		config: config,
+		active:  make(map[string]Checker),
+		running: make(map[string]chan struct{}),
+		routers: make(map[string]Routers),
+		applied: make(map[string]*DaemonConfig),
+		reloadState: map[string]interface{}{
+			"revision": 0,
+		},
+	}
+
+	if config.getOrDefault("history", "enable", false).(bool) {
+		history, err := NewHistory(config)
+		if err != nil {
+			errorln(fmt.Sprintf("History is disabled: %s", err))
+		} else {
+			daemon.history = history
+			registerCheckHook(history.record)
+		}
+	}
+
+	events, err := NewEvents(config)
+	if err != nil {
+		log.Fatalln(fmt.Sprintf("Invalid events config: %s", err))
+	}
+	daemon.events = events
+	registerCheckHook(events.observe)
+
+	publisher, err := NewPublisher(config)
+	if err != nil {
+		log.Fatalln(fmt.Sprintf("Invalid publisher config: %s", err))
+	}
+	if publisher != nil {
+		daemon.publisher = publisher
+		registerCheckHook(publisher.observe)
+		go publisher.run()
+	}
+
+	if err := daemon.apply(config); err != nil {
+		log.Fatalln(err.Error())
+	}
+	return daemon
+}
+
+// 监听配置文件的变化以及SIGHUP信号，重新加载配置
+func (daemon *Daemon) run() error {
+	if daemon.config.config_path == "" {
+		return nil
+	}
+	interval := daemon.config.getOrDefault("reload", "interval", time.Second*10).(time.Duration)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-ticker.C:
+			daemon.reload(false)
+		case <-hup:
+			infoln("Received SIGHUP, reloading config")
+			daemon.reload(true)
+		}
+	}
+}
+
+// force为false时，只有配置文件的内容发生变化才会重新加载，失败的版本也不会重复加载
+func (daemon *Daemon) reload(force bool) {
+	newConfig, err := daemon.config.load(daemon.config.config_path)
+	var hash string
+	if err == nil {
+		hash = newConfig.config_hash
+	} else {
+		hash = daemon.unloadableHash()
+	}
+	if !force && (hash == daemon.config.config_hash || hash == daemon.failedHash) {
+		return
+	}
+	if err == nil {
+		err = daemon.apply(newConfig)
+	}
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	if err != nil {
+		errorln(fmt.Sprintf("Failed to reload config: %s", err))
+		daemon.reloadState["lastError"] = err.Error()
+		daemon.reloadState["lastErrorTime"] = time.Now()
+		daemon.failedHash = hash
+	} else {
+		delete(daemon.reloadState, "lastError")
+		delete(daemon.reloadState, "lastErrorTime")
+		daemon.failedHash = ""
 	}
+}
+
+// 配置文件无法解析时用内容的hash标记失败的版本，文件无法读取时用错误标记
+func (daemon *Daemon) unloadableHash() string {
+	data, err := ioutil.ReadFile(daemon.config.config_path)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return configHash(data)
+}
 
-	disable_checkers := config.getOrDefault("checkers", "disable", []string{}).([]string)
+// 根据新的配置启停checker，只有配置发生变化的checker会被重新初始化
+func (daemon *Daemon) apply(newConfig *DaemonConfig) error {
+	warnings, err := validateConfig(newConfig)
+	for _, warning := range warnings {
+		warnln(warning)
+	}
+	if err != nil {
+		return err
+	}
+	if err := registerExecCheckers(newConfig); err != nil {
+		return err
+	}
+	desired := make(map[string]Checker)
+	for name, checker := range checkers {
+		desired[name] = checker
+	}
+	execInstances := make(map[string]bool)
+	for _, name := range newConfig.getOrDefault("exec", "instances", []string{}).([]string) {
+		execInstances[name] = true
+	}
+	for name, checker := range checkers {
+		if _, ok := checker.(*ExecChecker); ok && !execInstances[name] {
+			delete(desired, name)
+		}
+	}
+	disable_checkers := newConfig.getOrDefault("checkers", "disable", []string{}).([]string)
 	if len(disable_checkers) > 0 {
 		log.Println(fmt.Sprintf("Disable checkers: %s", strings.Join(disable_checkers, ",")))
 		for _, disable_checker := range disable_checkers {
-			delete(checkers, disable_checker)
+			delete(desired, disable_checker)
+		}
+	}
+	for name := range desired {
+		if _, err := loadRules(newConfig, name); err != nil {
+			return err
 		}
 	}
 
-	for name, checker := range checkers {
-		err := checker.initialize(daemon.config)
-		if err != nil {
-			log.Fatalln(err.Error())
+	oldConfig := daemon.config
+	if oldConfig != nil {
+		warnRestartRequired(oldConfig, newConfig)
+	}
+	errs := []string{}
+	for name, checker := range daemon.activeCheckers() {
+		if _, ok := desired[name]; !ok {
+			daemon.deactivate(name, checker)
+			delete(daemon.applied, name)
+			forgetRecordedConfigs(name)
+			log.Println(fmt.Sprintf("Checker: %s\t is stopped", name))
+		}
+	}
+	// 包括上次运行时写过condition、这次被禁用的checker
+	if daemon.publisher != nil {
+		for name := range checkers {
+			if _, ok := desired[name]; !ok {
+				daemon.publisher.forget(name)
+			}
+		}
+	}
+	for name, checker := range desired {
+		_, active := daemon.activeCheckers()[name]
+		appliedConfig := daemon.applied[name]
+		if active && !configChanged(appliedConfig, newConfig, name) {
+			continue
+		}
+		if active {
+			daemon.deactivate(name, checker)
 		}
+		forgetRecordedConfigs(name)
 		log.Println(fmt.Sprintf("Checker: %s\t begins to initialize", name))
-		go checker.start()
+		if err := checker.initialize(newConfig); err != nil {
+			if oldConfig == nil {
+				return err
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			if !active {
+				continue
+			}
+			// 回退到原来的配置
+			forgetRecordedConfigs(name)
+			if err := checker.initialize(appliedConfig); err != nil {
+				delete(daemon.applied, name)
+				errs = append(errs, fmt.Sprintf("%s: failed to rollback: %s", name, err))
+				continue
+			}
+		} else {
+			daemon.applied[name] = newConfig
+		}
+		daemon.activate(name, checker)
 	}
-	return daemon
-}
 
-func (*Daemon) run() error {
+	// 有checker初始化失败时保留原来的版本，失败的checker在下次加载(例如SIGHUP)时会重新尝试
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to initialize checkers: %s", strings.Join(errs, "; "))
+	}
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	daemon.config = newConfig
+	daemon.reloadState["revision"] = daemon.reloadState["revision"].(int) + 1
+	daemon.reloadState["hash"] = newConfig.config_hash
+	daemon.reloadState["time"] = time.Now()
 	return nil
 }
 
+// history、events、publisher和reload只在启动时读取，发生变化时提示需要重启
+func warnRestartRequired(oldConfig *DaemonConfig, newConfig *DaemonConfig) {
+	for _, name := range []string{"history", "events", "publisher", "reload"} {
+		if configChanged(oldConfig, newConfig, name) {
+			warnln(fmt.Sprintf("Changes of %s take effect after restart", name))
+		}
+	}
+}
+
+func (daemon *Daemon) activate(name string, checker Checker) {
+	notifyCheckHooks(checker.info())
+	running := make(chan struct{})
+	daemon.mutex.Lock()
+	daemon.active[name] = checker
+	daemon.running[name] = running
+	daemon.routers[name] = checker.newRouters()
+	daemon.mutex.Unlock()
+	go func() {
+		defer close(running)
+		checker.start()
+	}()
+}
+
+// 停止checker，并等待start()返回以及正在执行的check()结束，之后才可以重新initialize()
+func (daemon *Daemon) deactivate(name string, checker Checker) {
+	daemon.mutex.Lock()
+	running := daemon.running[name]
+	delete(daemon.active, name)
+	delete(daemon.running, name)
+	delete(daemon.routers, name)
+	daemon.mutex.Unlock()
+	checker.stop()
+	<-running
+	waitCheck(checker)
+}
+
+func configChanged(oldConfig *DaemonConfig, newConfig *DaemonConfig, name string) bool {
+	return oldConfig == nil || !reflect.DeepEqual(oldConfig.getCustomConfig(name), newConfig.getCustomConfig(name))
+}
+
+func (daemon *Daemon) activeCheckers() map[string]Checker {
+	daemon.mutex.RLock()
+	defer daemon.mutex.RUnlock()
+	active := make(map[string]Checker)
+	for name, checker := range daemon.active {
+		active[name] = checker
+	}
+	return active
+}
+
+func (daemon *Daemon) checkerRouters(name string) (Routers, bool) {
+	daemon.mutex.RLock()
+	defer daemon.mutex.RUnlock()
+	routers, ok := daemon.routers[name]
+	return routers, ok
+}
+
+func (daemon *Daemon) configs() map[string]interface{} {
+	daemon.mutex.RLock()
+	defer daemon.mutex.RUnlock()
+	reloadState := make(map[string]interface{})
+	for key, value := range daemon.reloadState {
+		reloadState[key] = value
+	}
+	return map[string]interface{}{
+		"daemon":  daemon.config.toMap(),
+		"checker": allRecordedConfigs(),
+		"reload":  reloadState,
+	}
+}
+
+// 立即触发指定checker的check()并等待结果，超时的checker返回Unknown
+func (daemon *Daemon) triggerChecks(names []string, timeout time.Duration) (map[string]interface{}, bool) {
+	active := daemon.activeCheckers()
+	calls := make(map[string]*checkCall)
+	for _, name := range names {
+		if checker, ok := active[name]; ok {
+			calls[name] = runCheck(checker)
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	expired := false
+	completed := true
+	states := make(map[string]interface{})
+	for name, call := range calls {
+		if !expired {
+			select {
+			case <-call.done:
+			case <-timer.C:
+				expired = true
+			}
+		}
+		select {
+		case <-call.done:
+			info := active[name].info()
+			if call.err != nil {
+				info.reason = call.err.Error()
+			}
+			states[name] = info.toMap()
+		default:
+			completed = false
+			info := UnknownInfo(name)
+			info.reason = fmt.Sprintf("Timeout after %s while checking", timeout)
+			states[name] = info.toMap()
+		}
+	}
+	return states, completed
+}
+
+type checkerMetrics struct {
+	name    string
+	metrics []Metric
+}
+
+// 每个checker并发收集，check()持有锁时info()和metrics()会阻塞；
+// 超过metrics.timeout的checker只输出状态为Unknown的通用指标
+func (daemon *Daemon) metrics() []Metric {
+	daemon.mutex.RLock()
+	timeout := daemon.config.getOrDefault("metrics", "timeout", defaultMetricsTimeout).(time.Duration)
+	daemon.mutex.RUnlock()
+	active := daemon.activeCheckers()
+	ch := make(chan checkerMetrics, len(active))
+	pending := make(map[string]bool)
+	for name, checker := range active {
+		pending[name] = true
+		go func(name string, checker Checker) {
+			ch <- checkerMetrics{name, append(infoMetrics(checker.info()), checker.metrics()...)}
+		}(name, checker)
+	}
+
+	metrics := []Metric{}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case result := <-ch:
+			delete(pending, result.name)
+			metrics = append(metrics, result.metrics...)
+		case <-timer.C:
+			for name := range pending {
+				log.Println(fmt.Sprintf("Timeout while trying to get metrics of %s", name))
+				metrics = append(metrics, infoMetrics(*UnknownInfo(name))...)
+			}
+			return metrics
+		}
+	}
+	return metrics
+}
+
 func (daemon *Daemon) states() map[string]interface{} {
-	if len(checkers) == 0 {
+	active := daemon.activeCheckers()
+	if len(active) == 0 {
 		return map[string]interface{}{}
 	}
 	states := make(map[string]interface{})
 	ch := make(chan Info)
 	ok := make(chan struct{})
-	for name, checker := range checkers {
+	for name, checker := range active {
 		info := UnknownInfo(name)
 		states[name] = info.toMap()
 		go func(name string, checker Checker) {
@@ -76,7 +437,7 @@ func (daemon *Daemon) states() map[string]interface{} {
 			case info := <-ch:
 				count += 1
 				states[info.name] = info.toMap()
-				if count == len(checkers) {
+				if count == len(active) {
 					close(ok)
 					break
 				}
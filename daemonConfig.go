@@ -1,17 +1,29 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
-var configsRecorded = make(map[string]map[string]interface{})
+var (
+	configsRecordedMutex sync.RWMutex
+	configsRecorded      = make(map[string]map[string]interface{})
+)
 
 type DaemonConfig struct {
+	config_path   string
+	config_hash   string
 	separator     string
 	debug_enable  bool
 	mount_point   string
@@ -24,6 +36,7 @@ type DaemonConfig struct {
 
 func (daemonConfig *DaemonConfig) toMap() map[string]interface{} {
 	return map[string]interface{}{
+		"config_path":  daemonConfig.config_path,
 		"separator":    daemonConfig.separator,
 		"debug_enable": daemonConfig.debug_enable,
 		"mount_point":  daemonConfig.mount_point,
@@ -56,6 +69,60 @@ func (daemonConfig *DaemonConfig) setMountPoint(mount_point string) *DaemonConfi
 	return daemonConfig
 }
 
+// 读取-c指定的yaml文件，返回的DaemonConfig除了customConfigs外都和原来的一致
+func (daemonConfig *DaemonConfig) load(config_path string) (*DaemonConfig, error) {
+	newConfig := *daemonConfig
+	newConfig.config_path = config_path
+	newConfig.customConfigs = make(map[string]map[string]interface{})
+	if config_path == "" {
+		return &newConfig, nil
+	}
+	yaml_data, err := ioutil.ReadFile(config_path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(yaml_data, &newConfig.customConfigs); err != nil {
+		return nil, err
+	}
+	newConfig.config_hash = configHash(yaml_data)
+	return &newConfig, nil
+}
+
+func configHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+func recordedConfigs(checkerName string) map[string]interface{} {
+	configsRecordedMutex.RLock()
+	defer configsRecordedMutex.RUnlock()
+	config := make(map[string]interface{})
+	for key, value := range configsRecorded[checkerName] {
+		config[key] = value
+	}
+	return config
+}
+
+func allRecordedConfigs() map[string]interface{} {
+	configsRecordedMutex.RLock()
+	defer configsRecordedMutex.RUnlock()
+	configs := make(map[string]interface{})
+	for checkerName, config := range configsRecorded {
+		checkerConfig := make(map[string]interface{})
+		for key, value := range config {
+			checkerConfig[key] = value
+		}
+		configs[checkerName] = checkerConfig
+	}
+	return configs
+}
+
+func forgetRecordedConfigs(checkerName string) {
+	configsRecordedMutex.Lock()
+	defer configsRecordedMutex.Unlock()
+	delete(configsRecorded, checkerName)
+}
+
 func (daemonConfig *DaemonConfig) getCustomConfig(checkerName string) map[string]interface{} {
 	if config, ok := daemonConfig.customConfigs[checkerName]; ok {
 		return config
@@ -63,21 +130,42 @@ func (daemonConfig *DaemonConfig) getCustomConfig(checkerName string) map[string
 	return make(map[string]interface{})
 }
 
+// 配置文件中只有改名之前的配置项(见deprecatedConfigKeys)时，使用它的值作为缺省值
+func (daemonConfig *DaemonConfig) getOrDeprecated(checkerName string, key string, default_value interface{}) interface{} {
+	custom := daemonConfig.getCustomConfig(checkerName)
+	if _, ok := custom[key]; !ok {
+		for oldKey, newKey := range deprecatedConfigKeys[checkerName] {
+			if value, ok := custom[oldKey]; ok && newKey == key && reflect.TypeOf(value) == reflect.TypeOf(default_value) {
+				default_value = value
+			}
+		}
+	}
+	return daemonConfig.getOrDefault(checkerName, key, default_value)
+}
+
 func (daemonConfig *DaemonConfig) getOrDefault(checkerName string, key string, default_value interface{}) (value interface{}) {
 	defer func() {
+		configsRecordedMutex.Lock()
+		defer configsRecordedMutex.Unlock()
 		if checkerConfigs, ok := configsRecorded[checkerName]; ok {
-			checkerConfigs[key] = value
+			checkerConfigs[key] = stringifyKeys(value)
 		} else {
-			configsRecorded[checkerName] = map[string]interface{}{key: value}
+			configsRecorded[checkerName] = map[string]interface{}{key: stringifyKeys(value)}
 		}
 	}()
 	//from env
-	value_str := os.Getenv(fmt.Sprintf("%s_%s", strings.ToUpper(checkerName), strings.ToUpper(strings.Replace(key, ".", "_", -1))))
-	if value_str != "" {
+	env_name := configEnvName(checkerName, key)
+	value_str := os.Getenv(env_name)
+	if err := validateEnvValue(ConfigItem{key, default_value, ""}, value_str, daemonConfig.separator); value_str != "" && err != nil {
+		errorln(fmt.Sprintf("Ignore env %s: %s", env_name, err))
+	} else if value_str != "" {
 		value_array_string := strings.Split(value_str, daemonConfig.separator) // used when default_value is an array
 		switch default_value.(type) {
 		case string:
 			return value_str
+		case bool:
+			value_bool, _ := strconv.ParseBool(value_str)
+			return value_bool
 		case int:
 			value_int, _ := strconv.Atoi(value_str)
 			return value_int
@@ -117,6 +205,10 @@ func (daemonConfig *DaemonConfig) getOrDefault(checkerName string, key string, d
 		//default
 		return default_value
 	}
+	if err := validateConfigValue(ConfigItem{key, default_value, ""}, the_value); err != nil {
+		errorln(fmt.Sprintf("Ignore config %s.%s: %s", checkerName, key, err))
+		return default_value
+	}
 
 	switch the_value.(type) {
 	case string:
@@ -132,6 +224,8 @@ func (daemonConfig *DaemonConfig) getOrDefault(checkerName string, key string, d
 		case time.Duration:
 			value_duration := time.Second * time.Duration(the_value.(int))
 			return value_duration
+		case float64:
+			return float64(the_value.(int))
 		default:
 			return the_value
 		}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的checker，block不为nil时check()和metrics()阻塞直到block被关闭
+type fakeChecker struct {
+	name   string
+	mutex  sync.Mutex
+	checks int
+	inits  int
+	value  int
+	block  chan struct{}
+}
+
+// 配置中fail为true时初始化失败，成功时记录配置中的value
+func (c *fakeChecker) initialize(daemonConfig *DaemonConfig) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inits++
+	if daemonConfig.getOrDefault(c.name, "fail", false).(bool) {
+		return fmt.Errorf("%s is misconfigured", c.name)
+	}
+	c.value = daemonConfig.getOrDefault(c.name, "value", 0).(int)
+	return nil
+}
+
+func (c *fakeChecker) initState() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inits, c.value
+}
+
+func (c *fakeChecker) state() (State, string) {
+	return Live, ""
+}
+
+func (c *fakeChecker) start() {}
+
+func (c *fakeChecker) stop() {}
+
+func (c *fakeChecker) check() error {
+	if c.block != nil {
+		<-c.block
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checks++
+	return nil
+}
+
+func (c *fakeChecker) checkCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.checks
+}
+
+func (c *fakeChecker) info() Info {
+	return Info{name: c.name, state: Live, basic: map[string]interface{}{"checks": c.checkCount()}}
+}
+
+func (c *fakeChecker) metrics() []Metric {
+	if c.block != nil {
+		<-c.block
+	}
+	return []Metric{newMetric("fake_value", "Value of the fake checker.", 1, "checker", c.name)}
+}
+
+func (c *fakeChecker) newRouters() Routers {
+	return make(Routers)
+}
+
+func TestDaemonMetricsTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	daemon := &Daemon{
+		config: &DaemonConfig{customConfigs: map[string]map[string]interface{}{
+			"metrics": {"timeout": "200ms"},
+		}},
+		active: map[string]Checker{
+			"fast": &fakeChecker{name: "fast"},
+			"slow": &fakeChecker{name: "slow", block: block},
+		},
+	}
+
+	startTime := time.Now()
+	output := string(writeMetrics(daemon.metrics()))
+	if elapsed := time.Since(startTime); elapsed < time.Millisecond*200 || elapsed > time.Second*2 {
+		t.Errorf("expected to return after metrics.timeout, took %s", elapsed)
+	}
+	for _, line := range []string{
+		`node_guard_fake_value{checker="fast"} 1`,
+		`node_guard_checker_state{checker="fast",state="Live"} 1`,
+		`node_guard_checker_state{checker="slow",state="Unknown"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, `node_guard_fake_value{checker="slow"}`) {
+		t.Errorf("metrics of the slow checker should be skipped:\n%s", output)
+	}
+
+	// 缺省的超时需要小于Prometheus缺省的scrape_timeout
+	daemon.config = &DaemonConfig{}
+	if timeout := daemon.config.getOrDefault("metrics", "timeout", defaultMetricsTimeout).(time.Duration); timeout >= time.Second*10 {
+		t.Errorf("default metrics.timeout %s should be below 10s", timeout)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	initLogger(false)
+	alpha, beta := &fakeChecker{name: "alpha"}, &fakeChecker{name: "beta"}
+	registered := checkers
+	checkers = map[string]Checker{"alpha": alpha, "beta": beta}
+	defer func() { checkers = registered }()
+
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := path.Join(dir, "conf.yaml")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectInits := func(step string, checker *fakeChecker, inits int, value int) {
+		if actualInits, actualValue := checker.initState(); actualInits != inits || actualValue != value {
+			t.Errorf("%s: expected %s initialized %d times with value %d, got %d %d", step, checker.name, inits, value, actualInits, actualValue)
+		}
+	}
+
+	writeConfig("alpha:\n  value: 1\nbeta:\n  value: 1\n")
+	config, err := (&DaemonConfig{}).load(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := &Daemon{
+		active:      make(map[string]Checker),
+		running:     make(map[string]chan struct{}),
+		routers:     make(map[string]Routers),
+		applied:     make(map[string]*DaemonConfig),
+		reloadState: map[string]interface{}{"revision": 0},
+	}
+	if err := daemon.apply(config); err != nil {
+		t.Fatal(err)
+	}
+	expectInits("apply", alpha, 1, 1)
+	expectInits("apply", beta, 1, 1)
+
+	// 内容没有变化时不重新加载
+	daemon.reload(false)
+	expectInits("unchanged", alpha, 1, 1)
+
+	// 只有配置变化的checker被重新初始化
+	writeConfig("alpha:\n  value: 2\nbeta:\n  value: 1\n")
+	daemon.reload(false)
+	expectInits("changed", alpha, 2, 2)
+	expectInits("changed", beta, 1, 1)
+	if daemon.reloadState["revision"] != 2 || daemon.reloadState["lastError"] != nil {
+		t.Errorf("expected revision 2 without errors, got %v", daemon.reloadState)
+	}
+
+	// 初始化失败的checker回退到原来的配置，其它checker使用新的配置
+	writeConfig("alpha:\n  value: 3\n  fail: true\nbeta:\n  value: 3\n")
+	daemon.reload(false)
+	expectInits("rollback", alpha, 4, 2)
+	expectInits("rollback", beta, 2, 3)
+	if _, ok := daemon.activeCheckers()["alpha"]; !ok {
+		t.Errorf("alpha should still be active after rollback")
+	}
+	if daemon.applied["alpha"].getCustomConfig("alpha")["value"] != 2 || daemon.applied["beta"].getCustomConfig("beta")["value"] != 3 {
+		t.Errorf("unexpected applied configs %v %v", daemon.applied["alpha"].customConfigs, daemon.applied["beta"].customConfigs)
+	}
+	if lastError, _ := daemon.reloadState["lastError"].(string); daemon.reloadState["revision"] != 2 || !strings.Contains(lastError, "alpha: alpha is misconfigured") {
+		t.Errorf("expected the failure in reload state, got %v", daemon.reloadState)
+	}
+
+	// 失败的版本只在强制加载时重试
+	daemon.reload(false)
+	expectInits("failed hash", alpha, 4, 2)
+	daemon.reload(true)
+	expectInits("forced", alpha, 6, 2)
+
+	// 被禁用的checker停止运行，修复之后清除错误
+	writeConfig("checkers:\n  disable:\n    - beta\nalpha:\n  value: 4\nbeta:\n  value: 3\n")
+	daemon.reload(false)
+	expectInits("fixed", alpha, 7, 4)
+	active := daemon.activeCheckers()
+	if _, ok := active["beta"]; ok || len(active) != 1 {
+		t.Errorf("expected only alpha to be active, got %v", active)
+	}
+	if daemon.reloadState["revision"] != 3 || daemon.reloadState["lastError"] != nil {
+		t.Errorf("expected revision 3 without errors, got %v", daemon.reloadState)
+	}
+
+	// 校验失败时不改变任何checker
+	writeConfig("checkers:\n  disable: beta\nalpha:\n  value: 5\n")
+	daemon.reload(false)
+	expectInits("invalid", alpha, 7, 4)
+	if lastError, _ := daemon.reloadState["lastError"].(string); !strings.Contains(lastError, "checkers.disable") {
+		t.Errorf("expected the validation error in reload state, got %v", daemon.reloadState)
+	}
+	writeConfig("alpha: [")
+	daemon.reload(false)
+	if daemon.reloadState["revision"] != 3 || daemon.config.getCustomConfig("alpha")["value"] != 4 {
+		t.Errorf("expected the applied config to be kept, got %v", daemon.reloadState)
+	}
+
+	// 无法解析的文件同样只在变化或者强制加载时重试
+	lastErrorTime := daemon.reloadState["lastErrorTime"]
+	daemon.reload(false)
+	if daemon.reloadState["lastErrorTime"] != lastErrorTime {
+		t.Errorf("expected the unchanged broken file to be skipped, got %v", daemon.reloadState)
+	}
+	daemon.reload(true)
+	if daemon.reloadState["lastErrorTime"] == lastErrorTime {
+		t.Errorf("expected a forced reload to retry the broken file")
+	}
+	os.Remove(configPath)
+	daemon.reload(false)
+	lastErrorTime = daemon.reloadState["lastErrorTime"]
+	daemon.reload(false)
+	if lastError, _ := daemon.reloadState["lastError"].(string); daemon.reloadState["lastErrorTime"] != lastErrorTime || !strings.Contains(lastError, "no such file") {
+		t.Errorf("expected the missing file to be reported once, got %v", daemon.reloadState)
+	}
+	writeConfig("alpha:\n  value: 6\n")
+	daemon.reload(false)
+	expectInits("repaired", alpha, 8, 6)
+	if daemon.reloadState["revision"] != 4 || daemon.reloadState["lastError"] != nil {
+		t.Errorf("expected revision 4 without errors, got %v", daemon.reloadState)
+	}
+}
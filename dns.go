@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 参考RFC 1035，只实现了检查需要的A、AAAA、CNAME和PTR
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypePTR   = 12
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+
+	dnsHeaderSize = 12
+	// 没有EDNS时UDP响应最大512字节，截断时改用TCP
+	dnsMaxUDPSize    = 512
+	dnsRcodeNXDomain = 3
+)
+
+var dnsRcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+type dnsAnswer struct {
+	name   string
+	rrType uint16
+	ttl    uint32
+	data   string
+}
+
+// rcode不为NOERROR时返回的错误
+type dnsRcodeError struct {
+	name  string
+	rcode int
+}
+
+func (e *dnsRcodeError) Error() string {
+	rcode, ok := dnsRcodeNames[e.rcode]
+	if !ok {
+		rcode = "RCODE" + strconv.Itoa(e.rcode)
+	}
+	return fmt.Sprintf("%s: %s", e.name, rcode)
+}
+
+func isNXDomain(err error) bool {
+	rcodeErr, ok := err.(*dnsRcodeError)
+	return ok && rcodeErr.rcode == dnsRcodeNXDomain
+}
+
+// 直接向server发送递归查询，不经过本机的/etc/hosts和nsswitch
+func dnsQuery(server string, name string, qtype uint16, timeout time.Duration) ([]dnsAnswer, error) {
+	id := uint16(rand.Uint32())
+	query, err := newDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	response, err := dnsExchangeUDP(server, query, id, deadline)
+	if err != nil {
+		return nil, err
+	}
+	// TC位
+	if response[2]&0x02 != 0 {
+		if response, err = dnsExchangeTCP(server, query, id, deadline); err != nil {
+			return nil, err
+		}
+	}
+	return parseDNSResponse(response, name)
+}
+
+func dnsExchangeUDP(server string, query []byte, id uint16, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略id不匹配的迟到的响应
+		if n >= dnsHeaderSize && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// TCP上每个消息前有2字节的长度
+func dnsExchangeTCP(server string, query []byte, id uint16, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	message := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	if _, err := conn.Write(append(message, query...)); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if len(response) < dnsHeaderSize || binary.BigEndian.Uint16(response) != id {
+		return nil, fmt.Errorf("unexpected response from %s", server)
+	}
+	return response, nil
+}
+
+func newDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	query := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(query[0:], id)
+	// RD位，请求递归查询
+	binary.BigEndian.PutUint16(query[2:], 0x0100)
+	binary.BigEndian.PutUint16(query[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name '%s'", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(query[len(query)-4:], qtype)
+	binary.BigEndian.PutUint16(query[len(query)-2:], dnsClassIN)
+	return query, nil
+}
+
+func parseDNSResponse(response []byte, name string) ([]dnsAnswer, error) {
+	if response[2]&0x80 == 0 {
+		return nil, fmt.Errorf("%s: not a response", name)
+	}
+	if rcode := int(response[3] & 0x0f); rcode != 0 {
+		return nil, &dnsRcodeError{name: name, rcode: rcode}
+	}
+	questions := int(binary.BigEndian.Uint16(response[4:]))
+	answers := int(binary.BigEndian.Uint16(response[6:]))
+	offset := dnsHeaderSize
+	for i := 0; i < questions; i++ {
+		_, next, err := decodeDNSName(response, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+	}
+	result := []dnsAnswer{}
+	for i := 0; i < answers; i++ {
+		owner, next, err := decodeDNSName(response, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(response) {
+			return nil, fmt.Errorf("truncated answer in the response of %s", name)
+		}
+		answer := dnsAnswer{
+			name:   owner,
+			rrType: binary.BigEndian.Uint16(response[next:]),
+			ttl:    binary.BigEndian.Uint32(response[next+4:]),
+		}
+		length := int(binary.BigEndian.Uint16(response[next+8:]))
+		dataOffset := next + 10
+		if dataOffset+length > len(response) {
+			return nil, fmt.Errorf("truncated answer in the response of %s", name)
+		}
+		data := response[dataOffset : dataOffset+length]
+		switch answer.rrType {
+		case dnsTypeA, dnsTypeAAAA:
+			answer.data = net.IP(data).String()
+		case dnsTypeCNAME, dnsTypePTR:
+			if answer.data, _, err = decodeDNSName(response, dataOffset); err != nil {
+				return nil, err
+			}
+		default:
+			offset = dataOffset + length
+			continue
+		}
+		result = append(result, answer)
+		offset = dataOffset + length
+	}
+	return result, nil
+}
+
+// 支持压缩指针，返回的名字不带结尾的"."，以及名字之后的偏移
+func decodeDNSName(message []byte, offset int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(message) {
+			return "", 0, fmt.Errorf("invalid domain name in the dns message")
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(message) || jumps > 64 {
+				return "", 0, fmt.Errorf("invalid compression pointer in the dns message")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(message) {
+				return "", 0, fmt.Errorf("invalid domain name in the dns message")
+			}
+			labels = append(labels, string(message[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// 与libc一样，名字中的"."少于ndots时先尝试search域，以"."结尾的名字不使用search域
+func dnsCandidates(name string, searches []string, ndots int) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	withSearches := []string{}
+	for _, search := range searches {
+		withSearches = append(withSearches, name+"."+strings.TrimSuffix(search, ".")+".")
+	}
+	if strings.Count(name, ".") >= ndots {
+		return append([]string{name + "."}, withSearches...)
+	}
+	return append(withSearches, name+".")
+}
+
+// 查询A和AAAA，依次尝试每个候选的名字直到有结果，返回实际解析的名字
+func dnsLookupIPs(server string, candidates []string, timeout time.Duration) (string, []string, error) {
+	var lastErr error
+	for _, candidate := range candidates {
+		ips := []string{}
+		var queryErr error
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			answers, err := dnsQuery(server, candidate, qtype, timeout)
+			// A查询出错时AAAA的结果也一样，不再查询
+			if err != nil {
+				queryErr = err
+				break
+			}
+			for _, answer := range answers {
+				if answer.rrType == qtype {
+					ips = append(ips, answer.data)
+				}
+			}
+		}
+		if len(ips) > 0 {
+			return strings.TrimSuffix(candidate, "."), ips, nil
+		}
+		// 只有名字不存在或者没有记录时才尝试下一个候选，超时、SERVFAIL等直接返回
+		if queryErr != nil && !isNXDomain(queryErr) {
+			return "", nil, queryErr
+		}
+		lastErr = queryErr
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%s: no A or AAAA records", strings.TrimSuffix(candidate, "."))
+		}
+	}
+	return "", nil, lastErr
+}
+
+func dnsLookupPTR(server string, ip string, timeout time.Duration) ([]string, error) {
+	name, err := reverseDNSName(ip)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := dnsQuery(server, name, dnsTypePTR, timeout)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, answer := range answers {
+		if answer.rrType == dnsTypePTR {
+			names = append(names, answer.data)
+		}
+	}
+	return names, nil
+}
+
+// 1.2.3.4对应4.3.2.1.in-addr.arpa.，IPv6按半字节倒序放在ip6.arpa.之下
+func reverseDNSName(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid ip '%s'", ip)
+	}
+	if ipv4 := parsed.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ipv4[3], ipv4[2], ipv4[1], ipv4[0]), nil
+	}
+	var name strings.Builder
+	for i := len(parsed) - 1; i >= 0; i-- {
+		fmt.Fprintf(&name, "%x.%x.", parsed[i]&0x0f, parsed[i]>>4)
+	}
+	name.WriteString("ip6.arpa.")
+	return name.String(), nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 127.0.0.1上同一个端口的UDP和TCP的DNS服务，按名字返回固定的记录，其它名字为NXDOMAIN
+type testDNSServer struct {
+	address    string
+	udp        net.PacketConn
+	tcp        net.Listener
+	tcpQueries int32
+}
+
+type testDNSRecord struct {
+	rrType uint16
+	data   []byte
+}
+
+var testDNSRecords = map[string][]testDNSRecord{
+	"host.example.com":  {{dnsTypeA, []byte{10, 0, 0, 1}}},
+	"noptr.example.com": {{dnsTypeA, []byte{10, 0, 0, 2}}},
+	"wrong.example.com": {{dnsTypeA, []byte{10, 0, 0, 3}}},
+	"v6.example.com":    {{dnsTypeAAAA, net.ParseIP("fd00::1")}},
+	// CNAME的data由testDNSResponse生成，用压缩指针引用问题中的example.com
+	"www.example.com":        {{dnsTypeCNAME, nil}, {dnsTypeA, []byte{10, 0, 0, 1}}},
+	"1.0.0.10.in-addr.arpa":  {{dnsTypePTR, testDNSName("host.example.com")}},
+	"3.0.0.10.in-addr.arpa":  {{dnsTypePTR, testDNSName("other.example.com")}},
+	"servfail.example.com":   nil,
+	"truncated.example.com":  {{dnsTypeA, []byte{10, 0, 0, 4}}},
+	"empty.example.com":      {},
+	"kubernetes.default.svc": {{dnsTypeA, []byte{10, 96, 0, 1}}},
+}
+
+func testDNSName(name string) []byte {
+	encoded := []byte{}
+	for _, label := range strings.Split(name, ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	server := &testDNSServer{}
+	// UDP的端口在TCP上可能被占用，重试几次
+	for i := 0; i < 10; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen udp: %s", err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			continue
+		}
+		server.udp, server.tcp, server.address = udp, tcp, udp.LocalAddr().String()
+		break
+	}
+	if server.udp == nil {
+		t.Fatalf("failed to listen on the same port of udp and tcp")
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := server.udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.udp.WriteTo(testDNSResponse(buf[:n], false), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := server.tcp.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.tcpQueries, 1)
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(conn, length); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, query); err == nil {
+					response := testDNSResponse(query, true)
+					binary.BigEndian.PutUint16(length, uint16(len(response)))
+					conn.Write(append(length, response...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return server
+}
+
+func (s *testDNSServer) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+// 回答的owner都是指向问题的压缩指针，没有记录时返回NXDOMAIN，记录为nil时返回SERVFAIL
+func testDNSResponse(query []byte, tcp bool) []byte {
+	name, next, err := decodeDNSName(query, dnsHeaderSize)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[next:])
+	response := append([]byte{}, query[:next+4]...)
+	// QR、RD、RA
+	response[2], response[3] = 0x81, 0x80
+	records, ok := testDNSRecords[name]
+	switch {
+	case !ok:
+		response[3] |= dnsRcodeNXDomain
+		return response
+	case records == nil:
+		response[3] |= 2
+		return response
+	case name == "truncated.example.com" && !tcp:
+		response[2] |= 0x02
+		return response
+	}
+	// 问题中第一个标签之后的名字，对www.example.com就是example.com
+	suffixOffset := dnsHeaderSize + 1 + int(query[dnsHeaderSize])
+	answers := 0
+	for _, record := range records {
+		if record.rrType != qtype && record.rrType != dnsTypeCNAME {
+			continue
+		}
+		data := record.data
+		if record.rrType == dnsTypeCNAME {
+			data = []byte{4, 'h', 'o', 's', 't', 0xc0, byte(suffixOffset)}
+		}
+		answer := []byte{0xc0, dnsHeaderSize}
+		answer = append(answer, 0, 0, 0, dnsClassIN, 0, 0, 0, 60, 0, 0)
+		binary.BigEndian.PutUint16(answer[2:], record.rrType)
+		binary.BigEndian.PutUint16(answer[10:], uint16(len(data)))
+		response = append(response, answer...)
+		response = append(response, data...)
+		answers++
+	}
+	binary.BigEndian.PutUint16(response[6:], uint16(answers))
+	return response
+}
+
+func TestNewDNSQuery(t *testing.T) {
+	query, err := newDNSQuery(0x1234, "www.example.com.", dnsTypeAAAA)
+	if err != nil {
+		t.Fatalf("newDNSQuery: %s", err)
+	}
+	expected := []byte{
+		0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, dnsTypeAAAA, 0, dnsClassIN,
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("expected %x, got %x", expected, query)
+	}
+	for _, name := range []string{"a..b", ".", strings.Repeat("a", 64) + ".com"} {
+		if _, err := newDNSQuery(1, name, dnsTypeA); err == nil {
+			t.Errorf("expected an error for '%s'", name)
+		}
+	}
+}
+
+func TestDecodeDNSName(t *testing.T) {
+	message := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		// 12: example.com
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		// 25: www -> 12
+		3, 'w', 'w', 'w', 0xc0, 12,
+		// 31: -> 25
+		0xc0, 25,
+		// 33: 指向自己的循环
+		0xc0, 33,
+	}
+	for offset, expected := range map[int]struct {
+		name string
+		next int
+	}{
+		12: {"example.com", 25},
+		25: {"www.example.com", 31},
+		31: {"www.example.com", 33},
+	} {
+		name, next, err := decodeDNSName(message, offset)
+		if err != nil || name != expected.name || next != expected.next {
+			t.Errorf("offset %d: expected %s and %d, got %s, %d, %v", offset, expected.name, expected.next, name, next, err)
+		}
+	}
+	if _, _, err := decodeDNSName(message, 33); err == nil {
+		t.Errorf("expected an error for a compression loop")
+	}
+	if _, _, err := decodeDNSName(message[:20], 12); err == nil {
+		t.Errorf("expected an error for a truncated name")
+	}
+}
+
+func TestDNSCandidates(t *testing.T) {
+	searches := []string{"default.svc.cluster.local", "cluster.local."}
+	for _, c := range []struct {
+		name     string
+		ndots    int
+		expected []string
+	}{
+		{"host.", 5, []string{"host."}},
+		{"kubernetes.default", 5, []string{"kubernetes.default.default.svc.cluster.local.", "kubernetes.default.cluster.local.", "kubernetes.default."}},
+		{"kubernetes.default", 1, []string{"kubernetes.default.", "kubernetes.default.default.svc.cluster.local.", "kubernetes.default.cluster.local."}},
+		{"host", 0, []string{"host.", "host.default.svc.cluster.local.", "host.cluster.local."}},
+	} {
+		if candidates := dnsCandidates(c.name, searches, c.ndots); !reflect.DeepEqual(candidates, c.expected) {
+			t.Errorf("%s with ndots %d: expected %v, got %v", c.name, c.ndots, c.expected, candidates)
+		}
+	}
+}
+
+func TestDNSQuery(t *testing.T) {
+	server := newTestDNSServer(t)
+	defer server.close()
+
+	answers, err := dnsQuery(server.address, "www.example.com.", dnsTypeA, time.Second)
+	if err != nil {
+		t.Fatalf("dnsQuery: %s", err)
+	}
+	expected := []dnsAnswer{
+		{name: "www.example.com", rrType: dnsTypeCNAME, ttl: 60, data: "host.example.com"},
+		{name: "www.example.com", rrType: dnsTypeA, ttl: 60, data: "10.0.0.1"},
+	}
+	if !reflect.DeepEqual(answers, expected) {
+		t.Errorf("expected %+v, got %+v", expected, answers)
+	}
+
+	if _, err := dnsQuery(server.address, "missing.example.com.", dnsTypeA, time.Second); !isNXDomain(err) {
+		t.Errorf("expected NXDOMAIN, got %v", err)
+	}
+	if _, err := dnsQuery(server.address, "servfail.example.com.", dnsTypeA, time.Second); err == nil || isNXDomain(err) || !strings.Contains(err.Error(), "SERVFAIL") {
+		t.Errorf("expected SERVFAIL, got %v", err)
+	}
+
+	// 截断的UDP响应改用TCP
+	answers, err = dnsQuery(server.address, "truncated.example.com.", dnsTypeA, time.Second)
+	if err != nil || len(answers) != 1 || answers[0].data != "10.0.0.4" {
+		t.Errorf("expected 10.0.0.4 over tcp, got %+v, %v", answers, err)
+	}
+	if queries := atomic.LoadInt32(&server.tcpQueries); queries != 1 {
+		t.Errorf("expected 1 tcp query, got %d", queries)
+	}
+}
+
+func TestDNSLookupIPs(t *testing.T) {
+	server := newTestDNSServer(t)
+	defer server.close()
+
+	resolved, ips, err := dnsLookupIPs(server.address, dnsCandidates("host", []string{"example.com"}, 1), time.Second)
+	if err != nil || resolved != "host.example.com" || !reflect.DeepEqual(ips, []string{"10.0.0.1"}) {
+		t.Errorf("expected host.example.com [10.0.0.1], got %s %v %v", resolved, ips, err)
+	}
+	resolved, ips, err = dnsLookupIPs(server.address, dnsCandidates("kubernetes.default.svc", []string{"cluster.local"}, 5), time.Second)
+	if err != nil || resolved != "kubernetes.default.svc" || !reflect.DeepEqual(ips, []string{"10.96.0.1"}) {
+		t.Errorf("expected kubernetes.default.svc [10.96.0.1] after the search domain, got %s %v %v", resolved, ips, err)
+	}
+	if _, ips, err = dnsLookupIPs(server.address, []string{"v6.example.com."}, time.Second); err != nil || !reflect.DeepEqual(ips, []string{"fd00::1"}) {
+		t.Errorf("expected [fd00::1], got %v %v", ips, err)
+	}
+	if _, _, err = dnsLookupIPs(server.address, []string{"empty.example.com.", "missing.example.com."}, time.Second); !isNXDomain(err) {
+		t.Errorf("expected NXDOMAIN of the last candidate, got %v", err)
+	}
+	// SERVFAIL不再尝试后面的候选
+	if _, _, err = dnsLookupIPs(server.address, []string{"servfail.example.com.", "host.example.com."}, time.Second); err == nil {
+		t.Errorf("expected SERVFAIL without trying the next candidate")
+	}
+}
+
+func TestDNSCheckerReverseLookup(t *testing.T) {
+	server := newTestDNSServer(t)
+	defer server.close()
+	c := &DNSChecker{timeout: time.Second}
+
+	result := c.lookup([]string{"host.example.com."}, server.address, true)
+	if result.err != nil || len(result.reverseMismatch) != 0 || !reflect.DeepEqual(result.reverse["10.0.0.1"], []string{"host.example.com"}) {
+		t.Errorf("expected a matched PTR, got %+v", result)
+	}
+	// 没有PTR记录(NXDOMAIN)不算不一致
+	result = c.lookup([]string{"noptr.example.com."}, server.address, true)
+	if result.err != nil || len(result.reverseMismatch) != 0 || len(result.reverse["10.0.0.2"]) != 0 {
+		t.Errorf("expected no PTR without a mismatch, got %+v", result)
+	}
+	result = c.lookup([]string{"wrong.example.com."}, server.address, true)
+	if result.err != nil || result.reverseMismatch["10.0.0.3"] == "" {
+		t.Errorf("expected a mismatched PTR, got %+v", result)
+	}
+}
+
+func TestReverseDNSName(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"10.0.0.1":    "1.0.0.10.in-addr.arpa.",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	} {
+		if name, err := reverseDNSName(ip); err != nil || name != expected {
+			t.Errorf("%s: expected %s, got %s %v", ip, expected, name, err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateChanged  = "StateChanged"
+	ErrorAppeared = "ErrorAppeared"
+	ErrorCleared  = "ErrorCleared"
+	ValueChanged  = "ValueChanged"
+)
+
+const eventQueueSize = 1024
+
+func init() {
+	registerConfigSchema("events",
+		ConfigItem{"watch", []string{}, "watched values like os.units.docker.service.activeState"},
+		ConfigItem{"sinks", []interface{}{}, "sinks of events, type is one of webhook, slack and file"},
+	)
+}
+
+type Event struct {
+	Type    string      `json:"type"`
+	Node    string      `json:"node"`
+	Checker string      `json:"checker"`
+	Time    time.Time   `json:"time"`
+	Key     string      `json:"key,omitempty"`
+	Old     interface{} `json:"old,omitempty"`
+	New     interface{} `json:"new,omitempty"`
+	Message string      `json:"message"`
+}
+
+type EventSink interface {
+	send(event Event) error
+}
+
+// 对比每个checker前后两次的Info，产生事件并投递给所有的sink
+type Events struct {
+	mutex    sync.Mutex
+	node     string
+	watches  map[string][]string
+	lastInfo map[string]Info
+	sinks    []*eventSinkRunner
+}
+
+type eventSinkRunner struct {
+	name    string
+	sink    EventSink
+	types   map[string]bool
+	retries int
+	backoff time.Duration
+	queue   chan Event
+}
+
+func NewEvents(daemonConfig *DaemonConfig) (*Events, error) {
+	events := &Events{
+		watches:  make(map[string][]string),
+		lastInfo: make(map[string]Info),
+	}
+	events.node, _ = os.Hostname()
+	// 形如 os.units.docker.service.activeState，第一个"."之前为checker的名字
+	for _, watch := range daemonConfig.getOrDefault("events", "watch", []string{}).([]string) {
+		segs := strings.SplitN(watch, ".", 2)
+		if len(segs) != 2 {
+			return nil, fmt.Errorf("invalid watch '%s', should be like checker.path", watch)
+		}
+		events.watches[segs[0]] = append(events.watches[segs[0]], segs[1])
+	}
+	sinkConfigs, ok := daemonConfig.getOrDefault("events", "sinks", []interface{}{}).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("events.sinks should be a list")
+	}
+	for i, sinkConfig := range sinkConfigs {
+		sinkConfigMap, ok := sinkConfig.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("sink %d should be a map", i)
+		}
+		runner, err := newEventSinkRunner(sinkConfigMap)
+		if err != nil {
+			return nil, fmt.Errorf("sink %d: %s", i, err)
+		}
+		events.sinks = append(events.sinks, runner)
+		go runner.run()
+	}
+	return events, nil
+}
+
+func newEventSinkRunner(config map[interface{}]interface{}) (*eventSinkRunner, error) {
+	var err error
+	sinkType, _ := config["type"].(string)
+	runner := &eventSinkRunner{
+		name:    sinkType,
+		types:   make(map[string]bool),
+		retries: 3,
+		backoff: time.Second,
+		queue:   make(chan Event, eventQueueSize),
+	}
+	if retries, ok := config["retries"].(int); ok {
+		runner.retries = retries
+	}
+	if backoff, ok := config["backoff"].(string); ok {
+		if runner.backoff, err = time.ParseDuration(backoff); err != nil {
+			return nil, err
+		}
+	}
+	timeout := time.Second * 10
+	if timeoutStr, ok := config["timeout"].(string); ok {
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			return nil, err
+		}
+	}
+	if types, ok := config["types"].([]interface{}); ok {
+		for _, t := range types {
+			runner.types[fmt.Sprint(t)] = true
+		}
+	}
+	url, _ := config["url"].(string)
+	switch sinkType {
+	case "webhook", "slack":
+		if url == "" {
+			return nil, fmt.Errorf("url is required by %s sink", sinkType)
+		}
+		runner.name = sinkType + " " + url
+		runner.sink = &webhookSink{
+			url:    url,
+			slack:  sinkType == "slack",
+			client: &http.Client{Timeout: timeout},
+		}
+	case "file":
+		filePath, _ := config["path"].(string)
+		if filePath == "" {
+			return nil, fmt.Errorf("path is required by file sink")
+		}
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			return nil, err
+		}
+		runner.name = sinkType + " " + filePath
+		runner.retries = 0
+		runner.sink = &fileSink{path: filePath}
+	default:
+		return nil, fmt.Errorf("unknown sink type '%s'", sinkType)
+	}
+	return runner, nil
+}
+
+func (e *Events) observe(info Info) {
+	e.mutex.Lock()
+	last, ok := e.lastInfo[info.name]
+	e.lastInfo[info.name] = info
+	e.mutex.Unlock()
+	if !ok {
+		return
+	}
+	for _, event := range e.diff(last, info) {
+		for _, runner := range e.sinks {
+			if len(runner.types) > 0 && !runner.types[event.Type] {
+				continue
+			}
+			select {
+			case runner.queue <- event:
+			default:
+				errorln(fmt.Sprintf("Event queue of %s is full, drop event: %s", runner.name, event.Message))
+			}
+		}
+	}
+}
+
+func (e *Events) diff(last Info, info Info) []Event {
+	events := []Event{}
+	newEvent := func(eventType string, key string, previous interface{}, current interface{}, message string) {
+		events = append(events, Event{
+			Type:    eventType,
+			Node:    e.node,
+			Checker: info.name,
+			Time:    info.checkTime,
+			Key:     key,
+			Old:     previous,
+			New:     current,
+			Message: fmt.Sprintf("[%s] %s: %s", e.node, info.name, message),
+		})
+	}
+	if last.state != info.state {
+		message := fmt.Sprintf("state changed from %s to %s", last.state, info.state)
+		if info.reason != "" {
+			message += ", reason: " + info.reason
+		}
+		newEvent(StateChanged, "", last.state, info.state, message)
+	}
+	lastErrors := stringifyErrors(last.errors)
+	errors := stringifyErrors(info.errors)
+	for key, value := range errors {
+		if _, ok := lastErrors[key]; !ok {
+			newEvent(ErrorAppeared, key, nil, value, fmt.Sprintf("error appeared on %s: %v", key, value))
+		}
+	}
+	for key, value := range lastErrors {
+		if _, ok := errors[key]; !ok {
+			newEvent(ErrorCleared, key, value, nil, fmt.Sprintf("error cleared on %s", key))
+		}
+	}
+	for _, watch := range e.watches[info.name] {
+		previous, _ := lookupPath(last.basic, watch)
+		current, _ := lookupPath(info.basic, watch)
+		if fmt.Sprint(previous) != fmt.Sprint(current) {
+			newEvent(ValueChanged, watch, previous, current, fmt.Sprintf("%s changed from %v to %v", watch, previous, current))
+		}
+	}
+	return events
+}
+
+// 失败后按backoff指数退避重试
+func (runner *eventSinkRunner) run() {
+	for event := range runner.queue {
+		backoff := runner.backoff
+		for attempt := 0; ; attempt++ {
+			err := runner.sink.send(event)
+			if err == nil {
+				break
+			}
+			if attempt >= runner.retries {
+				errorln(fmt.Sprintf("Failed to send event to %s after %d attempts: %s", runner.name, attempt+1, err))
+				break
+			}
+			debugln(fmt.Sprintf("Failed to send event to %s, retry after %s: %s", runner.name, backoff, err))
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+type webhookSink struct {
+	url    string
+	slack  bool
+	client *http.Client
+}
+
+func (s *webhookSink) send(event Event) error {
+	var payload interface{} = event
+	if s.slack {
+		payload = map[string]string{"text": event.Message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) send(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
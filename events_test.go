@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventsDiff(t *testing.T) {
+	events := &Events{node: "node1", watches: map[string][]string{"os": {"units.docker.service.activeState", "loads[0]"}}}
+	now := time.Now()
+	last := Info{
+		name:   "os",
+		state:  Live,
+		basic:  map[string]interface{}{"units": map[string]interface{}{"docker.service": map[string]interface{}{"activeState": "active"}}, "loads": []float64{1}},
+		errors: map[string]interface{}{"kernel": "permission denied"},
+	}
+	if diff := events.diff(last, last); len(diff) != 0 {
+		t.Errorf("expected no events without changes, got %v", diff)
+	}
+
+	info := Info{
+		name:      "os",
+		checkTime: now,
+		state:     Error,
+		reason:    "docker is down",
+		basic:     map[string]interface{}{"units": map[string]interface{}{"docker.service": map[string]interface{}{"activeState": "failed"}}, "loads": []float64{1}},
+		errors:    map[string]interface{}{"units": fmt.Errorf("dbus is unavailable")},
+	}
+	diff := events.diff(last, info)
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Type < diff[j].Type })
+	expected := []Event{
+		{Type: ErrorAppeared, Key: "units", New: "dbus is unavailable", Message: "[node1] os: error appeared on units: dbus is unavailable"},
+		{Type: ErrorCleared, Key: "kernel", Old: "permission denied", Message: "[node1] os: error cleared on kernel"},
+		{Type: StateChanged, Old: State(Live), New: State(Error), Message: "[node1] os: state changed from Live to Error, reason: docker is down"},
+		{Type: ValueChanged, Key: "units.docker.service.activeState", Old: "active", New: "failed", Message: "[node1] os: units.docker.service.activeState changed from active to failed"},
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), diff)
+	}
+	for i := range expected {
+		expected[i].Node, expected[i].Checker, expected[i].Time = "node1", "os", now
+		if fmt.Sprintf("%#v", diff[i]) != fmt.Sprintf("%#v", expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], diff[i])
+		}
+	}
+
+	// 只对比关注的checker
+	if diff := events.diff(Info{name: "disk", basic: map[string]interface{}{"loads": []float64{1}}}, Info{name: "disk", basic: map[string]interface{}{"loads": []float64{2}}}); len(diff) != 0 {
+		t.Errorf("expected no events of unwatched checkers, got %v", diff)
+	}
+}
+
+func TestEventsObserve(t *testing.T) {
+	initLogger(false)
+	all := &eventSinkRunner{name: "all", types: map[string]bool{}, queue: make(chan Event, 10)}
+	errorsOnly := &eventSinkRunner{name: "errors", types: map[string]bool{ErrorAppeared: true}, queue: make(chan Event, 10)}
+	full := &eventSinkRunner{name: "full", types: map[string]bool{}, queue: make(chan Event)}
+	events := &Events{node: "node1", lastInfo: make(map[string]Info), sinks: []*eventSinkRunner{all, errorsOnly, full}}
+
+	// 第一次观察到的checker不产生事件
+	events.observe(Info{name: "os", state: Live})
+	events.observe(Info{name: "os", state: Error, errors: map[string]interface{}{"units": "dbus is unavailable"}})
+	if len(all.queue) != 2 || len(errorsOnly.queue) != 1 {
+		t.Fatalf("expected 2 and 1 queued events, got %d %d", len(all.queue), len(errorsOnly.queue))
+	}
+	if event := <-errorsOnly.queue; event.Type != ErrorAppeared || event.Key != "units" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+// 按收到的次数返回状态码
+type eventWebhookServer struct {
+	mutex    sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (s *eventWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := 200
+	if len(s.bodies) < len(s.statuses) {
+		status = s.statuses[len(s.bodies)]
+	}
+	s.bodies = append(s.bodies, string(body))
+	w.WriteHeader(status)
+}
+
+func (s *eventWebhookServer) waitRequests(t *testing.T, count int) []string {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		bodies := append([]string{}, s.bodies...)
+		s.mutex.Unlock()
+		if len(bodies) >= count {
+			return bodies
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("expected %d requests", count)
+	return nil
+}
+
+func TestEventSinkRetries(t *testing.T) {
+	initLogger(false)
+	handler := &eventWebhookServer{statuses: []int{500, 502, 200}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	runner, err := newEventSinkRunner(map[interface{}]interface{}{"type": "webhook", "url": server.URL, "retries": 3, "backoff": "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go runner.run()
+	defer close(runner.queue)
+	runner.queue <- Event{Type: StateChanged, Checker: "os", Message: "state changed"}
+	bodies := handler.waitRequests(t, 3)
+	var event Event
+	if err := json.Unmarshal([]byte(bodies[2]), &event); err != nil || event.Checker != "os" || event.Message != "state changed" {
+		t.Errorf("unexpected body %s %v", bodies[2], err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if bodies := handler.waitRequests(t, 0); len(bodies) != 3 {
+		t.Errorf("expected no more retries after success, got %d requests", len(bodies))
+	}
+
+	// 重试retries次之后放弃，继续投递下一个事件
+	handler = &eventWebhookServer{statuses: []int{500, 500, 500, 500}}
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+	runner, err = newEventSinkRunner(map[interface{}]interface{}{"type": "slack", "url": server2.URL, "retries": 1, "backoff": "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go runner.run()
+	defer close(runner.queue)
+	runner.queue <- Event{Message: "first"}
+	runner.queue <- Event{Message: "second"}
+	bodies = handler.waitRequests(t, 4)
+	expected := []string{`{"text":"first"}`, `{"text":"first"}`, `{"text":"second"}`, `{"text":"second"}`}
+	if strings.Join(bodies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, bodies)
+	}
+}
+
+func TestFileEventSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "events/events.jsonl")
+	runner, err := newEventSinkRunner(map[interface{}]interface{}{"type": "file", "path": filePath, "retries": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runner.retries != 0 {
+		t.Errorf("file sink should not retry, got %d", runner.retries)
+	}
+	for _, message := range []string{"first", "second"} {
+		if err := runner.sink.send(Event{Type: StateChanged, Message: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := ioutil.ReadFile(filePath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"message":"second"`) {
+		t.Errorf("unexpected events file %s", data)
+	}
+}
+
+func TestNewEventSinkRunnerErrors(t *testing.T) {
+	for _, config := range []map[interface{}]interface{}{
+		{"type": "email"},
+		{"type": "webhook"},
+		{"type": "file"},
+		{"type": "webhook", "url": "http://127.0.0.1", "backoff": "soon"},
+		{"type": "webhook", "url": "http://127.0.0.1", "timeout": "soon"},
+	} {
+		if _, err := newEventSinkRunner(config); err == nil {
+			t.Errorf("newEventSinkRunner(%v): expected an error", config)
+		}
+	}
+	daemonConfig := &DaemonConfig{customConfigs: map[string]map[string]interface{}{"events": {"watch": []interface{}{"loads"}}}}
+	if _, err := NewEvents(daemonConfig); err == nil {
+		t.Errorf("expected an error for a watch without checker")
+	}
+}
@@ -2,10 +2,7 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
 	"os"
-
-	yaml "gopkg.in/yaml.v2"
 )
 
 var config_path string
@@ -26,15 +23,9 @@ func main() {
 	if mount_point != "" {
 		daemonConfig.setMountPoint(mount_point)
 	}
-	if config_path != "" {
-		yaml_data, err := ioutil.ReadFile(config_path)
-		if err != nil {
-			panic(err)
-		}
-		err = yaml.Unmarshal([]byte(yaml_data), &daemonConfig.customConfigs)
-		if err != nil {
-			panic(err)
-		}
+	daemonConfig, err := daemonConfig.load(config_path)
+	if err != nil {
+		panic(err)
 	}
 	daemon := NewDaemon(daemonConfig)
 	go daemon.run()
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// 与hadoop的Configuration一样，最多展开20层变量
+const hadoopMaxSubstitutions = 20
+
+var hadoopVariableRegexp = regexp.MustCompile(`\$\{[^\}\$\s]+\}`)
+
+type hadoopProperty struct {
+	value  string
+	source string
+	final  bool
+}
+
+// 按文件的顺序合并，后加载的覆盖先加载的，final的属性不能被覆盖
+type hadoopConf struct {
+	dir        string
+	files      []string
+	properties map[string]hadoopProperty
+}
+
+type hadoopConfiguration struct {
+	Properties []struct {
+		Name  string `xml:"name"`
+		Value string `xml:"value"`
+		Final string `xml:"final"`
+	} `xml:"property"`
+}
+
+// 返回第一个存在的目录，都不存在时返回空
+func findHadoopConfDir(mountPoint string, dirs []string) string {
+	for _, dir := range dirs {
+		if info, err := os.Stat(path.Join(mountPoint, dir)); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// 不存在的文件被跳过，解析失败的文件记录在返回的错误中
+func loadHadoopConf(mountPoint string, dir string, files []string) (*hadoopConf, map[string]interface{}) {
+	conf := &hadoopConf{
+		dir:        dir,
+		files:      []string{},
+		properties: make(map[string]hadoopProperty),
+	}
+	fileErrors := make(map[string]interface{})
+	for _, file := range files {
+		data, err := ioutil.ReadFile(path.Join(mountPoint, dir, file))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			fileErrors[file] = err.Error()
+			continue
+		}
+		configuration := hadoopConfiguration{}
+		if err := xml.Unmarshal(data, &configuration); err != nil {
+			fileErrors[file] = err.Error()
+			continue
+		}
+		conf.files = append(conf.files, file)
+		for _, property := range configuration.Properties {
+			name := strings.TrimSpace(property.Name)
+			if name == "" {
+				continue
+			}
+			if existing, ok := conf.properties[name]; ok && existing.final {
+				continue
+			}
+			conf.properties[name] = hadoopProperty{
+				value:  strings.TrimSpace(property.Value),
+				source: file,
+				final:  strings.TrimSpace(property.Final) == "true",
+			}
+		}
+	}
+	return conf, fileErrors
+}
+
+// 展开${name}形式的变量，无法展开的变量(例如${env.X})保持原样
+func (conf *hadoopConf) get(name string) (string, bool) {
+	property, ok := conf.properties[name]
+	if !ok {
+		return "", false
+	}
+	value := property.value
+	for i := 0; i < hadoopMaxSubstitutions && strings.Contains(value, "${"); i++ {
+		expanded := hadoopVariableRegexp.ReplaceAllStringFunc(value, func(variable string) string {
+			if referenced, ok := conf.properties[variable[2:len(variable)-1]]; ok {
+				return referenced.value
+			}
+			return variable
+		})
+		if expanded == value {
+			break
+		}
+		value = expanded
+	}
+	return value, true
+}
+
+// 按来源文件列出所有属性，用于/hadoop/detail
+func (conf *hadoopConf) toMap() map[string]interface{} {
+	files := make(map[string]interface{})
+	for _, file := range conf.files {
+		files[file] = make(map[string]interface{})
+	}
+	for name, property := range conf.properties {
+		value, _ := conf.get(name)
+		files[property.source].(map[string]interface{})[name] = value
+	}
+	return files
+}
+
+// dfs.datanode.data.dir等逗号分隔的目录，去掉[DISK]之类的存储类型以及file://
+func hadoopDirs(value string) []string {
+	dirs := []string{}
+	for _, dir := range strings.Split(value, ",") {
+		dir = strings.TrimSpace(dir)
+		if strings.HasPrefix(dir, "[") {
+			if end := strings.Index(dir, "]"); end > 0 {
+				dir = dir[end+1:]
+			}
+		}
+		if strings.HasPrefix(dir, "file:") {
+			if u, err := url.Parse(dir); err == nil {
+				dir = u.Path
+			}
+		}
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// fs.defaultFS的主机是HA的nameservice时解析每个namenode的rpc地址，否则直接解析主机名
+func (conf *hadoopConf) resolveDefaultFS() (map[string]interface{}, error) {
+	defaultFS, ok := conf.get("fs.defaultFS")
+	if !ok {
+		defaultFS, ok = conf.get("fs.default.name")
+	}
+	if !ok {
+		return nil, fmt.Errorf("fs.defaultFS is not configured")
+	}
+	u, err := url.Parse(defaultFS)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "hdfs" {
+		return map[string]interface{}{}, nil
+	}
+	hosts := []string{u.Hostname()}
+	nameservices, _ := conf.get("dfs.nameservices")
+	for _, nameservice := range strings.Split(nameservices, ",") {
+		if strings.TrimSpace(nameservice) != u.Hostname() {
+			continue
+		}
+		namenodes, _ := conf.get("dfs.ha.namenodes." + u.Hostname())
+		hosts = []string{}
+		for _, namenode := range strings.Split(namenodes, ",") {
+			address, ok := conf.get(fmt.Sprintf("dfs.namenode.rpc-address.%s.%s", u.Hostname(), strings.TrimSpace(namenode)))
+			if !ok {
+				return nil, fmt.Errorf("rpc-address of namenode %s of nameservice %s is not configured", namenode, u.Hostname())
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	resolved := make(map[string]interface{})
+	for _, host := range hosts {
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return resolved, err
+		}
+		resolved[host] = addrs
+	}
+	return resolved, nil
+}
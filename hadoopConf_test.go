@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testCoreSite = `<?xml version="1.0" encoding="UTF-8"?>
+<?xml-stylesheet type="text/xsl" href="configuration.xsl"?>
+<configuration>
+  <property>
+    <name>fs.defaultFS</name>
+    <value>hdfs://mycluster</value>
+  </property>
+  <property>
+    <name>hadoop.tmp.dir</name>
+    <value>/data/hadoop/tmp</value>
+    <final>true</final>
+  </property>
+  <property>
+    <name>hadoop.security.authentication</name>
+    <value>simple</value>
+  </property>
+  <property>
+    <name>hadoop.data.root</name>
+    <value>/data${hadoop.data.suffix}</value>
+  </property>
+  <property>
+    <name>hadoop.data.suffix</name>
+    <value>1</value>
+  </property>
+</configuration>
+`
+
+const testHDFSSite = `<?xml version="1.0" encoding="UTF-8"?>
+<configuration>
+  <property>
+    <name>hadoop.tmp.dir</name>
+    <value>/tmp/overridden</value>
+  </property>
+  <property>
+    <name>hadoop.security.authentication</name>
+    <value>kerberos</value>
+  </property>
+  <property>
+    <name>dfs.nameservices</name>
+    <value>mycluster</value>
+  </property>
+  <property>
+    <name>dfs.ha.namenodes.mycluster</name>
+    <value>nn1, nn2</value>
+  </property>
+  <property>
+    <name>dfs.namenode.rpc-address.mycluster.nn1</name>
+    <value>127.0.0.1:8020</value>
+  </property>
+  <property>
+    <name>dfs.namenode.rpc-address.mycluster.nn2</name>
+    <value>127.0.0.2:8020</value>
+  </property>
+  <property>
+    <name>dfs.datanode.data.dir</name>
+    <value>[DISK]file://${hadoop.data.root}/dfs/dn,[SSD]file:///data2/dfs/dn, /data3/dfs/dn</value>
+  </property>
+  <property>
+    <name>dfs.journalnode.edits.dir</name>
+    <value>${hadoop.tmp.dir}/journal/${user.name}</value>
+  </property>
+  <property>
+    <name>loop</name>
+    <value>${loop}x</value>
+  </property>
+</configuration>
+`
+
+func writeHadoopSiteFiles(t *testing.T, files map[string]string) string {
+	mountPoint, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	for name, content := range files {
+		file := path.Join(mountPoint, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			t.Fatalf("create %s: %s", path.Dir(file), err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", file, err)
+		}
+	}
+	return mountPoint
+}
+
+func TestLoadHadoopConf(t *testing.T) {
+	mountPoint := writeHadoopSiteFiles(t, map[string]string{
+		"etc/hadoop/conf/core-site.xml": testCoreSite,
+		"etc/hadoop/conf/hdfs-site.xml": testHDFSSite,
+		"etc/hadoop/conf/yarn-site.xml": "<configuration><property><name>x</value></configuration>",
+	})
+	defer os.RemoveAll(mountPoint)
+
+	dir := findHadoopConfDir(mountPoint, []string{"/usr/hdp/current/hadoop-client/conf", "/etc/hadoop/conf"})
+	if dir != "/etc/hadoop/conf" {
+		t.Fatalf("expected /etc/hadoop/conf, got '%s'", dir)
+	}
+	if dir := findHadoopConfDir(mountPoint, []string{"/opt/hadoop/etc/hadoop"}); dir != "" {
+		t.Errorf("expected no conf dir, got '%s'", dir)
+	}
+
+	conf, errors := loadHadoopConf(mountPoint, dir, []string{"core-site.xml", "hdfs-site.xml", "mapred-site.xml", "yarn-site.xml"})
+	if len(errors) != 1 || errors["yarn-site.xml"] == nil {
+		t.Errorf("expected an error of yarn-site.xml only, got %v", errors)
+	}
+	if !reflect.DeepEqual(conf.files, []string{"core-site.xml", "hdfs-site.xml"}) {
+		t.Errorf("unexpected loaded files %v", conf.files)
+	}
+
+	for name, expected := range map[string]string{
+		// final的属性不被后面的文件覆盖
+		"hadoop.tmp.dir": "/data/hadoop/tmp",
+		// 后加载的覆盖先加载的
+		"hadoop.security.authentication": "kerberos",
+		// 嵌套展开，无法展开的变量保持原样
+		"dfs.journalnode.edits.dir": "/data/hadoop/tmp/journal/${user.name}",
+		"dfs.datanode.data.dir":     "[DISK]file:///data1/dfs/dn,[SSD]file:///data2/dfs/dn, /data3/dfs/dn",
+	} {
+		if value, ok := conf.get(name); !ok || value != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, value)
+		}
+	}
+	if source := conf.properties["hadoop.tmp.dir"].source; source != "core-site.xml" {
+		t.Errorf("expected hadoop.tmp.dir from core-site.xml, got %s", source)
+	}
+	if source := conf.properties["hadoop.security.authentication"].source; source != "hdfs-site.xml" {
+		t.Errorf("expected hadoop.security.authentication from hdfs-site.xml, got %s", source)
+	}
+	if _, ok := conf.get("missing"); ok {
+		t.Errorf("expected no value of a missing property")
+	}
+	// 自引用的变量最多展开hadoopMaxSubstitutions层
+	if value, _ := conf.get("loop"); value != "${loop}"+strings.Repeat("x", hadoopMaxSubstitutions+1) {
+		t.Errorf("unexpected value of a self-referencing property %s", value)
+	}
+
+	files := conf.toMap()
+	core := files["core-site.xml"].(map[string]interface{})
+	if core["hadoop.data.root"] != "/data1" || core["hadoop.tmp.dir"] != "/data/hadoop/tmp" {
+		t.Errorf("unexpected properties of core-site.xml %v", core)
+	}
+	if _, ok := files["hdfs-site.xml"].(map[string]interface{})["hadoop.tmp.dir"]; ok {
+		t.Errorf("an overridden final property should not be listed under hdfs-site.xml")
+	}
+}
+
+func TestHadoopDirs(t *testing.T) {
+	for value, expected := range map[string][]string{
+		"[DISK]file:///data1/dfs/dn,[SSD]file:///data2/dfs/dn, /data3/dfs/dn": {"/data1/dfs/dn", "/data2/dfs/dn", "/data3/dfs/dn"},
+		"file:/data1/yarn/local":               {"/data1/yarn/local"},
+		"[ARCHIVE]/data4/dfs/dn,,":             {"/data4/dfs/dn"},
+		"":                                     {},
+		"[RAM_DISK]file:///mnt/ramdisk/dfs/dn": {"/mnt/ramdisk/dfs/dn"},
+	} {
+		if dirs := hadoopDirs(value); !reflect.DeepEqual(dirs, expected) {
+			t.Errorf("%q: expected %v, got %v", value, expected, dirs)
+		}
+	}
+}
+
+func TestResolveDefaultFS(t *testing.T) {
+	newConf := func(properties map[string]string) *hadoopConf {
+		conf := &hadoopConf{properties: make(map[string]hadoopProperty)}
+		for name, value := range properties {
+			conf.properties[name] = hadoopProperty{value: value}
+		}
+		return conf
+	}
+	ha := map[string]string{
+		"fs.defaultFS":                           "hdfs://mycluster",
+		"dfs.nameservices":                       "other,mycluster",
+		"dfs.ha.namenodes.mycluster":             "nn1, nn2",
+		"dfs.namenode.rpc-address.mycluster.nn1": "127.0.0.1:8020",
+		"dfs.namenode.rpc-address.mycluster.nn2": "127.0.0.2:8020",
+	}
+	resolved, err := newConf(ha).resolveDefaultFS()
+	if err != nil {
+		t.Fatalf("resolveDefaultFS: %s", err)
+	}
+	hosts := []string{}
+	for host := range resolved {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	if !reflect.DeepEqual(hosts, []string{"127.0.0.1", "127.0.0.2"}) || !reflect.DeepEqual(resolved["127.0.0.2"], []string{"127.0.0.2"}) {
+		t.Errorf("expected the rpc addresses of nn1 and nn2, got %v", resolved)
+	}
+
+	delete(ha, "dfs.namenode.rpc-address.mycluster.nn2")
+	if _, err := newConf(ha).resolveDefaultFS(); err == nil || !strings.Contains(err.Error(), "nn2") {
+		t.Errorf("expected an error of the missing rpc-address of nn2, got %v", err)
+	}
+
+	// 不是nameservice时直接解析主机名，兼容旧的fs.default.name
+	resolved, err = newConf(map[string]string{"fs.default.name": "hdfs://127.0.0.1:8020", "dfs.nameservices": "mycluster"}).resolveDefaultFS()
+	if err != nil || !reflect.DeepEqual(resolved, map[string]interface{}{"127.0.0.1": []string{"127.0.0.1"}}) {
+		t.Errorf("expected 127.0.0.1, got %v, %v", resolved, err)
+	}
+	if resolved, err := newConf(map[string]string{"fs.defaultFS": "file:///"}).resolveDefaultFS(); err != nil || len(resolved) != 0 {
+		t.Errorf("expected nothing to resolve for a local file system, got %v, %v", resolved, err)
+	}
+	if _, err := newConf(map[string]string{}).resolveDefaultFS(); err == nil {
+		t.Errorf("expected an error when fs.defaultFS is not configured")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	hadoopDataNode     = "datanode"
+	hadoopNodeManager  = "nodemanager"
+	hadoopRegionServer = "regionserver"
+)
+
+// hadoop 3和hbase 2的缺省http端口
+var defaultHadoopJMXPorts = map[string]int{
+	hadoopDataNode:     9864,
+	hadoopNodeManager:  8042,
+	hadoopRegionServer: 16030,
+}
+
+// /jmx的响应可能有几MB，超过的部分被截断
+const maxJMXResponseSize = 16 << 20
+
+type jmxBean map[string]interface{}
+
+// 返回/jmx中所有的bean，连接被拒绝时返回的错误满足isConnectionRefused
+func fetchJMX(client *http.Client, baseURL string) ([]jmxBean, error) {
+	response := struct {
+		Beans []jmxBean `json:"beans"`
+	}{}
+	if err := getJSON(client, baseURL+"/jmx", &response); err != nil {
+		return nil, err
+	}
+	return response.Beans, nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJMXResponseSize)).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %s", url, err)
+	}
+	return nil
+}
+
+// 不依赖go 1.13的errors.Is，逐层拆开http client返回的*url.Error、*net.OpError和*os.SyscallError
+func isConnectionRefused(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED
+		default:
+			return false
+		}
+	}
+}
+
+// 按名字的前缀查找bean，例如旧版本datanode的FSDatasetState后面带有存储的id
+func findBean(beans []jmxBean, prefix string) jmxBean {
+	for _, bean := range beans {
+		if name, _ := bean["name"].(string); strings.HasPrefix(name, prefix) {
+			return bean
+		}
+	}
+	return nil
+}
+
+// JvmMetrics的名字随服务不同，例如Hadoop:service=DataNode,name=JvmMetrics、Hadoop:service=HBase,name=JvmMetrics
+func findJvmMetrics(beans []jmxBean) jmxBean {
+	for _, bean := range beans {
+		if name, _ := bean["name"].(string); strings.HasSuffix(name, ",name=JvmMetrics") {
+			return bean
+		}
+	}
+	return nil
+}
+
+// 把bean中的属性拷贝到result中，不存在的属性被跳过
+func copyBeanAttributes(result map[string]interface{}, bean jmxBean, attributes map[string]string) {
+	if bean == nil {
+		return
+	}
+	for attribute, key := range attributes {
+		if value, ok := bean[attribute]; ok {
+			result[key] = value
+		}
+	}
+}
+
+// datanode到每个namenode的心跳，BPServiceActorInfo是JSON编码的字符串，
+// 例如[{"NamenodeAddress":"nn1:8020","ActorState":"RUNNING","LastHeartbeat":"1",...}]，LastHeartbeat为距今的秒数
+func parseBPServiceActorInfo(bean jmxBean) (map[string]interface{}, error) {
+	heartbeats := make(map[string]interface{})
+	if bean == nil {
+		return heartbeats, nil
+	}
+	encoded, _ := bean["BPServiceActorInfo"].(string)
+	if encoded == "" {
+		return heartbeats, nil
+	}
+	actors := []map[string]interface{}{}
+	if err := json.Unmarshal([]byte(encoded), &actors); err != nil {
+		return nil, fmt.Errorf("failed to decode BPServiceActorInfo: %s", err)
+	}
+	for _, actor := range actors {
+		namenode, _ := actor["NamenodeAddress"].(string)
+		heartbeat := map[string]interface{}{
+			"actorState":  actor["ActorState"],
+			"blockPoolId": actor["BlockPoolID"],
+		}
+		if lastHeartbeat, ok := toFloat(actor["LastHeartbeat"]); ok {
+			heartbeat["lastHeartbeatSeconds"] = lastHeartbeat
+		}
+		heartbeats[namenode] = heartbeat
+	}
+	return heartbeats, nil
+}
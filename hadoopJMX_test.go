@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 从真实的datanode、nodemanager的/jmx中截取的片段
+const testDataNodeJMX = `{
+  "beans" : [ {
+    "name" : "Hadoop:service=DataNode,name=JvmMetrics",
+    "modelerType" : "JvmMetrics",
+    "MemHeapUsedM" : 312.5,
+    "MemHeapMaxM" : 4096.0,
+    "GcCount" : 1200,
+    "GcTimeMillis" : 35000
+  }, {
+    "name" : "Hadoop:service=DataNode,name=FSDatasetState",
+    "modelerType" : "FSDatasetState",
+    "Capacity" : 7999999999999,
+    "Remaining" : 3999999999999,
+    "NumFailedVolumes" : 1,
+    "FailedStorageLocations" : [ "/data3/dfs/dn" ]
+  }, {
+    "name" : "Hadoop:service=DataNode,name=DataNodeInfo",
+    "modelerType" : "org.apache.hadoop.hdfs.server.datanode.DataNode",
+    "Version" : "3.1.1",
+    "ClusterId" : "CID-0b1c2d3e",
+    "BPServiceActorInfo" : "[{\"NamenodeAddress\":\"nn1.example.com:8020\",\"ActorState\":\"RUNNING\",\"LastHeartbeat\":\"1\",\"BlockPoolID\":\"BP-1-10.0.0.1-1500000000000\"},{\"NamenodeAddress\":\"nn2.example.com:8020\",\"ActorState\":\"RUNNING\",\"LastHeartbeat\":\"95\",\"BlockPoolID\":\"BP-1-10.0.0.1-1500000000000\"}]"
+  } ]
+}`
+
+const testNodeManagerJMX = `{
+  "beans" : [ {
+    "name" : "Hadoop:service=NodeManager,name=JvmMetrics",
+    "GcCount" : 10,
+    "GcTimeMillis" : 400
+  }, {
+    "name" : "Hadoop:service=NodeManager,name=NodeManagerMetrics",
+    "ContainersRunning" : 3,
+    "ContainersFailed" : 0,
+    "BadLocalDirs" : 1,
+    "BadLogDirs" : 0
+  } ]
+}`
+
+const testNodeManagerInfo = `{
+  "nodeInfo" : {
+    "healthReport" : "1/4 local-dirs are bad: /data2/yarn/local",
+    "nodeHealthy" : false,
+    "lastNodeUpdateTime" : 1600000000000,
+    "nodeManagerVersion" : "3.1.1"
+  }
+}`
+
+func newTestHadoopServer(routes map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+}
+
+func newTestHadoopChecker(urls map[string]string) *HadoopChecker {
+	return &HadoopChecker{
+		jmxURLs:      urls,
+		jmxRequired:  make(map[string]bool),
+		jmxClient:    &http.Client{Timeout: time.Second * 2},
+		heartbeatAge: time.Second * 30,
+	}
+}
+
+func TestParseBPServiceActorInfo(t *testing.T) {
+	heartbeats, err := parseBPServiceActorInfo(jmxBean{
+		"BPServiceActorInfo": `[{"NamenodeAddress":"nn1:8020","ActorState":"RUNNING","LastHeartbeat":"2","BlockPoolID":"BP-1"},{"NamenodeAddress":"nn2:8020","ActorState":"CONNECTING","LastHeartbeat":7}]`,
+	})
+	if err != nil {
+		t.Fatalf("parseBPServiceActorInfo: %s", err)
+	}
+	if len(heartbeats) != 2 {
+		t.Fatalf("expected 2 heartbeats, got %v", heartbeats)
+	}
+	nn1 := heartbeats["nn1:8020"].(map[string]interface{})
+	if nn1["actorState"] != "RUNNING" || nn1["blockPoolId"] != "BP-1" || nn1["lastHeartbeatSeconds"] != float64(2) {
+		t.Errorf("unexpected heartbeat of nn1 %v", nn1)
+	}
+	if age := heartbeats["nn2:8020"].(map[string]interface{})["lastHeartbeatSeconds"]; age != float64(7) {
+		t.Errorf("expected a numeric LastHeartbeat 7, got %v", age)
+	}
+
+	if heartbeats, err := parseBPServiceActorInfo(nil); err != nil || len(heartbeats) != 0 {
+		t.Errorf("expected no heartbeats without the bean, got %v, %v", heartbeats, err)
+	}
+	if _, err := parseBPServiceActorInfo(jmxBean{"BPServiceActorInfo": "[{"}); err == nil {
+		t.Errorf("expected an error for invalid BPServiceActorInfo")
+	}
+}
+
+func TestProbeDataNode(t *testing.T) {
+	server := newTestHadoopServer(map[string]string{"/jmx": testDataNodeJMX})
+	defer server.Close()
+	c := newTestHadoopChecker(map[string]string{hadoopDataNode: server.URL})
+
+	errors := make(map[string]interface{})
+	info, verdicts := c.probeDaemon(hadoopDataNode, errors)
+	if info["running"] != true || info["version"] != "3.1.1" || info["heapMaxMB"] != float64(4096) || info["gcTimeMillis"] != float64(35000) {
+		t.Errorf("unexpected datanode info %v", info)
+	}
+	if _, ok := errors["jmx.datanode.failedVolumes"]; !ok {
+		t.Errorf("failed volumes are not reported: %v", errors)
+	}
+	stale, ok := errors["jmx.datanode.heartbeat"].(map[string]interface{})
+	if !ok || len(stale) != 1 || stale["nn2.example.com:8020"] == nil {
+		t.Errorf("expected a stale heartbeat to nn2, got %v", errors["jmx.datanode.heartbeat"])
+	}
+	if len(verdicts) != 2 {
+		t.Errorf("expected 2 verdicts, got %v", verdicts)
+	}
+	for _, verdict := range verdicts {
+		if verdict.state != Error {
+			t.Errorf("unexpected verdict %v", verdict)
+		}
+	}
+}
+
+func TestProbeNodeManager(t *testing.T) {
+	server := newTestHadoopServer(map[string]string{"/jmx": testNodeManagerJMX, "/ws/v1/node/info": testNodeManagerInfo})
+	defer server.Close()
+	c := newTestHadoopChecker(map[string]string{hadoopNodeManager: server.URL})
+
+	errors := make(map[string]interface{})
+	info, verdicts := c.probeDaemon(hadoopNodeManager, errors)
+	if info["running"] != true || info["healthy"] != false || info["badLocalDirs"] != float64(1) || info["containersRunning"] != float64(3) {
+		t.Errorf("unexpected nodemanager info %v", info)
+	}
+	if errors["jmx.nodemanager.health"] != "1/4 local-dirs are bad: /data2/yarn/local" {
+		t.Errorf("unexpected health error %v", errors["jmx.nodemanager.health"])
+	}
+	if len(verdicts) != 1 || verdicts[0].state != Error {
+		t.Errorf("expected an Error verdict, got %v", verdicts)
+	}
+}
+
+func TestProbeDaemonFailures(t *testing.T) {
+	server := newTestHadoopServer(map[string]string{})
+	defer server.Close()
+	c := newTestHadoopChecker(map[string]string{hadoopRegionServer: server.URL})
+	errors := make(map[string]interface{})
+	if _, verdicts := c.probeDaemon(hadoopRegionServer, errors); len(verdicts) != 1 || errors["jmx.regionserver"] == nil {
+		t.Errorf("expected an error for a 404 response, got %v, %v", verdicts, errors)
+	}
+}
+
+func TestProbeDaemonNotDeployed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+	c := newTestHadoopChecker(map[string]string{hadoopDataNode: url})
+
+	if _, err := fetchJMX(c.jmxClient, url); err == nil || !isConnectionRefused(err) {
+		t.Fatalf("expected a refused connection, got %v", err)
+	}
+	errors := make(map[string]interface{})
+	info, verdicts := c.probeDaemon(hadoopDataNode, errors)
+	if info["running"] != false || len(verdicts) != 0 || len(errors) != 0 {
+		t.Errorf("a daemon which is not deployed should not be reported, got %v, %v, %v", info, verdicts, errors)
+	}
+
+	c.jmxRequired[hadoopDataNode] = true
+	if _, verdicts := c.probeDaemon(hadoopDataNode, errors); len(verdicts) != 1 || errors["jmx.datanode"] == nil {
+		t.Errorf("a required daemon which is not running should be reported, got %v, %v", verdicts, errors)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historySegmentPrefix = "history-"
+	historySegmentSuffix = ".jsonl"
+	historySegmentLayout = "20060102T15"
+)
+
+func init() {
+	registerConfigSchema("history",
+		ConfigItem{"enable", false, "whether to record the history of checks"},
+		ConfigItem{"path", "/var/lib/node_guard/history", "directory of history segments in the container, mount a hostPath volume to keep them across restarts"},
+		ConfigItem{"maxAge", time.Hour * 24, "segments older than maxAge are removed"},
+		ConfigItem{"maxSize", 256 * 1024 * 1024, "max total size of segments in bytes"},
+	)
+}
+
+// 每次check()之后的Info按小时分段以json lines的格式写入磁盘，超过maxAge或者总大小超过maxSize的分段会被删除。
+// 只在启动和切换分段时清理，当前分段不会被删除，总大小最多超出一个分段
+type History struct {
+	mutex       sync.Mutex
+	dir         string
+	maxAge      time.Duration
+	maxSize     int64
+	segment     string
+	segmentFile *os.File
+	totalSize   int64
+}
+
+type historyRecordHeader struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+func NewHistory(daemonConfig *DaemonConfig) (*History, error) {
+	history := &History{
+		dir:     daemonConfig.getOrDefault("history", "path", "/var/lib/node_guard/history").(string),
+		maxAge:  daemonConfig.getOrDefault("history", "maxAge", time.Hour*24).(time.Duration),
+		maxSize: int64(daemonConfig.getOrDefault("history", "maxSize", 256*1024*1024).(int)),
+	}
+	if err := os.MkdirAll(history.dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := history.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		history.totalSize += segment.Size()
+	}
+	history.prune(time.Now())
+	return history, nil
+}
+
+func (h *History) record(info Info) {
+	infoMap := info.toMap()
+	delete(infoMap, "detail")
+	if info.errors != nil {
+		infoMap["errors"] = stringifyErrors(info.errors)
+	}
+	line, err := json.Marshal(infoMap)
+	if err != nil {
+		errorln(fmt.Sprintf("Failed to marshal history of %s: %s", info.name, err))
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	segment := historySegmentPrefix + now.UTC().Format(historySegmentLayout) + historySegmentSuffix
+	if segment != h.segment || h.segmentFile == nil {
+		if h.segmentFile != nil {
+			h.segmentFile.Close()
+		}
+		h.segmentFile, err = os.OpenFile(path.Join(h.dir, segment), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			errorln(fmt.Sprintf("Failed to open history segment %s: %s", segment, err))
+			h.segmentFile = nil
+			return
+		}
+		h.segment = segment
+		h.prune(now)
+	}
+	n, err := h.segmentFile.Write(append(line, '\n'))
+	h.totalSize += int64(n)
+	if err != nil {
+		errorln(fmt.Sprintf("Failed to write history of %s: %s", info.name, err))
+	}
+}
+
+// 查询[from, to]之间的记录，names为空时查询所有的checker。
+// record()在check之后同步调用，所以只在列出分段时持有锁，扫描文件时不持有，以免大范围的查询阻塞所有的checker。
+// 每条记录由一次write追加，扫描时最后一行可能不完整，解析失败被跳过
+func (h *History) query(names []string, from time.Time, to time.Time) ([]map[string]interface{}, error) {
+	h.mutex.Lock()
+	segments, err := h.segments()
+	h.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	nameSet := make(map[string]bool)
+	for _, name := range names {
+		nameSet[name] = true
+	}
+	records := []map[string]interface{}{}
+	for _, segment := range segments {
+		segmentStart, err := parseSegmentTime(segment.Name())
+		if err != nil || segmentStart.After(to) || segmentStart.Add(time.Hour).Before(from) {
+			continue
+		}
+		file, err := os.Open(path.Join(h.dir, segment.Name()))
+		if os.IsNotExist(err) {
+			// 列出之后被prune删除
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var header historyRecordHeader
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				continue
+			}
+			if (len(nameSet) > 0 && !nameSet[header.Name]) || header.Time.Before(from) || header.Time.After(to) {
+				continue
+			}
+			record := make(map[string]interface{})
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			records = append(records, record)
+		}
+		file.Close()
+	}
+	return records, nil
+}
+
+// 删除过期的分段，然后从最旧的分段开始删除直到总大小不超过maxSize，当前正在写的分段不会被删除
+func (h *History) prune(now time.Time) {
+	segments, err := h.segments()
+	if err != nil {
+		errorln(fmt.Sprintf("Failed to list history segments: %s", err))
+		return
+	}
+	h.totalSize = 0
+	for _, segment := range segments {
+		h.totalSize += segment.Size()
+	}
+	for _, segment := range segments {
+		if segment.Name() == h.segment {
+			continue
+		}
+		segmentStart, err := parseSegmentTime(segment.Name())
+		if err == nil && now.Sub(segmentStart.Add(time.Hour)) <= h.maxAge && h.totalSize <= h.maxSize {
+			continue
+		}
+		if err := os.Remove(path.Join(h.dir, segment.Name())); err != nil {
+			errorln(fmt.Sprintf("Failed to remove history segment %s: %s", segment.Name(), err))
+			continue
+		}
+		h.totalSize -= segment.Size()
+		debugln(fmt.Sprintf("Removed history segment %s", segment.Name()))
+	}
+}
+
+// 按时间从旧到新排列的分段
+func (h *History) segments() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []os.FileInfo{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), historySegmentPrefix) && strings.HasSuffix(file.Name(), historySegmentSuffix) {
+			segments = append(segments, file)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Name() < segments[j].Name() })
+	return segments, nil
+}
+
+func parseSegmentTime(name string) (time.Time, error) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, historySegmentPrefix), historySegmentSuffix)
+	return time.ParseInLocation(historySegmentLayout, name, time.UTC)
+}
+
+// 时间可以是RFC3339格式、unix时间戳，或者是相对于当前时间的一段时长(例如1h表示1小时前)
+func parseHistoryTime(value string, defaultValue time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if duration, err := time.ParseDuration(strings.TrimPrefix(value, "-")); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Time{}, fmt.Errorf("can not parse time '%s'", value)
+}
+
+// error无法被json序列化，需要转成字符串
+func stringifyErrors(errors map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range errors {
+		if err, ok := value.(error); ok {
+			result[key] = err.Error()
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
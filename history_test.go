@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHistory(t *testing.T, maxAge string, maxSize int) (*History, string) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemonConfig := &DaemonConfig{customConfigs: map[string]map[string]interface{}{
+		"history": {"path": dir, "maxAge": maxAge, "maxSize": maxSize},
+	}}
+	history, err := NewHistory(daemonConfig)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return history, dir
+}
+
+func historySegmentName(t time.Time) string {
+	return historySegmentPrefix + t.UTC().Format(historySegmentLayout) + historySegmentSuffix
+}
+
+func TestHistoryRecordAndQuery(t *testing.T) {
+	history, dir := newTestHistory(t, "24h", 1024*1024)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	history.record(Info{name: "os", checkTime: now.Add(-time.Minute * 2), state: Live, basic: map[string]interface{}{"loads": []float64{1}}, detail: map[string]interface{}{"large": "x"}})
+	history.record(Info{name: "disk", checkTime: now.Add(-time.Minute), state: Error, reason: "/ is read-only", errors: map[string]interface{}{"diskstats": fmt.Errorf("no such file")}})
+	history.record(Info{name: "os", checkTime: now, state: Error})
+
+	if _, err := os.Stat(path.Join(dir, historySegmentName(now))); err != nil {
+		t.Errorf("expected the segment of the current hour: %s", err)
+	}
+
+	records, err := history.query(nil, now.Add(-time.Hour), now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %v", records)
+	}
+	// detail不记录，error被转成字符串
+	if _, ok := records[0]["detail"]; ok {
+		t.Errorf("detail should not be recorded, got %v", records[0])
+	}
+	if errors := records[1]["errors"].(map[string]interface{}); errors["diskstats"] != "no such file" || records[1]["reason"] != "/ is read-only" {
+		t.Errorf("unexpected record %v", records[1])
+	}
+
+	records, _ = history.query([]string{"os"}, now.Add(-time.Hour), now.Add(time.Second))
+	if len(records) != 2 || records[0]["name"] != "os" || records[1]["state"] != "Error" {
+		t.Errorf("expected 2 records of os, got %v", records)
+	}
+	records, _ = history.query([]string{"os", "disk"}, now.Add(-time.Second*90), now.Add(-time.Second*30))
+	if len(records) != 1 || records[0]["name"] != "disk" {
+		t.Errorf("expected the record of disk only, got %v", records)
+	}
+	records, _ = history.query(nil, now.Add(-time.Hour*3), now.Add(-time.Hour*2))
+	if len(records) != 0 {
+		t.Errorf("expected no records, got %v", records)
+	}
+
+	// 无法解析的行被跳过
+	ioutil.WriteFile(path.Join(dir, historySegmentName(now.Add(-time.Hour))), []byte("broken\n"), 0644)
+	if records, err = history.query(nil, now.Add(-time.Hour*2), now.Add(time.Second)); err != nil || len(records) != 3 {
+		t.Errorf("expected 3 records, got %v %v", records, err)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	segments := map[string]int{
+		historySegmentName(now.Add(-time.Hour * 5)): 10,
+		historySegmentName(now.Add(-time.Hour * 2)): 3000,
+		historySegmentName(now.Add(-time.Hour)):     3000,
+		"other.txt":                                 10000,
+	}
+	for name, size := range segments {
+		ioutil.WriteFile(path.Join(dir, name), []byte(strings.Repeat("x", size)), 0644)
+	}
+
+	// 启动时删除过期的分段，以及总大小超过maxSize时最旧的分段
+	daemonConfig := &DaemonConfig{customConfigs: map[string]map[string]interface{}{
+		"history": {"path": dir, "maxAge": "2h", "maxSize": 4096},
+	}}
+	history, err := NewHistory(daemonConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		historySegmentName(now.Add(-time.Hour * 5)): false,
+		historySegmentName(now.Add(-time.Hour * 2)): false,
+		historySegmentName(now.Add(-time.Hour)):     true,
+		"other.txt":                                 true,
+	} {
+		if _, err := os.Stat(path.Join(dir, name)); (err == nil) != expected {
+			t.Errorf("%s: expected exists %v, got %v", name, expected, err)
+		}
+	}
+	if history.totalSize != 3000 {
+		t.Errorf("expected total size 3000, got %d", history.totalSize)
+	}
+
+	// 只在切换分段时清理，当前分段不会被删除
+	history.record(Info{name: "os", checkTime: now, state: Live})
+	old := historySegmentName(now.Add(-time.Hour))
+	history.maxSize = 1
+	for i := 0; i < 10; i++ {
+		history.record(Info{name: "os", checkTime: now, state: Live})
+	}
+	if _, err := os.Stat(path.Join(dir, old)); err != nil {
+		t.Errorf("segments should not be pruned without rotation: %s", err)
+	}
+	history.segment = historySegmentName(now.Add(-time.Hour))
+	history.record(Info{name: "os", checkTime: now, state: Live})
+	if _, err := os.Stat(path.Join(dir, old)); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be pruned on rotation, got %v", old, err)
+	}
+	if _, err := os.Stat(path.Join(dir, historySegmentName(now))); err != nil {
+		t.Errorf("the current segment should not be pruned: %s", err)
+	}
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	defaultValue := time.Unix(1000, 0)
+	tests := map[string]time.Time{
+		"":                     defaultValue,
+		"2021-06-01T08:00:00Z": time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC),
+		"1622534400":           time.Unix(1622534400, 0),
+	}
+	for value, expected := range tests {
+		if actual, err := parseHistoryTime(value, defaultValue); err != nil || !actual.Equal(expected) {
+			t.Errorf("parseHistoryTime(%s): expected %s, got %s %v", value, expected, actual, err)
+		}
+	}
+	for _, value := range []string{"1h", "-1h"} {
+		actual, err := parseHistoryTime(value, defaultValue)
+		if delta := time.Since(actual) - time.Hour; err != nil || delta < 0 || delta > time.Second {
+			t.Errorf("parseHistoryTime(%s): expected an hour ago, got %s %v", value, actual, err)
+		}
+	}
+	if _, err := parseHistoryTime("yesterday", defaultValue); err == nil {
+		t.Errorf("expected an error for an invalid time")
+	}
+}
+
+func TestHistoryQueryConcurrentRecord(t *testing.T) {
+	initLogger(false)
+	history, dir := newTestHistory(t, "24h", 16*1024*1024)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			history.record(Info{name: "os", checkTime: now, state: Live, basic: map[string]interface{}{"index": i}})
+		}
+	}()
+	// 查询与写入交错时只能看到已经完整写入的记录
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		records, err := history.query(nil, now.Add(-time.Minute), now.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, record := range records {
+			if basic := record["basic"].(map[string]interface{}); basic["index"] != float64(i) {
+				t.Fatalf("expected record %d, got %v", i, record)
+			}
+		}
+	}
+	if records, _ := history.query(nil, now.Add(-time.Minute), now.Add(time.Minute)); len(records) != 200 {
+		t.Errorf("expected 200 records, got %d", len(records))
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	pingSocketAuto         = "auto"
+	pingSocketRaw          = "raw"
+	pingSocketUnprivileged = "unprivileged"
+)
+
+// echo的数据部分以此开头，之后是发送时间，用于过滤raw socket收到的其它进程的报文以及计算RTT
+var pingMagic = []byte("node_guard")
+
+// raw socket会收到本机所有的echo reply，包括其它进程的，每个目标用不同的id区分
+var pingID = uint32(os.Getpid())
+
+type pingOptions struct {
+	count    int
+	interval time.Duration
+	// 发出最后一个请求之后等待回复的时间
+	timeout time.Duration
+	// auto时先尝试raw socket，没有权限时使用非特权的datagram socket(需要net.ipv4.ping_group_range包含本进程的gid)
+	socket string
+}
+
+type pingResult struct {
+	sent     int
+	received int
+	rttMin   time.Duration
+	rttAvg   time.Duration
+	rttMax   time.Duration
+	err      error
+}
+
+func (r pingResult) reachable() bool {
+	return r.received > 0
+}
+
+func (r pingResult) toMap() map[string]interface{} {
+	result := map[string]interface{}{
+		"sent":     r.sent,
+		"received": r.received,
+	}
+	if r.sent > 0 {
+		result["lossPercent"] = float64(r.sent-r.received) * 100 / float64(r.sent)
+	}
+	if r.received > 0 {
+		result["rttMinMilliseconds"] = float64(r.rttMin) / float64(time.Millisecond)
+		result["rttAvgMilliseconds"] = float64(r.rttAvg) / float64(time.Millisecond)
+		result["rttMaxMilliseconds"] = float64(r.rttMax) / float64(time.Millisecond)
+	}
+	if r.err != nil {
+		result["error"] = r.err.Error()
+	}
+	return result
+}
+
+// 同一个地址族的所有目标共用一个socket，由一个goroutine读取回复，按来源地址分发给正在ping的目标。
+// raw socket会收到本机所有的echo reply，还要比较id；datagram socket的id由内核改写，只会收到本socket的回复
+type pinger struct {
+	options   pingOptions
+	mutex     sync.Mutex
+	listeners map[bool]*icmpListener
+}
+
+type icmpListener struct {
+	conn     net.PacketConn
+	raw      bool
+	ipv6     bool
+	err      error
+	mutex    sync.Mutex
+	sessions map[string]*pingSession
+	// 读取出错之后关闭，readErr为读取的错误
+	done    chan struct{}
+	readErr error
+}
+
+// 一个目标的一次ping，rtts的key为seq
+type pingSession struct {
+	id       uint16
+	count    int
+	rtts     map[int]time.Duration
+	complete chan struct{}
+}
+
+func newPinger(options pingOptions) *pinger {
+	return &pinger{options: options, listeners: make(map[bool]*icmpListener)}
+}
+
+// 第一次用到某个地址族时才打开socket，打开失败时该地址族的目标都返回同样的错误
+func (p *pinger) listener(ipv6 bool) *icmpListener {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if l, ok := p.listeners[ipv6]; ok {
+		return l
+	}
+	l := &icmpListener{ipv6: ipv6, sessions: make(map[string]*pingSession), done: make(chan struct{})}
+	p.listeners[ipv6] = l
+	if l.conn, l.raw, l.err = listenICMP(ipv6, p.options.socket); l.err == nil {
+		go l.read()
+	}
+	return l
+}
+
+func (p *pinger) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, l := range p.listeners {
+		if l.err == nil {
+			l.conn.Close()
+		}
+	}
+}
+
+func (l *icmpListener) read() {
+	replyType := byte(icmpv4EchoReply)
+	if l.ipv6 {
+		replyType = icmpv6EchoReply
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.mutex.Lock()
+			l.readErr = err
+			l.mutex.Unlock()
+			close(l.done)
+			return
+		}
+		receivedAt := time.Now()
+		seq, id, sentAt, ok := parseEchoReply(buf[:n], replyType)
+		if !ok {
+			continue
+		}
+		l.mutex.Lock()
+		session, ok := l.sessions[addrIP(from).String()]
+		if ok && (!l.raw || id == session.id) && seq < session.count {
+			if _, duplicated := session.rtts[seq]; !duplicated {
+				session.rtts[seq] = receivedAt.Sub(sentAt)
+				if len(session.rtts) == session.count {
+					close(session.complete)
+				}
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// 发送count个echo request，等待到收齐回复或者最后一个请求发出之后的timeout。
+// 同一个pinger中同一个ip同时只能有一个ping，由调用方去重
+func (p *pinger) ping(ip string) pingResult {
+	result := pingResult{}
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		result.err = fmt.Errorf("invalid ip '%s'", ip)
+		return result
+	}
+	ipv6 := dst.To4() == nil
+	l := p.listener(ipv6)
+	if l.err != nil {
+		result.err = l.err
+		return result
+	}
+	requestType := byte(icmpv4EchoRequest)
+	if ipv6 {
+		requestType = icmpv6EchoRequest
+	}
+	var addr net.Addr = &net.UDPAddr{IP: dst}
+	if l.raw {
+		addr = &net.IPAddr{IP: dst}
+	}
+
+	session := &pingSession{
+		id:       uint16(atomic.AddUint32(&pingID, 1)),
+		count:    p.options.count,
+		rtts:     make(map[int]time.Duration),
+		complete: make(chan struct{}),
+	}
+	key := dst.String()
+	l.mutex.Lock()
+	l.sessions[key] = session
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		delete(l.sessions, key)
+		l.mutex.Unlock()
+	}()
+
+	deadline := time.NewTimer(time.Duration(p.options.count-1)*p.options.interval + p.options.timeout)
+	defer deadline.Stop()
+Send:
+	for seq := 0; seq < p.options.count; seq++ {
+		if seq > 0 {
+			select {
+			case <-l.done:
+				// 读取出错，不再发送
+				break Send
+			case <-time.After(p.options.interval):
+			}
+		}
+		if _, err := l.conn.WriteTo(newEchoRequest(requestType, session.id, uint16(seq), time.Now()), addr); err != nil {
+			result.err = err
+			break
+		}
+		result.sent++
+	}
+	if result.sent > 0 {
+		select {
+		case <-session.complete:
+		case <-deadline.C:
+		case <-l.done:
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if result.err == nil && l.readErr != nil {
+		result.err = l.readErr
+	}
+	var total time.Duration
+	for _, rtt := range session.rtts {
+		if result.received == 0 || rtt < result.rttMin {
+			result.rttMin = rtt
+		}
+		if rtt > result.rttMax {
+			result.rttMax = rtt
+		}
+		total += rtt
+		result.received++
+	}
+	if result.received > 0 {
+		result.rttAvg = total / time.Duration(result.received)
+	}
+	return result
+}
+
+// 返回的bool表示是否为raw socket
+func listenICMP(ipv6 bool, socket string) (net.PacketConn, bool, error) {
+	if socket != pingSocketUnprivileged {
+		network, address := "ip4:icmp", "0.0.0.0"
+		if ipv6 {
+			network, address = "ip6:ipv6-icmp", "::"
+		}
+		conn, err := net.ListenPacket(network, address)
+		if err == nil || socket == pingSocketRaw {
+			return conn, true, err
+		}
+	}
+	conn, err := listenUnprivilegedICMP(ipv6)
+	return conn, false, err
+}
+
+// 与golang.org/x/net/icmp一样，通过SOCK_DGRAM的ICMP socket实现非特权的ping
+func listenUnprivilegedICMP(ipv6 bool) (net.PacketConn, error) {
+	family, proto, sockaddr := unix.AF_INET, unix.IPPROTO_ICMP, unix.Sockaddr(&unix.SockaddrInet4{})
+	if ipv6 {
+		family, proto, sockaddr = unix.AF_INET6, unix.IPPROTO_ICMPV6, &unix.SockaddrInet6{}
+	}
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, sockaddr); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	file := os.NewFile(uintptr(fd), "icmp")
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+// 参考RFC 792和RFC 4443，ICMPv6的校验和由内核计算
+func newEchoRequest(requestType byte, id uint16, seq uint16, now time.Time) []byte {
+	message := make([]byte, 8, 8+len(pingMagic)+8)
+	message[0] = requestType
+	binary.BigEndian.PutUint16(message[4:], id)
+	binary.BigEndian.PutUint16(message[6:], seq)
+	message = append(message, pingMagic...)
+	message = append(message, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(message[8+len(pingMagic):], uint64(now.UnixNano()))
+	if requestType == icmpv4EchoRequest {
+		binary.BigEndian.PutUint16(message[2:], icmpChecksum(message))
+	}
+	return message
+}
+
+// 返回seq、id以及请求中的发送时间
+func parseEchoReply(message []byte, replyType byte) (int, uint16, time.Time, bool) {
+	if len(message) < 8+len(pingMagic)+8 || message[0] != replyType || message[1] != 0 {
+		return 0, 0, time.Time{}, false
+	}
+	if string(message[8:8+len(pingMagic)]) != string(pingMagic) {
+		return 0, 0, time.Time{}, false
+	}
+	sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(message[8+len(pingMagic):])))
+	return int(binary.BigEndian.Uint16(message[6:])), binary.BigEndian.Uint16(message[4:]), sentAt, true
+}
+
+func icmpChecksum(message []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(message); i += 2 {
+		sum += uint32(message[i])<<8 | uint32(message[i+1])
+	}
+	if len(message)%2 == 1 {
+		sum += uint32(message[len(message)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
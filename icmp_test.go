@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPingLoopback(t *testing.T) {
+	options := pingOptions{count: 3, interval: time.Millisecond * 20, timeout: time.Second}
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		for _, socket := range []string{pingSocketRaw, pingSocketUnprivileged} {
+			// 没有CAP_NET_RAW、ping_group_range不包含本进程或者没有ipv6时跳过
+			conn, _, err := listenICMP(ip == "::1", socket)
+			if err != nil {
+				t.Logf("skip %s with %s socket: %s", ip, socket, err)
+				continue
+			}
+			conn.Close()
+
+			options.socket = socket
+			result := ping(map[string]string{"loopback": ip}, options)["loopback"]
+			if result.err != nil {
+				t.Errorf("ping %s with %s socket: %s", ip, socket, result.err)
+				continue
+			}
+			if result.sent != 3 || result.received != 3 {
+				t.Errorf("ping %s with %s socket: expected 3 sent and 3 received, got %d and %d", ip, socket, result.sent, result.received)
+			}
+			if !result.reachable() {
+				t.Errorf("ping %s with %s socket: expected reachable", ip, socket)
+			}
+			if result.rttMin <= 0 || result.rttMin > result.rttAvg || result.rttAvg > result.rttMax {
+				t.Errorf("ping %s with %s socket: unexpected rtt min %s avg %s max %s", ip, socket, result.rttMin, result.rttAvg, result.rttMax)
+			}
+			if loss := result.toMap()["lossPercent"]; loss != float64(0) {
+				t.Errorf("ping %s with %s socket: expected no loss, got %v", ip, socket, loss)
+			}
+		}
+	}
+}
+
+// 所有目标共用一个socket，回复按来源地址分发，相同的ip只ping一次
+func TestPingSharedSocket(t *testing.T) {
+	options := pingOptions{count: 2, interval: time.Millisecond * 20, timeout: time.Second, socket: pingSocketAuto}
+	if conn, _, err := listenICMP(false, pingSocketAuto); err != nil {
+		t.Skipf("icmp socket is not permitted: %s", err)
+	} else {
+		conn.Close()
+	}
+	targets := map[string]string{"invalid": "not an ip"}
+	for i := 0; i < 50; i++ {
+		targets[fmt.Sprintf("target%d", i)] = fmt.Sprintf("127.0.0.%d", i%10+1)
+	}
+	results := ping(targets, options)
+	if len(results) != len(targets) {
+		t.Fatalf("expected %d results, got %d", len(targets), len(results))
+	}
+	for name, result := range results {
+		if name == "invalid" {
+			if result.err == nil || result.sent != 0 {
+				t.Errorf("expected an error for an invalid ip, got %v", result.toMap())
+			}
+			continue
+		}
+		if result.err != nil || result.sent != 2 || result.received != 2 {
+			t.Errorf("ping %s (%s): unexpected result %v", name, targets[name], result.toMap())
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const kerberosPort = "88"
+
+// https://www.iana.org/assignments/kerberos-parameters
+var kerberosEnctypes = map[uint16]string{
+	1:  "des-cbc-crc",
+	2:  "des-cbc-md4",
+	3:  "des-cbc-md5",
+	16: "des3-cbc-sha1",
+	17: "aes128-cts-hmac-sha1-96",
+	18: "aes256-cts-hmac-sha1-96",
+	19: "aes128-cts-hmac-sha256-128",
+	20: "aes256-cts-hmac-sha384-192",
+	23: "arcfour-hmac",
+	24: "arcfour-hmac-exp",
+	25: "camellia128-cts-cmac",
+	26: "camellia256-cts-cmac",
+}
+
+// des和rc4已经被RFC 6649、RFC 8429废弃
+var defaultWeakEnctypes = []string{"des-cbc-crc", "des-cbc-md4", "des-cbc-md5", "des3-cbc-sha1", "arcfour-hmac", "arcfour-hmac-exp"}
+
+type krb5Realm struct {
+	kdcs          []string
+	adminServers  []string
+	defaultDomain string
+}
+
+type krb5Config struct {
+	libdefaults map[string]string
+	realms      map[string]*krb5Realm
+	domainRealm map[string]string
+}
+
+type keytabEntry struct {
+	principal  string
+	components []string
+	realm      string
+	nameType   uint32
+	timestamp  time.Time
+	kvno       uint32
+	enctype    uint16
+}
+
+func (config *krb5Config) defaultRealm() string {
+	return config.libdefaults["default_realm"]
+}
+
+func (config *krb5Config) toMap() map[string]interface{} {
+	realms := make(map[string]interface{})
+	for name, realm := range config.realms {
+		realms[name] = map[string]interface{}{
+			"kdcs":          realm.kdcs,
+			"adminServers":  realm.adminServers,
+			"defaultDomain": realm.defaultDomain,
+		}
+	}
+	libdefaults := make(map[string]interface{})
+	for key, value := range config.libdefaults {
+		libdefaults[key] = value
+	}
+	domainRealm := make(map[string]interface{})
+	for domain, realm := range config.domainRealm {
+		domainRealm[domain] = realm
+	}
+	return map[string]interface{}{
+		"defaultRealm": config.defaultRealm(),
+		"libdefaults":  libdefaults,
+		"realms":       realms,
+		"domainRealm":  domainRealm,
+	}
+}
+
+// 只解析libdefaults、realms和domain_realm三节，include和其它节被忽略
+func parseKrb5Conf(r io.Reader) (*krb5Config, error) {
+	config := &krb5Config{
+		libdefaults: make(map[string]string),
+		realms:      make(map[string]*krb5Realm),
+		domainRealm: make(map[string]string),
+	}
+	section := ""
+	var realm *krb5Realm
+	// realm之内还可能有嵌套的块(例如v4_name_convert)，只记录深度
+	depth := 0
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && depth == 0 {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section '%s'", lineNum, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if line == "}" {
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unexpected '}'", lineNum)
+			}
+			depth--
+			if depth == 0 {
+				realm = nil
+			}
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			// include、includedir以及其它无法识别的行
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		value := strings.TrimSuffix(strings.TrimSpace(fields[1]), "*")
+		value = strings.TrimSpace(value)
+		if value == "{" {
+			depth++
+			if section == "realms" && depth == 1 {
+				realm = &krb5Realm{}
+				config.realms[key] = realm
+			}
+			continue
+		}
+		switch {
+		case section == "libdefaults" && depth == 0:
+			config.libdefaults[key] = value
+		case section == "domain_realm" && depth == 0:
+			config.domainRealm[strings.ToLower(key)] = value
+		case section == "realms" && depth == 1 && realm != nil:
+			switch key {
+			case "kdc":
+				realm.kdcs = append(realm.kdcs, value)
+			case "admin_server":
+				realm.adminServers = append(realm.adminServers, value)
+			case "default_domain":
+				realm.defaultDomain = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unclosed '{'")
+	}
+	return config, nil
+}
+
+// 按domain_realm查找主机所属的realm，找不到时为default_realm
+func (config *krb5Config) hostRealm(host string) string {
+	host = strings.ToLower(host)
+	if realm, ok := config.domainRealm[host]; ok {
+		return realm
+	}
+	for domain := host; strings.Contains(domain, "."); {
+		domain = domain[strings.Index(domain, "."):]
+		if realm, ok := config.domainRealm[domain]; ok {
+			return realm
+		}
+		domain = domain[1:]
+	}
+	return config.defaultRealm()
+}
+
+// MIT keytab格式：0x05、版本(1或2)，之后是若干条带长度的entry，长度为负数表示被删除的空洞。
+// 版本1使用本机字节序，并且组件数量包含了realm
+func parseKeytab(data []byte) ([]keytabEntry, error) {
+	if len(data) < 2 || data[0] != 0x05 || (data[1] != 0x01 && data[1] != 0x02) {
+		return nil, fmt.Errorf("not a keytab file")
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if data[1] == 0x01 {
+		order = binary.LittleEndian
+	}
+	entries := []keytabEntry{}
+	reader := bytes.NewReader(data[2:])
+	for reader.Len() > 0 {
+		var size int32
+		if err := binary.Read(reader, order, &size); err != nil {
+			return nil, fmt.Errorf("truncated entry size: %s", err)
+		}
+		if size < 0 {
+			if _, err := reader.Seek(int64(-size), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if size == 0 {
+			break
+		}
+		// 损坏的文件中size可能很大，先检查再分配
+		if size > int32(reader.Len()) {
+			return nil, fmt.Errorf("truncated entry: size %d, %d bytes left", size, reader.Len())
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return nil, fmt.Errorf("truncated entry: %s", err)
+		}
+		entry, err := parseKeytabEntry(record, order, data[1] == 0x01)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func parseKeytabEntry(record []byte, order binary.ByteOrder, v1 bool) (keytabEntry, error) {
+	entry := keytabEntry{}
+	reader := bytes.NewReader(record)
+	readString := func() (string, error) {
+		var length uint16
+		if err := binary.Read(reader, order, &length); err != nil {
+			return "", err
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return "", err
+		}
+		return string(value), nil
+	}
+	var numComponents uint16
+	if err := binary.Read(reader, order, &numComponents); err != nil {
+		return entry, fmt.Errorf("invalid entry: %s", err)
+	}
+	if v1 && numComponents > 0 {
+		numComponents--
+	}
+	var err error
+	if entry.realm, err = readString(); err != nil {
+		return entry, fmt.Errorf("invalid realm: %s", err)
+	}
+	for i := 0; i < int(numComponents); i++ {
+		component, err := readString()
+		if err != nil {
+			return entry, fmt.Errorf("invalid principal: %s", err)
+		}
+		entry.components = append(entry.components, component)
+	}
+	if !v1 {
+		if err := binary.Read(reader, order, &entry.nameType); err != nil {
+			return entry, fmt.Errorf("invalid name type: %s", err)
+		}
+	}
+	var timestamp uint32
+	var vno8 uint8
+	if err := binary.Read(reader, order, &timestamp); err != nil {
+		return entry, fmt.Errorf("invalid timestamp: %s", err)
+	}
+	if err := binary.Read(reader, order, &vno8); err != nil {
+		return entry, fmt.Errorf("invalid kvno: %s", err)
+	}
+	if err := binary.Read(reader, order, &entry.enctype); err != nil {
+		return entry, fmt.Errorf("invalid enctype: %s", err)
+	}
+	if _, err := readString(); err != nil {
+		return entry, fmt.Errorf("invalid key: %s", err)
+	}
+	entry.timestamp = time.Unix(int64(timestamp), 0)
+	entry.kvno = uint32(vno8)
+	// 可选的32位kvno，非0时覆盖8位的kvno
+	var vno32 uint32
+	if reader.Len() >= 4 {
+		if err := binary.Read(reader, order, &vno32); err == nil && vno32 != 0 {
+			entry.kvno = vno32
+		}
+	}
+	entry.principal = strings.Join(entry.components, "/") + "@" + entry.realm
+	return entry, nil
+}
+
+func enctypeName(enctype uint16) string {
+	if name, ok := kerberosEnctypes[enctype]; ok {
+		return name
+	}
+	return fmt.Sprintf("enctype-%d", enctype)
+}
+
+// kdc可以是host或者host:port
+func kdcAddress(kdc string) string {
+	if _, _, err := net.SplitHostPort(kdc); err == nil {
+		return kdc
+	}
+	return net.JoinHostPort(strings.Trim(kdc, "[]"), kerberosPort)
+}
+
+// 发送一个AS-REQ，收到任何KRB-ERROR或AS-REP都说明KDC可达。network为tcp或udp
+func probeKDC(network string, address string, realm string, timeout time.Duration) error {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	request := newASRequest(realm)
+	var response []byte
+	if network == "tcp" {
+		// TCP上每条消息前有4字节的长度
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(request)))
+		if _, err := conn.Write(append(length, request...)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		response = make([]byte, 1)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return err
+		}
+	} else {
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		response = make([]byte, 4096)
+		n, err := conn.Read(response)
+		if err != nil {
+			return err
+		}
+		response = response[:n]
+	}
+	// [APPLICATION 30] KRB-ERROR或者[APPLICATION 11] AS-REP
+	if len(response) == 0 || (response[0] != 0x7e && response[0] != 0x6b) {
+		return fmt.Errorf("unexpected response from %s", address)
+	}
+	return nil
+}
+
+// 用krbtgt/REALM作为sname、一个不存在的用户作为cname的最简AS-REQ(RFC 4120 5.4.1)
+func newASRequest(realm string) []byte {
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	nonce[0] &= 0x7f
+	principalName := func(nameType byte, names ...string) []byte {
+		nameStrings := []byte{}
+		for _, name := range names {
+			nameStrings = append(nameStrings, derTLV(0x1b, []byte(name))...)
+		}
+		return derTLV(0x30, concatBytes(
+			derTLV(0xa0, derTLV(0x02, []byte{nameType})),
+			derTLV(0xa1, derTLV(0x30, nameStrings)),
+		))
+	}
+	till := time.Now().UTC().Add(time.Hour).Format("20060102150405Z")
+	body := derTLV(0x30, concatBytes(
+		derTLV(0xa0, derTLV(0x03, []byte{0, 0, 0, 0, 0})),
+		derTLV(0xa1, principalName(1, "node-guard-probe")),
+		derTLV(0xa2, derTLV(0x1b, []byte(realm))),
+		derTLV(0xa3, principalName(2, "krbtgt", realm)),
+		derTLV(0xa5, derTLV(0x18, []byte(till))),
+		derTLV(0xa7, derTLV(0x02, nonce)),
+		derTLV(0xa8, derTLV(0x30, concatBytes(derTLV(0x02, []byte{18}), derTLV(0x02, []byte{17})))),
+	))
+	return derTLV(0x6a, derTLV(0x30, concatBytes(
+		derTLV(0xa1, derTLV(0x02, []byte{5})),
+		derTLV(0xa2, derTLV(0x02, []byte{10})),
+		derTLV(0xa4, body),
+	)))
+}
+
+func derTLV(tag byte, content []byte) []byte {
+	length := len(content)
+	header := []byte{tag}
+	if length < 0x80 {
+		header = append(header, byte(length))
+	} else {
+		lengthBytes := []byte{}
+		for l := length; l > 0; l >>= 8 {
+			lengthBytes = append([]byte{byte(l)}, lengthBytes...)
+		}
+		header = append(header, 0x80|byte(len(lengthBytes)))
+		header = append(header, lengthBytes...)
+	}
+	return append(header, content...)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	result := []byte{}
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+// 短主机名时通过DNS找到FQDN，hadoop的_HOST也是这样替换的
+func fqdnHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(hostname, ".") {
+		return strings.ToLower(hostname), nil
+	}
+	if cname, err := net.LookupCNAME(hostname); err == nil && strings.Contains(strings.TrimSuffix(cname, "."), ".") {
+		return strings.ToLower(strings.TrimSuffix(cname, ".")), nil
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err == nil {
+		for _, addr := range addrs {
+			names, err := net.LookupAddr(addr)
+			if err == nil && len(names) > 0 {
+				return strings.ToLower(strings.TrimSuffix(names[0], ".")), nil
+			}
+		}
+	}
+	return strings.ToLower(hostname), nil
+}
+
+func readKeytab(keytabPath string) ([]keytabEntry, error) {
+	data, err := ioutil.ReadFile(keytabPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeytab(data)
+}
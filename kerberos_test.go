@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 按MIT keytab v2的格式(大端)写一条entry，kvno32为0时不写可选的32位kvno
+func keytabV2Entry(realm string, components []string, nameType uint32, timestamp uint32, kvno8 uint8, enctype uint16, key []byte, kvno32 uint32) []byte {
+	var record bytes.Buffer
+	writeString := func(s string) {
+		binary.Write(&record, binary.BigEndian, uint16(len(s)))
+		record.WriteString(s)
+	}
+	binary.Write(&record, binary.BigEndian, uint16(len(components)))
+	writeString(realm)
+	for _, component := range components {
+		writeString(component)
+	}
+	binary.Write(&record, binary.BigEndian, nameType)
+	binary.Write(&record, binary.BigEndian, timestamp)
+	record.WriteByte(kvno8)
+	binary.Write(&record, binary.BigEndian, enctype)
+	writeString(string(key))
+	if kvno32 != 0 {
+		binary.Write(&record, binary.BigEndian, kvno32)
+	}
+	var entry bytes.Buffer
+	binary.Write(&entry, binary.BigEndian, int32(record.Len()))
+	entry.Write(record.Bytes())
+	return entry.Bytes()
+}
+
+func TestParseKeytabV2(t *testing.T) {
+	var keytab bytes.Buffer
+	keytab.Write([]byte{0x05, 0x02})
+	keytab.Write(keytabV2Entry("EXAMPLE.COM", []string{"nn", "node1.example.com"}, 1, 1500000000, 3, 18, bytes.Repeat([]byte{0xaa}, 32), 0))
+	// 被删除的entry留下的空洞
+	binary.Write(&keytab, binary.BigEndian, int32(-8))
+	keytab.Write(make([]byte, 8))
+	keytab.Write(keytabV2Entry("EXAMPLE.COM", []string{"HTTP", "node1.example.com"}, 3, 1600000000, 255, 23, bytes.Repeat([]byte{0xbb}, 16), 300))
+
+	entries, err := parseKeytab(keytab.Bytes())
+	if err != nil {
+		t.Fatalf("parseKeytab: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	expected := []keytabEntry{
+		{
+			principal:  "nn/node1.example.com@EXAMPLE.COM",
+			components: []string{"nn", "node1.example.com"},
+			realm:      "EXAMPLE.COM",
+			nameType:   1,
+			timestamp:  time.Unix(1500000000, 0),
+			kvno:       3,
+			enctype:    18,
+		},
+		{
+			principal:  "HTTP/node1.example.com@EXAMPLE.COM",
+			components: []string{"HTTP", "node1.example.com"},
+			realm:      "EXAMPLE.COM",
+			nameType:   3,
+			timestamp:  time.Unix(1600000000, 0),
+			kvno:       300,
+			enctype:    23,
+		},
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(entries[i], expected[i]) {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], entries[i])
+		}
+	}
+	if name := enctypeName(entries[1].enctype); name != "arcfour-hmac" {
+		t.Errorf("expected arcfour-hmac, got %s", name)
+	}
+}
+
+func TestParseKeytabInvalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":      {},
+		"not keytab": []byte("-----BEGIN CERTIFICATE-----"),
+		"version":    {0x05, 0x03},
+		"truncated":  append([]byte{0x05, 0x02, 0, 0, 0, 100}, make([]byte, 10)...),
+		"huge size":  append([]byte{0x05, 0x02, 0x7f, 0xff, 0xff, 0xff}, make([]byte, 10)...),
+	} {
+		_, err := parseKeytab(data)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if (name == "truncated" || name == "huge size") && !strings.Contains(err.Error(), "truncated entry") {
+			t.Errorf("%s: expected a truncated entry error, got %s", name, err)
+		}
+	}
+}
+
+const testKrb5Conf = `
+# comment
+[libdefaults]
+  default_realm = EXAMPLE.COM
+  dns_lookup_kdc = false
+  ticket_lifetime = 24h
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = kdc1.example.com
+    kdc = kdc2.example.com:8888
+    admin_server = kadmin.example.com
+    default_domain = example.com
+    v4_name_convert = {
+      host = {
+        rcmd = host
+      }
+    }
+  }
+  OTHER.ORG = {
+    kdc = kdc.other.org
+  }
+
+[domain_realm]
+  .other.org = OTHER.ORG
+  other.org = OTHER.ORG
+  special.example.com = OTHER.ORG
+
+[logging]
+  default = FILE:/var/log/krb5libs.log
+`
+
+func TestParseKrb5Conf(t *testing.T) {
+	config, err := parseKrb5Conf(strings.NewReader(testKrb5Conf))
+	if err != nil {
+		t.Fatalf("parseKrb5Conf: %s", err)
+	}
+	if config.defaultRealm() != "EXAMPLE.COM" {
+		t.Errorf("expected default realm EXAMPLE.COM, got %s", config.defaultRealm())
+	}
+	if config.libdefaults["ticket_lifetime"] != "24h" {
+		t.Errorf("expected ticket_lifetime 24h, got %s", config.libdefaults["ticket_lifetime"])
+	}
+	realm, ok := config.realms["EXAMPLE.COM"]
+	if !ok {
+		t.Fatalf("realm EXAMPLE.COM is missing")
+	}
+	if !reflect.DeepEqual(realm.kdcs, []string{"kdc1.example.com", "kdc2.example.com:8888"}) {
+		t.Errorf("unexpected kdcs %v", realm.kdcs)
+	}
+	if !reflect.DeepEqual(realm.adminServers, []string{"kadmin.example.com"}) || realm.defaultDomain != "example.com" {
+		t.Errorf("unexpected realm %+v", realm)
+	}
+	if len(config.realms) != 2 {
+		t.Errorf("nested blocks should not be parsed as realms, got %d realms", len(config.realms))
+	}
+	for host, expected := range map[string]string{
+		"node1.example.com":   "EXAMPLE.COM",
+		"special.example.com": "OTHER.ORG",
+		"a.b.other.org":       "OTHER.ORG",
+		"OTHER.ORG":           "OTHER.ORG",
+		"localhost":           "EXAMPLE.COM",
+	} {
+		if realm := config.hostRealm(host); realm != expected {
+			t.Errorf("realm of %s: expected %s, got %s", host, expected, realm)
+		}
+	}
+	if address := kdcAddress("kdc2.example.com:8888"); address != "kdc2.example.com:8888" {
+		t.Errorf("unexpected kdc address %s", address)
+	}
+	if address := kdcAddress("[::1]"); address != "[::1]:88" {
+		t.Errorf("unexpected kdc address %s", address)
+	}
+}
+
+func TestParseKrb5ConfInvalid(t *testing.T) {
+	for _, conf := range []string{
+		"[realms]\n  EXAMPLE.COM = {\n    kdc = kdc1\n",
+		"[libdefaults\n",
+		"}\n",
+	} {
+		if _, err := parseKrb5Conf(strings.NewReader(conf)); err == nil {
+			t.Errorf("expected an error for %q", conf)
+		}
+	}
+}
+
+// 最简的KRB-ERROR，probeKDC只看[APPLICATION 30]的tag
+var testKrbError = derTLV(0x7e, derTLV(0x30, derTLV(0xa0, derTLV(0x02, []byte{5}))))
+
+func checkASRequest(t *testing.T, request []byte, realm string) {
+	if len(request) == 0 || request[0] != 0x6a {
+		t.Errorf("expected an AS-REQ, got %x", request)
+	}
+	if !bytes.Contains(request, []byte(realm)) {
+		t.Errorf("AS-REQ does not contain the realm %s", realm)
+	}
+}
+
+func TestProbeKDCTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			length := make([]byte, 4)
+			if _, err := io.ReadFull(conn, length); err == nil {
+				request := make([]byte, binary.BigEndian.Uint32(length))
+				if _, err := io.ReadFull(conn, request); err == nil {
+					checkASRequest(t, request, "EXAMPLE.COM")
+					binary.BigEndian.PutUint32(length, uint32(len(testKrbError)))
+					conn.Write(append(length, testKrbError...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	if err := probeKDC("tcp", listener.Addr().String(), "EXAMPLE.COM", time.Second*2); err != nil {
+		t.Errorf("probeKDC over tcp: %s", err)
+	}
+}
+
+func TestProbeKDCUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			checkASRequest(t, buf[:n], "EXAMPLE.COM")
+			conn.WriteTo(testKrbError, addr)
+		}
+	}()
+	if err := probeKDC("udp", conn.LocalAddr().String(), "EXAMPLE.COM", time.Second*2); err != nil {
+		t.Errorf("probeKDC over udp: %s", err)
+	}
+}
+
+func TestProbeKDCUnexpectedResponse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		if _, addr, err := conn.ReadFrom(buf); err == nil {
+			conn.WriteTo([]byte("HTTP/1.1 400 Bad Request\r\n"), addr)
+		}
+	}()
+	if err := probeKDC("udp", conn.LocalAddr().String(), "EXAMPLE.COM", time.Second*2); err == nil {
+		t.Errorf("expected an error for a non-kerberos response")
+	}
+}
+
+func TestProbeKDCRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	if err := probeKDC("tcp", address, "EXAMPLE.COM", time.Second); err == nil {
+		t.Errorf("expected an error when the kdc is not listening")
+	}
+}
+
+func TestCheckKeytabs(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(mountPoint)
+	if err := os.MkdirAll(path.Join(mountPoint, "keytabs"), 0755); err != nil {
+		t.Fatalf("create keytab dir: %s", err)
+	}
+	aes, rc4 := uint16(18), uint16(23)
+	for name, principals := range map[string][]struct {
+		realm      string
+		components []string
+		enctype    uint16
+	}{
+		"good":     {{"EXAMPLE.COM", []string{"nn", "node1.example.com"}, aes}, {"EXAMPLE.COM", []string{"hdfs-cluster"}, rc4 + 1}},
+		"weak":     {{"EXAMPLE.COM", []string{"HTTP", "node1.example.com"}, rc4}},
+		"other":    {{"EXAMPLE.COM", []string{"dn", "node2.example.com"}, aes}},
+		"realm":    {{"OTHER.ORG", []string{"nm", "NODE1.example.com"}, aes}},
+		"headless": {{"EXAMPLE.COM", []string{"hdfs-cluster"}, aes}},
+	} {
+		keytab := []byte{0x05, 0x02}
+		for _, p := range principals {
+			keytab = append(keytab, keytabV2Entry(p.realm, p.components, 1, 1500000000, 1, p.enctype, make([]byte, 16), 0)...)
+		}
+		if err := ioutil.WriteFile(path.Join(mountPoint, "keytabs", name+".keytab"), keytab, 0600); err != nil {
+			t.Fatalf("write keytab: %s", err)
+		}
+	}
+	ioutil.WriteFile(path.Join(mountPoint, "keytabs", "broken.keytab"), []byte{0x05, 0x02, 0, 0, 0, 100}, 0600)
+	krb5, err := parseKrb5Conf(strings.NewReader(testKrb5Conf))
+	if err != nil {
+		t.Fatalf("parseKrb5Conf: %s", err)
+	}
+	c := &HadoopChecker{
+		mountPoint:    mountPoint,
+		keytabPaths:   []string{"/keytabs/*.keytab"},
+		hostname:      "node1.example.com",
+		weakEnctypes:  map[string]bool{"arcfour-hmac": true},
+		weakState:     Error,
+		mismatchState: Fatal,
+	}
+
+	keytabs, errors, verdicts := c.checkKeytabs(krb5)
+	if len(keytabs) != 5 {
+		t.Errorf("expected 5 parsed keytabs, got %v", keytabs)
+	}
+	expectedErrors := map[string]interface{}{
+		"keytabs.weakEnctype": map[string]interface{}{"/keytabs/weak.keytab": []string{"HTTP/node1.example.com@EXAMPLE.COM (arcfour-hmac)"}},
+		"keytabs.wrongHost":   map[string]interface{}{"/keytabs/other.keytab": []string{"dn/node2.example.com@EXAMPLE.COM"}},
+		"keytabs.wrongRealm":  map[string]interface{}{"/keytabs/realm.keytab": []string{"nm/NODE1.example.com@OTHER.ORG"}},
+		"keytabs.missingHost": []string{"/keytabs/other.keytab"},
+	}
+	if broken, ok := errors["keytabs"].(map[string]interface{}); !ok || len(broken) != 1 || broken["/keytabs/broken.keytab"] == nil {
+		t.Errorf("expected an error of broken.keytab, got %v", errors["keytabs"])
+	}
+	delete(errors, "keytabs")
+	if !reflect.DeepEqual(errors, expectedErrors) {
+		t.Errorf("expected errors %v, got %v", expectedErrors, errors)
+	}
+	expectedVerdicts := []Verdict{
+		{Error, "keytab /keytabs/weak.keytab contains weak enctypes"},
+		{Fatal, "keytab /keytabs/other.keytab contains principals of other hosts than node1.example.com"},
+		{Fatal, "keytab /keytabs/realm.keytab contains principals of other realms than EXAMPLE.COM"},
+		{Fatal, "keytab /keytabs/other.keytab has no principal of node1.example.com"},
+	}
+	if !reflect.DeepEqual(verdicts, expectedVerdicts) {
+		t.Errorf("expected verdicts %v, got %v", expectedVerdicts, verdicts)
+	}
+
+	// Live时只记录错误
+	c.mismatchState = Live
+	if _, errors, verdicts := c.checkKeytabs(krb5); len(verdicts) != 1 || errors["keytabs.wrongHost"] == nil {
+		t.Errorf("expected only the weak enctype verdict, got %v, %v", verdicts, errors)
+	}
+}
+
+// 一个KDC只有UDP可达，另一个TCP和UDP都不可达
+func TestCheckKDCs(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			checkASRequest(t, buf[:n], "EXAMPLE.COM")
+			conn.WriteTo(testKrbError, addr)
+		}
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+	up := conn.LocalAddr().String()
+
+	krb5 := &krb5Config{realms: map[string]*krb5Realm{"EXAMPLE.COM": {kdcs: []string{up, down}}}}
+	c := &HadoopChecker{kdcTimeout: time.Second, kdcState: Fatal}
+	kdcs, errors, verdicts := c.checkKDCs(krb5)
+	realm := kdcs["EXAMPLE.COM"].(map[string]interface{})
+	if result := realm[up].(map[string]interface{}); result["udp"] != true {
+		t.Errorf("expected %s to be reachable over udp, got %v", up, result)
+	}
+	if result := realm[down].(map[string]interface{}); result["tcp"] != false || result["udp"] != false {
+		t.Errorf("expected %s to be unreachable, got %v", down, result)
+	}
+	if errors["EXAMPLE.COM/"+down+"/tcp"] == nil || errors["EXAMPLE.COM/"+down+"/udp"] == nil {
+		t.Errorf("expected errors of %s, got %v", down, errors)
+	}
+	expected := []Verdict{{Fatal, fmt.Sprintf("KDC %s of EXAMPLE.COM is unreachable", down)}}
+	if !reflect.DeepEqual(verdicts, expected) {
+		t.Errorf("expected verdicts %v, got %v", expected, verdicts)
+	}
+}
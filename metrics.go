@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Prometheus text format, 参考 https://prometheus.io/docs/instrumenting/exposition_formats/
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	metricNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	checkerStates    = []State{Live, Error, Fatal, Unknown, Unitialized}
+	unitActiveStates = []string{"active", "activating", "deactivating", "inactive", "failed"}
+)
+
+type Metric struct {
+	name    string
+	help    string
+	labels  map[string]string
+	value   float64
+	counter bool
+}
+
+func newMetric(name string, help string, value float64, labels ...string) Metric {
+	metric := Metric{
+		name:   "node_guard_" + metricNameRegexp.ReplaceAllString(name, "_"),
+		help:   help,
+		labels: make(map[string]string),
+		value:  value,
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		metric.labels[labels[i]] = labels[i+1]
+	}
+	return metric
+}
+
+// 只增不减的累计值，名字以_total结尾
+func newCounter(name string, help string, value float64, labels ...string) Metric {
+	metric := newMetric(name+"_total", help, value, labels...)
+	metric.counter = true
+	return metric
+}
+
+// 每个checker都会输出的通用指标
+func infoMetrics(info Info) []Metric {
+	metrics := []Metric{}
+	for _, state := range checkerStates {
+		metrics = append(metrics, newMetric("checker_state", "Current state of the checker.", boolToFloat(info.state == state), "checker", info.name, "state", string(state)))
+	}
+	metrics = append(metrics,
+		newMetric("checker_check_duration_seconds", "Duration of the last check.", info.duration.Seconds(), "checker", info.name),
+		newMetric("checker_errors", "Number of errors in the last check.", float64(len(info.errors)), "checker", info.name),
+	)
+	if !info.checkTime.IsZero() {
+		metrics = append(metrics, newMetric("checker_last_check_timestamp_seconds", "Unix time of the last check.", float64(info.checkTime.UnixNano())/1e9, "checker", info.name))
+	}
+	return metrics
+}
+
+// 只输出能解析为数字的内核参数
+func kernelParameterMetrics(checkerName string, parameters interface{}) []Metric {
+	metrics := []Metric{}
+	parametersMap, ok := parameters.(map[string]interface{})
+	if !ok {
+		return metrics
+	}
+	for name, value := range parametersMap {
+		if valueFloat, ok := toFloat(value); ok {
+			metrics = append(metrics, newMetric(checkerName+"_kernel_parameter", "Value of the concerned kernel runtime parameter.", valueFloat, "parameter", name))
+		}
+	}
+	return metrics
+}
+
+func writeMetrics(metrics []Metric) []byte {
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	var buf bytes.Buffer
+	lastName := ""
+	for _, metric := range metrics {
+		if metric.name != lastName {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", metric.name, metric.help)
+			metricType := "gauge"
+			if metric.counter {
+				metricType = "counter"
+			}
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", metric.name, metricType)
+			lastName = metric.name
+		}
+		buf.WriteString(metric.name)
+		if len(metric.labels) > 0 {
+			keys := []string{}
+			for key := range metric.labels {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			pairs := []string{}
+			for _, key := range keys {
+				pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", key, escapeLabelValue(metric.labels[key])))
+			}
+			buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		fmt.Fprintf(&buf, " %g\n", metric.value)
+	}
+	return buf.Bytes()
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		metrics  []Metric
+		expected string
+	}{
+		{
+			"one header per family across interleaved names",
+			[]Metric{
+				newMetric("disk_size_bytes", "Size of the filesystem.", 100, "mountpoint", "/"),
+				newMetric("disk_inodes", "Inodes of the filesystem.", 10, "mountpoint", "/"),
+				newMetric("disk_size_bytes", "Size of the filesystem.", 200, "mountpoint", "/data"),
+			},
+			"# HELP node_guard_disk_inodes Inodes of the filesystem.\n" +
+				"# TYPE node_guard_disk_inodes gauge\n" +
+				"node_guard_disk_inodes{mountpoint=\"/\"} 10\n" +
+				"# HELP node_guard_disk_size_bytes Size of the filesystem.\n" +
+				"# TYPE node_guard_disk_size_bytes gauge\n" +
+				"node_guard_disk_size_bytes{mountpoint=\"/\"} 100\n" +
+				"node_guard_disk_size_bytes{mountpoint=\"/data\"} 200\n",
+		},
+		{
+			"sorted labels",
+			[]Metric{newMetric("checker_state", "Current state of the checker.", 1, "state", "Live", "checker", "os")},
+			"# HELP node_guard_checker_state Current state of the checker.\n" +
+				"# TYPE node_guard_checker_state gauge\n" +
+				"node_guard_checker_state{checker=\"os\",state=\"Live\"} 1\n",
+		},
+		{
+			"escaped label values",
+			[]Metric{newMetric("exec_up", "Whether the command succeeded.", 0, "output", "C:\\tmp \"quoted\"\nsecond line")},
+			"# HELP node_guard_exec_up Whether the command succeeded.\n" +
+				"# TYPE node_guard_exec_up gauge\n" +
+				"node_guard_exec_up{output=\"C:\\\\tmp \\\"quoted\\\"\\nsecond line\"} 0\n",
+		},
+		{
+			"counters",
+			[]Metric{
+				newCounter("memory_oom_kills", "Number of OOM kills.", 3),
+				newMetric("memory_oom_kills_recent", "Number of recent OOM kills.", 1),
+			},
+			"# HELP node_guard_memory_oom_kills_recent Number of recent OOM kills.\n" +
+				"# TYPE node_guard_memory_oom_kills_recent gauge\n" +
+				"node_guard_memory_oom_kills_recent 1\n" +
+				"# HELP node_guard_memory_oom_kills_total Number of OOM kills.\n" +
+				"# TYPE node_guard_memory_oom_kills_total counter\n" +
+				"node_guard_memory_oom_kills_total 3\n",
+		},
+		{
+			"invalid characters in names and large values",
+			[]Metric{newMetric("exec_disk-health.latency", "Latency.", 1.5e10)},
+			"# HELP node_guard_exec_disk_health_latency Latency.\n" +
+				"# TYPE node_guard_exec_disk_health_latency gauge\n" +
+				"node_guard_exec_disk_health_latency 1.5e+10\n",
+		},
+	}
+	for _, test := range tests {
+		if output := string(writeMetrics(test.metrics)); output != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, output)
+		}
+	}
+}
+
+func TestInfoMetrics(t *testing.T) {
+	metrics := infoMetrics(Info{name: "os", state: Error, duration: time.Millisecond * 1500, errors: map[string]interface{}{"units": "dbus is unavailable"}})
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		if metric.counter {
+			t.Errorf("%s should be a gauge", metric.name)
+		}
+		values[metric.name+"/"+metric.labels["state"]] = metric.value
+	}
+	if values["node_guard_checker_state/Error"] != 1 || values["node_guard_checker_state/Live"] != 0 || values["node_guard_checker_check_duration_seconds/"] != 1.5 || values["node_guard_checker_errors/"] != 1 {
+		t.Errorf("unexpected metrics %v", values)
+	}
+	if _, ok := values["node_guard_checker_last_check_timestamp_seconds/"]; ok {
+		t.Errorf("expected no timestamp before the first check")
+	}
+}
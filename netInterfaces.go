@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// /sys/class/net/<if>/statistics下关注的计数器，参考 https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-net-statistics
+var intfCounters = []string{
+	"rx_bytes", "tx_bytes",
+	"rx_packets", "tx_packets",
+	"rx_errors", "tx_errors",
+	"rx_dropped", "tx_dropped",
+}
+
+// 网卡期望的MTU，interface可以是path.Match的通配符
+type mtuExpectation struct {
+	intf  string
+	mtu   int
+	state State
+}
+
+// /sys/class/net下的网卡，bonding_masters等文件被跳过，名字按include和exclude的通配符过滤
+func listIntfs(classNetPath string, include []string, exclude []string) ([]string, error) {
+	entries, err := ioutil.ReadDir(classNetPath)
+	if err != nil {
+		return nil, err
+	}
+	intfs := []string{}
+	for _, entry := range entries {
+		// 网卡是指向/sys/devices的符号链接
+		if info, err := os.Stat(path.Join(classNetPath, entry.Name())); err != nil || !info.IsDir() {
+			continue
+		}
+		if matchAny(entry.Name(), include) && !matchAny(entry.Name(), exclude) {
+			intfs = append(intfs, entry.Name())
+		}
+	}
+	sort.Strings(intfs)
+	return intfs, nil
+}
+
+func matchAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回网卡的链路状态，以及statistics下的计数器和carrier_changes。
+// 网卡down时读取carrier、speed和duplex返回EINVAL，虚拟网卡的speed为-1，这些值被跳过
+func readIntfLink(classNetPath string, name string) (map[string]interface{}, map[string]uint64, error) {
+	dir := path.Join(classNetPath, name)
+	info := make(map[string]interface{})
+	counters := make(map[string]uint64)
+	for _, counter := range intfCounters {
+		value, err := readUintFile(path.Join(dir, "statistics", counter))
+		if err != nil {
+			return nil, nil, err
+		}
+		counters[counter] = value
+	}
+	info["statistics"] = counters
+
+	if operstate, err := ioutil.ReadFile(path.Join(dir, "operstate")); err == nil {
+		info["operstate"] = strings.TrimSpace(string(operstate))
+	}
+	if carrier, err := readUintFile(path.Join(dir, "carrier")); err == nil {
+		info["carrier"] = carrier == 1
+	}
+	// 3.15之前的内核没有carrier_changes
+	if changes, err := readUintFile(path.Join(dir, "carrier_changes")); err == nil {
+		info["carrierChanges"] = changes
+		counters["carrier_changes"] = changes
+	}
+	if speed, err := ioutil.ReadFile(path.Join(dir, "speed")); err == nil {
+		if value, err := strconv.Atoi(strings.TrimSpace(string(speed))); err == nil && value > 0 {
+			info["speedMbps"] = value
+		}
+	}
+	if duplex, err := ioutil.ReadFile(path.Join(dir, "duplex")); err == nil {
+		info["duplex"] = strings.TrimSpace(string(duplex))
+	}
+	if mtu, err := readUintFile(path.Join(dir, "mtu")); err == nil {
+		info["mtu"] = int(mtu)
+	}
+	return info, counters, nil
+}
+
+func readUintFile(file string) (uint64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func parseMTUExpectations(items []interface{}) ([]mtuExpectation, error) {
+	expectations := []mtuExpectation{}
+	for i, item := range items {
+		itemMap, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expectation %d should be a map", i)
+		}
+		expectation := mtuExpectation{state: Error}
+		expectation.intf, _ = itemMap["interface"].(string)
+		if expectation.intf == "" {
+			return nil, fmt.Errorf("interface of expectation %d is required", i)
+		}
+		if _, err := path.Match(expectation.intf, ""); err != nil {
+			return nil, fmt.Errorf("interface of expectation %d: %s", i, err)
+		}
+		if expectation.mtu, ok = itemMap["mtu"].(int); !ok || expectation.mtu <= 0 {
+			return nil, fmt.Errorf("mtu of expectation %d should be a positive integer, got %v", i, itemMap["mtu"])
+		}
+		if state, ok := itemMap["state"].(string); ok {
+			expectation.state = State(state)
+		}
+		if err := checkAllowed(string(expectation.state), ruleStateValues); err != nil {
+			return nil, fmt.Errorf("state of expectation %d %s", i, err)
+		}
+		expectations = append(expectations, expectation)
+	}
+	return expectations, nil
+}
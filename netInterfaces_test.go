@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在dir下模拟/sys/class/net/<name>，files中的值为空时不创建该文件
+func writeTestIntf(t *testing.T, dir string, name string, files map[string]string) {
+	if err := os.MkdirAll(path.Join(dir, name, "statistics"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, value := range files {
+		if value == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name, file), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testIntfCounters(base uint64, overrides map[string]uint64) map[string]string {
+	files := make(map[string]string)
+	for i, counter := range intfCounters {
+		value := base + uint64(i)
+		if override, ok := overrides[counter]; ok {
+			value = override
+		}
+		files["statistics/"+counter] = fmt.Sprint(value)
+	}
+	return files
+}
+
+func mergeTestFiles(maps ...map[string]string) map[string]string {
+	result := make(map[string]string)
+	for _, m := range maps {
+		for key, value := range m {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func TestListIntfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	classNetPath := path.Join(dir, "class/net")
+	for _, name := range []string{"lo", "eth1", "bond0", "veth1a2b3c"} {
+		writeTestIntf(t, classNetPath, name, nil)
+	}
+	// 真实的网卡是指向devices的符号链接，bonding_masters是普通文件
+	writeTestIntf(t, path.Join(dir, "devices"), "eth0", nil)
+	if err := os.Symlink(path.Join(dir, "devices/eth0"), path.Join(classNetPath, "eth0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(classNetPath, "bonding_masters"), []byte("bond0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{[]string{"*"}, []string{"lo", "veth*"}, []string{"bond0", "eth0", "eth1"}},
+		{[]string{"eth*"}, []string{}, []string{"eth0", "eth1"}},
+		{[]string{"*"}, []string{"eth[0-9]"}, []string{"bond0", "lo", "veth1a2b3c"}},
+		{[]string{}, []string{}, []string{}},
+	} {
+		intfs, err := listIntfs(classNetPath, test.include, test.exclude)
+		if err != nil || !reflect.DeepEqual(intfs, test.expected) {
+			t.Errorf("listIntfs(%v, %v): expected %v, got %v %v", test.include, test.exclude, test.expected, intfs, err)
+		}
+	}
+	if _, err := listIntfs(path.Join(dir, "missing"), []string{"*"}, nil); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+}
+
+func TestReadIntfLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestIntf(t, dir, "eth0", mergeTestFiles(testIntfCounters(100, nil), map[string]string{
+		"operstate": "up", "carrier": "1", "carrier_changes": "4", "speed": "10000", "duplex": "full", "mtu": "9000",
+	}))
+	// 网卡down时没有carrier、speed和duplex，3.10内核没有carrier_changes
+	writeTestIntf(t, dir, "eth1", mergeTestFiles(testIntfCounters(0, nil), map[string]string{"operstate": "down", "mtu": "1500"}))
+	// 虚拟网卡的speed为-1
+	writeTestIntf(t, dir, "flannel.1", mergeTestFiles(testIntfCounters(0, nil), map[string]string{
+		"operstate": "unknown", "carrier": "1", "speed": "-1", "mtu": "1450",
+	}))
+	writeTestIntf(t, dir, "broken", map[string]string{"statistics/rx_bytes": "1"})
+
+	info, counters, err := readIntfLink(dir, "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"operstate":      "up",
+		"carrier":        true,
+		"carrierChanges": uint64(4),
+		"speedMbps":      10000,
+		"duplex":         "full",
+		"mtu":            9000,
+		"statistics":     counters,
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected %v, got %v", expected, info)
+	}
+	if counters["rx_bytes"] != 100 || counters["tx_dropped"] != 107 || counters["carrier_changes"] != 4 || len(counters) != len(intfCounters)+1 {
+		t.Errorf("unexpected counters %v", counters)
+	}
+
+	info, counters, err = readIntfLink(dir, "eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"operstate": "down", "mtu": 1500, "statistics": counters}
+	if !reflect.DeepEqual(info, expected) || len(counters) != len(intfCounters) {
+		t.Errorf("expected %v, got %v", expected, info)
+	}
+
+	info, _, err = readIntfLink(dir, "flannel.1")
+	if _, ok := info["speedMbps"]; err != nil || ok || info["carrier"] != true {
+		t.Errorf("expected no speed of a virtual interface, got %v %v", info, err)
+	}
+
+	if _, _, err = readIntfLink(dir, "broken"); err == nil || !strings.Contains(err.Error(), "tx_bytes") {
+		t.Errorf("expected an error for missing statistics, got %v", err)
+	}
+}
+
+func TestParseMTUExpectations(t *testing.T) {
+	expectations, err := parseMTUExpectations([]interface{}{
+		map[interface{}]interface{}{"interface": "eth*", "mtu": 9000},
+		map[interface{}]interface{}{"interface": "flannel.1", "mtu": 1450, "state": "Fatal"},
+	})
+	expected := []mtuExpectation{{"eth*", 9000, Error}, {"flannel.1", 1450, Fatal}}
+	if err != nil || !reflect.DeepEqual(expectations, expected) {
+		t.Errorf("expected %v, got %v %v", expected, expectations, err)
+	}
+
+	for _, item := range []interface{}{
+		"eth0",
+		map[interface{}]interface{}{"mtu": 1500},
+		map[interface{}]interface{}{"interface": "eth[", "mtu": 1500},
+		map[interface{}]interface{}{"interface": "eth0", "mtu": "1500"},
+		map[interface{}]interface{}{"interface": "eth0", "mtu": 0},
+		map[interface{}]interface{}{"interface": "eth0", "mtu": 1500, "state": "Live"},
+	} {
+		if _, err := parseMTUExpectations([]interface{}{item}); err == nil {
+			t.Errorf("parseMTUExpectations(%v): expected an error", item)
+		}
+	}
+}
+
+func TestNetworkCheckIntfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node_guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	link := map[string]string{"operstate": "up", "carrier": "1", "carrier_changes": "2", "mtu": "1500"}
+	writeTestIntf(t, dir, "eth0", mergeTestFiles(testIntfCounters(1000, nil), link))
+	writeTestIntf(t, dir, "eth1", mergeTestFiles(testIntfCounters(1000, nil), link))
+	writeTestIntf(t, dir, "lo", mergeTestFiles(testIntfCounters(0, nil), map[string]string{"mtu": "65536"}))
+	c := &NetworkChecker{
+		statusFilePath: dir,
+		intfInclude:    []string{"*"},
+		intfExclude:    []string{"lo"},
+		intfErrorsRate: 1,
+		intfDropsRate:  100,
+		intfState:      Error,
+		mtuExpectations: []mtuExpectation{
+			{"eth*", 1500, Error},
+			{"bond*", 9000, Error},
+			{"flannel.1", 1450, Fatal},
+		},
+	}
+
+	// 第一次check()没有速率，精确名字的网卡不存在时不符合期望
+	basicInfo, errors := make(map[string]interface{}), make(map[string]interface{})
+	verdicts := c.checkIntfs(basicInfo, errors)
+	if fmt.Sprint(verdicts) != fmt.Sprint([]Verdict{{Fatal, "interface flannel.1 with expected mtu 1450 is not found"}}) {
+		t.Errorf("unexpected verdicts %v", verdicts)
+	}
+	intfs := basicInfo["interfaces"].(map[string]interface{})
+	if _, ok := intfs["lo"]; ok || len(intfs) != 2 {
+		t.Errorf("expected eth0 and eth1, got %v", intfs)
+	}
+	if _, ok := intfs["eth0"].(map[string]interface{})["ratesPerSecond"]; ok {
+		t.Errorf("expected no rates in the first check")
+	}
+
+	// eth0的错误超过阈值，eth1的计数器清零后不计算速率，eth1的MTU被改小
+	c.lastIntfTime = time.Now().Add(-time.Second * 10)
+	writeTestIntf(t, dir, "eth0", mergeTestFiles(testIntfCounters(1000, map[string]uint64{"rx_bytes": 11000, "rx_errors": 1024, "tx_errors": 1025}), link, map[string]string{"carrier_changes": "5"}))
+	writeTestIntf(t, dir, "eth1", mergeTestFiles(testIntfCounters(0, nil), link, map[string]string{"mtu": "1400"}))
+	basicInfo, errors = make(map[string]interface{}), make(map[string]interface{})
+	verdicts = c.checkIntfs(basicInfo, errors)
+	if len(verdicts) != 3 || verdicts[0].state != Error || !strings.HasPrefix(verdicts[0].reason, "errors of eth0 are 4.") || !strings.HasSuffix(verdicts[0].reason, "/s, exceeding 1/s") {
+		t.Errorf("unexpected verdicts %v", verdicts)
+	}
+	if len(verdicts) == 3 && (verdicts[1] != Verdict{Error, "mtu of eth1 is 1400, expected 1500"}) {
+		t.Errorf("unexpected mtu verdict %v", verdicts[1])
+	}
+	eth0 := basicInfo["interfaces"].(map[string]interface{})["eth0"].(map[string]interface{})
+	rates := eth0["ratesPerSecond"].(map[string]interface{})
+	if rate := rates["rx_bytes"].(float64); rate < 900 || rate > 1000 {
+		t.Errorf("unexpected rx_bytes rate %v", rate)
+	}
+	if _, ok := rates["carrier_changes"]; ok || eth0["carrierChangesSinceLastCheck"] != uint64(3) {
+		t.Errorf("expected 3 carrier changes apart from the rates, got %v %v", rates, eth0["carrierChangesSinceLastCheck"])
+	}
+	eth1Rates := basicInfo["interfaces"].(map[string]interface{})["eth1"].(map[string]interface{})["ratesPerSecond"].(map[string]interface{})
+	if _, ok := eth1Rates["rx_bytes"]; ok {
+		t.Errorf("expected no rates of reset counters, got %v", eth1Rates)
+	}
+	mismatches := errors["interfaces.mtu.mismatch"].(map[string]interface{})
+	if len(mismatches) != 2 || mismatches["eth1"] == nil || mismatches["flannel.1"] == nil {
+		t.Errorf("unexpected mismatches %v", mismatches)
+	}
+
+	// carrier_changes是累计值，输出为counter
+	c.basicInfo = basicInfo
+	output := string(writeMetrics(c.metrics()))
+	for _, line := range []string{
+		"# TYPE node_guard_network_interface_carrier_changes_total counter",
+		`node_guard_network_interface_carrier_changes_total{interface="eth0"} 5`,
+		"# TYPE node_guard_network_interface_mtu gauge",
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, output)
+		}
+	}
+}
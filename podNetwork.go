@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+const (
+	// pod informer按spec.nodeName建的索引
+	podNodeNameIndex = "spec.nodeName"
+
+	peerReachable   = "reachable"
+	peerDegraded    = "degraded"
+	peerUnreachable = "unreachable"
+	// 既没有podCIDR也没有可以ping的pod
+	peerUnknown = "unknown"
+
+	networkOK            = "ok"
+	networkLocalBroken   = "local"
+	networkPeersBroken   = "peers"
+	networkNotApplicable = "unknown"
+)
+
+func podNodeName(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	return []string{pod.Spec.NodeName}, nil
+}
+
+// 一个节点的探测目标，gateway为podCIDR的第一个地址(flannel.1上的地址)，pods的key为namespace/name。
+// 本节点的gateway就是自己的地址，总是能ping通，不参与本节点状态的判断
+type podNetworkPeer struct {
+	node    string
+	gateway string
+	pods    map[string]string
+	local   bool
+}
+
+// 对端节点上抽样的pod，sampledAt之后超过network.pods.resampleInterval或者有pod不通时重新list
+type peerPodSample struct {
+	pods      map[string]string
+	sampledAt time.Time
+	stale     bool
+}
+
+// 每个对端只用spec.nodeName字段选择器list一次，resourceVersion为0时由apiserver的缓存返回。
+// 第一次抽样的时间随机提前，使各个对端以及各个节点的list分散在整个间隔内
+func (c *KubernetesChecker) samplePeerPods(node string, errors map[string]interface{}) map[string]string {
+	sample, ok := c.peerSamples[node]
+	if ok && !sample.stale && time.Since(sample.sampledAt) < c.meshResample {
+		return sample.pods
+	}
+	pods, err := c.clientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("spec.nodeName", node).String(),
+		ResourceVersion: "0",
+	})
+	if err != nil {
+		listErrors, _ := errors["network.pods"].(map[string]interface{})
+		if listErrors == nil {
+			listErrors = make(map[string]interface{})
+			errors["network.pods"] = listErrors
+		}
+		listErrors[node] = err.Error()
+		if ok {
+			return sample.pods
+		}
+		return map[string]string{}
+	}
+	objs := make([]interface{}, 0, len(pods.Items))
+	for i := range pods.Items {
+		objs = append(objs, &pods.Items[i])
+	}
+	sampledAt := time.Now()
+	if !ok {
+		sampledAt = sampledAt.Add(-time.Duration(rand.Int63n(int64(c.meshResample))))
+	}
+	c.peerSamples[node] = &peerPodSample{pods: samplePods(objs, c.nodeName, c.meshPodsPerNode), sampledAt: sampledAt}
+	return c.peerSamples[node].pods
+}
+
+// 每个节点用自己的名字打散，不同节点会抽到对端不同的pod，同一个节点每次抽到的pod不变
+func samplePods(pods []interface{}, localNode string, count int) map[string]string {
+	type candidate struct {
+		key  string
+		ip   string
+		hash uint64
+	}
+	candidates := []candidate{}
+	for _, obj := range pods {
+		pod := obj.(*v1.Pod)
+		// hostNetwork的pod使用节点的ip，不经过overlay
+		if pod.Spec.HostNetwork || pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(localNode + "/" + string(pod.UID)))
+		candidates = append(candidates, candidate{pod.Namespace + "/" + pod.Name, pod.Status.PodIP, h.Sum64()})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].hash < candidates[j].hash })
+	sampled := make(map[string]string)
+	for i := 0; i < len(candidates) && i < count; i++ {
+		sampled[candidates[i].key] = candidates[i].ip
+	}
+	return sampled
+}
+
+// 汇总多个目标的结果，RTT按收到的回复数加权
+func mergePingResults(results []pingResult) pingResult {
+	merged := pingResult{}
+	var total time.Duration
+	for _, result := range results {
+		if result.received > 0 {
+			if merged.received == 0 || result.rttMin < merged.rttMin {
+				merged.rttMin = result.rttMin
+			}
+			if result.rttMax > merged.rttMax {
+				merged.rttMax = result.rttMax
+			}
+			total += result.rttAvg * time.Duration(result.received)
+		}
+		merged.sent += result.sent
+		merged.received += result.received
+	}
+	if merged.received > 0 {
+		merged.rttAvg = total / time.Duration(merged.received)
+	}
+	return merged
+}
+
+// 对端的状态：所有目标都没有回复为unreachable，有目标没有回复或者有丢包为degraded
+func peerState(results []pingResult) string {
+	if len(results) == 0 {
+		return peerUnknown
+	}
+	reachable := 0
+	for _, result := range results {
+		if result.reachable() {
+			reachable++
+		}
+	}
+	merged := mergePingResults(results)
+	switch {
+	case reachable == 0:
+		return peerUnreachable
+	case reachable < len(results) || merged.received < merged.sent:
+		return peerDegraded
+	}
+	return peerReachable
+}
+
+// 本节点的pod不通，或者不可达的对端不少于brokenRatio时认为本节点的overlay有问题，否则是个别对端的问题
+func judgePodNetwork(localState string, peerStates map[string]string, brokenRatio float64) (string, []string) {
+	tested := 0
+	unreachable := []string{}
+	for node, state := range peerStates {
+		if state == peerUnknown {
+			continue
+		}
+		tested++
+		if state == peerUnreachable {
+			unreachable = append(unreachable, node)
+		}
+	}
+	sort.Strings(unreachable)
+	if localState == peerUnreachable {
+		return networkLocalBroken, unreachable
+	}
+	if tested == 0 {
+		return networkNotApplicable, unreachable
+	}
+	// 只有一个对端时无法区分，认为是对端的问题
+	if tested > 1 && float64(len(unreachable)) >= brokenRatio*float64(tested) {
+		return networkLocalBroken, unreachable
+	}
+	if len(unreachable) > 0 {
+		return networkPeersBroken, unreachable
+	}
+	return networkOK, unreachable
+}
+
+// 返回本节点到每个对端的矩阵，一次ping所有对端的gateway和抽样的pod，以及本节点的gateway和所有pod。
+// 本节点的pod来自informer，对端的pod来自samplePeerPods；还没有抽样的对端每次check()最多list meshNewPeers个，
+// 避免启动时(整个集群的节点同时启动时更明显)一次list所有的对端
+func (c *KubernetesChecker) testPodNetwork(nodes map[string]interface{}, errors map[string]interface{}) (map[string]interface{}, []Verdict) {
+	var local *podNetworkPeer
+	peers := []podNetworkPeer{}
+	newPeers := 0
+	for _, obj := range c.nodeInformer.GetStore().List() {
+		node := obj.(*v1.Node)
+		peer := podNetworkPeer{node: node.Name, pods: map[string]string{}}
+		if node.Spec.PodCIDR != "" {
+			peer.gateway = strings.Split(node.Spec.PodCIDR, "/")[0]
+		}
+		if node.Name == c.nodeName {
+			pods, err := c.podInformer.GetIndexer().ByIndex(podNodeNameIndex, node.Name)
+			if err != nil {
+				pods = []interface{}{}
+			}
+			peer.pods = samplePods(pods, c.nodeName, len(pods))
+			peer.local = true
+			local = &peer
+			continue
+		}
+		if _, sampled := c.peerSamples[node.Name]; c.meshPodsPerNode > 0 && (sampled || newPeers < c.meshNewPeers) {
+			if !sampled {
+				newPeers++
+			}
+			peer.pods = c.samplePeerPods(node.Name, errors)
+		}
+		peers = append(peers, peer)
+	}
+	// 删除已经不存在的节点的抽样
+	for node := range c.peerSamples {
+		if _, ok := nodes[node]; !ok {
+			delete(c.peerSamples, node)
+		}
+	}
+
+	targets := make(map[string]string)
+	for _, peer := range append(peers, podNetworkPeerOrEmpty(local)) {
+		if peer.gateway != "" {
+			targets[peer.node+"#gateway"] = peer.gateway
+		}
+		for key, ip := range peer.pods {
+			targets[peer.node+"#"+key] = ip
+		}
+	}
+	results := ping(targets, c.pingOptions)
+
+	localRow, localState := podNetworkRow(podNetworkPeerOrEmpty(local), results, nodes)
+	if localNodeInfo, ok := nodes[c.nodeName].(map[string]interface{}); ok && local != nil {
+		pingSuccessPods, pingFailPods := []string{}, []string{}
+		for key := range local.pods {
+			name := key[strings.Index(key, "/")+1:]
+			if results[c.nodeName+"#"+key].reachable() {
+				pingSuccessPods = append(pingSuccessPods, name)
+			} else {
+				pingFailPods = append(pingFailPods, name)
+			}
+		}
+		if len(pingSuccessPods) > 0 {
+			localNodeInfo["pods.ping.success.num"] = len(pingSuccessPods)
+		}
+		if len(pingFailPods) > 0 {
+			sort.Strings(pingFailPods)
+			localNodeInfo["pods.ping.fail"] = pingFailPods
+		}
+	}
+	rows := make(map[string]interface{})
+	peerStates := make(map[string]string)
+	degraded := []string{}
+	for _, peer := range peers {
+		rows[peer.node], peerStates[peer.node] = podNetworkRow(peer, results, nodes)
+		if peerStates[peer.node] == peerDegraded {
+			degraded = append(degraded, peer.node)
+		}
+		// 抽到的pod可能已经被删除或者迁移，下次check()时重新抽样
+		if sample, ok := c.peerSamples[peer.node]; ok {
+			for key := range peer.pods {
+				if !results[peer.node+"#"+key].reachable() {
+					sample.stale = true
+				}
+			}
+		}
+	}
+	sort.Strings(degraded)
+
+	verdict, unreachable := judgePodNetwork(localState, peerStates, c.meshBrokenRatio)
+	network := map[string]interface{}{
+		"source":      c.nodeName,
+		"verdict":     verdict,
+		"peers":       len(peers),
+		"unreachable": unreachable,
+		"degraded":    degraded,
+		"local":       localRow,
+		"matrix":      rows,
+	}
+	verdicts := []Verdict{}
+	switch {
+	case verdict == networkLocalBroken && c.meshLocalState != Live:
+		if localState == peerUnreachable {
+			verdicts = append(verdicts, Verdict{c.meshLocalState, "pod network of the local node is broken: none of the pods on the local node is reachable"})
+		} else {
+			verdicts = append(verdicts, Verdict{c.meshLocalState, fmt.Sprintf("pod network of the local node is broken: %d of %d peers are unreachable", len(unreachable), len(peers))})
+		}
+	case verdict == networkPeersBroken && c.meshPeerState != Live:
+		verdicts = append(verdicts, Verdict{c.meshPeerState, fmt.Sprintf("pod network of peers is unreachable: %s", strings.Join(unreachable, ","))})
+	}
+	return network, verdicts
+}
+
+// 矩阵中的一行，同时写回basic中节点的flannel.ping
+func podNetworkRow(peer podNetworkPeer, results map[string]pingResult, nodes map[string]interface{}) (map[string]interface{}, string) {
+	peerResults := []pingResult{}
+	pods := make(map[string]interface{})
+	row := map[string]interface{}{"pods": pods}
+	if peer.gateway != "" {
+		result := results[peer.node+"#gateway"]
+		if !peer.local {
+			peerResults = append(peerResults, result)
+		}
+		row["gateway"] = withIP(result.toMap(), peer.gateway)
+		if nodeInfo, ok := nodes[peer.node].(map[string]interface{}); ok {
+			nodeInfo["flannel.ping"] = result.reachable()
+			nodeInfo["flannel.ping.stats"] = result.toMap()
+		}
+	}
+	for key, ip := range peer.pods {
+		result := results[peer.node+"#"+key]
+		peerResults = append(peerResults, result)
+		pods[key] = withIP(result.toMap(), ip)
+	}
+	state := peerState(peerResults)
+	row["state"] = state
+	for key, value := range mergePingResults(peerResults).toMap() {
+		row[key] = value
+	}
+	return row, state
+}
+
+// 缓存中还没有本节点时返回空的
+func podNetworkPeerOrEmpty(peer *podNetworkPeer) podNetworkPeer {
+	if peer == nil {
+		return podNetworkPeer{}
+	}
+	return *peer
+}
+
+func withIP(result map[string]interface{}, ip string) map[string]interface{} {
+	result["ip"] = ip
+	return result
+}
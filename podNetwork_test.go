@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPeerState(t *testing.T) {
+	up := pingResult{sent: 3, received: 3, rttMin: time.Millisecond, rttAvg: time.Millisecond, rttMax: time.Millisecond}
+	lossy := pingResult{sent: 3, received: 2, rttMin: time.Millisecond, rttAvg: time.Millisecond, rttMax: time.Millisecond}
+	down := pingResult{sent: 3}
+	failed := pingResult{err: errors.New("invalid ip")}
+	cases := []struct {
+		name     string
+		results  []pingResult
+		expected string
+	}{
+		{"no target", nil, peerUnknown},
+		{"all reachable", []pingResult{up, up, up}, peerReachable},
+		{"one pod down", []pingResult{up, up, down}, peerDegraded},
+		{"packet loss", []pingResult{up, lossy}, peerDegraded},
+		{"all down", []pingResult{down, down}, peerUnreachable},
+		{"error", []pingResult{failed}, peerUnreachable},
+	}
+	for _, c := range cases {
+		if state := peerState(c.results); state != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, state)
+		}
+	}
+}
+
+func TestJudgePodNetwork(t *testing.T) {
+	cases := []struct {
+		name        string
+		localState  string
+		peerStates  map[string]string
+		verdict     string
+		unreachable []string
+	}{
+		{
+			"all reachable", peerReachable,
+			map[string]string{"n1": peerReachable, "n2": peerDegraded},
+			networkOK, []string{},
+		},
+		{
+			"one peer down", peerReachable,
+			map[string]string{"n1": peerReachable, "n2": peerReachable, "n3": peerReachable, "n4": peerUnreachable},
+			networkPeersBroken, []string{"n4"},
+		},
+		{
+			"ratio exactly at brokenRatio", peerReachable,
+			map[string]string{"n1": peerReachable, "n2": peerReachable, "n3": peerUnreachable, "n4": peerUnreachable},
+			networkLocalBroken, []string{"n3", "n4"},
+		},
+		{
+			"ratio below brokenRatio", peerReachable,
+			map[string]string{"n1": peerReachable, "n2": peerReachable, "n3": peerUnreachable},
+			networkPeersBroken, []string{"n3"},
+		},
+		{
+			// 只有一个对端时无法区分是哪一端的问题
+			"the only peer down", peerReachable,
+			map[string]string{"n1": peerUnreachable},
+			networkPeersBroken, []string{"n1"},
+		},
+		{
+			"local pods unreachable", peerUnreachable,
+			map[string]string{"n1": peerReachable, "n2": peerReachable},
+			networkLocalBroken, []string{},
+		},
+		{
+			"all peers unknown", peerReachable,
+			map[string]string{"n1": peerUnknown, "n2": peerUnknown},
+			networkNotApplicable, []string{},
+		},
+		{
+			// unknown的对端不参与比例的计算
+			"unknown peers are not counted", peerUnknown,
+			map[string]string{"n1": peerUnknown, "n2": peerUnknown, "n3": peerReachable, "n4": peerUnreachable},
+			networkLocalBroken, []string{"n4"},
+		},
+	}
+	for _, c := range cases {
+		verdict, unreachable := judgePodNetwork(c.localState, c.peerStates, 0.5)
+		if verdict != c.verdict || !reflect.DeepEqual(unreachable, c.unreachable) {
+			t.Errorf("%s: expected %s %v, got %s %v", c.name, c.verdict, c.unreachable, verdict, unreachable)
+		}
+	}
+}
+
+func TestMergePingResults(t *testing.T) {
+	merged := mergePingResults([]pingResult{
+		{sent: 3, received: 3, rttMin: time.Millisecond, rttAvg: time.Millisecond * 2, rttMax: time.Millisecond * 3},
+		{sent: 3, received: 1, rttMin: time.Millisecond * 5, rttAvg: time.Millisecond * 5, rttMax: time.Millisecond * 5},
+		{sent: 3},
+		{err: errors.New("invalid ip")},
+	})
+	// 平均RTT按收到的回复数加权：(2ms*3+5ms*1)/4
+	expected := pingResult{sent: 9, received: 4, rttMin: time.Millisecond, rttAvg: time.Microsecond * 2750, rttMax: time.Millisecond * 5}
+	if merged != expected {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+	if merged := mergePingResults(nil); merged != (pingResult{}) {
+		t.Errorf("expected an empty result, got %+v", merged)
+	}
+	if merged := mergePingResults([]pingResult{{sent: 3}, {sent: 2}}); merged.sent != 5 || merged.received != 0 || merged.rttAvg != 0 || merged.rttMin != 0 {
+		t.Errorf("expected no rtt without replies, got %+v", merged)
+	}
+}
+
+func newTestPod(name string, ip string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name)},
+		Spec:       v1.PodSpec{NodeName: "peer"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: ip},
+	}
+}
+
+func TestSamplePods(t *testing.T) {
+	pods := []interface{}{}
+	for i := 0; i < 20; i++ {
+		pods = append(pods, newTestPod(fmt.Sprintf("pod%d", i), fmt.Sprintf("10.244.1.%d", i+2)))
+	}
+	hostNetwork := newTestPod("host-network", "192.168.0.2")
+	hostNetwork.Spec.HostNetwork = true
+	pending := newTestPod("pending", "10.244.1.100")
+	pending.Status.Phase = v1.PodPending
+	noIP := newTestPod("no-ip", "")
+	pods = append(pods, hostNetwork, pending, noIP)
+
+	sampled := samplePods(pods, "node-a", 3)
+	if len(sampled) != 3 {
+		t.Fatalf("expected 3 pods, got %v", sampled)
+	}
+	for key := range sampled {
+		if key == "default/host-network" || key == "default/pending" || key == "default/no-ip" {
+			t.Errorf("%s should not be sampled", key)
+		}
+	}
+	// 同一个节点的抽样与顺序无关
+	reversed := make([]interface{}, len(pods))
+	for i, pod := range pods {
+		reversed[len(pods)-1-i] = pod
+	}
+	if again := samplePods(reversed, "node-a", 3); !reflect.DeepEqual(again, sampled) {
+		t.Errorf("expected the same sample %v, got %v", sampled, again)
+	}
+	// 不同的节点抽到不同的pod
+	different := 0
+	for i := 0; i < 10; i++ {
+		if !reflect.DeepEqual(samplePods(pods, fmt.Sprintf("node-%d", i), 3), sampled) {
+			different++
+		}
+	}
+	if different < 9 {
+		t.Errorf("expected other nodes to sample other pods, only %d of 10 differ", different)
+	}
+
+	if all := samplePods(pods, "node-a", 100); len(all) != 20 {
+		t.Errorf("expected all 20 candidates, got %d", len(all))
+	}
+	if none := samplePods(pods, "node-a", 0); len(none) != 0 {
+		t.Errorf("expected no pod, got %v", none)
+	}
+}
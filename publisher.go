@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	publisherComponent = "node-guard"
+	publisherRetries   = 3
+)
+
+// 条件类型中需要全大写的checker名字，例如os对应NodeGuardOSProblem
+var conditionAcronyms = map[string]bool{"os": true, "dns": true}
+
+func init() {
+	registerConfigSchema("publisher",
+		ConfigItem{"enable", false, "whether to publish states of checkers to the local kubernetes node"},
+		ConfigItem{"kubelet.conf.path", "{mount_point}/etc/kubernetes/kubelet.conf", "path of kubelet.conf"},
+		ConfigItem{"nodeName", "", "name of the local node, the hostname by default"},
+		ConfigItem{"conditionPrefix", "NodeGuard", "prefix of node condition types, e.g. NodeGuardNetworkProblem"},
+		ConfigItem{"resyncInterval", time.Minute, "interval between refreshing the heartbeat of node conditions"},
+		ConfigItem{"events.enable", true, "whether to emit kubernetes events when states change"},
+		ConfigItem{"taint.enable", false, "whether to taint the node when any checker is Fatal, requires taint.kubeconfig"},
+		ConfigItem{"taint.kubeconfig", "", "kubeconfig allowed to update the node, NodeRestriction forbids kubelet from changing its own taints"},
+		ConfigItem{"taint.key", "node-guard/fatal", "key of the taint"},
+		ConfigItem{"taint.value", "true", "value of the taint"},
+		ConfigItem{"taint.effect", oneOf(string(v1.TaintEffectNoSchedule), string(v1.TaintEffectNoSchedule), string(v1.TaintEffectPreferNoSchedule), string(v1.TaintEffectNoExecute)), "effect of the taint, NoSchedule, PreferNoSchedule or NoExecute"},
+	)
+}
+
+// 把每个checker的状态写成本节点的NodeCondition，状态变化时产生kubernetes Event，有checker为Fatal时给节点打上taint。
+// condition和Event使用kubelet的凭证，taint需要单独配置有权限更新节点的凭证
+type Publisher struct {
+	mutex           sync.Mutex
+	client          kubernetes.Interface
+	taintClient     kubernetes.Interface
+	nodeName        string
+	conditionPrefix string
+	resyncInterval  time.Duration
+	eventsEnable    bool
+	taintEnable     bool
+	taint           v1.Taint
+	infos           map[string]Info
+	removed         map[string]bool
+	dirty           chan struct{}
+	events          chan *v1.Event
+}
+
+// 没有开启时返回nil
+func NewPublisher(daemonConfig *DaemonConfig) (*Publisher, error) {
+	if !daemonConfig.getOrDefault("publisher", "enable", false).(bool) {
+		return nil, nil
+	}
+	kubeletConfPath := daemonConfig.getOrDefault("publisher", "kubelet.conf.path", path.Join(daemonConfig.mount_point, "/etc/kubernetes/kubelet.conf")).(string)
+	clientConfig, err := clientcmd.BuildConfigFromFlags("", kubeletConfPath)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	nodeName := daemonConfig.getOrDefault("publisher", "nodeName", "").(string)
+	if nodeName == "" {
+		if nodeName, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	publisher := newPublisher(clientset, nodeName)
+	publisher.conditionPrefix = daemonConfig.getOrDefault("publisher", "conditionPrefix", "NodeGuard").(string)
+	publisher.resyncInterval = daemonConfig.getOrDefault("publisher", "resyncInterval", time.Minute).(time.Duration)
+	publisher.eventsEnable = daemonConfig.getOrDefault("publisher", "events.enable", true).(bool)
+	publisher.taintEnable = daemonConfig.getOrDefault("publisher", "taint.enable", false).(bool)
+	publisher.taint = v1.Taint{
+		Key:    daemonConfig.getOrDefault("publisher", "taint.key", "node-guard/fatal").(string),
+		Value:  daemonConfig.getOrDefault("publisher", "taint.value", "true").(string),
+		Effect: v1.TaintEffect(daemonConfig.getOrDefault("publisher", "taint.effect", string(v1.TaintEffectNoSchedule)).(string)),
+	}
+	if publisher.taintEnable {
+		taintKubeconfig := daemonConfig.getOrDefault("publisher", "taint.kubeconfig", "").(string)
+		if taintKubeconfig == "" {
+			return nil, fmt.Errorf("taint.kubeconfig is required by taint.enable")
+		}
+		taintConfig, err := clientcmd.BuildConfigFromFlags("", taintKubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		if publisher.taintClient, err = kubernetes.NewForConfig(taintConfig); err != nil {
+			return nil, err
+		}
+	}
+	return publisher, nil
+}
+
+// client可以是fake.NewSimpleClientset()，便于测试
+func newPublisher(client kubernetes.Interface, nodeName string) *Publisher {
+	return &Publisher{
+		client:          client,
+		nodeName:        nodeName,
+		conditionPrefix: "NodeGuard",
+		resyncInterval:  time.Minute,
+		eventsEnable:    true,
+		infos:           make(map[string]Info),
+		removed:         make(map[string]bool),
+		dirty:           make(chan struct{}, 1),
+		events:          make(chan *v1.Event, eventQueueSize),
+	}
+}
+
+// 作为check hook，状态或原因变化时立即同步，否则等到下一次resync
+func (p *Publisher) observe(info Info) {
+	if info.state == Unitialized {
+		return
+	}
+	p.mutex.Lock()
+	last, ok := p.infos[info.name]
+	p.infos[info.name] = info
+	delete(p.removed, info.name)
+	p.mutex.Unlock()
+	if ok && last.state == info.state && last.reason == info.reason {
+		return
+	}
+	if ok && last.state != info.state && p.eventsEnable {
+		select {
+		case p.events <- p.newEvent(info, last.state):
+		default:
+			errorln(fmt.Sprintf("Kubernetes event queue is full, drop event of %s", info.name))
+		}
+	}
+	select {
+	case p.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// checker停止或者被禁用之后删除它的condition，没有写过condition的checker也可以调用
+func (p *Publisher) forget(name string) {
+	p.mutex.Lock()
+	delete(p.infos, name)
+	p.removed[name] = true
+	p.mutex.Unlock()
+	select {
+	case p.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Publisher) run() {
+	go func() {
+		for event := range p.events {
+			if _, err := p.client.CoreV1().Events(event.Namespace).Create(event); err != nil {
+				errorln(fmt.Sprintf("Failed to create kubernetes event %s: %s", event.Message, err))
+			}
+		}
+	}()
+	ticker := time.NewTicker(p.resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.dirty:
+		case <-ticker.C:
+		}
+		if err := p.sync(); err != nil {
+			errorln(fmt.Sprintf("Failed to publish states to node %s: %s", p.nodeName, err))
+		}
+	}
+}
+
+func (p *Publisher) sync() error {
+	p.mutex.Lock()
+	infos := make(map[string]Info)
+	for name, info := range p.infos {
+		infos[name] = info
+	}
+	removed := []string{}
+	for name := range p.removed {
+		removed = append(removed, name)
+	}
+	p.mutex.Unlock()
+
+	// 只更新status，kubelet的凭证在NodeRestriction下也可以更新本节点的status
+	if err := p.updateNode(p.client, true, func(node *v1.Node) bool {
+		now := metav1.Now()
+		for name, info := range infos {
+			setNodeCondition(node, p.newCondition(name, info, now))
+		}
+		for _, name := range removed {
+			removeNodeCondition(node, p.conditionType(name))
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	for _, name := range removed {
+		if _, ok := p.infos[name]; !ok {
+			delete(p.removed, name)
+		}
+	}
+	p.mutex.Unlock()
+	if !p.taintEnable {
+		return nil
+	}
+	fatal := false
+	for _, info := range infos {
+		if info.state == Fatal {
+			fatal = true
+		}
+	}
+	return p.updateNode(p.taintClient, false, func(node *v1.Node) bool {
+		return setNodeTaint(node, p.taint, fatal)
+	})
+}
+
+// 先取最新的node再修改，与kubelet等同时更新发生冲突时重试；mutate返回false表示无需更新
+func (p *Publisher) updateNode(client kubernetes.Interface, status bool, mutate func(node *v1.Node) bool) error {
+	var err error
+	for attempt := 0; attempt < publisherRetries; attempt++ {
+		var node *v1.Node
+		if node, err = client.CoreV1().Nodes().Get(p.nodeName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+		if !mutate(node) {
+			return nil
+		}
+		if status {
+			_, err = client.CoreV1().Nodes().UpdateStatus(node)
+		} else {
+			_, err = client.CoreV1().Nodes().Update(node)
+		}
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *Publisher) conditionType(name string) v1.NodeConditionType {
+	return v1.NodeConditionType(p.conditionPrefix + camelCase(name) + "Problem")
+}
+
+// Live对应False，Error和Fatal对应True，其它对应Unknown
+func (p *Publisher) newCondition(name string, info Info, now metav1.Time) v1.NodeCondition {
+	status := v1.ConditionUnknown
+	switch info.state {
+	case Live:
+		status = v1.ConditionFalse
+	case Error, Fatal:
+		status = v1.ConditionTrue
+	}
+	message := info.reason
+	if message == "" {
+		message = fmt.Sprintf("checker %s is %s", name, info.state)
+	}
+	return v1.NodeCondition{
+		Type:               p.conditionType(name),
+		Status:             status,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             camelCase(name) + "Is" + string(info.state),
+		Message:            message,
+	}
+}
+
+func (p *Publisher) newEvent(info Info, lastState State) *v1.Event {
+	now := metav1.Now()
+	eventType := v1.EventTypeNormal
+	if info.state == Error || info.state == Fatal {
+		eventType = v1.EventTypeWarning
+	}
+	message := fmt.Sprintf("checker %s changed from %s to %s", info.name, lastState, info.state)
+	if info.reason != "" {
+		message += ": " + info.reason
+	}
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", p.nodeName, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: p.nodeName,
+			UID:  types.UID(p.nodeName),
+		},
+		Reason:         camelCase(info.name) + "Is" + string(info.state),
+		Message:        message,
+		Source:         v1.EventSource{Component: publisherComponent, Host: p.nodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+}
+
+// 状态没有变化时保留原来的lastTransitionTime
+func setNodeCondition(node *v1.Node, condition v1.NodeCondition) {
+	for i := range node.Status.Conditions {
+		existing := &node.Status.Conditions[i]
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		*existing = condition
+		return
+	}
+	node.Status.Conditions = append(node.Status.Conditions, condition)
+}
+
+func removeNodeCondition(node *v1.Node, conditionType v1.NodeConditionType) {
+	conditions := []v1.NodeCondition{}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != conditionType {
+			conditions = append(conditions, condition)
+		}
+	}
+	node.Status.Conditions = conditions
+}
+
+// 返回taint是否发生了变化
+func setNodeTaint(node *v1.Node, taint v1.Taint, present bool) bool {
+	taints := []v1.Taint{}
+	found := false
+	for _, existing := range node.Spec.Taints {
+		if existing.Key == taint.Key && existing.Effect == taint.Effect {
+			found = true
+			if present {
+				taints = append(taints, existing)
+			}
+			continue
+		}
+		taints = append(taints, existing)
+	}
+	if found == present {
+		return false
+	}
+	if present {
+		now := metav1.Now()
+		taint.TimeAdded = &now
+		taints = append(taints, taint)
+	}
+	node.Spec.Taints = taints
+	return true
+}
+
+// disk-health对应DiskHealth，os对应OS
+func camelCase(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '-' || r == '_' || r == '.'
+	})
+	for i, part := range parts {
+		if conditionAcronyms[part] {
+			parts[i] = strings.ToUpper(part)
+		} else {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
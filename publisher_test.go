@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestNode(taints ...v1.Taint) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{Taints: taints},
+		Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+			{Type: v1.NodeReady, Status: v1.ConditionTrue},
+		}},
+	}
+}
+
+func getTestNode(t *testing.T, client *fake.Clientset) *v1.Node {
+	node, err := client.CoreV1().Nodes().Get("node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get node: %s", err)
+	}
+	return node
+}
+
+func findCondition(node *v1.Node, conditionType v1.NodeConditionType) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// 按verb和subresource统计对nodes的请求，例如"update/status"
+func countNodeActions(client *fake.Clientset) map[string]int {
+	counts := make(map[string]int)
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource != "nodes" {
+			continue
+		}
+		key := action.GetVerb()
+		if action.GetSubresource() != "" {
+			key += "/" + action.GetSubresource()
+		}
+		counts[key]++
+	}
+	return counts
+}
+
+func TestPublisherConditions(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestNode())
+	p := newPublisher(client, "node1")
+	p.observe(Info{name: "network", state: Error, reason: "bond0 is degraded"})
+	p.observe(Info{name: "os", state: Live})
+	p.observe(Info{name: "disk-health", state: Unitialized})
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+
+	node := getTestNode(t, client)
+	if ready := findCondition(node, v1.NodeReady); ready == nil || ready.Status != v1.ConditionTrue {
+		t.Errorf("conditions of kubelet should be kept, got %v", node.Status.Conditions)
+	}
+	network := findCondition(node, "NodeGuardNetworkProblem")
+	if network == nil || network.Status != v1.ConditionTrue || network.Reason != "NetworkIsError" || network.Message != "bond0 is degraded" {
+		t.Fatalf("unexpected network condition %+v", network)
+	}
+	os := findCondition(node, "NodeGuardOSProblem")
+	if os == nil || os.Status != v1.ConditionFalse || os.Reason != "OSIsLive" || os.Message != "checker os is Live" {
+		t.Errorf("unexpected os condition %+v", os)
+	}
+	if findCondition(node, "NodeGuardDiskHealthProblem") != nil {
+		t.Errorf("uninitialized checkers should not be published")
+	}
+	if counts := countNodeActions(client); counts["update/status"] != 1 || counts["update"] != 0 {
+		t.Errorf("expected only the status to be updated, got %v", counts)
+	}
+
+	// 状态不变时保留lastTransitionTime
+	transition := network.LastTransitionTime
+	p.observe(Info{name: "network", state: Error, reason: "bond1 is degraded"})
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	network = findCondition(getTestNode(t, client), "NodeGuardNetworkProblem")
+	if network.Message != "bond1 is degraded" || !network.LastTransitionTime.Equal(&transition) {
+		t.Errorf("expected the same transition time and a new message, got %+v", network)
+	}
+	p.observe(Info{name: "network", state: Live})
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if network := findCondition(getTestNode(t, client), "NodeGuardNetworkProblem"); network.Status != v1.ConditionFalse {
+		t.Errorf("expected the network condition to be cleared, got %+v", network)
+	}
+
+	// 停止的checker的condition被删除，没有写过condition的checker也可以forget
+	p.forget("os")
+	p.forget("never-published")
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	node = getTestNode(t, client)
+	if findCondition(node, "NodeGuardOSProblem") != nil || findCondition(node, "NodeGuardNetworkProblem") == nil || findCondition(node, v1.NodeReady) == nil {
+		t.Errorf("expected only the os condition to be removed, got %v", node.Status.Conditions)
+	}
+	if len(p.removed) != 0 {
+		t.Errorf("removed checkers should be cleared after a successful sync, got %v", p.removed)
+	}
+}
+
+func TestPublisherEvents(t *testing.T) {
+	p := newPublisher(fake.NewSimpleClientset(newTestNode()), "node1")
+	p.observe(Info{name: "memory", state: Live})
+	p.observe(Info{name: "memory", state: Live, reason: "same state"})
+	p.observe(Info{name: "memory", state: Fatal, reason: "processes were OOM-killed"})
+	p.observe(Info{name: "memory", state: Live})
+	if len(p.events) != 2 {
+		t.Fatalf("expected an event for each transition, got %d", len(p.events))
+	}
+	event := <-p.events
+	if event.Type != v1.EventTypeWarning || event.Reason != "MemoryIsFatal" || event.Message != "checker memory changed from Live to Fatal: processes were OOM-killed" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event.InvolvedObject.Kind != "Node" || event.InvolvedObject.Name != "node1" || event.Source.Component != publisherComponent || event.Namespace != metav1.NamespaceDefault {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event := <-p.events; event.Type != v1.EventTypeNormal || event.Message != "checker memory changed from Fatal to Live" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	p.eventsEnable = false
+	p.observe(Info{name: "memory", state: Error})
+	if len(p.events) != 0 {
+		t.Errorf("expected no event when events are disabled")
+	}
+}
+
+func TestPublisherTaint(t *testing.T) {
+	other := v1.Taint{Key: "dedicated", Value: "hadoop", Effect: v1.TaintEffectNoSchedule}
+	client := fake.NewSimpleClientset(newTestNode())
+	taintClient := fake.NewSimpleClientset(newTestNode(other))
+	p := newPublisher(client, "node1")
+	p.taintEnable = true
+	p.taintClient = taintClient
+	p.taint = v1.Taint{Key: "node-guard/fatal", Value: "true", Effect: v1.TaintEffectNoSchedule}
+
+	hasTaint := func(node *v1.Node, key string) bool {
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	p.observe(Info{name: "kubernetes", state: Fatal, reason: "node is not ready"})
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	node := getTestNode(t, taintClient)
+	if !hasTaint(node, "node-guard/fatal") || !hasTaint(node, "dedicated") || len(node.Spec.Taints) != 2 {
+		t.Errorf("expected the taint to be added, got %v", node.Spec.Taints)
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == "node-guard/fatal" && taint.TimeAdded == nil {
+			t.Errorf("expected timeAdded of the taint")
+		}
+	}
+	if counts := countNodeActions(taintClient); counts["update"] != 1 || counts["update/status"] != 0 {
+		t.Errorf("expected the taint client to update the spec only, got %v", counts)
+	}
+	if counts := countNodeActions(client); counts["update"] != 0 {
+		t.Errorf("the kubelet credential should not update the spec, got %v", counts)
+	}
+
+	// 没有变化时不更新
+	taintClient.ClearActions()
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if counts := countNodeActions(taintClient); counts["update"] != 0 {
+		t.Errorf("expected no update without changes, got %v", counts)
+	}
+
+	// 第一次更新冲突时重新get再更新
+	conflicts := 1
+	taintClient.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, "node1", fmt.Errorf("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+	taintClient.ClearActions()
+	p.observe(Info{name: "kubernetes", state: Live})
+	if err := p.sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	node = getTestNode(t, taintClient)
+	if hasTaint(node, "node-guard/fatal") || !hasTaint(node, "dedicated") {
+		t.Errorf("expected only the taint of node-guard to be removed, got %v", node.Spec.Taints)
+	}
+	if counts := countNodeActions(taintClient); counts["get"] != 3 || counts["update"] != 2 {
+		t.Errorf("expected a retry after the conflict, got %v", counts)
+	}
+
+	// 一直冲突时放弃并返回错误
+	conflicts = publisherRetries
+	p.observe(Info{name: "kubernetes", state: Fatal})
+	if err := p.sync(); !apierrors.IsConflict(err) {
+		t.Errorf("expected a conflict after %d attempts, got %v", publisherRetries, err)
+	}
+	if hasTaint(getTestNode(t, taintClient), "node-guard/fatal") {
+		t.Errorf("the taint should not be added when all attempts conflict")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 规则形如:
+//
+//	rules:
+//	  - when: loads[0] > 20
+//	    state: Error
+//	    reason: load is too high # 可选
+//
+// when的左侧是basicInfo中的路径，以"errors."开头时则取errors中的值
+var (
+	binaryRuleRegexp = regexp.MustCompile(`^\s*([^\s=!<>]+)\s*(==|!=|>=|<=|>|<)\s*(.*?)\s*$`)
+	unaryRuleRegexp  = regexp.MustCompile(`^\s*([^\s=!<>]+)\s+(exists|missing)\s*$`)
+)
+
+var stateSeverity = map[State]int{
+	Live:    0,
+	Unknown: 1,
+	Error:   2,
+	Fatal:   3,
+}
+
+// checker自身判断出的状态，与规则的结果一起参与求值
+type Verdict struct {
+	state  State
+	reason string
+}
+
+type Rule struct {
+	expr   string
+	scope  string
+	path   string
+	op     string
+	value  string
+	state  State
+	reason string
+}
+
+func loadRules(daemonConfig *DaemonConfig, checkerName string) ([]*Rule, error) {
+	rules := []*Rule{}
+	items, ok := daemonConfig.getOrDefault(checkerName, "rules", []interface{}{}).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rules of checker %s should be a list", checkerName)
+	}
+	for i, item := range items {
+		itemMap, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rule %d of checker %s should be a map", i, checkerName)
+		}
+		when, _ := itemMap["when"].(string)
+		state, _ := itemMap["state"].(string)
+		reason, _ := itemMap["reason"].(string)
+		rule, err := parseRule(when, State(state), reason)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d of checker %s: %s", i, checkerName, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(expr string, state State, reason string) (*Rule, error) {
+	if err := checkAllowed(string(state), ruleStateValues); err != nil {
+		return nil, fmt.Errorf("state %s", err)
+	}
+	rule := &Rule{
+		expr:   strings.TrimSpace(expr),
+		scope:  "basic",
+		state:  state,
+		reason: reason,
+	}
+	if matches := unaryRuleRegexp.FindStringSubmatch(expr); matches != nil {
+		rule.path, rule.op = matches[1], matches[2]
+	} else if matches := binaryRuleRegexp.FindStringSubmatch(expr); matches != nil && matches[3] != "" {
+		rule.path, rule.op, rule.value = matches[1], matches[2], unquote(matches[3])
+	} else {
+		return nil, fmt.Errorf("can not parse '%s'", expr)
+	}
+	if rule.path == "errors" || strings.HasPrefix(rule.path, "errors.") || strings.HasPrefix(rule.path, "errors[") {
+		rule.scope = "errors"
+		rule.path = strings.TrimPrefix(rule.path, "errors")
+	} else {
+		rule.path = strings.TrimPrefix(rule.path, "basic.")
+	}
+	return rule, nil
+}
+
+// 对basicInfo和errors依次执行所有的规则，连同checker自身的verdicts，返回最严重的状态以及所有的原因
+func evaluateRules(rules []*Rule, basicInfo map[string]interface{}, errors map[string]interface{}, verdicts ...Verdict) (State, string) {
+	var state State = Live
+	reasons := []string{}
+	for _, verdict := range verdicts {
+		if stateSeverity[verdict.state] > stateSeverity[state] {
+			state = verdict.state
+		}
+		if verdict.reason != "" {
+			reasons = append(reasons, verdict.reason)
+		}
+	}
+	for _, rule := range rules {
+		data := basicInfo
+		if rule.scope == "errors" {
+			data = errors
+		}
+		actual, found := lookupPath(data, rule.path)
+		if !rule.match(actual, found) {
+			continue
+		}
+		if stateSeverity[rule.state] > stateSeverity[state] {
+			state = rule.state
+		}
+		reasons = append(reasons, rule.describe(actual))
+	}
+	return state, strings.Join(reasons, "; ")
+}
+
+func (rule *Rule) match(actual interface{}, found bool) bool {
+	switch rule.op {
+	case "exists":
+		return found && !isEmpty(actual)
+	case "missing":
+		return !found || isEmpty(actual)
+	}
+	// 路径不存在时不等于任何值，例如units.docker.service.activeState != active在docker.service不存在时也命中
+	if !found {
+		return rule.op == "!="
+	}
+	actualFloat, actualIsNumber := toFloat(actual)
+	expectedFloat, err := strconv.ParseFloat(rule.value, 64)
+	if actualIsNumber && err == nil {
+		switch rule.op {
+		case "==":
+			return actualFloat == expectedFloat
+		case "!=":
+			return actualFloat != expectedFloat
+		case ">":
+			return actualFloat > expectedFloat
+		case ">=":
+			return actualFloat >= expectedFloat
+		case "<":
+			return actualFloat < expectedFloat
+		case "<=":
+			return actualFloat <= expectedFloat
+		}
+		return false
+	}
+	actualString := ""
+	if actual != nil {
+		actualString = fmt.Sprint(actual)
+	}
+	switch rule.op {
+	case "==":
+		return actualString == rule.value
+	case "!=":
+		return actualString != rule.value
+	}
+	return false
+}
+
+func (rule *Rule) describe(actual interface{}) string {
+	if rule.reason != "" {
+		return rule.reason
+	}
+	if rule.op == "exists" || rule.op == "missing" {
+		return rule.expr
+	}
+	return fmt.Sprintf("%s (actual: %v)", rule.expr, actual)
+}
+
+// 按路径取值，路径中的key可以包含"."，例如units.docker.service.activeState，会优先匹配最长的key
+func lookupPath(data interface{}, keyPath string) (interface{}, bool) {
+	keyPath = strings.TrimPrefix(keyPath, ".")
+	if keyPath == "" {
+		return data, true
+	}
+	value := reflect.ValueOf(data)
+	for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, false
+		}
+		value = value.Elem()
+	}
+	if strings.HasPrefix(keyPath, "[") {
+		end := strings.Index(keyPath, "]")
+		if end < 0 {
+			return nil, false
+		}
+		index, rest := unquote(keyPath[1:end]), keyPath[end+1:]
+		switch value.Kind() {
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(index)
+			if err != nil || i < 0 || i >= value.Len() {
+				return nil, false
+			}
+			return lookupPath(value.Index(i).Interface(), rest)
+		case reflect.Map:
+			if value.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			item := value.MapIndex(reflect.ValueOf(index).Convert(value.Type().Key()))
+			if !item.IsValid() {
+				return nil, false
+			}
+			return lookupPath(item.Interface(), rest)
+		}
+		return nil, false
+	}
+	if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	keys := []string{}
+	for _, key := range value.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	for _, key := range keys {
+		if keyPath != key && !strings.HasPrefix(keyPath, key+".") && !strings.HasPrefix(keyPath, key+"[") {
+			continue
+		}
+		item := value.MapIndex(reflect.ValueOf(key).Convert(value.Type().Key()))
+		if result, found := lookupPath(item.Interface(), keyPath[len(key):]); found {
+			return result, true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v.String()), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
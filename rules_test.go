@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		expr  string
+		scope string
+		path  string
+		op    string
+		value string
+	}{
+		{"loads[0] > 20", "basic", "loads[0]", ">", "20"},
+		{"  loads[0]>=20.5 ", "basic", "loads[0]", ">=", "20.5"},
+		{"hosts.concerned.localhost == ''", "basic", "hosts.concerned.localhost", "==", ""},
+		{`units.docker.service.activeState != "active"`, "basic", "units.docker.service.activeState", "!=", "active"},
+		{"basic.units.docker.service.subState == running", "basic", "units.docker.service.subState", "==", "running"},
+		{"errors.units exists", "errors", ".units", "exists", ""},
+		{"errors missing", "errors", "", "missing", ""},
+		{"errors[meminfo] exists", "errors", "[meminfo]", "exists", ""},
+		{"errorsCount < 1", "basic", "errorsCount", "<", "1"},
+	}
+	for _, test := range tests {
+		rule, err := parseRule(test.expr, Error, "")
+		if err != nil {
+			t.Errorf("parseRule(%s): %s", test.expr, err)
+			continue
+		}
+		if rule.scope != test.scope || rule.path != test.path || rule.op != test.op || rule.value != test.value {
+			t.Errorf("parseRule(%s): expected %s %s %s %s, got %s %s %s %s", test.expr, test.scope, test.path, test.op, test.value, rule.scope, rule.path, rule.op, rule.value)
+		}
+	}
+
+	for _, expr := range []string{"", "loads[0]", "loads[0] >", "loads[0] ~ 20", "loads[0] is empty"} {
+		if _, err := parseRule(expr, Error, ""); err == nil {
+			t.Errorf("parseRule(%s): expected an error", expr)
+		}
+	}
+	for _, state := range []State{Live, Unknown, "fatal", ""} {
+		if _, err := parseRule("loads[0] > 20", state, ""); err == nil {
+			t.Errorf("parseRule with state %s: expected an error", state)
+		}
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	data := map[string]interface{}{
+		"loads": []float64{1.5, 2, 3},
+		"units": map[string]interface{}{
+			"docker.service":  map[string]interface{}{"activeState": "active"},
+			"docker":          map[string]interface{}{"service": map[string]interface{}{"activeState": "shadowed"}},
+			"kubelet.service": map[string]string{"activeState": "failed"},
+		},
+		"hosts.concerned": map[string]string{"localhost": "127.0.0.1", "master": ""},
+		"interfaces":      []map[string]interface{}{{"name": "eth0"}},
+		"pointer":         &Verdict{},
+		"nil":             nil,
+	}
+	tests := []struct {
+		path     string
+		expected interface{}
+		found    bool
+	}{
+		{"loads[0]", 1.5, true},
+		{"loads[2]", float64(3), true},
+		{"loads[3]", nil, false},
+		{"loads[-1]", nil, false},
+		{"loads[x]", nil, false},
+		{"loads[0", nil, false},
+		// 优先匹配最长的key，docker.service不会被docker.service.activeState拆开
+		{"units.docker.service.activeState", "active", true},
+		{"units.kubelet.service.activeState", "failed", true},
+		{"units[kubelet.service].activeState", "failed", true},
+		{"units['docker.service'].activeState", "active", true},
+		{"units.containerd.service.activeState", nil, false},
+		{"hosts.concerned.localhost", "127.0.0.1", true},
+		{"hosts.concerned.master", "", true},
+		{"hosts.concerned.worker", nil, false},
+		{"interfaces[0].name", "eth0", true},
+		{"interfaces[1].name", nil, false},
+		{"loads.x", nil, false},
+		{"pointer.state", nil, false},
+		{"nil.x", nil, false},
+		{".loads[1]", float64(2), true},
+	}
+	for _, test := range tests {
+		actual, found := lookupPath(data, test.path)
+		if found != test.found || actual != test.expected {
+			t.Errorf("lookupPath(%s): expected %v %v, got %v %v", test.path, test.expected, test.found, actual, found)
+		}
+	}
+	if actual, found := lookupPath(data, ""); !found || actual == nil {
+		t.Errorf("empty path should return the data itself")
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	basicInfo := map[string]interface{}{
+		"loads":           []float64{25.5, 3, 1},
+		"processes":       120,
+		"version":         "1.10",
+		"units":           map[string]interface{}{"docker.service": map[string]interface{}{"activeState": "active"}},
+		"hosts.concerned": map[string]string{"localhost": "", "master": "10.0.0.1"},
+		"empty":           map[string]interface{}{},
+	}
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		// 数字比较
+		{"loads[0] > 20", true},
+		{"loads[1] > 20", false},
+		{"loads[0] >= 25.5", true},
+		{"loads[2] < 1", false},
+		{"loads[2] <= 1", true},
+		{"processes == 120", true},
+		{"processes != 120.0", false},
+		// 两侧都能解析为数字时按数字比较，1.10 == 1.1
+		{"version == 1.1", true},
+		{"version == '1.10'", true},
+		// 否则按字符串比较，只支持==和!=
+		{"units.docker.service.activeState != active", false},
+		{"units.docker.service.activeState == active", true},
+		{"units.docker.service.activeState > active", false},
+		{"hosts.concerned.localhost == ''", true},
+		{"hosts.concerned.master == ''", false},
+		{"hosts.concerned.master != ''", true},
+		// 路径不存在时!=命中，其它比较符不命中
+		{"units.containerd.service.activeState != active", true},
+		{"units.containerd.service.activeState == active", false},
+		{"hosts.concerned.worker == ''", false},
+		{"hosts.concerned.worker != ''", true},
+		{"loads[5] > 20", false},
+		{"loads[5] < 20", false},
+		// exists和missing把空值当作不存在
+		{"loads exists", true},
+		{"empty exists", false},
+		{"empty missing", true},
+		{"hosts.concerned.localhost missing", true},
+		{"hosts.concerned.worker missing", true},
+		{"hosts.concerned.master missing", false},
+	}
+	for _, test := range tests {
+		rule, err := parseRule(test.expr, Error, "")
+		if err != nil {
+			t.Errorf("parseRule(%s): %s", test.expr, err)
+			continue
+		}
+		actual, found := lookupPath(basicInfo, rule.path)
+		if matched := rule.match(actual, found); matched != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.expr, test.expected, matched)
+		}
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	newRule := func(expr string, state State, reason string) *Rule {
+		rule, err := parseRule(expr, state, reason)
+		if err != nil {
+			t.Fatalf("parseRule(%s): %s", expr, err)
+		}
+		return rule
+	}
+	rules := []*Rule{
+		newRule("loads[0] > 20", Error, "load1 is too high"),
+		newRule("units.docker.service.activeState != active", Fatal, ""),
+		newRule("errors.units exists", Error, ""),
+	}
+
+	state, reason := evaluateRules(rules, map[string]interface{}{"loads": []float64{1}, "units": map[string]interface{}{"docker.service": map[string]interface{}{"activeState": "active"}}}, map[string]interface{}{})
+	if state != Live || reason != "" {
+		t.Errorf("expected Live without reasons, got %s %s", state, reason)
+	}
+
+	state, reason = evaluateRules(rules, map[string]interface{}{"loads": []float64{30}}, map[string]interface{}{"units": "dbus is unavailable"})
+	if state != Fatal {
+		t.Errorf("expected the most severe state Fatal, got %s", state)
+	}
+	if reason != "load1 is too high; units.docker.service.activeState != active (actual: <nil>); errors.units exists" {
+		t.Errorf("unexpected reason %s", reason)
+	}
+
+	// checker自身的verdicts与规则一起求值
+	state, reason = evaluateRules(rules[:1], map[string]interface{}{"loads": []float64{30}}, nil, Verdict{Unknown, "runtime is unavailable"}, Verdict{Live, ""})
+	if state != Error || reason != "runtime is unavailable; load1 is too high" {
+		t.Errorf("unexpected state %s and reason %s", state, reason)
+	}
+	state, _ = evaluateRules(nil, nil, nil, Verdict{Unknown, ""})
+	if state != Unknown {
+		t.Errorf("expected Unknown from the verdict, got %s", state)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置项的类型由缺省值的类型决定，与getOrDefault一致；缺省值为oneOf()时只能取其中的值
+type ConfigItem struct {
+	key          string
+	defaultValue interface{}
+	description  string
+}
+
+// 取值有限的字符串配置项，例如ConfigItem{"oom.state", oneOf("Error", stateValues...), "..."}
+type enumValue struct {
+	value   string
+	allowed []string
+}
+
+func oneOf(defaultValue string, allowed ...string) enumValue {
+	return enumValue{value: defaultValue, allowed: allowed}
+}
+
+var configSchemas = make(map[string]map[string]ConfigItem)
+
+// 改名后不再注册的配置项，出现时打印warning，value为新的名字
+var deprecatedConfigKeys = map[string]map[string]string{
+	"kubernetes": {"dcoker.api.version": "docker.api.version"},
+}
+
+// 状态类配置项的取值，Live表示忽略
+var (
+	stateValues     = []string{Error, Fatal, Live}
+	ruleStateValues = []string{Error, Fatal}
+)
+
+var rulesConfigItem = ConfigItem{"rules", []interface{}{}, "state rules, see docs/checkers.md"}
+
+func registerConfigSchema(section string, items ...ConfigItem) {
+	schema, ok := configSchemas[section]
+	if !ok {
+		schema = make(map[string]ConfigItem)
+		configSchemas[section] = schema
+	}
+	for _, item := range items {
+		schema[item.key] = item
+	}
+}
+
+func (item ConfigItem) allowed() []string {
+	if enum, ok := item.defaultValue.(enumValue); ok {
+		return enum.allowed
+	}
+	return nil
+}
+
+func checkAllowed(value string, allowed []string) error {
+	for _, v := range allowed {
+		if value == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("should be one of %s, got '%s'", strings.Join(allowed, ", "), value)
+}
+
+func (item ConfigItem) typeName() string {
+	switch item.defaultValue.(type) {
+	case string, enumValue:
+		return "string"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case time.Duration:
+		return "duration"
+	case []string:
+		return "[]string"
+	case []int:
+		return "[]int"
+	case []float64:
+		return "[]float"
+	case []interface{}:
+		return "list"
+	}
+	return fmt.Sprintf("%T", item.defaultValue)
+}
+
+func (item ConfigItem) toMap() map[string]interface{} {
+	defaultValue := item.defaultValue
+	if duration, ok := defaultValue.(time.Duration); ok {
+		defaultValue = duration.String()
+	}
+	if enum, ok := defaultValue.(enumValue); ok {
+		defaultValue = enum.value
+	}
+	result := map[string]interface{}{
+		"type":        item.typeName(),
+		"default":     defaultValue,
+		"description": item.description,
+	}
+	if allowed := item.allowed(); allowed != nil {
+		result["allowed"] = allowed
+	}
+	return result
+}
+
+func configSchemasToMap() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	for section, schema := range configSchemas {
+		items := make(map[string]interface{})
+		for key, item := range schema {
+			items[key] = item.toMap()
+		}
+		schemas[section] = items
+	}
+	return schemas
+}
+
+// 校验配置文件以及env中的值，类型不对或者无法解析时返回error，未知的配置项只返回warning
+func validateConfig(daemonConfig *DaemonConfig) (warnings []string, err error) {
+	errs := []string{}
+	schemaOf := func(section string) (map[string]ConfigItem, bool) {
+		if schema, ok := configSchemas[section]; ok {
+			return schema, true
+		}
+		if isExecInstance(daemonConfig, section) {
+			return configSchemas[execInstanceSchema], true
+		}
+		return nil, false
+	}
+
+	sections := []string{}
+	for section := range daemonConfig.customConfigs {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		schema, ok := schemaOf(section)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("unknown config section '%s'", section))
+			continue
+		}
+		for key, value := range daemonConfig.customConfigs[section] {
+			item, ok := schema[key]
+			if newKey, deprecated := deprecatedConfigKeys[section][key]; !ok && deprecated {
+				warnings = append(warnings, fmt.Sprintf("config key '%s.%s' is deprecated, use '%s.%s' instead", section, key, section, newKey))
+				continue
+			}
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("unknown config key '%s.%s'", section, key))
+				continue
+			}
+			if err := validateConfigValue(item, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s: %s", section, key, err))
+			}
+		}
+	}
+
+	for section := range configSchemas {
+		sections = append(sections, section)
+	}
+	checked := make(map[string]bool)
+	for _, section := range sections {
+		schema, ok := schemaOf(section)
+		if !ok || checked[section] {
+			continue
+		}
+		checked[section] = true
+		for key, item := range schema {
+			env := configEnvName(section, key)
+			if value := os.Getenv(env); value != "" {
+				if err := validateEnvValue(item, value, daemonConfig.separator); err != nil {
+					errs = append(errs, fmt.Sprintf("env %s: %s", env, err))
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return warnings, fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return warnings, nil
+}
+
+func configEnvName(section string, key string) string {
+	return fmt.Sprintf("%s_%s", strings.ToUpper(section), strings.ToUpper(strings.Replace(key, ".", "_", -1)))
+}
+
+func validateConfigValue(item ConfigItem, value interface{}) error {
+	switch item.defaultValue.(type) {
+	case string, enumValue:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("should be a string, got %v, quote it if needed", value)
+		}
+		if allowed := item.allowed(); allowed != nil {
+			return checkAllowed(v, allowed)
+		}
+	case bool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("should be a bool, got %v", value)
+		}
+	case int:
+		if _, ok := value.(int); !ok {
+			return fmt.Errorf("should be an int, got %v", value)
+		}
+	case float64:
+		switch value.(type) {
+		case int, float64:
+		default:
+			return fmt.Errorf("should be a number, got %v", value)
+		}
+	case time.Duration:
+		switch v := value.(type) {
+		case int:
+		case string:
+			if _, err := time.ParseDuration(v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("should be a duration like 1m30s, got %v", value)
+		}
+	case []string, []int, []float64, []interface{}:
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("should be a list, got %v", value)
+		}
+		for i, itemValue := range items {
+			var err error
+			switch item.defaultValue.(type) {
+			case []string:
+				err = validateConfigValue(ConfigItem{defaultValue: ""}, itemValue)
+			case []int:
+				err = validateConfigValue(ConfigItem{defaultValue: 0}, itemValue)
+			case []float64:
+				err = validateConfigValue(ConfigItem{defaultValue: float64(0)}, itemValue)
+			}
+			if err != nil {
+				return fmt.Errorf("item %d %s", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateEnvValue(item ConfigItem, value string, separator string) error {
+	var err error
+	switch item.defaultValue.(type) {
+	case enumValue:
+		err = checkAllowed(value, item.allowed())
+	case bool:
+		_, err = strconv.ParseBool(value)
+	case int:
+		_, err = strconv.Atoi(value)
+	case float64:
+		_, err = strconv.ParseFloat(value, 64)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	case []int:
+		for _, v := range strings.Split(value, separator) {
+			if _, err = strconv.Atoi(v); err != nil {
+				break
+			}
+		}
+	case []float64:
+		for _, v := range strings.Split(value, separator) {
+			if _, err = strconv.ParseFloat(v, 64); err != nil {
+				break
+			}
+		}
+	case []interface{}:
+		err = fmt.Errorf("%s can not be set by env", item.typeName())
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfigValue(t *testing.T) {
+	tests := []struct {
+		defaultValue interface{}
+		value        interface{}
+		valid        bool
+	}{
+		{"", "text", true},
+		{"", 1, false},
+		{oneOf("Error", stateValues...), "Fatal", true},
+		{oneOf("Error", stateValues...), "fatal", false},
+		{false, true, true},
+		{false, "yes", false},
+		{0, 3, true},
+		{0, 1.5, false},
+		{float64(0), 3, true},
+		{float64(0), 1.5, true},
+		{float64(0), "1.5", false},
+		{time.Second, "1m30s", true},
+		{time.Second, 30, true},
+		{time.Second, "30", false},
+		{time.Second, 1.5, false},
+		{[]string{}, []interface{}{"a", "b"}, true},
+		{[]string{}, []interface{}{"a", 1}, false},
+		{[]string{}, "a", false},
+		{[]int{}, []interface{}{1, 2}, true},
+		{[]int{}, []interface{}{1, "2"}, false},
+		{[]float64{}, []interface{}{1, 2.5}, true},
+		{[]interface{}{}, []interface{}{map[interface{}]interface{}{"a": 1}}, true},
+		{[]interface{}{}, map[interface{}]interface{}{"a": 1}, false},
+	}
+	for _, test := range tests {
+		err := validateConfigValue(ConfigItem{"key", test.defaultValue, ""}, test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("validateConfigValue(%T, %#v): expected valid %v, got %v", test.defaultValue, test.value, test.valid, err)
+		}
+	}
+	err := validateConfigValue(ConfigItem{"key", []string{}, ""}, []interface{}{"a", 1})
+	if err == nil || err.Error() != "item 1 should be a string, got 1, quote it if needed" {
+		t.Errorf("expected the index of the invalid item, got %v", err)
+	}
+}
+
+func TestValidateEnvValue(t *testing.T) {
+	tests := []struct {
+		defaultValue interface{}
+		value        string
+		valid        bool
+	}{
+		{"", "anything", true},
+		{oneOf("Error", stateValues...), "Live", true},
+		{oneOf("Error", stateValues...), "Unknown", false},
+		{false, "true", true},
+		{false, "yes", false},
+		{0, "10", true},
+		{0, "ten", false},
+		{float64(0), "0.5", true},
+		{time.Second, "10s", true},
+		{time.Second, "10", false},
+		{[]string{}, "a,b", true},
+		{[]int{}, "1,2", true},
+		{[]int{}, "1,b", false},
+		{[]float64{}, "1.5,x", false},
+		{[]interface{}{}, "a", false},
+	}
+	for _, test := range tests {
+		err := validateEnvValue(ConfigItem{"key", test.defaultValue, ""}, test.value, ",")
+		if (err == nil) != test.valid {
+			t.Errorf("validateEnvValue(%T, %s): expected valid %v, got %v", test.defaultValue, test.value, test.valid, err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	daemonConfig := &DaemonConfig{separator: ",", customConfigs: map[string]map[string]interface{}{
+		"os": {
+			"checkInterval": "1m",
+			"unknownKey":    1,
+		},
+		"disk": {
+			"statfs.timeout":      "soon",
+			"diskstats.unknown":   true,
+			"mountpoints.ignored": 1,
+		},
+		"kubernetes": {"dcoker.api.version": "1.24"},
+		"exec":       {"instances": []interface{}{"disk-health"}},
+		"disk-health": {
+			"command": "/opt/check.sh",
+			"output":  "xml",
+		},
+		"unknown-section": {"key": "value"},
+	}}
+	warnings, err := validateConfig(daemonConfig)
+	expectedWarnings := []string{
+		"unknown config key 'disk.diskstats.unknown'",
+		"config key 'kubernetes.dcoker.api.version' is deprecated, use 'kubernetes.docker.api.version' instead",
+		"unknown config key 'os.unknownKey'",
+		"unknown config section 'unknown-section'",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expectedWarnings, "\n") {
+		t.Errorf("expected warnings %v, got %v", expectedWarnings, warnings)
+	}
+	// 所有的错误排好序一起返回，exec instance按exec instance的schema校验
+	expected := "invalid config: " + strings.Join([]string{
+		"disk-health.output: should be one of nagios, json, got 'xml'",
+		"disk.mountpoints.ignored: should be a string, got 1, quote it if needed",
+		"disk.statfs.timeout: time: invalid duration \"soon\"",
+	}, "; ")
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %s, got %v", expected, err)
+	}
+
+	// env中的值同样校验
+	os.Setenv("MEMORY_OOM_STATE", "Broken")
+	defer os.Unsetenv("MEMORY_OOM_STATE")
+	os.Setenv("OS_CHECKINTERVAL", "1m")
+	defer os.Unsetenv("OS_CHECKINTERVAL")
+	_, err = validateConfig(&DaemonConfig{separator: ","})
+	if err == nil || err.Error() != "invalid config: env MEMORY_OOM_STATE: should be one of Error, Fatal, Live, got 'Broken'" {
+		t.Errorf("expected the env error, got %v", err)
+	}
+	os.Unsetenv("MEMORY_OOM_STATE")
+	if warnings, err := validateConfig(&DaemonConfig{separator: ","}); err != nil || len(warnings) != 0 {
+		t.Errorf("expected no errors and warnings, got %v %v", warnings, err)
+	}
+}
+
+func TestConfigItemToMap(t *testing.T) {
+	item := ConfigItem{"verify.state", oneOf("Error", stateValues...), "state when verification fails"}
+	result := item.toMap()
+	if result["type"] != "string" || result["default"] != "Error" || strings.Join(result["allowed"].([]string), ",") != "Error,Fatal,Live" {
+		t.Errorf("unexpected map %v", result)
+	}
+	result = ConfigItem{"checkInterval", time.Minute, ""}.toMap()
+	if result["type"] != "duration" || result["default"] != "1m0s" || result["allowed"] != nil {
+		t.Errorf("unexpected map %v", result)
+	}
+	if configEnvName("disk", "statfs.timeout") != "DISK_STATFS_TIMEOUT" {
+		t.Errorf("unexpected env name %s", configEnvName("disk", "statfs.timeout"))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -29,20 +30,98 @@ func (s *Server) createMux() *mux.Router {
 	r := mux.NewRouter()
 	statesInfoSetup(r, s.daemon)
 	configsSetup(r, s.daemon)
-	checkerRoutersSetup(r)
+	metricsSetup(r, s.daemon)
+	checkTriggerSetup(r, s.daemon)
+	historySetup(r, s.daemon)
+	checkerRoutersSetup(r, s.daemon)
 	profilerSetup(r)
 	return r
 }
 
 func configsSetup(r *mux.Router, daemon *Daemon) {
 	r.HandleFunc("/configs", func(w http.ResponseWriter, r *http.Request) {
-		configs := map[string]interface{}{
-			"daemon":  daemon.config.toMap(),
-			"checker": configsRecorded,
-		}
-		formatWrite(configs, w, r)
+		formatWrite(daemon.configs(), w, r)
 	})
 	infoln(fmt.Sprintf("Setup on /configs"))
+	r.HandleFunc("/configs/schema", func(w http.ResponseWriter, r *http.Request) {
+		formatWrite(configSchemasToMap(), w, r)
+	})
+	infoln(fmt.Sprintf("Setup on /configs/schema"))
+}
+
+func metricsSetup(r *mux.Router, daemon *Daemon) {
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		w.Write(writeMetrics(daemon.metrics()))
+	})
+	infoln(fmt.Sprintf("Setup on /metrics"))
+}
+
+func checkTriggerSetup(r *mux.Router, daemon *Daemon) {
+	r.HandleFunc("/check", func(w http.ResponseWriter, r *http.Request) {
+		names := []string{}
+		for name := range daemon.activeCheckers() {
+			names = append(names, name)
+		}
+		triggerChecks(daemon, names, w, r)
+	}).Methods("POST")
+	infoln(fmt.Sprintf("Setup on /check"))
+}
+
+// 通过?timeout=指定等待check()的超时时间，缺省为timeoutSeconds
+func triggerChecks(daemon *Daemon, names []string, w http.ResponseWriter, r *http.Request) {
+	timeout := time.Second * timeoutSeconds
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "invalid timeout '%s': %s", timeoutStr, err)
+			return
+		}
+	}
+	states, completed := daemon.triggerChecks(names, timeout)
+	if !completed {
+		w.WriteHeader(504)
+	}
+	// 无论触发了几个checker，都返回以名字为key的map，便于调用方统一解析
+	formatWrite(states, w, r)
+}
+
+func historySetup(r *mux.Router, daemon *Daemon) {
+	r.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		queryHistory(daemon, r.URL.Query()["checker"], w, r)
+	})
+	infoln(fmt.Sprintf("Setup on /history"))
+}
+
+// 通过?from=&to=指定时间范围，缺省为最近1小时
+func queryHistory(daemon *Daemon, names []string, w http.ResponseWriter, r *http.Request) {
+	if daemon.history == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "history is disabled")
+		return
+	}
+	now := time.Now()
+	from, err := parseHistoryTime(r.URL.Query().Get("from"), now.Add(-time.Hour))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	to, err := parseHistoryTime(r.URL.Query().Get("to"), now)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	records, err := daemon.history.query(names, from, to)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	formatWrite(records, w, r)
 }
 
 func statesInfoSetup(r *mux.Router, daemon *Daemon) {
@@ -52,27 +131,36 @@ func statesInfoSetup(r *mux.Router, daemon *Daemon) {
 	infoln(fmt.Sprintf("Setup on /"))
 }
 
-func checkerRoutersSetup(r *mux.Router) {
-	for name, checker := range checkers {
-		config_set := false
-		for path, _func := range checker.newRouters() {
-			router_path := fmt.Sprintf("/%s/%s", name, path)
-			r.HandleFunc(router_path, _func)
-			infoln(fmt.Sprintf("Setup on %s", router_path))
-			if router_path == "config" {
-				config_set = true
-			}
+// checker可能在重新加载配置时被启停，所以路由在请求时才根据当前启用的checker分发
+func checkerRoutersSetup(r *mux.Router, daemon *Daemon) {
+	r.HandleFunc("/{checker}/{path}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name, router_path := vars["checker"], vars["path"]
+		routers, ok := daemon.checkerRouters(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
 		}
-		if !config_set {
-			config_path := fmt.Sprintf("/%s/config", name)
-			r.HandleFunc(config_path, func(w http.ResponseWriter, r *http.Request) {
-				config, _ := configsRecorded[name]
-				formatWrite(config, w, r)
-			})
-			infoln(fmt.Sprintf("Setup on %s", config_path))
+		if _func, ok := routers[router_path]; ok {
+			_func(w, r)
+			return
 		}
-
-	}
+		switch router_path {
+		case "check":
+			if r.Method != "POST" {
+				w.WriteHeader(405)
+				return
+			}
+			triggerChecks(daemon, []string{name}, w, r)
+		case "history":
+			queryHistory(daemon, []string{name}, w, r)
+		case "config":
+			formatWrite(recordedConfigs(name), w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	infoln(fmt.Sprintf("Setup on /{checker}/{path}"))
 }
 
 func profilerSetup(r *mux.Router) {
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newTestRouter(active map[string]Checker) (*mux.Router, *Daemon) {
+	// setup时会打印日志
+	initLogger(false)
+	daemon := &Daemon{
+		config:  &DaemonConfig{},
+		active:  active,
+		routers: make(map[string]Routers),
+	}
+	for name, checker := range active {
+		daemon.routers[name] = checker.newRouters()
+	}
+	r := mux.NewRouter()
+	checkTriggerSetup(r, daemon)
+	checkerRoutersSetup(r, daemon)
+	return r, daemon
+}
+
+func serveTestRequest(r *mux.Router, method string, url string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(method, url, nil))
+	return recorder
+}
+
+// 等待checker的check()开始执行
+func waitCheckInFlight(t *testing.T, checker Checker) {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		checkCallsMutex.Lock()
+		_, ok := checkCalls[checker]
+		checkCallsMutex.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatalf("check() was not triggered")
+}
+
+func TestRunCheckCoalescing(t *testing.T) {
+	checker := &fakeChecker{name: "fake", block: make(chan struct{})}
+	first := runCheck(checker)
+	if second := runCheck(checker); second != first {
+		t.Errorf("expected the running check to be shared")
+	}
+	close(checker.block)
+	<-first.done
+	waitCheck(checker)
+	if third := runCheck(checker); third == first {
+		t.Errorf("expected a new check after the previous one finished")
+	} else {
+		<-third.done
+	}
+	if count := checker.checkCount(); count != 2 {
+		t.Errorf("expected 2 checks, got %d", count)
+	}
+}
+
+func TestCheckTriggerCoalescing(t *testing.T) {
+	slow := &fakeChecker{name: "slow", block: make(chan struct{})}
+	r, _ := newTestRouter(map[string]Checker{"slow": slow})
+
+	var wg sync.WaitGroup
+	codes := make([]int, 3)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := "/check"
+			if i > 0 {
+				url = "/slow/check"
+			}
+			codes[i] = serveTestRequest(r, "POST", url).Code
+		}(i)
+		if i == 0 {
+			waitCheckInFlight(t, slow)
+		}
+	}
+	// 之后的请求共享正在执行的check()
+	time.Sleep(time.Millisecond * 100)
+	close(slow.block)
+	wg.Wait()
+	for i, code := range codes {
+		if code != 200 {
+			t.Errorf("request %d: expected 200, got %d", i, code)
+		}
+	}
+	if count := slow.checkCount(); count != 1 {
+		t.Errorf("expected concurrent requests to share 1 check, got %d", count)
+	}
+
+	recorder := serveTestRequest(r, "POST", "/check?format=json")
+	states := map[string]map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &states); err != nil {
+		t.Fatal(err)
+	}
+	if states["slow"]["state"] != "Live" || states["slow"]["basic"].(map[string]interface{})["checks"] != float64(2) {
+		t.Errorf("expected the result of a new check, got %v", states)
+	}
+}
+
+func TestCheckTriggerTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	fast, slow := &fakeChecker{name: "fast"}, &fakeChecker{name: "slow", block: block}
+	r, _ := newTestRouter(map[string]Checker{"fast": fast, "slow": slow})
+
+	recorder := serveTestRequest(r, "POST", "/check?timeout=100ms&format=json")
+	if recorder.Code != 504 {
+		t.Errorf("expected 504, got %d", recorder.Code)
+	}
+	states := map[string]map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &states); err != nil {
+		t.Fatal(err)
+	}
+	if states["fast"]["state"] != "Live" {
+		t.Errorf("expected fast to be Live, got %v", states["fast"])
+	}
+	if states["slow"]["state"] != "Unknown" || states["slow"]["reason"] != "Timeout after 100ms while checking" {
+		t.Errorf("expected slow to be Unknown, got %v", states["slow"])
+	}
+
+	// 单个checker的结果同样以名字为key
+	recorder = serveTestRequest(r, "POST", "/fast/check?format=json")
+	states = map[string]map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &states); err != nil || recorder.Code != 200 || len(states) != 1 || states["fast"] == nil {
+		t.Errorf("expected the state of fast only, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	for _, test := range []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"POST", "/check?timeout=soon", 400},
+		{"GET", "/check", 405},
+		{"GET", "/fast/check", 405},
+		{"POST", "/missing/check", 404},
+	} {
+		if recorder := serveTestRequest(r, test.method, test.url); recorder.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d %s", test.method, test.url, test.code, recorder.Code, strings.TrimSpace(recorder.Body.String()))
+		}
+	}
+	if checks := fast.checkCount(); checks != 2 {
+		t.Errorf("expected 2 checks of fast, got %d", checks)
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 var debugLogger *log.Logger
 var infoLogger *log.Logger
+var warnLogger *log.Logger
 var errorLogger *log.Logger
 
 func initLogger(debug_enable bool) {
@@ -29,6 +30,7 @@ func initLogger(debug_enable bool) {
 		debugLogger = log.New(os.Stdout, "DEBUG\t", log.LstdFlags)
 	}
 	infoLogger = log.New(os.Stdout, "INFO\t", log.LstdFlags)
+	warnLogger = log.New(os.Stdout, "WARN\t", log.LstdFlags)
 	errorLogger = log.New(os.Stdout, "ERROR\t", log.LstdFlags)
 }
 
@@ -42,42 +44,57 @@ func infoln(args ...interface{}) {
 	infoLogger.Printf(fmt.Sprintln(args))
 }
 
+func warnln(args ...interface{}) {
+	warnLogger.Printf(fmt.Sprintln(args))
+}
+
 func errorln(args ...interface{}) {
 	errorLogger.Printf(fmt.Sprintln(args))
 }
 
-func ping(ips map[string]string, timeout time.Duration) map[string]bool {
-	var wg sync.WaitGroup
-	conditions := make(map[string]bool)
-	ch := make(chan ([]interface{}))
+// 同时ping的目标数量的上限，所有目标共用每个地址族的一个ICMP socket
+const maxConcurrentPings = 256
 
+// 由固定数量的worker并发ping所有的ip，相同的ip只ping一次，key与ips相同
+func ping(ips map[string]string, options pingOptions) map[string]pingResult {
+	names := make(map[string][]string)
 	for name, ip := range ips {
-		wg.Add(1)
-		go func(name string, ip string, timeout time.Duration) {
-			_, err := net.DialTimeout("ip4:icmp", ip, timeout)
-			if err != nil {
-				ch <- []interface{}{name, false}
-			} else {
-				ch <- []interface{}{name, true}
-			}
-		}(name, ip, timeout)
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ip = parsed.String()
+		}
+		names[ip] = append(names[ip], name)
+	}
+	pinger := newPinger(options)
+	defer pinger.close()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	results := make(map[string]pingResult)
+	jobs := make(chan string)
+	workers := maxConcurrentPings
+	if len(names) < workers {
+		workers = len(names)
 	}
-	go func() {
-	Loop:
-		for {
-			select {
-			case cond, ok := <-ch:
-				if !ok {
-					break Loop
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				result := pinger.ping(ip)
+				mutex.Lock()
+				for _, name := range names[ip] {
+					results[name] = result
 				}
-				conditions[cond[0].(string)] = cond[1].(bool)
-				wg.Done()
+				mutex.Unlock()
 			}
-		}
-	}()
+		}()
+	}
+	for ip := range names {
+		jobs <- ip
+	}
+	close(jobs)
 	wg.Wait()
-	close(ch)
-	return conditions
+	return results
 }
 
 func getKernelParameters(procPath string, params []string) (map[string]interface{}, error) {
@@ -93,6 +110,25 @@ func getKernelParameters(procPath string, params []string) (map[string]interface
 	return runtime_parameters, nil
 }
 
+// yaml解析出的map[interface{}]interface{}无法被json序列化，需要转成map[string]interface{}
+func stringifyKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, item := range v {
+			m[fmt.Sprint(key)] = stringifyKeys(item)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = stringifyKeys(item)
+		}
+		return items
+	}
+	return value
+}
+
 func formatWrite(data interface{}, w http.ResponseWriter, r *http.Request) {
 	format_type := "yaml"
 	if len(r.URL.Query().Get("format")) > 0 {